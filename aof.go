@@ -2,393 +2,782 @@ package iqdb
 
 import (
 	"bufio"
-	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/ravlio/iqdb/aof"
+	log "github.com/sirupsen/logrus"
 )
 
-func (iq *IqDB) writeKeyOp(op byte, key string) error {
-	// op
-	_, err := iq.aofW.Write([]byte{op})
-	if err != nil {
-		return err
-	}
-	// key
-	kb := []byte(key)
-	l := make([]byte, 8)
-	binary.LittleEndian.PutUint64(l, uint64(len(kb)))
-	_, err = iq.aofW.Write(l)
-	if err != nil {
-		return err
-	}
-	_, err = iq.aofW.Write(kb)
-	if err != nil {
-		return err
-	}
+var ErrAOFVersion = aof.ErrVersion
+var ErrAOFUnknownOp = aof.ErrUnknownOp
+var ErrAOFCorrupt = aof.ErrCorrupt
+var ErrAOFTornTail = aof.ErrTornTail
+var ErrEncryptionKey = aof.ErrKey
+var ErrEncryptionKeySize = aof.ErrKeySize
+
+// Format is described in aof package
+const aofHeaderSize = aof.HeaderSize
+const aofVersion = aof.Version
+
+// AOF record compression
+type Compression int
+
+const (
+	CompressionNone Compression = iota
+	// Large records are compressed with DEFLATE
+	CompressionDeflate
+)
+
+// Default minimal record size for compression
+const defaultCompressionMinSize = 1024
+
+// AOF replay behaviour on damaged records
+type AOFRecoveryMode int
+
+const (
+	// Fail on any damaged record
+	AOFRecoveryStrict AOFRecoveryMode = iota
+	// Truncate AOF at the first damaged record. Only the last segment is truncated,
+	// damage in the others is an error
+	AOFRecoveryTruncateTail
+	// Skip records with wrong checksum, truncate incomplete tail
+	AOFRecoverySkipCorrupt
+)
 
-	return nil
+func encodeSet(key, value string, expire time.Time) aof.Record {
+	return aof.NewRecord(aof.OpSetAt, key).PutUint64(unixNano(expire)).PutString(value)
 }
 
-func (iq *IqDB) writeRemove(key string) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+func encodeTTL(key string, expire time.Time) aof.Record {
+	return aof.NewRecord(aof.OpExpireAt, key).PutUint64(unixNano(expire))
+}
 
-	return iq.writeKeyOp(opRemove, key)
+func encodeMSet(args []string, expire time.Time) aof.Record {
+	return aof.NewRecord(aof.OpMSet, args[0]).PutUint64(unixNano(expire)).PutStrings(args)
 }
 
-func (iq *IqDB) writeListPop(key string) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+func encodeSetBit(key string, offset int, bit int) aof.Record {
+	return aof.NewRecord(aof.OpSetBit, key).PutStrings([]string{strconv.Itoa(offset), strconv.Itoa(bit)})
+}
 
-	return iq.writeKeyOp(opListPop, key)
+func encodeHLLAdd(key string, elements []string) aof.Record {
+	return aof.NewRecord(aof.OpHLLAdd, key).PutStrings(elements)
 }
 
-func (iq *IqDB) writeSet(key, value string, ttl time.Duration) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+func encodeHLLMerge(key string, b []byte) aof.Record {
+	return aof.NewRecord(aof.OpHLLMerge, key).PutString(string(b))
+}
 
-	err := iq.writeKeyOp(opSet, key)
-	if err != nil {
-		return err
-	}
+func encodeStreamAdd(key string, id streamID, maxLen int, fields []string) aof.Record {
+	return aof.NewRecord(aof.OpStreamAdd, key).PutStrings(append([]string{id.String(), strconv.Itoa(maxLen)}, fields...))
+}
 
-	ttlb := make([]byte, 8)
+func encodeStreamRestore(key string, b []byte) aof.Record {
+	return aof.NewRecord(aof.OpStreamRestore, key).PutString(string(b))
+}
 
-	binary.LittleEndian.PutUint64(ttlb, uint64(ttl.Seconds()))
-	_, err = iq.aofW.Write(ttlb)
-	if err != nil {
-		return err
-	}
-	// value
-	kb := []byte(value)
-	l := make([]byte, 8)
-	binary.LittleEndian.PutUint64(l, uint64(len(kb)))
+func encodeListPush(key string, args []string) aof.Record {
+	return aof.NewRecord(aof.OpListPush, key).PutStrings(args)
+}
 
-	_, err = iq.aofW.Write(l)
-	if err != nil {
-		return err
-	}
-	_, err = iq.aofW.Write(kb)
-	if err != nil {
-		return err
+func encodeHashSet(key string, args []string) aof.Record {
+	return aof.NewRecord(aof.OpHashSet, key).PutStrings(args)
+}
+
+func encodeSetAdd(key string, members []string) aof.Record {
+	return aof.NewRecord(aof.OpSetAdd, key).PutStrings(members)
+}
+
+func encodeZSetAdd(key string, members []ScoredMember) aof.Record {
+	return aof.NewRecord(aof.OpZSetAdd, key).PutStrings(scorePairs(members))
+}
+
+func encodeHashDel(key, field string) aof.Record {
+	return aof.NewRecord(aof.OpHashDel, key).PutString(field)
+}
+
+// Compress record if compression is on and record is large enough.
+// Compressed records are marked, so they can be mixed with plain ones
+func (iq *IqDB) compress(r aof.Record) aof.Record {
+	if iq.opts.Compression == CompressionNone || len(r) < iq.opts.CompressionMinSize {
+		return r
 	}
-	return nil
+
+	return aof.Compress(r)
 }
 
-func (iq *IqDB) writeTTL(key string, ttl time.Duration) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+// Append record to AOF and wait until it is written according to fsync policy
+func (iq *IqDB) writeRecord(r aof.Record) error {
+	return iq.writeFramed(aof.Frame(r))
+}
 
-	err := iq.writeKeyOp(opTTL, key)
-	if err != nil {
-		return err
+// Append already framed records in one batch
+func (iq *IqDB) writeFramed(b []byte) error {
+	return iq.queueFramed(b).wait()
+}
+
+// Queue framed records without waiting for them, so caller can release its locks first.
+// Records are written in the order they are queued. Caller must hold cutMx
+func (iq *IqDB) queueFramed(b []byte) *aofWrite {
+	w := &aofWrite{b: b, done: make(chan error, 1)}
+	if iq.closed {
+		w.done <- ErrClosed
+		return w
 	}
 
-	ttlb := make([]byte, 8)
+	iq.aofCh <- w
 
-	binary.LittleEndian.PutUint64(ttlb, uint64(ttl.Seconds()))
-	_, err = iq.aofW.Write(ttlb)
-	if err != nil {
-		return err
+	return w
+}
+
+// Wait until queued records are written according to fsync policy
+func (w *aofWrite) wait() error {
+	return <-w.done
+}
+
+func (iq *IqDB) writeRemove(key string) error {
+	return iq.writeRecord(aof.NewRecord(aof.OpRemove, key))
+}
+
+func (iq *IqDB) queueListPop(key string, head bool) *aofWrite {
+	if head {
+		return iq.queueFramed(aof.Frame(aof.NewRecord(aof.OpListPopLeft, key)))
 	}
 
-	return nil
+	return iq.queueFramed(aof.Frame(aof.NewRecord(aof.OpListPop, key)))
 }
 
-func (iq *IqDB) writeListPush(key string, args ...string) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+func (iq *IqDB) writeSet(key, value string, expire time.Time) error {
+	return iq.queueSet(key, value, expire).wait()
+}
 
-	err := iq.writeKeyOp(opListPush, key)
-	if err != nil {
-		return err
+func (iq *IqDB) queueSet(key, value string, expire time.Time) *aofWrite {
+	return iq.queueFramed(aof.Frame(iq.compress(encodeSet(key, value, expire))))
+}
+
+func (iq *IqDB) writeMSet(args []string, expire time.Time) error {
+	return iq.writeRecord(iq.compress(encodeMSet(args, expire)))
+}
+
+func (iq *IqDB) queueSetBit(key string, offset int, bit int) *aofWrite {
+	return iq.queueFramed(aof.Frame(encodeSetBit(key, offset, bit)))
+}
+
+func (iq *IqDB) writeHLLAdd(key string, elements ...string) error {
+	return iq.writeRecord(iq.compress(encodeHLLAdd(key, elements)))
+}
+
+func (iq *IqDB) writeHLLMerge(key string, b []byte) error {
+	return iq.writeRecord(iq.compress(encodeHLLMerge(key, b)))
+}
+
+func (iq *IqDB) writeStreamAdd(key string, id streamID, maxLen int, fields []string) error {
+	return iq.writeRecord(iq.compress(encodeStreamAdd(key, id, maxLen, fields)))
+}
+
+func (iq *IqDB) writeStreamTrim(key string, maxLen int) error {
+	return iq.writeRecord(aof.NewRecord(aof.OpStreamTrim, key).PutStrings([]string{strconv.Itoa(maxLen)}))
+}
+
+func (iq *IqDB) writeStreamGroupCreate(key, group string, id streamID) error {
+	return iq.writeRecord(aof.NewRecord(aof.OpStreamGroupCreate, key).PutStrings([]string{group, id.String()}))
+}
+
+func (iq *IqDB) writeStreamGroupDestroy(key, group string) error {
+	return iq.writeRecord(aof.NewRecord(aof.OpStreamGroupDestroy, key).PutStrings([]string{group}))
+}
+
+func (iq *IqDB) writeStreamDeliver(key, group, consumer string, delivered time.Time, ids []string) error {
+	args := append([]string{group, consumer, strconv.FormatUint(unixNano(delivered), 10)}, ids...)
+
+	return iq.writeRecord(iq.compress(aof.NewRecord(aof.OpStreamDeliver, key).PutStrings(args)))
+}
+
+func (iq *IqDB) writeStreamAck(key, group string, ids []string) error {
+	return iq.writeRecord(iq.compress(aof.NewRecord(aof.OpStreamAck, key).PutStrings(append([]string{group}, ids...))))
+}
+
+func (iq *IqDB) writeTTL(key string, expire time.Time) error {
+	return iq.writeRecord(encodeTTL(key, expire))
+}
+
+func (iq *IqDB) queueListPush(key string, args ...string) *aofWrite {
+	return iq.queueFramed(aof.Frame(iq.compress(encodeListPush(key, args))))
+}
+
+func (iq *IqDB) queueListPushLeft(key string, args ...string) *aofWrite {
+	return iq.queueFramed(aof.Frame(iq.compress(aof.NewRecord(aof.OpListPushLeft, key).PutStrings(args))))
+}
+
+// Move is logged as pop and push records written in one batch, so each record keeps touching
+// a single key and replay order of every key is kept
+func (iq *IqDB) queueListMove(src, dst string, srcLeft, dstLeft bool, item string) *aofWrite {
+	pop, push := aof.NewRecord(aof.OpListPop, src), aof.NewRecord(aof.OpListPush, dst)
+	if srcLeft {
+		pop = aof.NewRecord(aof.OpListPopLeft, src)
 	}
 
-	an := make([]byte, 8)
-	binary.LittleEndian.PutUint64(an, uint64(len(args)))
-	_, err = iq.aofW.Write(an)
-	if err != nil {
-		return err
+	if dstLeft {
+		push = aof.NewRecord(aof.OpListPushLeft, dst)
 	}
-	for _, v := range args {
-		// key
-		kb := []byte(v)
-		l := make([]byte, 8)
-		binary.LittleEndian.PutUint64(l, uint64(len(kb)))
-		_, err = iq.aofW.Write(l)
-		if err != nil {
-			return err
-		}
-		_, err = iq.aofW.Write(kb)
-		if err != nil {
-			return err
-		}
+
+	push = iq.compress(push.PutStrings([]string{item}))
+
+	return iq.queueFramed(append(aof.Frame(pop), aof.Frame(push)...))
+}
+
+func (iq *IqDB) queueListInsert(key string, before bool, pivot, value string) *aofWrite {
+	where := "AFTER"
+	if before {
+		where = "BEFORE"
 	}
 
-	return nil
+	return iq.queueFramed(aof.Frame(iq.compress(aof.NewRecord(aof.OpListInsert, key).PutStrings([]string{where, pivot, value}))))
+}
+
+func (iq *IqDB) queueListSet(key string, index int, value string) *aofWrite {
+	return iq.queueFramed(aof.Frame(iq.compress(aof.NewRecord(aof.OpListSet, key).PutStrings([]string{strconv.Itoa(index), value}))))
+}
+
+func (iq *IqDB) queueListRemove(key string, count int, value string) *aofWrite {
+	return iq.queueFramed(aof.Frame(iq.compress(aof.NewRecord(aof.OpListRem, key).PutStrings([]string{strconv.Itoa(count), value}))))
+}
+
+func (iq *IqDB) queueListTrim(key string, start, stop int) *aofWrite {
+	return iq.queueFramed(aof.Frame(aof.NewRecord(aof.OpListTrim, key).PutStrings([]string{strconv.Itoa(start), strconv.Itoa(stop)})))
 }
 
 func (iq *IqDB) writeHashSet(key string, args ...string) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+	return iq.queueHashSet(key, args...).wait()
+}
 
-	err := iq.writeKeyOp(opHashSet, key)
-	if err != nil {
-		return err
-	}
+func (iq *IqDB) queueHashSet(key string, args ...string) *aofWrite {
+	return iq.queueFramed(aof.Frame(iq.compress(encodeHashSet(key, args))))
+}
 
-	an := make([]byte, 8)
-	binary.LittleEndian.PutUint64(an, uint64(len(args)))
-	_, err = iq.aofW.Write(an)
-	if err != nil {
-		return err
-	}
-	for _, v := range args {
-		// field or value
-		kb := []byte(v)
-		l := make([]byte, 8)
-		binary.LittleEndian.PutUint64(l, uint64(len(kb)))
-		_, err = iq.aofW.Write(l)
-		if err != nil {
-			return err
-		}
-		_, err = iq.aofW.Write(kb)
-		if err != nil {
-			return err
-		}
+// Record per field, written in one batch
+func (iq *IqDB) queueHashDel(key string, fields ...string) *aofWrite {
+	b := make([]byte, 0)
+	for _, f := range fields {
+		b = append(b, aof.Frame(encodeHashDel(key, f))...)
 	}
 
-	return nil
+	return iq.queueFramed(b)
 }
 
-func (iq *IqDB) writeHashDel(key, f string) error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+func (iq *IqDB) writeSetAdd(key string, members ...string) error {
+	return iq.writeRecord(iq.compress(encodeSetAdd(key, members)))
+}
 
-	err := iq.writeKeyOp(opHashDel, key)
-	if err != nil {
-		return err
-	}
+func (iq *IqDB) writeSetRem(key string, members ...string) error {
+	return iq.writeRecord(iq.compress(aof.NewRecord(aof.OpSetRem, key).PutStrings(members)))
+}
 
-	// field
-	kb := []byte(f)
-	l := make([]byte, 8)
-	binary.LittleEndian.PutUint64(l, uint64(len(kb)))
-	_, err = iq.aofW.Write(l)
-	if err != nil {
-		return err
-	}
-	_, err = iq.aofW.Write(kb)
-	if err != nil {
-		return err
-	}
+func (iq *IqDB) writeZSetAdd(key string, members []ScoredMember) error {
+	return iq.writeRecord(iq.compress(encodeZSetAdd(key, members)))
+}
 
-	return nil
+func (iq *IqDB) writeZSetRem(key string, members ...string) error {
+	return iq.writeRecord(iq.compress(aof.NewRecord(aof.OpZSetRem, key).PutStrings(members)))
 }
 
-func (iq *IqDB) readAOF() error {
-	iq.syncMx.Lock()
-	defer iq.syncMx.Unlock()
+// Deadline of key after increment is logged, increment of key that expires before replay is dropped with it
+func (iq *IqDB) queueIncrBy(key string, delta int64, expire time.Time) *aofWrite {
+	return iq.queueFramed(aof.Frame(aof.NewRecord(aof.OpIncrByAt, key).PutUint64(unixNano(expire)).PutString(strconv.FormatInt(delta, 10))))
+}
+
+func (iq *IqDB) queueIncrByFloat(key string, delta float64, expire time.Time) *aofWrite {
+	return iq.queueFramed(aof.Frame(aof.NewRecord(aof.OpIncrByFloatAt, key).PutUint64(unixNano(expire)).PutString(strconv.FormatFloat(delta, 'g', -1, 64))))
+}
+
+func (iq *IqDB) queueHashIncrBy(key, field string, delta int64) *aofWrite {
+	return iq.queueFramed(aof.Frame(aof.NewRecord(aof.OpHashIncrBy, key).PutStrings([]string{field, strconv.FormatInt(delta, 10)})))
+}
 
-	f, err := os.Open(iq.fname)
+func (iq *IqDB) applyOp(op *aof.Op) error {
+	var err error
 
-	fi, _ := f.Stat()
-	if fi.Size() == 0 {
+	if iq.skipExpired(op) {
 		return nil
 	}
 
-	if err != nil {
-		return err
-	}
+	switch op.Code {
+	case aof.OpSet:
+		// Legacy relative TTL, default TTL was applied on replay
+		ttl := time.Duration(op.TTL) * time.Second
+		if ttl == 0 {
+			ttl = iq.opts.TTL
+		}
 
-	rdr := bufio.NewReader(f)
+		iq.loadExpired.remove(op.Key)
+		err = iq.set(op.Key, op.Value, deadline(ttl), false)
+	case aof.OpSetAt:
+		expire := fromUnixNano(op.Expire)
+		if isExpired(expire) {
+			err = iq.removeExpired(op.Key)
+			break
+		}
 
-	for {
-		op := make([]byte, 1)
+		iq.loadExpired.remove(op.Key)
+		err = iq.set(op.Key, op.Value, expire, false)
+	case aof.OpMSet:
+		if len(op.Args) == 0 || len(op.Args)%2 != 0 {
+			return aof.ErrCorrupt
+		}
+
+		expire := fromUnixNano(op.Expire)
+		if !isExpired(expire) {
+			for i := 0; i < len(op.Args); i += 2 {
+				iq.loadExpired.remove(op.Args[i])
+			}
+
+			_, err = iq.setMulti(op.Args, expire, false, false)
+			break
+		}
+
+		for i := 0; i < len(op.Args) && err == nil; i += 2 {
+			err = iq.removeExpired(op.Args[i])
+		}
+	case aof.OpSetBit:
+		if len(op.Args) != 2 {
+			return aof.ErrCorrupt
+		}
+
+		offset, perr := strconv.Atoi(op.Args[0])
+		if perr != nil || offset < 0 || offset > maxBitOffset {
+			return aof.ErrCorrupt
+		}
+
+		bit, perr := strconv.Atoi(op.Args[1])
+		if perr != nil || (bit != 0 && bit != 1) {
+			return aof.ErrCorrupt
+		}
+
+		_, err = iq.setBit(op.Key, offset, bit, false)
+	case aof.OpHLLAdd:
+		_, err = iq.hllAdd(op.Key, op.Args, false)
+	case aof.OpHLLMerge:
+		h, perr := parseHLL([]byte(op.Value))
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
+
+		regs := make([]uint8, hllRegisters)
+		h.mergeInto(regs)
+		err = iq.hllMerge(op.Key, regs, false)
+	case aof.OpStreamAdd:
+		if len(op.Args) < 4 || len(op.Args)%2 != 0 {
+			return aof.ErrCorrupt
+		}
+
+		maxLen, perr := strconv.Atoi(op.Args[1])
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
+
+		_, err = iq.streamAdd(op.Key, op.Args[0], maxLen, op.Args[2:], false)
+		if err == nil {
+			iq.waiters.notifyAll(op.Key)
+		}
+	case aof.OpStreamTrim:
+		if len(op.Args) != 1 {
+			return aof.ErrCorrupt
+		}
+
+		maxLen, perr := strconv.Atoi(op.Args[0])
+		if perr != nil || maxLen < 0 {
+			return aof.ErrCorrupt
+		}
+
+		_, err = iq.streamTrim(op.Key, maxLen, false)
+	case aof.OpStreamGroupCreate:
+		if len(op.Args) != 2 {
+			return aof.ErrCorrupt
+		}
+
+		_, err = iq.streamGroupCreate(op.Key, op.Args[0], op.Args[1], false)
+	case aof.OpStreamGroupDestroy:
+		if len(op.Args) != 1 {
+			return aof.ErrCorrupt
+		}
+
+		_, err = iq.streamGroupDestroy(op.Key, op.Args[0], false)
+	case aof.OpStreamDeliver:
+		if len(op.Args) < 4 {
+			return aof.ErrCorrupt
+		}
+
+		delivered, perr := strconv.ParseUint(op.Args[2], 10, 64)
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
+
+		ids, perr := parseStreamIDs(op.Args[3:])
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-		n, err := io.ReadFull(rdr, op)
+		err = iq.streamDeliver(op.Key, op.Args[0], op.Args[1], fromUnixNano(delivered), ids, false)
+	case aof.OpStreamAck:
+		if len(op.Args) < 2 {
+			return aof.ErrCorrupt
+		}
+
+		ids, perr := parseStreamIDs(op.Args[1:])
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-		if err != nil && err != io.EOF {
-			return err
+		_, err = iq.streamAck(op.Key, op.Args[0], ids, false)
+	case aof.OpStreamRestore:
+		s, perr := parseStream([]byte(op.Value))
+		if perr != nil {
+			return aof.ErrCorrupt
 		}
 
-		if n == 0 || err == io.EOF {
+		iq.loadExpired.remove(op.Key)
+		err = iq.streamRestore(op.Key, s, false)
+	case aof.OpRemove:
+		err = iq.remove(op.Key, false)
+	case aof.OpTTL:
+		err = iq._ttl(op.Key, deadline(time.Duration(op.TTL)*time.Second), false)
+	case aof.OpExpireAt:
+		expire := fromUnixNano(op.Expire)
+		if isExpired(expire) {
+			err = iq.removeExpired(op.Key)
 			break
 		}
 
-		switch op[0] {
-		case opSet:
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
+		err = iq._ttl(op.Key, expire, false)
+	case aof.OpListPush:
+		_, _, err = iq.listPush(op.Key, op.Args, false)
+		iq.wakeListWaiters(op.Key)
+	case aof.OpListPop:
+		_, _, err = iq.listPop(op.Key, false)
+	case aof.OpListPushLeft:
+		_, _, err = iq.listPushLeft(op.Key, op.Args, false)
+		iq.wakeListWaiters(op.Key)
+	case aof.OpListPopLeft:
+		_, _, err = iq.listPopLeft(op.Key, false)
+	case aof.OpListInsert:
+		if len(op.Args) != 3 || (op.Args[0] != "BEFORE" && op.Args[0] != "AFTER") {
+			return aof.ErrCorrupt
+		}
 
-			ttl, err := readUint64(rdr)
-			if err != nil {
-				return err
-			}
+		_, _, err = iq.listInsert(op.Key, op.Args[0] == "BEFORE", op.Args[1], op.Args[2], false)
+	case aof.OpListSet, aof.OpListRem:
+		if len(op.Args) != 2 {
+			return aof.ErrCorrupt
+		}
 
-			val, err := readString(rdr)
-			if err != nil {
-				return err
-			}
+		n, perr := strconv.Atoi(op.Args[0])
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-			err = iq.set(key, val, time.Duration(ttl)*time.Second, false)
-			if err != nil {
-				return err
-			}
-		case opRemove:
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
+		if op.Code == aof.OpListSet {
+			_, err = iq.listSet(op.Key, n, op.Args[1], false)
+		} else {
+			_, _, err = iq.listRemove(op.Key, n, op.Args[1], false)
+		}
+	case aof.OpListTrim:
+		if len(op.Args) != 2 {
+			return aof.ErrCorrupt
+		}
 
-			err = iq.remove(key, false)
-			if err != nil {
-				return err
-			}
-		case opTTL:
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
-			ttl, err := readUint64(rdr)
-			if err != nil {
-				return err
-			}
+		start, perr := strconv.Atoi(op.Args[0])
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-			err = iq._ttl(key, time.Duration(ttl)*time.Second, false)
-			if err != nil {
-				return err
-			}
-		case opListPush:
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
-			n, err := readUint64(rdr)
-			if err != nil {
-				return err
-			}
+		stop, perr := strconv.Atoi(op.Args[1])
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-			vals := make([]string, int(n))
-			for i := 0; i < int(n); i++ {
-				v, err := readString(rdr)
-				if err != nil {
-					return err
-				}
+		_, err = iq.listTrim(op.Key, start, stop, false)
+	case aof.OpHashDel:
+		_, err = iq.hashDel(op.Key, []string{op.Value}, false)
+	case aof.OpHashSet:
+		vals := make(map[string]string, len(op.Args)/2)
+		for i := 0; i+1 < len(op.Args); i += 2 {
+			vals[op.Args[i]] = op.Args[i+1]
+		}
 
-				vals[i] = v
-			}
+		_, err = iq.hashSet(op.Key, vals, false)
+	case aof.OpSetAdd:
+		_, err = iq.setAdd(op.Key, op.Args, false)
+	case aof.OpSetRem:
+		_, err = iq.setRemove(op.Key, op.Args, false)
+	case aof.OpZSetAdd:
+		var members []ScoredMember
+		members, err = parseScorePairs(op.Args)
+		if err != nil {
+			return aof.ErrCorrupt
+		}
 
-			_, err = iq.listPush(key, vals, false)
-			if err != nil {
-				return err
-			}
-		case opListPop:
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
+		_, err = iq.zsetAdd(op.Key, members, false)
+	case aof.OpZSetRem:
+		_, err = iq.zsetRemove(op.Key, op.Args, false)
+	case aof.OpIncrBy, aof.OpIncrByAt:
+		delta, perr := strconv.ParseInt(op.Value, 10, 64)
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-			_, err = iq.listPop(key, false)
-			if err != nil {
-				return err
-			}
-		case opHashDel:
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
+		if iq.incrExpired(op) {
+			err = iq.removeExpired(op.Key)
+			break
+		}
 
-			field, err := readString(rdr)
-			if err != nil {
-				return err
-			}
+		_, err = iq.incrBy(op.Key, delta, false)
+	case aof.OpIncrByFloat, aof.OpIncrByFloatAt:
+		delta, perr := strconv.ParseFloat(op.Value, 64)
+		if perr != nil {
+			return aof.ErrCorrupt
+		}
 
-			err = iq.hashDel(key, field, false)
-			if err != nil {
-				return err
-			}
-		case opHashSet:
-			// TODO check eoh
-			key, err := readString(rdr)
-			if err != nil {
-				return err
-			}
-			n, err := readUint64(rdr)
-			if err != nil {
-				return err
-			}
+		if iq.incrExpired(op) {
+			err = iq.removeExpired(op.Key)
+			break
+		}
 
-			vals := make(map[string]string, int(n))
-			for i := 0; i < int(n/2); i++ {
-				f, err := readString(rdr)
-				if err != nil {
-					return err
-				}
-				v, err := readString(rdr)
-				if err != nil {
-					return err
-				}
-
-				vals[f] = v
-			}
+		_, err = iq.incrByFloat(op.Key, delta, false)
+	case aof.OpHashIncrBy:
+		if len(op.Args) != 2 {
+			return aof.ErrCorrupt
+		}
 
-			err = iq.hashSet(key, vals, false)
-			if err != nil {
-				return err
-			}
+		delta, perr := strconv.ParseInt(op.Args[1], 10, 64)
+		if perr != nil {
+			return aof.ErrCorrupt
 		}
 
+		_, err = iq.hashIncrBy(op.Key, op.Args[0], delta, false)
 	}
 
-	return nil
+	return err
 }
 
-func readString(rdr io.Reader) (string, error) {
-	b, err := readBytes(rdr)
+// Key expired before replay, so whatever was there is gone too.
+// Key is remembered, so records that changed it before it expired don't bring it back
+func (iq *IqDB) removeExpired(key string) error {
+	iq.loadExpired.add(key)
 
-	if err != nil {
-		return "", err
+	err := iq.remove(key, false)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// Records of key dropped as expired are skipped until key is set again or removed.
+// Removal is logged when key expires while DB is running, so whatever follows it is a new key
+// Returns true if record must be skipped
+func (iq *IqDB) skipExpired(op *aof.Op) bool {
+	if op.Code == aof.OpMSet || !iq.loadExpired.has(op.Key) {
+		return false
+	}
+
+	switch op.Code {
+	case aof.OpSet, aof.OpSetAt, aof.OpStreamRestore, aof.OpIncrByAt, aof.OpIncrByFloatAt:
+		return false
+	case aof.OpRemove:
+		iq.loadExpired.remove(op.Key)
+	}
+
+	return true
+}
+
+// Increment with deadline that has passed is dropped with its key. Increment that creates
+// key again after it was dropped has later deadline or none
+func (iq *IqDB) incrExpired(op *aof.Op) bool {
+	if op.Code == aof.OpIncrBy || op.Code == aof.OpIncrByFloat {
+		return false
 	}
 
-	return string(b), nil
+	if isExpired(fromUnixNano(op.Expire)) {
+		return true
+	}
+
+	iq.loadExpired.remove(op.Key)
+
+	return false
+}
+
+// Keys dropped on load because they expired before it
+type expiredKeys struct {
+	mx   *sync.Mutex
+	keys map[string]struct{}
 }
 
-func readBytes(rdr io.Reader) ([]byte, error) {
-	var l = make([]byte, 8)
+func newExpiredKeys() *expiredKeys {
+	return &expiredKeys{mx: &sync.Mutex{}, keys: make(map[string]struct{})}
+}
+
+func (e *expiredKeys) add(key string) {
+	e.mx.Lock()
+	e.keys[key] = struct{}{}
+	e.mx.Unlock()
+}
+
+func (e *expiredKeys) remove(key string) {
+	e.mx.Lock()
+	delete(e.keys, key)
+	e.mx.Unlock()
+}
+
+func (e *expiredKeys) has(key string) bool {
+	e.mx.Lock()
+	_, ok := e.keys[key]
+	e.mx.Unlock()
+
+	return ok
+}
+
+// Keys in no particular order
+func (e *expiredKeys) list() []string {
+	e.mx.Lock()
+	defer e.mx.Unlock()
+
+	ret := make([]string, 0, len(e.keys))
+	for key := range e.keys {
+		ret = append(ret, key)
+	}
+
+	return ret
+}
+
+// Decode AOF segment starting from offset and pass operations to replayer.
+// Only the last segment is truncated at damaged record, crash can't tear the others
+// Returns AOF format version and whether segment was truncated on success
+func (iq *IqDB) readAOF(path string, offset int64, last bool, r *replayer) (int, bool, error) {
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
 
-	_, err := io.ReadFull(rdr, l)
+	fi, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return 0, false, err
 	}
 
-	b := make([]byte, binary.LittleEndian.Uint64(l))
+	rdr := bufio.NewReader(f)
 
-	_, err = io.ReadFull(rdr, b)
+	version, err := aof.ReadHeader(rdr)
 	if err != nil {
-		return nil, err
+		return 0, false, err
 	}
 
-	return b, nil
-}
+	var c *aof.Cipher
+	if version == aof.VersionEncrypted {
+		c, err = aof.ReadCipher(rdr, iq.keys)
+		if err == aof.ErrKey {
+			return 0, false, fmt.Errorf("%s: %w", path, ErrEncryptionKey)
+		}
+
+		if err != nil {
+			return 0, false, err
+		}
+	}
 
-func readUint64(rdr io.Reader) (uint64, error) {
-	i := make([]byte, 8)
-	_, err := io.ReadFull(rdr, i)
+	if offset < aof.HeaderLen(version) {
+		offset = aof.HeaderLen(version)
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
+	rdr.Reset(f)
+
+	sc := aof.NewScanner(rdr, version, offset, fi.Size())
+	sc.SetCipher(c)
+	defer func() {
+		r.segmentDone(sc.Pos() + sc.Len() - offset)
+	}()
 
-	return binary.LittleEndian.Uint64(i), nil
+	for {
+		op, err := sc.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err == nil {
+			err = r.apply(op)
+			if err != nil {
+				return 0, false, err
+			}
+
+			r.progress(sc.Pos() + sc.Len() - offset)
+			continue
+		}
+
+		// Key is known to be right here, so failed decryption means damaged record
+		if err == aof.ErrDecrypt {
+			err = aof.ErrChecksum
+		}
+
+		if err != aof.ErrChecksum && err != io.ErrUnexpectedEOF {
+			return 0, false, err
+		}
+
+		mode := iq.opts.AOFRecovery
+		if mode == AOFRecoveryStrict {
+			return 0, false, fmt.Errorf("%s: %s at offset %d", path, aofError(err), sc.Pos())
+		}
+
+		if err == aof.ErrChecksum && mode == AOFRecoverySkipCorrupt {
+			log.Warnf("%s: skipping corrupt record at offset %d (%d bytes)", path, sc.Pos(), sc.Len())
+			continue
+		}
+
+		// Segments after it may still hold data, it must be repaired by hand
+		if !last {
+			return 0, false, fmt.Errorf("%s: %w at offset %d of segment which is not the last", path, aofError(err), sc.Pos())
+		}
+
+		// Whatever follows can't be trusted
+		log.Warnf("%s: truncating at offset %d, %d bytes discarded", path, sc.Pos(), fi.Size()-sc.Pos())
+
+		err = os.Truncate(path, sc.Pos())
+		if err != nil {
+			return 0, false, err
+		}
+
+		return version, true, nil
+	}
+
+	return version, false, nil
 }
 
-func (iq *IqDB) runSyncer() {
-	for range iq.syncTicker.C {
-		iq.flushAOFBuffer()
+func aofError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return ErrAOFTornTail
 	}
+
+	return ErrAOFCorrupt
+}
+
+// Result of offline AOF check
+type AOFCheckResult = aof.CheckResult
+
+// Check AOF directory or a single segment file without loading it.
+// Scanning continues after corrupt records if they could be skipped.
+// Only checksums of encrypted records are checked, they are not decrypted
+// Returns check result on success and error on fail
+func CheckAOF(path string) (*AOFCheckResult, error) {
+	return aof.Check(path, nil)
 }
 
 func (iq *IqDB) flushAOFBuffer() {
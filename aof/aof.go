@@ -0,0 +1,429 @@
+// Package aof reads and writes iqdb append-only file format.
+//
+// AOF starts with magic and version byte. Files without header are legacy version 1 files
+// with plain records. Since version 2 every record is framed as
+//
+//	[uint32 payload length][uint32 CRC32C of payload][payload]
+//
+// Payload is an operation code followed by the key and operation arguments.
+// Integers are little endian uint64, strings are prefixed with their length,
+// string lists are prefixed with the number of strings.
+//
+// Records may be compressed, op code has FlagCompressed set then.
+//
+// Version 4 files are encrypted: header is followed by [key ID][nonce base]
+// and every payload is sealed with AES-GCM
+package aof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+var ErrVersion = errors.New("unsupported AOF version")
+var ErrUnknownOp = errors.New("unknown AOF operation")
+var ErrCorrupt = errors.New("corrupt AOF record")
+var ErrTornTail = errors.New("incomplete AOF record")
+var ErrChecksum = errors.New("AOF record checksum mismatch")
+
+const Magic = "IQDBAOF"
+
+// Magic and version byte
+const HeaderSize = 8
+const FrameHeaderSize = 8
+
+const (
+	VersionLegacy = 1
+	VersionFramed = 2
+	// Deadlines are stored as absolute unix nanoseconds
+	VersionDeadlines = 3
+	// Same records sealed with AES-GCM, header is followed by encryption header
+	VersionEncrypted = 4
+)
+
+// Current version for new plain files
+const Version = VersionDeadlines
+
+// The newest known version
+const MaxVersion = VersionEncrypted
+
+// Strings longer than that are never written, so length is garbage
+const MaxStringLen = 512 << 20
+
+const (
+	OpSet      = 1
+	OpRemove   = 2
+	OpTTL      = 3
+	OpListPush = 4
+	OpListPop  = 5
+	OpHashDel  = 6
+	OpHashSet  = 7
+	// Same as OpSet and OpTTL, but with absolute deadline instead of relative TTL
+	OpSetAt    = 8
+	OpExpireAt = 9
+	OpSetAdd   = 10
+	OpSetRem   = 11
+	// Member-score pairs of sorted set, scores are decimal strings
+	OpZSetAdd = 12
+	OpZSetRem = 13
+	// Increments are logged as deltas, decimal strings in Value.
+	// Field and delta of OpHashIncrBy are in Args
+	OpIncrBy      = 14
+	OpIncrByFloat = 15
+	OpHashIncrBy  = 16
+	// Head counterparts of OpListPush and OpListPop
+	OpListPushLeft = 17
+	OpListPopLeft  = 18
+	// List edits, arguments are in Args: BEFORE or AFTER, pivot and value for OpListInsert,
+	// index and value for OpListSet, count and value for OpListRem, start and stop for OpListTrim
+	OpListInsert = 19
+	OpListSet    = 20
+	OpListRem    = 21
+	OpListTrim   = 22
+	// Batch of string values with common deadline, key is the first key of batch
+	// and Args are key-value pairs. The only operation on many keys
+	OpMSet = 23
+	// Single bit of string value, offset and bit are in Args
+	OpSetBit = 24
+	// Elements added to HyperLogLog are in Args
+	OpHLLAdd = 25
+	// HyperLogLog merged into the one of key, Value is its Redis HYLL string.
+	// Registers are raised to the merged ones, so replay does not depend on order of adds
+	OpHLLMerge = 26
+	// Stream operations, arguments are in Args: ID, max length (-1 if none) and field-value pairs for OpStreamAdd,
+	// max length for OpStreamTrim, group and ID for OpStreamGroupCreate, group for OpStreamGroupDestroy,
+	// group, consumer, delivery unix nanoseconds and IDs for OpStreamDeliver, group and IDs for OpStreamAck
+	OpStreamAdd          = 27
+	OpStreamTrim         = 28
+	OpStreamGroupCreate  = 29
+	OpStreamGroupDestroy = 30
+	OpStreamDeliver      = 31
+	OpStreamAck          = 32
+	// Whole stream with its groups in Value, it replaces key
+	OpStreamRestore = 33
+	// Same as OpIncrBy and OpIncrByFloat, but with deadline of key after increment,
+	// so increment of expired key is not replayed
+	OpIncrByAt      = 34
+	OpIncrByFloatAt = 35
+)
+
+var opNames = map[byte]string{
+	OpSet:          "SET",
+	OpRemove:       "REMOVE",
+	OpTTL:          "TTL",
+	OpListPush:     "LISTPUSH",
+	OpListPop:      "LISTPOP",
+	OpHashDel:      "HASHDEL",
+	OpHashSet:      "HASHSET",
+	OpSetAt:        "SETAT",
+	OpExpireAt:     "EXPIREAT",
+	OpSetAdd:       "SETADD",
+	OpSetRem:       "SETREM",
+	OpZSetAdd:      "ZSETADD",
+	OpZSetRem:      "ZSETREM",
+	OpIncrBy:       "INCRBY",
+	OpIncrByFloat:  "INCRBYFLOAT",
+	OpHashIncrBy:   "HASHINCRBY",
+	OpListPushLeft: "LISTPUSHLEFT",
+	OpListPopLeft:  "LISTPOPLEFT",
+	OpListInsert:   "LISTINSERT",
+	OpListSet:      "LISTSET",
+	OpListRem:      "LISTREM",
+	OpListTrim:     "LISTTRIM",
+	OpMSet:         "MSET",
+	OpSetBit:       "SETBIT",
+	OpHLLAdd:       "HLLADD",
+	OpHLLMerge:     "HLLMERGE",
+
+	OpStreamAdd:          "STREAMADD",
+	OpStreamTrim:         "STREAMTRIM",
+	OpStreamGroupCreate:  "STREAMGROUPCREATE",
+	OpStreamGroupDestroy: "STREAMGROUPDESTROY",
+	OpStreamDeliver:      "STREAMDELIVER",
+	OpStreamAck:          "STREAMACK",
+	OpStreamRestore:      "STREAMRESTORE",
+
+	OpIncrByAt:      "INCRBYAT",
+	OpIncrByFloatAt: "INCRBYFLOATAT",
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Name of operation code, e.g. SETAT for OpSetAt
+func OpName(code byte) string {
+	name, ok := opNames[code]
+	if !ok {
+		return "UNKNOWN"
+	}
+
+	return name
+}
+
+// Operation code by its name. Returns false if there is no such operation
+func OpCode(name string) (byte, bool) {
+	for code, n := range opNames {
+		if n == name {
+			return code, true
+		}
+	}
+
+	return 0, false
+}
+
+// Single encoded AOF operation. Records are built in memory first,
+// so they can be written to the log and to the rewrite buffer in one go
+type Record []byte
+
+func NewRecord(op byte, key string) Record {
+	r := Record{op}
+
+	return r.PutString(key)
+}
+
+func (r Record) PutUint64(v uint64) Record {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+
+	return append(r, b...)
+}
+
+func (r Record) PutString(s string) Record {
+	r = r.PutUint64(uint64(len(s)))
+
+	return append(r, s...)
+}
+
+func (r Record) PutStrings(args []string) Record {
+	r = r.PutUint64(uint64(len(args)))
+	for _, v := range args {
+		r = r.PutString(v)
+	}
+
+	return r
+}
+
+// Frame record with its length and checksum
+func Frame(r Record) []byte {
+	b := make([]byte, FrameHeaderSize, FrameHeaderSize+len(r))
+	binary.LittleEndian.PutUint32(b, uint32(len(r)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.Checksum(r, crc32c))
+
+	return append(b, r...)
+}
+
+// Header of new AOF files
+func Header() []byte {
+	return append([]byte(Magic), Version)
+}
+
+// Returns format version. Files without header are the legacy ones.
+// Header is not consumed
+func ReadHeader(rdr *bufio.Reader) (int, error) {
+	b, err := rdr.Peek(HeaderSize)
+	if err == io.EOF || (err == nil && string(b[:len(Magic)]) != Magic) {
+		return VersionLegacy, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	version := int(b[len(Magic)])
+	if version > MaxVersion {
+		return 0, ErrVersion
+	}
+
+	return version, nil
+}
+
+// Size of file header of given version
+func HeaderLen(version int) int64 {
+	switch version {
+	case VersionLegacy:
+		return 0
+	case VersionEncrypted:
+		return HeaderSize + EncryptionHeaderSize
+	}
+
+	return HeaderSize
+}
+
+// Cipher of encrypted file. Header is not consumed
+// Returns ErrKey if file is encrypted with a key missing in keyring
+func ReadCipher(rdr *bufio.Reader, keys *Keyring) (*Cipher, error) {
+	b, err := rdr.Peek(HeaderSize + EncryptionHeaderSize)
+	if err == io.EOF {
+		err = ErrTornTail
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys.Cipher(b[HeaderSize:])
+}
+
+// Decoded AOF operation
+type Op struct {
+	Code byte
+	Key  string
+	// TTL in seconds for OpSet and OpTTL
+	TTL uint64
+	// Deadline in unix nanoseconds for OpSetAt, OpExpireAt, OpMSet, OpIncrByAt and OpIncrByFloatAt, 0 if none
+	Expire uint64
+	// Value for OpSet and OpSetAt, field for OpHashDel, delta for increments,
+	// HYLL string for OpHLLMerge, stream for OpStreamRestore
+	Value string
+	// Values for OpListPush and OpListPushLeft, arguments of list edits, field-value pairs for OpHashSet, members for OpSetAdd, OpSetRem and OpZSetRem,
+	// member-score pairs for OpZSetAdd, field and delta for OpHashIncrBy, key-value pairs for OpMSet,
+	// offset and bit for OpSetBit, elements for OpHLLAdd, arguments of stream operations
+	Args []string
+	// Record was compressed
+	Compressed bool
+}
+
+func (op *Op) Name() string {
+	return OpName(op.Code)
+}
+
+// Decode single operation. Returns io.EOF if there is nothing to read
+// and io.ErrUnexpectedEOF if operation is incomplete
+func Decode(rdr io.Reader) (*Op, error) {
+	code := make([]byte, 1)
+
+	_, err := io.ReadFull(rdr, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var op *Op
+	if code[0]&FlagCompressed != 0 {
+		op, err = decodeCompressed(rdr, code[0]&^FlagCompressed)
+	} else {
+		op, err = decodeArgs(rdr, code[0])
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return op, err
+}
+
+func decodeArgs(rdr io.Reader, code byte) (*Op, error) {
+	var err error
+	op := &Op{Code: code}
+
+	op.Key, err = ReadString(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch code {
+	case OpSet:
+		op.TTL, err = ReadUint64(rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		op.Value, err = ReadString(rdr)
+	case OpTTL:
+		op.TTL, err = ReadUint64(rdr)
+	case OpSetAt, OpIncrByAt, OpIncrByFloatAt:
+		op.Expire, err = ReadUint64(rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		op.Value, err = ReadString(rdr)
+	case OpExpireAt:
+		op.Expire, err = ReadUint64(rdr)
+	case OpMSet:
+		op.Expire, err = ReadUint64(rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		op.Args, err = ReadStrings(rdr)
+	case OpListPush, OpHashSet, OpSetAdd, OpSetRem, OpZSetAdd, OpZSetRem, OpHashIncrBy,
+		OpListPushLeft, OpListInsert, OpListSet, OpListRem, OpListTrim, OpSetBit, OpHLLAdd,
+		OpStreamAdd, OpStreamTrim, OpStreamGroupCreate, OpStreamGroupDestroy, OpStreamDeliver, OpStreamAck:
+		op.Args, err = ReadStrings(rdr)
+	case OpHashDel, OpIncrBy, OpIncrByFloat, OpHLLMerge, OpStreamRestore:
+		op.Value, err = ReadString(rdr)
+	case OpRemove, OpListPop, OpListPopLeft:
+	default:
+		err = ErrUnknownOp
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+func ReadString(rdr io.Reader) (string, error) {
+	b, err := ReadBytes(rdr)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func ReadBytes(rdr io.Reader) ([]byte, error) {
+	var l = make([]byte, 8)
+
+	_, err := io.ReadFull(rdr, l)
+	if err != nil {
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint64(l)
+	if n > MaxStringLen {
+		return nil, ErrCorrupt
+	}
+
+	b := make([]byte, n)
+
+	_, err = io.ReadFull(rdr, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func ReadStrings(rdr io.Reader) ([]string, error) {
+	n, err := ReadUint64(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for i := uint64(0); i < n; i++ {
+		s, err := ReadString(rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, s)
+	}
+
+	return ret, nil
+}
+
+func ReadUint64(rdr io.Reader) (uint64, error) {
+	i := make([]byte, 8)
+	_, err := io.ReadFull(rdr, i)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(i), nil
+}
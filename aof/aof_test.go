@@ -0,0 +1,290 @@
+package aof_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ravlio/iqdb/aof"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecode(t *testing.T) {
+	req := require.New(t)
+
+	b := aof.NewRecord(aof.OpSetAt, "k").PutUint64(42).PutString("v")
+	b = append(b, aof.NewRecord(aof.OpHashSet, "h").PutStrings([]string{"f", "v"})...)
+	b = append(b, aof.NewRecord(aof.OpListPop, "l")...)
+	b = append(b, aof.NewRecord(aof.OpMSet, "a").PutUint64(7).PutStrings([]string{"a", "1", "b", "2"})...)
+	b = append(b, aof.NewRecord(aof.OpSetBit, "bits").PutStrings([]string{"7", "1"})...)
+	b = append(b, aof.NewRecord(aof.OpHLLAdd, "hll").PutStrings([]string{"a", "b"})...)
+	b = append(b, aof.NewRecord(aof.OpHLLMerge, "hll").PutString("HYLL")...)
+	b = append(b, aof.NewRecord(aof.OpStreamAdd, "s").PutStrings([]string{"1-1", "-1", "f", "v"})...)
+	b = append(b, aof.NewRecord(aof.OpStreamAck, "s").PutStrings([]string{"g", "1-1"})...)
+	b = append(b, aof.NewRecord(aof.OpStreamRestore, "s").PutString("dump")...)
+	b = append(b, aof.NewRecord(aof.OpIncrByAt, "n").PutUint64(9).PutString("5")...)
+
+	rdr := bytes.NewReader(b)
+
+	op, err := aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpSetAt, Key: "k", Expire: 42, Value: "v"}, op)
+	req.Equal("SETAT", op.Name())
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal([]string{"f", "v"}, op.Args)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpListPop, Key: "l"}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpMSet, Key: "a", Expire: 7, Args: []string{"a", "1", "b", "2"}}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpSetBit, Key: "bits", Args: []string{"7", "1"}}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpHLLAdd, Key: "hll", Args: []string{"a", "b"}}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpHLLMerge, Key: "hll", Value: "HYLL"}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpStreamAdd, Key: "s", Args: []string{"1-1", "-1", "f", "v"}}, op)
+	req.Equal("STREAMADD", op.Name())
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpStreamAck, Key: "s", Args: []string{"g", "1-1"}}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpStreamRestore, Key: "s", Value: "dump"}, op)
+
+	op, err = aof.Decode(rdr)
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpIncrByAt, Key: "n", Expire: 9, Value: "5"}, op)
+	req.Equal("INCRBYAT", op.Name())
+
+	_, err = aof.Decode(rdr)
+	req.Equal(io.EOF, err)
+
+	_, err = aof.Decode(bytes.NewReader(b[:5]))
+	req.Equal(io.ErrUnexpectedEOF, err)
+
+	_, err = aof.Decode(bytes.NewReader(aof.NewRecord(100, "k")))
+	req.Equal(aof.ErrUnknownOp, err)
+
+	code, ok := aof.OpCode("HASHSET")
+	req.True(ok)
+	req.EqualValues(aof.OpHashSet, code)
+}
+
+func TestCompress(t *testing.T) {
+	req := require.New(t)
+
+	value := strings.Repeat("value ", 100)
+	r := aof.NewRecord(aof.OpSetAt, "k").PutUint64(42).PutString(value)
+
+	c := aof.Compress(r)
+	req.True(len(c) < len(r))
+
+	op, err := aof.Decode(bytes.NewReader(c))
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpSetAt, Key: "k", Expire: 42, Value: value, Compressed: true}, op)
+	req.Equal("SETAT", op.Name())
+
+	// Small records don't get smaller
+	small := aof.NewRecord(aof.OpRemove, "k")
+	req.Equal(small, aof.Compress(small))
+
+	c[len(c)-3] ^= 0xff
+	_, err = aof.Decode(bytes.NewReader(c))
+	req.Equal(aof.ErrCorrupt, err)
+}
+
+func TestScanner(t *testing.T) {
+	req := require.New(t)
+
+	b := aof.Header()
+	b = append(b, aof.Frame(aof.NewRecord(aof.OpRemove, "a"))...)
+	corrupt := len(b)
+	b = append(b, aof.Frame(aof.NewRecord(aof.OpRemove, "b"))...)
+	b = append(b, aof.Frame(aof.NewRecord(aof.OpRemove, "c"))...)
+	b[len(b)-1] ^= 0xff
+	tail := len(b)
+	b = append(b, aof.Frame(aof.NewRecord(aof.OpRemove, "d"))[:5]...)
+	b[corrupt+aof.FrameHeaderSize+1] ^= 0xff
+
+	rdr := bufio.NewReader(bytes.NewReader(b))
+	version, err := aof.ReadHeader(rdr)
+	req.NoError(err)
+	req.Equal(aof.Version, version)
+
+	_, err = rdr.Discard(aof.HeaderSize)
+	req.NoError(err)
+
+	sc := aof.NewScanner(rdr, version, aof.HeaderSize, int64(len(b)))
+
+	op, err := sc.Next()
+	req.NoError(err)
+	req.Equal("a", op.Key)
+
+	_, err = sc.Next()
+	req.Equal(aof.ErrChecksum, err)
+	req.EqualValues(corrupt, sc.Pos())
+
+	_, err = sc.Next()
+	req.Equal(aof.ErrChecksum, err)
+
+	_, err = sc.Next()
+	req.Equal(io.ErrUnexpectedEOF, err)
+	req.EqualValues(tail, sc.Pos())
+}
+
+func TestRepair(t *testing.T) {
+	req := require.New(t)
+
+	dir, err := ioutil.TempDir("", "iqdb-aof")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	req.NoError(os.Mkdir(src, 0700))
+	req.NoError(aof.WriteManifest(src, &aof.Manifest{ID: "id", Segments: []uint64{1, 2, 3}}))
+
+	seg1 := aof.Header()
+	seg1 = append(seg1, aof.Frame(aof.NewRecord(aof.OpRemove, "a"))...)
+	bad := aof.Frame(aof.NewRecord(aof.OpRemove, "b"))
+	bad[len(bad)-1] ^= 0xff
+	seg1 = append(seg1, bad...)
+	seg1 = append(seg1, aof.Frame(aof.NewRecord(aof.OpRemove, "c"))...)
+
+	seg2 := aof.Header()
+	seg2 = append(seg2, aof.Frame(aof.NewRecord(aof.OpRemove, "d"))...)
+	seg2 = append(seg2, aof.Frame(aof.NewRecord(aof.OpRemove, "e"))[:3]...)
+
+	seg3 := append(aof.Header(), aof.Frame(aof.NewRecord(aof.OpRemove, "f"))...)
+
+	for i, b := range [][]byte{seg1, seg2, seg3} {
+		req.NoError(ioutil.WriteFile(filepath.Join(src, aof.SegmentName(uint64(i+1))), b, 0600))
+	}
+
+	res, err := aof.Check(src, nil)
+	req.NoError(err)
+	req.Equal(4, res.Records)
+	req.Equal(1, res.Corrupt)
+	req.True(res.TornTail)
+	req.Len(res.Segments, 3)
+
+	// Truncation stops at the corrupt record
+	dst := filepath.Join(dir, "truncated")
+	res, err = aof.Repair(src, dst, false, nil)
+	req.NoError(err)
+	req.Equal(1, res.Records)
+
+	m, err := aof.ReadManifest(dst)
+	req.NoError(err)
+	req.Equal(&aof.Manifest{ID: "id", Segments: []uint64{1}}, m)
+
+	// Corrupt records are dropped, segments after incomplete one too
+	dst = filepath.Join(dir, "skipped")
+	res, err = aof.Repair(src, dst, true, nil)
+	req.NoError(err)
+	req.Equal(3, res.Records)
+	req.Equal(1, res.Corrupt)
+	req.True(res.TornTail)
+
+	res, err = aof.Check(dst, nil)
+	req.NoError(err)
+	req.Equal(3, res.Records)
+	req.Equal(0, res.Corrupt)
+	req.False(res.TornTail)
+	req.Equal(res.Size, res.ValidSize)
+	req.Len(res.Segments, 2)
+}
+
+func TestEncryption(t *testing.T) {
+	req := require.New(t)
+
+	dir, err := ioutil.TempDir("", "iqdb-aof")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+
+	key := bytes.Repeat([]byte("k"), 32)
+	keys, err := aof.NewKeyring(key)
+	req.NoError(err)
+
+	c, err := keys.NewCipher()
+	req.NoError(err)
+	req.Equal(aof.KeyID(key), c.KeyID())
+
+	first := aof.Frame(aof.NewRecord(aof.OpSetAt, "a").PutUint64(0).PutString("secret"))
+	frames := append(first, aof.Frame(aof.NewRecord(aof.OpRemove, "b"))...)
+	frames = append(frames, aof.Frame(aof.NewRecord(aof.OpRemove, "c"))...)
+
+	b := c.Header()
+	b = append(b, c.SealFrames(frames, int64(len(b)))...)
+	req.False(bytes.Contains(b, []byte("secret")))
+
+	// Damage the second record, sealed records are longer by GCM tag
+	second := len(c.Header()) + len(first) + 16
+	b[second+aof.FrameHeaderSize] ^= 0xff
+
+	src := filepath.Join(dir, aof.SegmentName(1))
+	req.NoError(ioutil.WriteFile(src, b, 0600))
+
+	r, err := aof.Open(src, keys)
+	req.NoError(err)
+
+	op, err := r.Next()
+	req.NoError(err)
+	req.Equal(&aof.Op{Code: aof.OpSetAt, Key: "a", Value: "secret"}, op)
+	r.Close()
+
+	// Records can't be decoded with unknown key, but are still checked
+	other, err := aof.NewKeyring(bytes.Repeat([]byte("o"), 32))
+	req.NoError(err)
+
+	r, err = aof.Open(src, other)
+	req.NoError(err)
+
+	_, err = r.Next()
+	req.Equal(aof.ErrKey, err)
+	r.Close()
+
+	res, err := aof.Check(src, nil)
+	req.NoError(err)
+	req.Equal(aof.VersionEncrypted, res.Version)
+	req.Equal(2, res.Records)
+	req.Equal(1, res.Corrupt)
+
+	// Dropped record moves the rest, so they are sealed again
+	_, err = aof.Repair(src, filepath.Join(dir, "nokey.aof"), true, nil)
+	req.Equal(aof.ErrKey, err)
+
+	dst := filepath.Join(dir, "repaired.aof")
+	res, err = aof.Repair(src, dst, true, keys)
+	req.NoError(err)
+	req.Equal(2, res.Records)
+
+	res, err = aof.Check(dst, keys)
+	req.NoError(err)
+	req.Equal(2, res.Records)
+	req.Equal(0, res.Corrupt)
+
+	_, err = aof.NewKeyring([]byte("short"))
+	req.Equal(aof.ErrKeySize, err)
+}
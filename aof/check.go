@@ -0,0 +1,231 @@
+package aof
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Result of offline AOF check
+type CheckResult struct {
+	Path string
+	// The oldest format version met
+	Version int
+	// File size and size of the valid part
+	Size      int64
+	ValidSize int64
+	// Valid and corrupt records count
+	Records int
+	Corrupt int
+	// File ends with incomplete record
+	TornTail bool
+	// Results for every segment if AOF directory is checked
+	Segments []*CheckResult
+}
+
+func (res *CheckResult) add(sr *CheckResult) {
+	if sr.Version < res.Version {
+		res.Version = sr.Version
+	}
+
+	res.Size += sr.Size
+	res.ValidSize += sr.ValidSize
+	res.Records += sr.Records
+	res.Corrupt += sr.Corrupt
+	res.TornTail = res.TornTail || sr.TornTail
+	res.Segments = append(res.Segments, sr)
+}
+
+// Check AOF directory or a single segment file without loading it.
+// Scanning continues after corrupt records if they could be skipped.
+// Records of encrypted segments are decoded only if keys have their key
+// Returns check result on success and error on fail
+func Check(path string, keys *Keyring) (*CheckResult, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return checkSegment(path, keys)
+	}
+
+	segs, err := Segments(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CheckResult{Path: path, Version: Version}
+	for _, s := range segs {
+		sr, err := checkSegment(s, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		res.add(sr)
+	}
+
+	return res, nil
+}
+
+func checkSegment(fname string, keys *Keyring) (*CheckResult, error) {
+	r, err := Open(fname, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	res := &CheckResult{Path: fname, Version: r.version, Size: r.Size, ValidSize: r.pos}
+
+	for {
+		_, err := r.next(false)
+		if err == io.EOF {
+			break
+		}
+
+		if err == ErrChecksum || err == ErrDecrypt {
+			res.Corrupt++
+			continue
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			res.TornTail = true
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		res.Records++
+		if res.Corrupt == 0 {
+			res.ValidSize = r.pos + r.n
+		}
+	}
+
+	return res, nil
+}
+
+// Write repaired copy of AOF directory or a single segment file to dst.
+// Copy ends at the first damaged record, the same way as replay with tail truncation does.
+// If skipCorrupt is set, records with wrong checksum are dropped and copying goes on.
+// Segments after incomplete one are never copied, replay drops them as well.
+// Encrypted segments are sealed again with new nonces if keys have their key,
+// otherwise they are copied as is and records can't be dropped
+// Returns result describing the copy on success and error on fail
+func Repair(src, dst string, skipCorrupt bool, keys *Keyring) (*CheckResult, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return repairSegment(src, dst, skipCorrupt, keys)
+	}
+
+	m, err := ReadManifest(src)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(dst, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &CheckResult{Path: dst, Version: Version}
+	copied := &Manifest{ID: m.ID}
+	for _, s := range m.Segments {
+		name := SegmentName(s)
+
+		sr, err := repairSegment(filepath.Join(src, name), filepath.Join(dst, name), skipCorrupt, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		res.add(sr)
+		copied.Segments = append(copied.Segments, s)
+
+		if sr.TornTail || (sr.Corrupt > 0 && !skipCorrupt) {
+			break
+		}
+	}
+
+	return res, WriteManifest(dst, copied)
+}
+
+func repairSegment(src, dst string, skipCorrupt bool, keys *Keyring) (*CheckResult, error) {
+	r, err := Open(src, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := r.RawHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	// Records are moved if some are dropped, and nonce depends on offset,
+	// so the copy is sealed with new nonce base
+	var c *Cipher
+	if r.cipher != nil {
+		c, err = keys.newCipher(r.KeyID)
+		if err != nil {
+			return nil, err
+		}
+
+		b = c.Header()
+	}
+
+	res := &CheckResult{Path: dst, Version: r.version}
+
+	for {
+		_, err := r.next(false)
+		if err == io.EOF {
+			break
+		}
+
+		if err == ErrChecksum || err == ErrDecrypt {
+			res.Corrupt++
+			if !skipCorrupt {
+				break
+			}
+
+			if r.version == VersionEncrypted && c == nil {
+				return nil, ErrKey
+			}
+
+			continue
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			res.TornTail = true
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if c != nil {
+			b = append(b, c.SealFrames(Frame(r.payload), int64(len(b)))...)
+			res.Records++
+			continue
+		}
+
+		raw, err := r.Raw()
+		if err != nil {
+			return nil, err
+		}
+
+		b = append(b, raw...)
+		res.Records++
+	}
+
+	res.Size = int64(len(b))
+	res.ValidSize = res.Size
+
+	return res, ioutil.WriteFile(dst, b, 0600)
+}
@@ -0,0 +1,65 @@
+package aof
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// Operation code flag of compressed record. Compressed record is
+//
+//	[byte op code | FlagCompressed][string DEFLATE compressed arguments]
+//
+// so compressed and plain records can be mixed in one file
+const FlagCompressed = 0x80
+
+// Compress record arguments with DEFLATE.
+// Record is returned as is if it doesn't get smaller
+func Compress(r Record) Record {
+	var buf bytes.Buffer
+
+	// Records are compressed on write path, so speed is preferred
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return r
+	}
+
+	_, err = w.Write(r[1:])
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err != nil || 1+8+buf.Len() >= len(r) {
+		return r
+	}
+
+	return Record{r[0] | FlagCompressed}.PutString(buf.String())
+}
+
+func decodeCompressed(rdr io.Reader, code byte) (*Op, error) {
+	b, err := ReadBytes(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Uncompressed record must fit into a frame
+	args, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(b)), math.MaxUint32))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+
+	op, err := decodeArgs(bytes.NewReader(args), code)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrCorrupt
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	op.Compressed = true
+
+	return op, nil
+}
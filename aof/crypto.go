@@ -0,0 +1,225 @@
+package aof
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
+)
+
+var ErrKey = errors.New("AOF is encrypted with unknown key")
+var ErrKeySize = errors.New("encryption key must be 16, 24 or 32 bytes")
+var ErrDecrypt = errors.New("AOF record decryption failed")
+
+const KeyIDSize = 8
+const NonceSize = 12
+
+// Encrypted segment header follows the common one: [key ID][nonce base]
+const EncryptionHeaderSize = KeyIDSize + NonceSize
+
+// Short key fingerprint stored with encrypted data, so wrong key is detected before decrypting anything
+func KeyID(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("iqdb key id:"), key...))
+
+	return sum[:KeyIDSize]
+}
+
+// Encryption keys. The current key encrypts new data, the previous ones only decrypt old data.
+// Nil keyring has no keys
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// Keyring with current key, nil current key disables encryption of new data
+// Returns keyring on success and error on fail
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+
+	for _, key := range append([][]byte{current}, previous...) {
+		if key == nil {
+			continue
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrKeySize
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		k.keys[string(KeyID(key))] = aead
+	}
+
+	if current != nil {
+		k.current = string(KeyID(current))
+	}
+
+	return k, nil
+}
+
+// Keyring with new current key, all keys of k are kept for decrypting old data.
+// Nil key disables encryption of new data
+// Returns keyring on success and error on fail
+func (k *Keyring) Rotate(key []byte) (*Keyring, error) {
+	r, err := NewKeyring(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if k != nil {
+		for id, aead := range k.keys {
+			r.keys[id] = aead
+		}
+	}
+
+	return r, nil
+}
+
+// ID of the current key, nil if new data is not encrypted
+func (k *Keyring) CurrentID() []byte {
+	if k == nil || k.current == "" {
+		return nil
+	}
+
+	return []byte(k.current)
+}
+
+// Cipher with the current key and new random nonce base, nil if new data is not encrypted
+func (k *Keyring) NewCipher() (*Cipher, error) {
+	if k == nil || k.current == "" {
+		return nil, nil
+	}
+
+	return k.newCipher([]byte(k.current))
+}
+
+func (k *Keyring) newCipher(id []byte) (*Cipher, error) {
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.Cipher(append(append([]byte(nil), id...), nonce...))
+}
+
+// Cipher of encryption header. Returns ErrKey if there is no such key
+func (k *Keyring) Cipher(hdr []byte) (*Cipher, error) {
+	if k == nil {
+		return nil, ErrKey
+	}
+
+	aead, ok := k.keys[string(hdr[:KeyIDSize])]
+	if !ok {
+		return nil, ErrKey
+	}
+
+	hdr = append([]byte(nil), hdr[:EncryptionHeaderSize]...)
+
+	return &Cipher{aead: aead, keyID: hdr[:KeyIDSize], nonce: hdr[KeyIDSize:]}, nil
+}
+
+// Record cipher of a single segment. Every record is sealed with AES-GCM,
+// nonce is the segment nonce base XOR record offset, so it is never reused within a key
+// as long as nonce bases are random
+type Cipher struct {
+	aead  cipher.AEAD
+	keyID []byte
+	nonce []byte
+}
+
+func (c *Cipher) KeyID() []byte {
+	return c.keyID
+}
+
+// Key ID and nonce base, read back with Keyring.Cipher
+func (c *Cipher) EncryptionHeader() []byte {
+	return append(append([]byte(nil), c.keyID...), c.nonce...)
+}
+
+// Full header of encrypted segment
+func (c *Cipher) Header() []byte {
+	b := append([]byte(Magic), VersionEncrypted)
+
+	return append(b, c.EncryptionHeader()...)
+}
+
+func (c *Cipher) nonceAt(offset uint64) []byte {
+	n := append([]byte(nil), c.nonce...)
+	b := n[NonceSize-8:]
+	binary.BigEndian.PutUint64(b, binary.BigEndian.Uint64(b)^offset)
+
+	return n
+}
+
+// Seal data stored at offset
+func (c *Cipher) Seal(p []byte, offset uint64) []byte {
+	return c.aead.Seal(nil, c.nonceAt(offset), p, nil)
+}
+
+// Open data stored at offset. Returns ErrDecrypt if it was damaged or moved
+func (c *Cipher) Open(p []byte, offset uint64) ([]byte, error) {
+	b, err := c.aead.Open(nil, c.nonceAt(offset), p, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return b, nil
+}
+
+// Seal plain framed records to be written at offset. Frames of sealed records
+// carry checksum of ciphertext, so damage is detected without the key
+func (c *Cipher) SealFrames(b []byte, offset int64) []byte {
+	ret := make([]byte, 0, len(b)+len(b)/8)
+
+	for len(b) >= FrameHeaderSize {
+		l := int(binary.LittleEndian.Uint32(b))
+		sealed := c.Seal(b[FrameHeaderSize:FrameHeaderSize+l], uint64(offset))
+		b = b[FrameHeaderSize+l:]
+
+		hdr := make([]byte, FrameHeaderSize)
+		binary.LittleEndian.PutUint32(hdr, uint32(len(sealed)))
+		binary.LittleEndian.PutUint32(hdr[4:], crc32.Checksum(sealed, crc32c))
+
+		ret = append(append(ret, hdr...), sealed...)
+		offset += int64(FrameHeaderSize + len(sealed))
+	}
+
+	return ret
+}
+
+// Read hex encoded keys from file, one per line. The first key is the current one
+// Returns keys on success and error on fail
+func ReadKeyFile(path string) ([][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0)
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,117 @@
+package aof
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// AOF is stored as a directory of numbered segment files. Manifest lists live segments in order,
+// the last one is appended to. Every segment starts with AOF header
+const ManifestName = "MANIFEST"
+const SegmentExt = ".aof"
+
+type Manifest struct {
+	// Random log identifier, so snapshots of another log are never mixed up with this one
+	ID       string   `json:"id"`
+	Segments []uint64 `json:"segments"`
+}
+
+func (m *Manifest) Last() uint64 {
+	return m.Segments[len(m.Segments)-1]
+}
+
+func (m *Manifest) Next() uint64 {
+	return m.Last() + 1
+}
+
+func (m *Manifest) Has(seg uint64) bool {
+	for _, s := range m.Segments {
+		if s == seg {
+			return true
+		}
+	}
+
+	return false
+}
+
+func SegmentName(seg uint64) string {
+	return fmt.Sprintf("%08d%s", seg, SegmentExt)
+}
+
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Segments) == 0 {
+		return nil, ErrCorrupt
+	}
+
+	return m, nil
+}
+
+// Replace manifest atomically
+func WriteManifest(dir string, m *Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, ManifestName)
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Segment files of AOF directory in replay order. Single file is returned as is
+func Segments(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	m, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(m.Segments))
+	for _, s := range m.Segments {
+		ret = append(ret, filepath.Join(path, SegmentName(s)))
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,217 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Sequential AOF reader, knows about both framed and legacy formats
+type Scanner struct {
+	rdr     *bufio.Reader
+	version int
+	// Offset of the current record and its size
+	pos  int64
+	n    int64
+	size int64
+	// Cipher of encrypted file and the last decrypted payload
+	cipher  *Cipher
+	payload []byte
+}
+
+// Scanner of records starting at pos of a file of given size and format version
+func NewScanner(rdr *bufio.Reader, version int, pos, size int64) *Scanner {
+	return &Scanner{rdr: rdr, version: version, pos: pos, size: size}
+}
+
+// Set cipher of encrypted file
+func (sc *Scanner) SetCipher(c *Cipher) {
+	sc.cipher = c
+}
+
+// Read next operation. Returns ErrChecksum if record is corrupt
+// and io.ErrUnexpectedEOF if file ends with incomplete record.
+// Corrupt record is skipped on the next call.
+// Records of encrypted file can't be read without cipher, ErrKey is returned then
+func (sc *Scanner) Next() (*Op, error) {
+	return sc.next(true)
+}
+
+// Records of encrypted file are only checked for damage if there is no cipher and decode is not set
+func (sc *Scanner) next(decode bool) (*Op, error) {
+	sc.pos += sc.n
+	sc.n = 0
+	sc.payload = nil
+
+	if sc.version == VersionLegacy {
+		cr := &countingReader{r: sc.rdr}
+		op, err := Decode(cr)
+		sc.n = cr.n
+
+		return op, err
+	}
+
+	hdr := make([]byte, FrameHeaderSize)
+	n, err := io.ReadFull(sc.rdr, hdr)
+	if err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, io.EOF
+		}
+
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	l := int64(binary.LittleEndian.Uint32(hdr))
+	if sc.pos+FrameHeaderSize+l > sc.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	sc.n = FrameHeaderSize + l
+
+	payload := make([]byte, l)
+	_, err = io.ReadFull(sc.rdr, payload)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	if crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, ErrChecksum
+	}
+
+	if sc.version == VersionEncrypted {
+		if sc.cipher == nil && !decode {
+			return nil, nil
+		}
+
+		if sc.cipher == nil {
+			return nil, ErrKey
+		}
+
+		payload, err = sc.cipher.Open(payload, uint64(sc.pos))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sc.payload = payload
+
+	op, err := Decode(bytes.NewReader(payload))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrCorrupt
+	}
+
+	return op, err
+}
+
+// Offset of the last read record
+func (sc *Scanner) Pos() int64 {
+	return sc.pos
+}
+
+// Size of the last read record including frame
+func (sc *Scanner) Len() int64 {
+	return sc.n
+}
+
+// Format version of scanned file
+func (sc *Scanner) Version() int {
+	return sc.version
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
+
+// Segment file opened for scanning from the first record
+type Reader struct {
+	*Scanner
+	f    *os.File
+	Size int64
+	// Key ID of encrypted file
+	KeyID []byte
+}
+
+// Open AOF segment file and skip its header. Keys are needed to decode records of encrypted file,
+// without them records are only checked for damage
+// Returns reader on success and error on fail
+func Open(fname string, keys *Keyring) (*Reader, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	rdr := bufio.NewReader(f)
+
+	version, err := ReadHeader(rdr)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r := &Reader{f: f, Size: fi.Size()}
+
+	var c *Cipher
+	if version == VersionEncrypted {
+		c, err = ReadCipher(rdr, keys)
+		if err != nil && err != ErrKey {
+			f.Close()
+			return nil, err
+		}
+
+		b, _ := rdr.Peek(HeaderSize + KeyIDSize)
+		r.KeyID = append([]byte(nil), b[HeaderSize:]...)
+	}
+
+	offset := HeaderLen(version)
+	_, err = rdr.Discard(int(offset))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r.Scanner = NewScanner(rdr, version, offset, fi.Size())
+	r.SetCipher(c)
+
+	return r, nil
+}
+
+// Raw bytes of the last read record, including frame
+func (r *Reader) Raw() ([]byte, error) {
+	b := make([]byte, r.n)
+	_, err := r.f.ReadAt(b, r.pos)
+
+	return b, err
+}
+
+// Raw bytes of file header, empty for legacy files
+func (r *Reader) RawHeader() ([]byte, error) {
+	if r.version == VersionLegacy {
+		return nil, nil
+	}
+
+	b := make([]byte, HeaderLen(r.version))
+	_, err := r.f.ReadAt(b, 0)
+
+	return b, err
+}
+
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
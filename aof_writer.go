@@ -0,0 +1,95 @@
+package iqdb
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Max records written in one batch
+const aofMaxBatch = 1024
+
+// Framed record queued for writing
+type aofWrite struct {
+	b    []byte
+	done chan error
+}
+
+// AOF writer goroutine. Takes everything queued so far, writes it with a single write
+// and with FsyncAlways policy syncs the whole batch at once before acknowledging it.
+// Exits when the queue is closed and drained
+func (iq *IqDB) runAOFWriter() {
+	defer close(iq.aofDone)
+
+	batch := make([]*aofWrite, 0, aofMaxBatch)
+	buf := make([]byte, 0)
+
+	for w := range iq.aofCh {
+		batch = append(batch[:0], w)
+		buf = append(buf[:0], w.b...)
+
+	collect:
+		for len(batch) < aofMaxBatch {
+			select {
+			case w, ok := <-iq.aofCh:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, w)
+				buf = append(buf, w.b...)
+			default:
+				break collect
+			}
+		}
+
+		err := iq.writeBatch(buf, len(batch))
+		if err == nil && iq.opts.FsyncPolicy == FsyncAlways {
+			err = iq.fsync()
+		}
+
+		for _, w := range batch {
+			w.done <- err
+		}
+	}
+}
+
+// Write records to AOF and to the rewrite buffer if rewrite is in progress
+func (iq *IqDB) writeBatch(b []byte, n int) error {
+	iq.syncMx.Lock()
+
+	// Rewrite buffer is sealed when it is appended to the new segment
+	if iq.rewriteBuf != nil {
+		iq.rewriteBuf.Write(b)
+	}
+	if iq.cipher != nil {
+		b = iq.cipher.SealFrames(b, iq.segSize)
+	}
+
+	_, err := iq.aofW.Write(b)
+	iq.aofSize += int64(len(b))
+	iq.segSize += int64(len(b))
+	iq.writeSeq += uint64(n)
+	if iq.unsyncedSince.IsZero() {
+		iq.unsyncedSince = time.Now()
+	}
+
+	if err == nil && iq.needsRotate() {
+		rerr := iq.rotate()
+		if rerr != nil {
+			log.Errorf("AOF segment rotation failed: %s", rerr)
+		}
+	}
+
+	rewrite := iq.needsRewrite()
+	if rewrite {
+		iq.isRewriting = true
+	}
+
+	iq.syncMx.Unlock()
+
+	if rewrite {
+		go iq.runRewrite()
+	}
+
+	return err
+}
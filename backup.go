@@ -0,0 +1,409 @@
+package iqdb
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	nethttp "net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ravlio/iqdb/aof"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrBackupFormat = errors.New("wrong backup format")
+var ErrBackupChecksum = errors.New("backup checksum mismatch")
+var ErrBackupInProgress = errors.New("backup in progress")
+var ErrRestoreTarget = errors.New("restore target is not empty")
+
+const backupMagic = "IQDBBACK"
+const backupVersion = 1
+
+// Max data size of backup section
+const backupChunkSize = 64 << 10
+
+const (
+	// Chunk of snapshot
+	backupSectionSnapshot = 1
+	// Start of AOF segment, data is its uint64 number
+	backupSectionSegment = 2
+	// Chunk of the current AOF segment
+	backupSectionData = 3
+	// End of backup, data is uint32 CRC32 of everything before the section
+	backupSectionEnd = 4
+)
+
+// Backup stream layout:
+//
+//	[magic][byte version][string log ID][sections...]
+//
+// where section is
+//
+//	[byte type][uint32 data length][data]
+//
+// Snapshot comes first, then AOF segments from the snapshot position up to the cut-off position.
+// Segments are copied as is, so encrypted ones stay encrypted
+type backupWriter struct {
+	w   io.Writer
+	ctx context.Context
+	// Type of sections written by Write
+	typ byte
+}
+
+func (bw *backupWriter) section(typ byte, data []byte) error {
+	err := bw.ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 5, 5+len(data))
+	hdr[0] = typ
+	binary.LittleEndian.PutUint32(hdr[1:], uint32(len(data)))
+
+	_, err = bw.w.Write(append(hdr, data...))
+
+	return err
+}
+
+// Write data as sections of current type
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		k := len(p)
+		if k > backupChunkSize {
+			k = backupChunkSize
+		}
+
+		err := bw.section(bw.typ, p[:k])
+		if err != nil {
+			return 0, err
+		}
+
+		p = p[k:]
+	}
+
+	return n, nil
+}
+
+// AOF segment opened for backup
+type tailSegment struct {
+	seg uint64
+	f   *os.File
+	r   io.Reader
+}
+
+// Write consistent backup of running database to w. Backup is a snapshot and AOF tail
+// written while the snapshot was streamed, so it is as recent as the moment snapshot is written.
+// Writes are not blocked. Segments are not pruned and AOF rewrite can't start until backup is finished
+// Returns error on fail
+func (iq *IqDB) Backup(ctx context.Context, w io.Writer) error {
+	iq.syncMx.Lock()
+	if iq.isRewriting {
+		iq.syncMx.Unlock()
+		return ErrRewriteInProgress
+	}
+	iq.backups++
+	id := iq.manifest.ID
+	iq.syncMx.Unlock()
+
+	defer func() {
+		iq.syncMx.Lock()
+		iq.backups--
+		iq.syncMx.Unlock()
+	}()
+
+	sum := crc32.NewIEEE()
+	bw := &backupWriter{w: io.MultiWriter(w, sum), ctx: ctx, typ: backupSectionSnapshot}
+
+	hdr := aof.Record(backupMagic)
+	hdr = append(hdr, backupVersion)
+	_, err := bw.w.Write(hdr.PutString(id))
+	if err != nil {
+		return err
+	}
+
+	pos, err := iq.snapshot(bw)
+	if err != nil {
+		return err
+	}
+
+	segs, err := iq.openTail(pos)
+	if err != nil {
+		return err
+	}
+	defer closeTail(segs)
+
+	for _, s := range segs {
+		n := make([]byte, 8)
+		binary.LittleEndian.PutUint64(n, s.seg)
+		err = bw.section(backupSectionSegment, n)
+		if err != nil {
+			return err
+		}
+
+		bw.typ = backupSectionData
+		_, err = io.Copy(bw, s.r)
+		if err != nil {
+			return err
+		}
+	}
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, sum.Sum32())
+
+	return bw.section(backupSectionEnd, crc)
+}
+
+// Open segments from position up to the current end of AOF
+func (iq *IqDB) openTail(pos LogPosition) ([]*tailSegment, error) {
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	err := iq.aofBuf.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	segs := make([]*tailSegment, 0)
+	for _, s := range iq.manifest.Segments {
+		if s < pos.Segment {
+			continue
+		}
+
+		f, err := os.Open(iq.segmentPath(s))
+		if err != nil {
+			closeTail(segs)
+			return nil, err
+		}
+
+		// Current segment keeps growing
+		var r io.Reader = f
+		if s == iq.manifest.Last() {
+			r = io.LimitReader(f, iq.segSize)
+		}
+
+		segs = append(segs, &tailSegment{seg: s, f: f, r: r})
+	}
+
+	return segs, nil
+}
+
+func closeTail(segs []*tailSegment) {
+	for _, s := range segs {
+		s.f.Close()
+	}
+}
+
+// Restore backup stream to new AOF directory and open it.
+// Snapshot of the backup is saved to opts.SnapshotFile. If it is not set,
+// AOF is rewritten from the restored dataset, so it doesn't need the snapshot
+// Returns opened database on success and error on fail
+func Restore(r io.Reader, dir string, opts *Options) (*IqDB, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err == nil && len(files) > 0 {
+		return nil, ErrRestoreTarget
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	o := *opts
+	if opts.SnapshotFile == "" {
+		o.SnapshotFile = filepath.Join(dir, "restore.snap")
+		o.SnapshotPeriod = 0
+	}
+
+	err = restoreFiles(r, dir, o.SnapshotFile)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := Open(dir, &o)
+	if err != nil || opts.SnapshotFile != "" {
+		return db, err
+	}
+
+	// Rewrite removes the snapshot
+	err = db.RewriteAOF()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	o.SnapshotFile = ""
+
+	return db, nil
+}
+
+// Write snapshot and segments of backup stream, manifest is written the last
+func restoreFiles(r io.Reader, dir, snapshotFile string) error {
+	sum := crc32.NewIEEE()
+	rdr := io.TeeReader(bufio.NewReader(r), sum)
+
+	magic := make([]byte, len(backupMagic)+1)
+	_, err := io.ReadFull(rdr, magic)
+	if err != nil {
+		return err
+	}
+
+	if string(magic[:len(backupMagic)]) != backupMagic || magic[len(backupMagic)] != backupVersion {
+		return ErrBackupFormat
+	}
+
+	m := &aof.Manifest{}
+	m.ID, err = aof.ReadString(rdr)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	snap, err := os.OpenFile(snapshotFile, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	var seg *os.File
+	defer func() {
+		if seg != nil {
+			seg.Close()
+		}
+	}()
+
+	for {
+		expected := sum.Sum32()
+
+		hdr := make([]byte, 5)
+		_, err = io.ReadFull(rdr, hdr)
+		// Backup ends with its own section
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return err
+		}
+
+		n := binary.LittleEndian.Uint32(hdr[1:])
+		if n > backupChunkSize {
+			return ErrBackupFormat
+		}
+
+		data := make([]byte, n)
+		_, err = io.ReadFull(rdr, data)
+		if err != nil {
+			return err
+		}
+
+		switch hdr[0] {
+		case backupSectionSnapshot:
+			_, err = snap.Write(data)
+		case backupSectionSegment:
+			if n != 8 {
+				return ErrBackupFormat
+			}
+
+			if seg != nil {
+				err = seg.Close()
+				seg = nil
+				if err != nil {
+					return err
+				}
+			}
+
+			s := binary.LittleEndian.Uint64(data)
+			m.Segments = append(m.Segments, s)
+			seg, err = os.OpenFile(filepath.Join(dir, aof.SegmentName(s)), os.O_EXCL|os.O_WRONLY|os.O_CREATE, 0600)
+		case backupSectionData:
+			if seg == nil {
+				return ErrBackupFormat
+			}
+
+			_, err = seg.Write(data)
+		case backupSectionEnd:
+			if n != 4 || seg == nil {
+				return ErrBackupFormat
+			}
+
+			if binary.LittleEndian.Uint32(data) != expected {
+				return ErrBackupChecksum
+			}
+
+			err = seg.Sync()
+			if err == nil {
+				err = snap.Sync()
+			}
+			if err == nil {
+				err = aof.WriteManifest(dir, m)
+			}
+
+			return err
+		default:
+			return ErrBackupFormat
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GET /backup streams backup of the database
+func (iq *IqDB) handleBackup(w nethttp.ResponseWriter, r *nethttp.Request) {
+	if r.Method != nethttp.MethodGet {
+		nethttp.Error(w, "method not allowed", nethttp.StatusMethodNotAllowed)
+		return
+	}
+
+	// Backup is the whole dataset, so it is served to local clients only unless token is set
+	token := iq.opts.BackupToken
+	if token == "" && !isLocalAddr(r.RemoteAddr) {
+		nethttp.Error(w, "backup is served to local clients only", nethttp.StatusForbidden)
+		return
+	}
+
+	auth := []byte(r.Header.Get("Authorization"))
+	if token != "" && subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		nethttp.Error(w, "unauthorized", nethttp.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	err := iq.Backup(r.Context(), w)
+	if err == ErrRewriteInProgress {
+		nethttp.Error(w, err.Error(), nethttp.StatusServiceUnavailable)
+		return
+	}
+
+	// Stream is already started, client sees it has no end
+	if err != nil {
+		log.Errorf("backup failed: %s", err)
+	}
+}
+
+// Whether address of HTTP client is loopback one
+func isLocalAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
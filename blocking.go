@@ -0,0 +1,169 @@
+package iqdb
+
+import (
+	"context"
+	"sync"
+)
+
+// Clients blocked on empty lists and streams. Every key has FIFO queue of waiters, push to the key
+// wakes the first one. Woken waiter pops by itself, so it may lose the item to
+// non-blocking pop; then it queues again in front of the others.
+// Stream entries are read by every consumer group, so add to stream wakes all its waiters
+type listWaiters struct {
+	mx     *sync.Mutex
+	queues map[string][]*listWaiter
+}
+
+type listWaiter struct {
+	keys []string
+	// Key which got items, buffered, so wakeup never blocks
+	wake chan string
+}
+
+func newListWaiters() *listWaiters {
+	return &listWaiters{mx: &sync.Mutex{}, queues: make(map[string][]*listWaiter)}
+}
+
+func newListWaiter(keys []string) *listWaiter {
+	return &listWaiter{keys: keys, wake: make(chan string, 1)}
+}
+
+// Queue waiter on all its keys, in front of other waiters if front is set
+func (lw *listWaiters) add(w *listWaiter, front bool) {
+	lw.mx.Lock()
+	defer lw.mx.Unlock()
+
+	for _, key := range w.keys {
+		if front {
+			lw.queues[key] = append([]*listWaiter{w}, lw.queues[key]...)
+		} else {
+			lw.queues[key] = append(lw.queues[key], w)
+		}
+	}
+}
+
+// Caller must hold the lock
+func (lw *listWaiters) unqueue(w *listWaiter) {
+	for _, key := range w.keys {
+		q := lw.queues[key]
+		for i, qw := range q {
+			if qw == w {
+				q = append(q[:i:i], q[i+1:]...)
+				break
+			}
+		}
+
+		if len(q) == 0 {
+			delete(lw.queues, key)
+		} else {
+			lw.queues[key] = q
+		}
+	}
+}
+
+// Wake the first waiter of key. It is unqueued from all its keys
+func (lw *listWaiters) notify(key string) {
+	lw.mx.Lock()
+	defer lw.mx.Unlock()
+
+	q := lw.queues[key]
+	if len(q) == 0 {
+		return
+	}
+
+	w := q[0]
+	lw.unqueue(w)
+	w.wake <- key
+}
+
+// Wake all waiters of key
+func (lw *listWaiters) notifyAll(key string) {
+	lw.mx.Lock()
+	defer lw.mx.Unlock()
+
+	for len(lw.queues[key]) > 0 {
+		w := lw.queues[key][0]
+		lw.unqueue(w)
+		w.wake <- key
+	}
+}
+
+// Unqueue waiter which is not going to wait anymore. Wakeup it got meanwhile
+// is passed to the next waiter, so pushed items are not left unnoticed
+func (lw *listWaiters) remove(w *listWaiter) {
+	lw.mx.Lock()
+	lw.unqueue(w)
+	lw.mx.Unlock()
+
+	select {
+	case key := <-w.wake:
+		lw.notify(key)
+	default:
+	}
+}
+
+// Wake waiter of key if list has items after write
+func (iq *IqDB) wakeListWaiters(key string) {
+	if l, err := iq.ListLen(key); err == nil && l > 0 {
+		iq.waiters.notify(key)
+	}
+}
+
+// Pop from the first non-empty list, blocking until some of them gets items
+func (iq *IqDB) listBlockingPop(ctx context.Context, keys []string, pop func(key string) (string, error)) (string, string, error) {
+	w := newListWaiter(keys)
+	front := false
+
+	for {
+		// Queue before trying, so push between try and wait is not missed
+		iq.waiters.add(w, front)
+
+		for _, key := range keys {
+			v, err := pop(key)
+			if err == ErrKeyNotFound {
+				continue
+			}
+
+			iq.waiters.remove(w)
+			if err != nil {
+				return "", "", err
+			}
+
+			// There may be more items for the next waiter
+			iq.wakeListWaiters(key)
+
+			return key, v, nil
+		}
+
+		select {
+		case <-w.wake:
+			front = true
+		case <-ctx.Done():
+			iq.waiters.remove(w)
+			return "", "", ctx.Err()
+		}
+	}
+}
+
+// Read from stream, blocking until read gets entries
+func (iq *IqDB) streamBlockingRead(ctx context.Context, key string, read func() ([]StreamEntry, error)) ([]StreamEntry, error) {
+	w := newListWaiter([]string{key})
+
+	for {
+		// Queue before trying, so add between try and wait is not missed
+		iq.waiters.add(w, false)
+
+		entries, err := read()
+		if err != nil || len(entries) > 0 {
+			iq.waiters.remove(w)
+			return entries, err
+		}
+
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			iq.waiters.remove(w)
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Offline AOF inspection and repair tool.
+//
+//	iqdb-aof [flags] <AOF directory or segment file>
+//
+// Prints decoded operations, one per line or as JSON, or statistics of them.
+// Can check AOF and write repaired copy of it
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ravlio/iqdb/aof"
+)
+
+var jsonOut = flag.Bool("json", false, "print operations as JSON, one object per line")
+var prefix = flag.String("prefix", "", "only operations on keys with this prefix")
+var ops = flag.String("op", "", "only these comma separated operations, e.g. SETAT,HASHSET")
+var stats = flag.Bool("stats", false, "print statistics instead of operations")
+var top = flag.Int("top", 20, "number of the biggest keys in statistics")
+var check = flag.Bool("check", false, "check AOF and exit")
+var repair = flag.String("repair", "", "write repaired copy of AOF to this path")
+var skipCorrupt = flag.Bool("skip-corrupt", false, "drop corrupt records instead of truncating at them on repair")
+var keyFile = flag.String("key-file", "", "file with hex encoded encryption keys, one per line")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <AOF directory or segment file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	path := flag.Arg(0)
+
+	keys, err := readKeys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var code int
+	switch {
+	case *check:
+		code, err = checkAOF(path, keys)
+	case *repair != "":
+		code, err = repairAOF(path, *repair, keys)
+	default:
+		code, err = dump(path, keys)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	os.Exit(code)
+}
+
+// Keyring of key file, empty if there is no key file
+func readKeys() (*aof.Keyring, error) {
+	if *keyFile == "" {
+		return nil, nil
+	}
+
+	keys, err := aof.ReadKeyFile(*keyFile)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	return aof.NewKeyring(keys[0], keys[1:]...)
+}
+
+func checkAOF(path string, keys *aof.Keyring) (int, error) {
+	res, err := aof.Check(path, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, s := range res.Segments {
+		printResult(s)
+	}
+	printResult(res)
+
+	if res.Corrupt > 0 || res.TornTail {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+func repairAOF(src, dst string, keys *aof.Keyring) (int, error) {
+	res, err := aof.Repair(src, dst, *skipCorrupt, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	printResult(res)
+
+	return 0, nil
+}
+
+func printResult(res *aof.CheckResult) {
+	fmt.Printf("%s: version %d, size %d, valid size %d, records %d, corrupt records %d, torn tail %t\n",
+		res.Path, res.Version, res.Size, res.ValidSize, res.Records, res.Corrupt, res.TornTail)
+}
+
+// Operation filter built from flags
+type filter struct {
+	prefix string
+	codes  map[byte]bool
+}
+
+func newFilter() (*filter, error) {
+	f := &filter{prefix: *prefix}
+	if *ops == "" {
+		return f, nil
+	}
+
+	f.codes = make(map[byte]bool)
+	for _, name := range strings.Split(*ops, ",") {
+		code, ok := aof.OpCode(strings.ToUpper(strings.TrimSpace(name)))
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %q", name)
+		}
+
+		f.codes[code] = true
+	}
+
+	return f, nil
+}
+
+func (f *filter) match(op *aof.Op) bool {
+	if !strings.HasPrefix(op.Key, f.prefix) {
+		return false
+	}
+
+	return f.codes == nil || f.codes[op.Code]
+}
+
+// Operation with its place in AOF
+type record struct {
+	op      *aof.Op
+	segment string
+	offset  int64
+	size    int64
+}
+
+// Walk operations of every segment. Damaged records are reported to stderr,
+// returns 1 if there were any
+func walk(path string, keys *aof.Keyring, fn func(r *record)) (int, error) {
+	f, err := newFilter()
+	if err != nil {
+		return 0, err
+	}
+
+	segs, err := aof.Segments(path)
+	if err != nil {
+		return 0, err
+	}
+
+	code := 0
+	for _, s := range segs {
+		c, err := walkSegment(s, keys, f, fn)
+		if err != nil {
+			return 0, err
+		}
+
+		if c > code {
+			code = c
+		}
+	}
+
+	return code, nil
+}
+
+func walkSegment(fname string, keys *aof.Keyring, f *filter, fn func(r *record)) (int, error) {
+	r, err := aof.Open(fname, keys)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	name := filepath.Base(fname)
+	code := 0
+	for {
+		op, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err == aof.ErrChecksum || err == aof.ErrDecrypt {
+			fmt.Fprintf(os.Stderr, "%s:%d: corrupt record, %d bytes\n", name, r.Pos(), r.Len())
+			code = 1
+			continue
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			fmt.Fprintf(os.Stderr, "%s:%d: incomplete record, %d bytes to the end\n", name, r.Pos(), r.Size-r.Pos())
+			return 1, nil
+		}
+
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %s", name, r.Pos(), err)
+		}
+
+		if f.match(op) {
+			fn(&record{op: op, segment: name, offset: r.Pos(), size: r.Len()})
+		}
+	}
+
+	return code, nil
+}
+
+func dump(path string, keys *aof.Keyring) (int, error) {
+	if *stats {
+		return printStats(path, keys)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+
+	return walk(path, keys, func(r *record) {
+		if *jsonOut {
+			enc.Encode(jsonRecord(r))
+			return
+		}
+
+		fmt.Printf("%s:%d %s\n", r.segment, r.offset, formatOp(r.op))
+	})
+}
+
+func formatExpire(expire uint64) string {
+	if expire == 0 {
+		return "none"
+	}
+
+	return time.Unix(0, int64(expire)).UTC().Format(time.RFC3339Nano)
+}
+
+func quote(args []string) string {
+	q := make([]string, len(args))
+	for i, a := range args {
+		q[i] = strconv.Quote(a)
+	}
+
+	return strings.Join(q, " ")
+}
+
+// Human readable operation, e.g. SETAT "key" "value" expire=none
+func formatOp(op *aof.Op) string {
+	s := op.Name() + " " + strconv.Quote(op.Key)
+
+	switch op.Code {
+	case aof.OpSet:
+		s += fmt.Sprintf(" %s ttl=%ds", strconv.Quote(op.Value), op.TTL)
+	case aof.OpSetAt, aof.OpIncrByAt, aof.OpIncrByFloatAt:
+		s += fmt.Sprintf(" %s expire=%s", strconv.Quote(op.Value), formatExpire(op.Expire))
+	case aof.OpTTL:
+		s += fmt.Sprintf(" ttl=%ds", op.TTL)
+	case aof.OpExpireAt:
+		s += " expire=" + formatExpire(op.Expire)
+	case aof.OpMSet:
+		s += fmt.Sprintf(" %s expire=%s", quote(op.Args), formatExpire(op.Expire))
+	case aof.OpHashDel, aof.OpIncrBy, aof.OpIncrByFloat, aof.OpHLLMerge, aof.OpStreamRestore:
+		s += " " + strconv.Quote(op.Value)
+	case aof.OpListPush, aof.OpHashSet, aof.OpSetAdd, aof.OpSetRem, aof.OpZSetAdd, aof.OpZSetRem, aof.OpHashIncrBy,
+		aof.OpListPushLeft, aof.OpListInsert, aof.OpListSet, aof.OpListRem, aof.OpListTrim, aof.OpSetBit, aof.OpHLLAdd,
+		aof.OpStreamAdd, aof.OpStreamTrim, aof.OpStreamGroupCreate, aof.OpStreamGroupDestroy, aof.OpStreamDeliver, aof.OpStreamAck:
+		s += " " + quote(op.Args)
+	}
+
+	return s
+}
+
+type jsonOp struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	// Relative TTL of legacy operations in seconds
+	TTL *uint64 `json:"ttl,omitempty"`
+	// Deadline in RFC 3339 format, empty if key does not expire
+	ExpiresAt *string  `json:"expires_at,omitempty"`
+	Value     *string  `json:"value,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	// Record is compressed in AOF
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+func jsonRecord(r *record) *jsonOp {
+	op := r.op
+	j := &jsonOp{Segment: r.segment, Offset: r.offset, Op: op.Name(), Key: op.Key, Compressed: op.Compressed}
+
+	switch op.Code {
+	case aof.OpSet, aof.OpSetAt, aof.OpHashDel, aof.OpIncrBy, aof.OpIncrByFloat, aof.OpHLLMerge, aof.OpStreamRestore,
+		aof.OpIncrByAt, aof.OpIncrByFloatAt:
+		j.Value = &op.Value
+	case aof.OpListPush, aof.OpHashSet, aof.OpSetAdd, aof.OpSetRem, aof.OpZSetAdd, aof.OpZSetRem, aof.OpHashIncrBy,
+		aof.OpListPushLeft, aof.OpListInsert, aof.OpListSet, aof.OpListRem, aof.OpListTrim, aof.OpMSet, aof.OpSetBit, aof.OpHLLAdd,
+		aof.OpStreamAdd, aof.OpStreamTrim, aof.OpStreamGroupCreate, aof.OpStreamGroupDestroy, aof.OpStreamDeliver, aof.OpStreamAck:
+		j.Args = op.Args
+	}
+
+	switch op.Code {
+	case aof.OpSet, aof.OpTTL:
+		j.TTL = &op.TTL
+	case aof.OpSetAt, aof.OpExpireAt, aof.OpMSet, aof.OpIncrByAt, aof.OpIncrByFloatAt:
+		var e string
+		if op.Expire != 0 {
+			e = formatExpire(op.Expire)
+		}
+		j.ExpiresAt = &e
+	}
+
+	return j
+}
+
+type keyStats struct {
+	key   string
+	ops   int
+	bytes int64
+}
+
+func printStats(path string, keyring *aof.Keyring) (int, error) {
+	var records int
+	var total int64
+	counts := make(map[string]int)
+	keys := make(map[string]*keyStats)
+
+	code, err := walk(path, keyring, func(r *record) {
+		records++
+		total += r.size
+		counts[r.op.Name()]++
+
+		ks, ok := keys[r.op.Key]
+		if !ok {
+			ks = &keyStats{key: r.op.Key}
+			keys[r.op.Key] = ks
+		}
+		ks.ops++
+		ks.bytes += r.size
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Printf("records: %d\nbytes: %d\nkeys: %d\n", records, total, len(keys))
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("operations:")
+	for _, name := range names {
+		fmt.Printf("  %-10s %d\n", name, counts[name])
+	}
+
+	list := make([]*keyStats, 0, len(keys))
+	for _, ks := range keys {
+		list = append(list, ks)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].bytes != list[j].bytes {
+			return list[i].bytes > list[j].bytes
+		}
+		return list[i].key < list[j].key
+	})
+
+	if len(list) > *top {
+		list = list[:*top]
+	}
+
+	fmt.Println("biggest keys:")
+	for _, ks := range list {
+		fmt.Printf("  %s: %d bytes, %d operations\n", strconv.Quote(ks.key), ks.bytes, ks.ops)
+	}
+
+	return code, nil
+}
@@ -1,18 +1,60 @@
 package main
 
 import "github.com/ravlio/iqdb"
+import "github.com/ravlio/iqdb/aof"
 import (
+	"context"
 	"flag"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"os"
 )
 
-var dbname = flag.String("dbname", "db", "database filename")
+var dbname = flag.String("dbname", "db", "database AOF directory")
 var tcpPort = flag.Int("tcp", 7379, "tcp port")
+var checkAOF = flag.Bool("check", false, "check AOF and exit")
+var redisDB = flag.Int("redisdb", 0, "Redis database to take keys from on RDB import")
+var keyFile = flag.String("key-file", "", "file with hex encoded encryption keys, one per line, the first one is current")
 
+// Subcommands:
+//
+//	export [file]  write the dataset as JSON Lines to file or stdout
+//	import [file]  load JSON Lines from file or stdin
+//	import-rdb [file]  load Redis RDB dump from file or stdin
+//	backup [file]  write backup stream to file or stdout
+//	restore [file]  restore backup stream from file or stdin to new database
+//
+// Database must not be served by another process meanwhile
 func main() {
+	flag.Parse()
+
+	err := setKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *checkAOF {
+		os.Exit(check(*dbname))
+	}
+
+	switch flag.Arg(0) {
+	case "export":
+		os.Exit(export(*dbname, flag.Arg(1)))
+	case "import":
+		os.Exit(load(*dbname, flag.Arg(1)))
+	case "import-rdb":
+		os.Exit(loadRDB(*dbname, flag.Arg(1)))
+	case "backup":
+		os.Exit(backup(*dbname, flag.Arg(1)))
+	case "restore":
+		os.Exit(restore(*dbname, flag.Arg(1)))
+	}
+
 	log.Info("Starting ...")
 	db, err := iqdb.Open(*dbname, &iqdb.Options{
-		RedisPort: *tcpPort,
+		RedisPort:              *tcpPort,
+		EncryptionKey:          encryptionKey,
+		PreviousEncryptionKeys: previousKeys,
 	})
 
 	if err != nil {
@@ -21,3 +63,187 @@ func main() {
 
 	log.Fatal(db.Start())
 }
+
+var encryptionKey []byte
+var previousKeys [][]byte
+
+func setKeys() error {
+	if *keyFile == "" {
+		return nil
+	}
+
+	keys, err := aof.ReadKeyFile(*keyFile)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	encryptionKey, previousKeys = keys[0], keys[1:]
+
+	return nil
+}
+
+func check(fname string) int {
+	res, err := iqdb.CheckAOF(fname)
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+
+	fmt.Printf("version: %d\nsize: %d\nvalid size: %d\nrecords: %d\ncorrupt records: %d\ntorn tail: %t\n",
+		res.Version, res.Size, res.ValidSize, res.Records, res.Corrupt, res.TornTail)
+
+	if res.Corrupt > 0 || res.TornTail {
+		return 1
+	}
+
+	return 0
+}
+
+// Export database to file, stdout if file is empty
+func export(fname, out string) int {
+	db, err := iqdb.Open(fname, &iqdb.Options{EncryptionKey: encryptionKey, PreviousEncryptionKeys: previousKeys})
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	defer db.Close()
+
+	w := os.Stdout
+	if out != "" {
+		w, err = os.Create(out)
+		if err != nil {
+			log.Error(err)
+			return 2
+		}
+		defer w.Close()
+	}
+
+	err = db.Export(w)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	return 0
+}
+
+// Import file to database, stdin if file is empty
+func load(fname, in string) int {
+	db, err := iqdb.Open(fname, &iqdb.Options{EncryptionKey: encryptionKey, PreviousEncryptionKeys: previousKeys})
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	defer db.Close()
+
+	r := os.Stdin
+	if in != "" {
+		r, err = os.Open(in)
+		if err != nil {
+			log.Error(err)
+			return 2
+		}
+		defer r.Close()
+	}
+
+	err = db.Import(r)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	return 0
+}
+
+// Import Redis RDB dump to database, stdin if file is empty
+func loadRDB(fname, in string) int {
+	db, err := iqdb.Open(fname, &iqdb.Options{EncryptionKey: encryptionKey, PreviousEncryptionKeys: previousKeys})
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	defer db.Close()
+
+	r := os.Stdin
+	if in != "" {
+		r, err = os.Open(in)
+		if err != nil {
+			log.Error(err)
+			return 2
+		}
+		defer r.Close()
+	}
+
+	res, err := db.ImportRDB(r, *redisDB)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	fmt.Printf("imported: %d\nexpired: %d\nother databases: %d\n", res.Keys, res.Expired, res.OtherDB)
+	for kind, n := range res.Unsupported {
+		fmt.Printf("unsupported %s: %d\n", kind, n)
+	}
+
+	if len(res.Unsupported) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// Write backup of database to file, stdout if file is empty
+func backup(fname, out string) int {
+	db, err := iqdb.Open(fname, &iqdb.Options{EncryptionKey: encryptionKey, PreviousEncryptionKeys: previousKeys})
+	if err != nil {
+		log.Error(err)
+		return 2
+	}
+	defer db.Close()
+
+	w := os.Stdout
+	if out != "" {
+		w, err = os.Create(out)
+		if err != nil {
+			log.Error(err)
+			return 2
+		}
+		defer w.Close()
+	}
+
+	err = db.Backup(context.Background(), w)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	return 0
+}
+
+// Restore backup from file, stdin if file is empty
+func restore(fname, in string) int {
+	r := os.Stdin
+	if in != "" {
+		var err error
+		r, err = os.Open(in)
+		if err != nil {
+			log.Error(err)
+			return 2
+		}
+		defer r.Close()
+	}
+
+	db, err := iqdb.Restore(r, fname, &iqdb.Options{EncryptionKey: encryptionKey, PreviousEncryptionKeys: previousKeys})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	err = db.Close()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	return 0
+}
@@ -1,6 +1,12 @@
 package iqdb
 
 import (
+	"context"
+	"math"
+	"math/bits"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -24,27 +30,38 @@ func (iq *IqDB) Get(key string) (string, error) {
 // Set value by key. TTl is optional parameter
 // Returns error on fail
 func (iq *IqDB) Set(key, value string, ttl ...time.Duration) error {
-	var t time.Duration
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	t := iq.opts.TTL
 
 	if ttl != nil && ttl[0] > 0 {
 		t = ttl[0]
 	}
 
-	err := iq.set(key, value, t, true)
+	expire := deadline(t)
+
+	// Record is queued before other updates of key, as with updateValueLogged
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
+
+	err := iq.set(key, value, expire, true)
 	if err != nil {
+		mx.Unlock()
 		return err
 	}
 
-	err = iq.writeSet(key, value, t)
+	w := iq.queueSet(key, value, expire)
+	mx.Unlock()
 
-	return err
+	return w.wait()
 }
 
-func (iq *IqDB) set(key, value string, ttl time.Duration, lock bool) error {
+func (iq *IqDB) set(key, value string, expire time.Time, lock bool) error {
 	kv := &KV{dataType: dataTypeKV, Value: value}
 
-	if ttl > 0 {
-		kv.ttl = ttl
+	if old, err := iq.distmap.Get(key); err == nil {
+		iq.unscheduleTTL(key, old)
 	}
 
 	err := iq.distmap.Set(key, kv)
@@ -52,19 +69,39 @@ func (iq *IqDB) set(key, value string, ttl time.Duration, lock bool) error {
 		return err
 	}
 
-	if ttl > 0 {
-		iq.ttl.ReplaceOrInsert(NewttlTreeItem(key, ttl))
-	} else if iq.opts.TTL > 0 {
-		iq.ttl.ReplaceOrInsert(NewttlTreeItem(key, iq.opts.TTL))
-	}
+	iq.scheduleTTL(key, kv, expire)
 
 	return nil
 }
 
+// Set key expiration time and put it to TTL tree
+func (iq *IqDB) scheduleTTL(key string, kv *KV, expire time.Time) {
+	if expire.IsZero() {
+		return
+	}
+
+	item := newTTLTreeItemAt(key, expire)
+	kv.ttl = item.ttl
+	kv.expire = expire
+	iq.ttl.ReplaceOrInsert(item)
+}
+
+func (iq *IqDB) unscheduleTTL(key string, kv *KV) {
+	if !kv.expire.IsZero() {
+		iq.ttl.Delete(&ttlTreeItem{key: key, expire: kv.expire})
+	}
+}
+
 // Removes key from storage
 // Returns error on fail
 func (iq *IqDB) Remove(key string) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
 	err := iq.remove(key, true)
+	if err != nil {
+		return err
+	}
 
 	err = iq.writeRemove(key)
 
@@ -79,42 +116,71 @@ func (iq *IqDB) remove(key string, lock bool) error {
 	}
 
 	iq.distmap.Remove(key)
-
-	if v.ttl > 0 {
-		iq.ttl.Delete(&ttlTreeItem{ttl: v.ttl, key: key})
-	}
+	iq.unscheduleTTL(key, v)
 
 	return nil
 }
+
+// Put prepared KV to storage and schedule its expiration
+func (iq *IqDB) restoreKV(key string, kv *KV) {
+	_ = iq.distmap.Set(key, kv)
+
+	iq.scheduleTTL(key, kv, kv.expire)
+}
+
 func (iq *IqDB) removeFromHash(key string) error {
-	iq.distmap.Remove(key)
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
 
-	return nil
+	v, err := iq.distmap.Get(key)
+	if err != nil {
+		return err
+	}
+
+	// Key could be set again with another TTL after this expiration was scheduled
+	if !isExpired(v.expire) || !iq.distmap.CompareAndRemove(key, v) {
+		return nil
+	}
+
+	// Replay drops expired key anyway, removal tells it that whatever follows is a new key
+	return iq.writeRemove(key)
 }
 
 // Set TTL on key
 // Returns error on fail
 func (iq *IqDB) TTL(key string, ttl time.Duration) error {
-	err := iq._ttl(key, ttl, true)
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
 
-	err = iq.writeTTL(key, ttl)
+	if ttl <= 0 {
+		return nil
+	}
+
+	expire := deadline(ttl)
+
+	err := iq._ttl(key, expire, true)
+	if err != nil {
+		return err
+	}
+
+	err = iq.writeTTL(key, expire)
 
 	return err
 }
 
-func (iq *IqDB) _ttl(key string, ttl time.Duration, lock bool) error {
+func (iq *IqDB) _ttl(key string, expire time.Time, lock bool) error {
 	v, err := iq.distmap.Get(key)
 
 	if err != nil {
 		return err
 	}
 
-	if v.ttl == ttl || ttl == 0 {
+	if v.expire.Equal(expire) || expire.IsZero() {
 		return nil
 	}
 
-	v.ttl = ttl
-	iq.ttl.ReplaceOrInsert(NewttlTreeItem(key, ttl))
+	iq.unscheduleTTL(key, v)
+	iq.scheduleTTL(key, v, expire)
 
 	return nil
 }
@@ -135,293 +201,3269 @@ func (iq *IqDB) Type(key string) (int, error) {
 	return v.dataType, nil
 }
 
-// Lists
+// Strings
+
+// Options of SetWithOptions
+type SetOptions struct {
+	// Set only if key does not exist
+	NX bool
+	// Set only if key exists
+	XX bool
+	// Old value is wanted, key of other type is an error then
+	Get bool
+	// Keep expiration of existing key
+	KeepTTL bool
+	// TTL of key, default TTL is used if it is 0
+	TTL time.Duration
+}
 
-// Helper method to obtain and check data type
-func (iq *IqDB) list(key string) (*list, error) {
-	v, err := iq.distmap.Get(key)
+// Outcome of SetWithOptions
+type SetResult struct {
+	// Value was set
+	Set bool
+	// Key existed before
+	Existed bool
+	// Old value, if key existed
+	Old string
+}
 
-	if err != nil {
-		return nil, err
+// Set value by key according to options, e.g. only if key does not exist
+// Returns outcome on success and error on fail
+func (iq *IqDB) SetWithOptions(key, value string, opts SetOptions) (SetResult, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	if (opts.NX && opts.XX) || (opts.KeepTTL && opts.TTL > 0) {
+		return SetResult{}, ErrSetOptions
 	}
 
-	if v.dataType != dataTypeList {
-		return nil, ErrKeyTypeError
+	t := iq.opts.TTL
+	if opts.TTL > 0 {
+		t = opts.TTL
 	}
 
-	return v.list, nil
-}
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
 
-// Get list length
-// Returns items count on success and error on fail
-func (iq *IqDB) ListLen(key string) (int, error) {
-	v, err := iq.list(key)
+	var res SetResult
+	kv, err := iq.replaceKV(key, func(old *KV) (*KV, error) {
+		res = SetResult{Existed: old != nil}
 
-	if err != nil {
-		return 0, err
+		if old != nil && old.dataType == dataTypeKV {
+			res.Old = old.Value
+		} else if old != nil && opts.Get {
+			return nil, ErrKeyTypeError
+		}
+
+		if (opts.NX && old != nil) || (opts.XX && old == nil) {
+			return nil, nil
+		}
+
+		expire := deadline(t)
+		if opts.KeepTTL && old != nil {
+			expire = old.expire
+		}
+
+		return newKV(value, expire), nil
+	})
+
+	if err != nil || kv == nil {
+		mx.Unlock()
+		return res, err
 	}
 
-	return len(v.list), nil
+	res.Set = true
+	w := iq.queueSet(key, value, kv.expire)
+	mx.Unlock()
+
+	return res, w.wait()
 }
 
-// Get list item by its index
-// Returns item on success and error on fail
-func (iq *IqDB) ListIndex(key string, index int) (string, error) {
-	v, err := iq.list(key)
+// Set value only if key does not exist. TTl is optional parameter
+// Returns true if value was set on success and error on fail
+func (iq *IqDB) SetNX(key, value string, ttl ...time.Duration) (bool, error) {
+	opts := SetOptions{NX: true}
+	if ttl != nil {
+		opts.TTL = ttl[0]
+	}
+
+	res, err := iq.SetWithOptions(key, value, opts)
+
+	return res.Set, err
+}
 
+// Set value by key and get the old one. Key gets default TTL, as with Set
+// Returns old value on success and error on fail, ErrKeyNotFound if there was no key,
+// value is set anyway then
+func (iq *IqDB) GetSet(key, value string) (string, error) {
+	res, err := iq.SetWithOptions(key, value, SetOptions{Get: true})
 	if err != nil {
 		return "", err
 	}
 
-	if len(v.list) <= index {
-		return "", ErrListIndexError
+	if !res.Existed {
+		return "", ErrKeyNotFound
 	}
 
-	return v.list[index], nil
+	return res.Old, nil
 }
 
-// Push item to end of list
-// Returns items count on success and error on fail
-func (iq *IqDB) ListPush(key string, value ...string) (int, error) {
-	l, err := iq.listPush(key, value, true)
+// Get value by key and remove the key
+// Returns value on success and error on fail
+func (iq *IqDB) GetDel(key string) (string, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
 
-	err = iq.writeListPush(key, value...)
+	for {
+		kv, err := iq.distmap.Get(key)
+		if err != nil {
+			return "", err
+		}
 
-	return l, err
-}
+		if kv.dataType != dataTypeKV {
+			return "", ErrKeyTypeError
+		}
 
-func (iq *IqDB) listPush(key string, value []string, lock bool) (int, error) {
-	v, err := iq.list(key)
+		// Key is removed only if nobody changed it meanwhile
+		if !iq.distmap.CompareAndRemove(key, kv) {
+			continue
+		}
 
-	if err != nil && err != ErrKeyNotFound {
-		return 0, err
-	} else if err == ErrKeyNotFound {
-		l, err := iq.newList(key)
+		iq.unscheduleTTL(key, kv)
 
+		err = iq.writeRemove(key)
 		if err != nil {
-			return 0, err
+			return "", err
+		}
+
+		// Expired key is gone, it is just not deleted yet
+		if isExpired(kv.expire) {
+			return "", ErrKeyNotFound
 		}
-		v = l.list
+
+		return kv.Value, nil
 	}
+}
 
-	v.mx.Lock()
-	defer v.mx.Unlock()
+// Append value to the value of key, missing key is created. Expiration of key is kept
+// Returns length of the new value on success and error on fail
+func (iq *IqDB) Append(key, value string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
 
-	for _, val := range value {
-		v.list = append(v.list, val)
+	// The final value is logged, so replay does not depend on what was there
+	kv, err := iq.updateValueLogged(key, func(v string, ok bool) (string, error) {
+		if len(v)+len(value) > maxStringLen {
+			return "", ErrStringTooLong
+		}
+
+		return v + value, nil
+	}, func(kv *KV) *aofWrite {
+		return iq.queueSet(key, kv.Value, kv.expire)
+	})
+
+	if err != nil {
+		return 0, err
 	}
 
-	return len(v.list), nil
+	return len(kv.Value), nil
 }
 
-// Pop item from end of list
-// Returns items count on success and error on fail
-func (iq *IqDB) ListPop(key string) (int, error) {
-	l, err := iq.listPop(key, true)
+// Get length of value by key, missing key is empty
+// Returns length on success and error on fail
+func (iq *IqDB) StrLen(key string) (int, error) {
+	v, err := iq.Get(key)
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+
+	return len(v), err
+}
+
+// Get substring of value from start to end byte inclusive. Negative offsets are counted
+// from the end, range is clamped to value bounds. Missing key is empty
+// Returns substring on success and error on fail
+func (iq *IqDB) GetRange(key string, start, end int) (string, error) {
+	v, err := iq.Get(key)
+	if err == ErrKeyNotFound {
+		return "", nil
+	}
 
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
-	err = iq.writeListPop(key)
+	start, end, ok := normalizeRange(start, end, len(v))
+	if !ok {
+		return "", nil
+	}
 
-	return l, err
+	return v[start : end+1], nil
 }
 
-func (iq *IqDB) listPop(key string, lock bool) (int, error) {
-	v, err := iq.list(key)
+// Overwrite part of value starting at offset. Value is padded with zero bytes if it is
+// shorter than offset, missing key is created. Expiration of key is kept
+// Returns length of the new value on success and error on fail
+func (iq *IqDB) SetRange(key string, offset int, value string) (int, error) {
+	if offset < 0 {
+		return 0, ErrOffsetOutOfRange
+	}
+
+	if offset+len(value) > maxStringLen {
+		return 0, ErrStringTooLong
+	}
+
+	// Nothing to write, missing key is not created
+	if value == "" {
+		return iq.StrLen(key)
+	}
+
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	kv, err := iq.updateValueLogged(key, func(v string, ok bool) (string, error) {
+		b := []byte(v)
+		if l := offset + len(value); l > len(b) {
+			b = append(b, make([]byte, l-len(b))...)
+		}
+
+		copy(b[offset:], value)
+
+		return string(b), nil
+	}, func(kv *KV) *aofWrite {
+		return iq.queueSet(key, kv.Value, kv.expire)
+	})
 
 	if err != nil {
 		return 0, err
 	}
 
-	v.mx.Lock()
-	defer v.mx.Unlock()
+	return len(kv.Value), nil
+}
 
-	l := len(v.list)
-	if l == 0 {
-		return 0, nil
+// Get values of keys at once, missing keys and keys of other types are empty strings.
+// Batch set by MSet is seen either whole or not at all
+// Returns values slice on success and error on fail
+func (iq *IqDB) MGet(key ...string) ([]string, error) {
+	ret := make([]string, len(key))
+	for i, kv := range iq.distmap.GetMulti(key) {
+		if kv != nil && kv.dataType == dataTypeKV {
+			ret[i] = kv.Value
+		}
 	}
 
-	v.list = v.list[0 : l-1]
+	return ret, nil
+}
 
-	return len(v.list), nil
+// Set values of many keys at once with default TTL. Readers never see a part of batch
+// Example: MSet("k1","v1","k2","v2")
+// Returns error on fail
+func (iq *IqDB) MSet(args ...string) error {
+	_, err := iq.mset(args, false)
+
+	return err
 }
 
-// Get list items by key with specified index range
-// Returns items slice on success and error on fail
-func (iq *IqDB) ListRange(key string, from, to int) ([]string, error) {
-	v, err := iq.list(key)
+// Same as MSet, but nothing is set if any of keys exists
+// Returns true if values were set on success and error on fail
+func (iq *IqDB) MSetNX(args ...string) (bool, error) {
+	return iq.mset(args, true)
+}
 
-	if err != nil {
-		return nil, err
+func (iq *IqDB) mset(args []string, nx bool) (bool, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	if len(args) == 0 || len(args)%2 != 0 {
+		return false, ErrKeyValueMismatch
 	}
 
-	if from < 0 || len(v.list) < to || from > to {
-		return nil, ErrListOutOfBounds
+	expire := deadline(iq.opts.TTL)
+
+	ok, err := iq.setMulti(args, expire, nx, true)
+	if err != nil || !ok {
+		return false, err
 	}
 
-	return v.list[from : to+1], nil
+	// Whole batch is a single record
+	err = iq.writeMSet(args, expire)
+
+	return true, err
 }
 
-// Hashes
-func (iq *IqDB) hash(key string) (*hash, error) {
-	v, err := iq.distmap.Get(key)
+func (iq *IqDB) setMulti(args []string, expire time.Time, nx bool, lock bool) (bool, error) {
+	keys := make([]string, 0, len(args)/2)
+	kvs := make([]*KV, 0, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		keys = append(keys, args[i])
+		kvs = append(kvs, newKV(args[i+1], expire))
+	}
 
-	if err != nil {
-		return nil, err
+	var check func(old []*KV) bool
+	if nx {
+		check = func(old []*KV) bool {
+			for _, kv := range old {
+				if kv != nil && !isExpired(kv.expire) {
+					return false
+				}
+			}
+
+			return true
+		}
 	}
 
-	if v.dataType != dataTypeHash {
-		return nil, ErrKeyTypeError
+	old, ok := iq.distmap.SetMulti(keys, kvs, check)
+	if !ok {
+		return false, nil
 	}
 
-	return v.hash, nil
+	for i, kv := range old {
+		if kv != nil {
+			iq.unscheduleTTL(keys[i], kv)
+		}
+	}
+
+	if !expire.IsZero() {
+		for _, key := range keys {
+			iq.ttl.ReplaceOrInsert(newTTLTreeItemAt(key, expire))
+		}
+	}
+
+	return true, nil
 }
 
-// Get hash value by key and field
-// Returns value on success and error on fail
-func (iq *IqDB) HashGet(key string, field string) (string, error) {
-	v, err := iq.hash(key)
+// Replace key atomically with KV made by fn from the current one, which is nil if there is no key.
+// Key is replaced only if nobody changed it meanwhile, otherwise fn is called again.
+// fn returns nil to leave key as is
+// Returns the new KV on success and error on fail
+func (iq *IqDB) replaceKV(key string, fn func(old *KV) (*KV, error)) (*KV, error) {
+	for {
+		old, err := iq.distmap.Get(key)
+		if err == ErrKeyNotFound {
+			old = nil
+		} else if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		return "", err
+		// Expired key is gone, it is just not deleted yet
+		cur := old
+		if cur != nil && isExpired(cur.expire) {
+			cur = nil
+		}
+
+		kv, err := fn(cur)
+		if err != nil || kv == nil {
+			return nil, err
+		}
+
+		if iq.distmap.CompareAndSet(key, old, kv) {
+			if old != nil {
+				iq.unscheduleTTL(key, old)
+			}
+
+			if !kv.expire.IsZero() {
+				iq.ttl.ReplaceOrInsert(newTTLTreeItemAt(key, kv.expire))
+			}
+
+			return kv, nil
+		}
 	}
+}
 
-	if s, ok := v.hash.Load(field); ok {
-		return s.(string), nil
+// String KV expiring at expire, zero time means no expiration
+func newKV(value string, expire time.Time) *KV {
+	kv := &KV{dataType: dataTypeKV, Value: value, expire: expire}
+	if !expire.IsZero() {
+		kv.ttl = expire.Sub(timeFunc())
 	}
 
-	return "", ErrHashKeyNotFound
+	return kv
 }
 
-// Get hash fields and values map by key
-// Returns map of fields and values on success and error on fail
-func (iq *IqDB) HashGetAll(key string) (map[string]string, error) {
-	v, err := iq.hash(key)
+// Bitmaps
 
-	if err != nil {
-		return nil, err
+// Bitwise operations of BitOp
+const (
+	BitAnd = "AND"
+	BitOr  = "OR"
+	BitXor = "XOR"
+	BitNot = "NOT"
+)
+
+// Bits are numbered from the most significant bit of the first byte, as in Redis
+const maxBitOffset = maxStringLen*8 - 1
+
+// Set or clear bit of value at offset. Value is padded with zero bytes if it is shorter,
+// missing key is created. Expiration of key is kept
+// Returns the old bit on success and error on fail
+func (iq *IqDB) SetBit(key string, offset int, bit int) (int, error) {
+	if offset < 0 || offset > maxBitOffset {
+		return 0, ErrBitOffset
 	}
 
-	ret := make(map[string]string)
-	v.hash.Range(func(key, value interface{}) bool {
-		ret[key.(string)] = value.(string)
-		return true
-	})
+	if bit != 0 && bit != 1 {
+		return 0, ErrBitValue
+	}
 
-	return ret, nil
-}
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
 
-// Get hash keys of key
-// Returns string slice of keys on success and error on fail
-func (iq *IqDB) HashKeys(key string) ([]string, error) {
-	v, err := iq.hash(key)
+	// Only the bit is logged, not the whole value
+	var old int
+	_, err := iq.updateValueLogged(key, func(v string, ok bool) (string, error) {
+		v, old = withBit(v, offset, bit)
+		return v, nil
+	}, func(kv *KV) *aofWrite {
+		return iq.queueSetBit(key, offset, bit)
+	})
 
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	ret := make([]string, 0)
-	v.hash.Range(func(key, value interface{}) bool {
-		ret = append(ret, key.(string))
-		return true
+	return old, nil
+}
+
+func (iq *IqDB) setBit(key string, offset int, bit int, lock bool) (int, error) {
+	var old int
+	_, err := iq.updateValue(key, func(v string, ok bool) (string, error) {
+		v, old = withBit(v, offset, bit)
+		return v, nil
 	})
 
-	return ret, nil
+	return old, err
 }
 
-// Delete field from hash
-// Returns error on fail
-func (iq *IqDB) HashDel(key string, field string) error {
-	err := iq.hashDel(key, field, true)
-	if err != nil {
-		return err
+// Padding of bitmaps
+var zeroBytes [4096]byte
+
+// Copy of v with bit at offset set, padded with zero bytes up to it. Value is copied once,
+// as large bitmaps are updated bit by bit
+// Returns the new value and the old bit
+func withBit(v string, offset int, bit int) (string, int) {
+	i := offset / 8
+	n := len(v)
+	if i >= n {
+		n = i + 1
 	}
 
-	err = iq.writeHashDel(key, field)
-
-	return err
-}
+	mask := byte(0x80) >> uint(offset%8)
 
-func (iq *IqDB) hashDel(key, field string, lock bool) error {
-	v, err := iq.hash(key)
+	var b byte
+	if i < len(v) {
+		b = v[i]
+	}
 
-	if err != nil {
-		return err
+	old := 0
+	if b&mask != 0 {
+		old = 1
 	}
 
-	// redundant call
-	/*if _, ok := v.hash.Load(field); !ok {
-		return ErrHashKeyNotFound
-	}*/
+	if bit == 1 {
+		b |= mask
+	} else {
+		b &^= mask
+	}
 
-	v.hash.Delete(field)
+	// Builder hands over its buffer without copying it again
+	sb := strings.Builder{}
+	sb.Grow(n)
+	if i < len(v) {
+		sb.WriteString(v[:i])
+		sb.WriteByte(b)
+		sb.WriteString(v[i+1:])
+	} else {
+		sb.WriteString(v)
+		for pad := i - len(v); pad > 0; pad -= len(zeroBytes) {
+			if pad < len(zeroBytes) {
+				sb.Write(zeroBytes[:pad])
+				break
+			}
+			sb.Write(zeroBytes[:])
+		}
+		sb.WriteByte(b)
+	}
 
-	return nil
+	return sb.String(), old
 }
 
-// Set one or more field-value pairs on hash by key
-// Example: HashSet("test","k1","v1","k2","v2")
-// Returns error on fail
-func (iq *IqDB) HashSet(key string, args ...string) error {
+// Get bit of value at offset, bits past the end and bits of missing key are 0
+// Returns bit on success and error on fail
+func (iq *IqDB) GetBit(key string, offset int) (int, error) {
+	if offset < 0 || offset > maxBitOffset {
+		return 0, ErrBitOffset
+	}
 
-	if len(args)%2 != 0 {
-		return ErrHashKeyValueMismatch
+	v, err := iq.Get(key)
+	if err == ErrKeyNotFound {
+		return 0, nil
 	}
 
-	kv := make(map[string]string)
-	for i := 0; i < len(args); i += 2 {
-		kv[args[i]] = args[i+1]
+	if err != nil {
+		return 0, err
+	}
 
+	i := offset / 8
+	if i >= len(v) || v[i]&(byte(0x80)>>uint(offset%8)) == 0 {
+		return 0, nil
 	}
 
-	err := iq.hashSet(key, kv, true)
+	return 1, nil
+}
+
+// Count set bits in bytes from start to end inclusive. Negative offsets are counted
+// from the end, so 0, -1 is the whole value. Missing key has no bits
+// Returns count on success and error on fail
+func (iq *IqDB) BitCount(key string, start, end int) (int, error) {
+	v, err := iq.GetRange(key, start, end)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = iq.writeHashSet(key, args...)
+	n := 0
+	for i := 0; i < len(v); i++ {
+		n += bits.OnesCount8(v[i])
+	}
 
-	return err
+	return n, nil
 }
 
-func (iq *IqDB) hashSet(key string, kv map[string]string, lock bool) error {
-	h, err := iq.hash(key)
-
-	if err != nil && err != ErrKeyNotFound {
-		return err
-	} else if err == ErrKeyNotFound {
-		nh, err := iq.newHash(key)
+// Find the first bit set to bit in bytes from start to end inclusive, counted as in BitCount.
+// If end is not given, value is padded with zero bytes, so clear bit is found past the end
+// of value of all ones. Missing key is all zeros
+// Returns bit position on success, -1 if there is no such bit and error on fail
+func (iq *IqDB) BitPos(key string, bit int, start int, end ...int) (int, error) {
+	if bit != 0 && bit != 1 {
+		return 0, ErrBitValue
+	}
 
-		if err != nil {
-			return err
+	v, err := iq.Get(key)
+	if err == ErrKeyNotFound {
+		if bit == 0 {
+			return 0, nil
 		}
 
-		h = nh.hash
+		return -1, nil
 	}
 
-	for k, v := range kv {
-		h.hash.Store(k, v)
-	}
+	if err != nil {
+		return 0, err
+	}
+
+	stop := -1
+	if end != nil {
+		stop = end[0]
+	}
+
+	from, to, ok := normalizeRange(start, stop, len(v))
+	if !ok {
+		return -1, nil
+	}
+
+	for i := from; i <= to; i++ {
+		b := v[i]
+		if bit == 0 {
+			b = ^b
+		}
+
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b), nil
+		}
+	}
+
+	if bit == 0 && end == nil {
+		return (to + 1) * 8, nil
+	}
+
+	return -1, nil
+}
+
+// Store result of bitwise operation on values of src keys in dst. Shorter values are padded
+// with zero bytes. NOT takes single key. Missing keys are empty, dst is removed if result is empty
+// Returns length of result on success and error on fail
+func (iq *IqDB) BitOp(op string, dst string, src ...string) (int, error) {
+	switch op {
+	case BitAnd, BitOr, BitXor:
+		if len(src) == 0 {
+			return 0, ErrBitOp
+		}
+	case BitNot:
+		if len(src) != 1 {
+			return 0, ErrBitOp
+		}
+	default:
+		return 0, ErrBitOp
+	}
+
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	// Sources are read at once, so MSet batch is seen whole
+	vals := make([][]byte, len(src))
+	l := 0
+	for i, kv := range iq.distmap.GetMulti(src) {
+		if kv == nil || isExpired(kv.expire) {
+			continue
+		}
+
+		if kv.dataType != dataTypeKV {
+			return 0, ErrKeyTypeError
+		}
+
+		vals[i] = []byte(kv.Value)
+		if len(vals[i]) > l {
+			l = len(vals[i])
+		}
+	}
+
+	res := bitOp(op, vals, l)
+
+	if len(res) == 0 {
+		err := iq.remove(dst, true)
+		if err == ErrKeyNotFound {
+			return 0, nil
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		return 0, iq.writeRemove(dst)
+	}
+
+	expire := deadline(iq.opts.TTL)
+	err := iq.set(dst, string(res), expire, true)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(res), iq.writeSet(dst, string(res), expire)
+}
+
+// Result of bitwise operation, l is the longest value length
+func bitOp(op string, vals [][]byte, l int) []byte {
+	res := make([]byte, l)
+	if op == BitNot {
+		for i := range res {
+			res[i] = ^vals[0][i]
+		}
+
+		return res
+	}
+
+	copy(res, vals[0])
+	for _, v := range vals[1:] {
+		for i := range res {
+			var b byte
+			if i < len(v) {
+				b = v[i]
+			}
+
+			switch op {
+			case BitAnd:
+				res[i] &= b
+			case BitOr:
+				res[i] |= b
+			case BitXor:
+				res[i] ^= b
+			}
+		}
+	}
+
+	return res
+}
+
+// Counters
+
+// Increment integer value by one, missing key is 0
+// Returns new value on success and error on fail
+func (iq *IqDB) Incr(key string) (int64, error) {
+	return iq.IncrBy(key, 1)
+}
+
+// Decrement integer value by one, missing key is 0
+// Returns new value on success and error on fail
+func (iq *IqDB) Decr(key string) (int64, error) {
+	return iq.IncrBy(key, -1)
+}
+
+// Increment integer value by delta, missing key is 0. Expiration of key is kept
+// Returns new value on success and error on fail
+func (iq *IqDB) IncrBy(key string, delta int64) (int64, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	var n int64
+	_, err := iq.updateValueLogged(key, func(v string, ok bool) (string, error) {
+		var err error
+		n, err = addInt(v, ok, delta)
+
+		return strconv.FormatInt(n, 10), err
+	}, func(kv *KV) *aofWrite {
+		return iq.queueIncrBy(key, delta, kv.expire)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (iq *IqDB) incrBy(key string, delta int64, lock bool) (int64, error) {
+	var n int64
+	_, err := iq.updateValue(key, func(v string, ok bool) (string, error) {
+		var err error
+		n, err = addInt(v, ok, delta)
+
+		return strconv.FormatInt(n, 10), err
+	})
+
+	return n, err
+}
+
+// Increment float value by delta, missing key is 0. Expiration of key is kept
+// Returns new value on success and error on fail
+func (iq *IqDB) IncrByFloat(key string, delta float64) (float64, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	var f float64
+	_, err := iq.updateValueLogged(key, func(v string, ok bool) (string, error) {
+		var err error
+		f, err = addFloat(v, ok, delta)
+
+		return formatFloat(f), err
+	}, func(kv *KV) *aofWrite {
+		return iq.queueIncrByFloat(key, delta, kv.expire)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return f, nil
+}
+
+func (iq *IqDB) incrByFloat(key string, delta float64, lock bool) (float64, error) {
+	var f float64
+	_, err := iq.updateValue(key, func(v string, ok bool) (string, error) {
+		var err error
+		f, err = addFloat(v, ok, delta)
+
+		return formatFloat(f), err
+	})
+
+	return f, err
+}
+
+// Replace value of key with fn result atomically. Value is replaced only if key
+// was not changed by anybody else meanwhile, otherwise fn is called again.
+// fn gets false if there is no such key
+// Returns the new KV on success and error on fail
+func (iq *IqDB) updateValue(key string, fn func(v string, ok bool) (string, error)) (*KV, error) {
+	for {
+		old, err := iq.distmap.Get(key)
+		if err == ErrKeyNotFound {
+			old = nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Expired key is gone, it is just not deleted yet
+		ok := old != nil && !isExpired(old.expire)
+		if ok && old.dataType != dataTypeKV {
+			return nil, ErrKeyTypeError
+		}
+
+		var value string
+		if ok {
+			value = old.Value
+		}
+
+		value, err = fn(value, ok)
+		if err != nil {
+			return nil, err
+		}
+
+		kv := &KV{dataType: dataTypeKV, Value: value}
+		if ok {
+			kv.ttl = old.ttl
+			kv.expire = old.expire
+		}
+
+		if !iq.distmap.CompareAndSet(key, old, kv) {
+			continue
+		}
+
+		// Sweeper must not act on the new value
+		if old != nil && !ok {
+			iq.unscheduleTTL(key, old)
+		}
+
+		return kv, nil
+	}
+}
+
+// Same as updateValue, but record of the update is queued before other updates of key
+// are applied, so records of the updates are written in the same order. Record of delta
+// is replaced with the whole value when key is created, as replay drops whatever follows
+// expired key until it is set again.
+// Returns the new KV when its record is written and error on fail
+func (iq *IqDB) updateValueLogged(key string, fn func(v string, ok bool) (string, error), record func(kv *KV) *aofWrite) (*KV, error) {
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
+
+	var existed bool
+	kv, err := iq.updateValue(key, func(v string, ok bool) (string, error) {
+		existed = ok
+		return fn(v, ok)
+	})
+	if err != nil {
+		mx.Unlock()
+		return nil, err
+	}
+
+	var w *aofWrite
+	if existed {
+		w = record(kv)
+	} else {
+		w = iq.queueSet(key, kv.Value, kv.expire)
+	}
+	mx.Unlock()
+
+	return kv, w.wait()
+}
+
+// Missing value is 0
+func addInt(v string, ok bool, delta int64) (int64, error) {
+	var n int64
+	if ok {
+		var err error
+		n, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrIncrOverflow
+	}
+
+	return n + delta, nil
+}
+
+// Missing value is 0
+func addFloat(v string, ok bool, delta float64) (float64, error) {
+	var f float64
+	if ok {
+		var err error
+		f, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, ErrNotFloat
+		}
+	}
+
+	f += delta
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrIncrNaN
+	}
+
+	return f, nil
+}
+
+// Floats are stored without exponent, as Redis does
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// Lists
+
+// Helper method to obtain and check data type
+func (iq *IqDB) list(key string) (*list, error) {
+	v, err := iq.distmap.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v.dataType != dataTypeList {
+		return nil, ErrKeyTypeError
+	}
+
+	return v.list, nil
+}
+
+// Get list length
+// Returns items count on success and error on fail
+func (iq *IqDB) ListLen(key string) (int, error) {
+	v, err := iq.list(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+
+	return len(v.list), nil
+}
+
+// Get list item by its index. Negative index is counted from the end, -1 is the last item
+// Returns item on success and error on fail
+func (iq *IqDB) ListIndex(key string, index int) (string, error) {
+	v, err := iq.list(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+
+	i, ok := listIndex(index, len(v.list))
+	if !ok {
+		return "", ErrListIndexError
+	}
+
+	return v.list[i], nil
+}
+
+// Absolute list index, negative index is counted from the end
+func listIndex(index, l int) (int, bool) {
+	if index < 0 {
+		index += l
+	}
+
+	return index, index >= 0 && index < l
+}
+
+// Push items to the end of list
+// Returns items count on success and error on fail
+func (iq *IqDB) ListPush(key string, value ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	l, w, err := iq.listPush(key, value, true)
+	if err != nil {
+		return 0, err
+	}
+
+	err = w.wait()
+	if err == nil {
+		iq.wakeListWaiters(key)
+	}
+
+	return l, err
+}
+
+// Record is queued while list is locked if lock is set, so records of list
+// are written in the order they are applied. Same for the other list changes
+func (iq *IqDB) listPush(key string, value []string, lock bool) (int, *aofWrite, error) {
+	v, err := iq.lockList(key, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer v.mx.Unlock()
+
+	for _, val := range value {
+		v.list = append(v.list, val)
+	}
+
+	var w *aofWrite
+	if lock {
+		w = iq.queueListPush(key, value...)
+	}
+
+	return len(v.list), w, nil
+}
+
+// Push items to the head of list one by one, so the last one becomes the first item
+// Returns items count on success and error on fail
+func (iq *IqDB) ListPushLeft(key string, value ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	l, w, err := iq.listPushLeft(key, value, true)
+	if err != nil {
+		return 0, err
+	}
+
+	err = w.wait()
+	if err == nil {
+		iq.wakeListWaiters(key)
+	}
+
+	return l, err
+}
+
+func (iq *IqDB) listPushLeft(key string, value []string, lock bool) (int, *aofWrite, error) {
+	v, err := iq.lockList(key, true)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer v.mx.Unlock()
+
+	l := make([]string, 0, len(value)+len(v.list))
+	for i := len(value) - 1; i >= 0; i-- {
+		l = append(l, value[i])
+	}
+
+	v.list = append(l, v.list...)
+
+	var w *aofWrite
+	if lock {
+		w = iq.queueListPushLeft(key, value...)
+	}
+
+	return len(v.list), w, nil
+}
+
+// List of key, it is created if key does not exist
+func (iq *IqDB) listForPush(key string) (*list, error) {
+	for {
+		v, err := iq.list(key)
+		if err != ErrKeyNotFound {
+			return v, err
+		}
+
+		// Somebody else may create it meanwhile
+		kv, ok := iq.newList(key)
+		if ok {
+			return kv.list, nil
+		}
+	}
+}
+
+// Lock list of key for write, it is created if create is set and key does not exist.
+// List may be removed with its last item or replaced while its lock is awaited,
+// so it is looked up again until the locked one is still there. Caller must unlock the list
+// Returns locked list on success and error on fail
+func (iq *IqDB) lockList(key string, create bool) (*list, error) {
+	for {
+		var v *list
+		var err error
+		if create {
+			v, err = iq.listForPush(key)
+		} else {
+			v, err = iq.list(key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		v.mx.Lock()
+		if iq.isList(key, v) {
+			return v, nil
+		}
+		v.mx.Unlock()
+	}
+}
+
+// Whether list is still the one of key
+func (iq *IqDB) isList(key string, v *list) bool {
+	kv, err := iq.distmap.Get(key)
+
+	return err == nil && kv.list == v
+}
+
+// Pop item from the end of list. Key is removed with the last item
+// Returns popped item on success and error on fail
+func (iq *IqDB) ListPop(key string) (string, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	item, w, err := iq.listPop(key, true)
+
+	if err != nil {
+		return "", err
+	}
+
+	return item, w.wait()
+}
+
+func (iq *IqDB) listPop(key string, lock bool) (string, *aofWrite, error) {
+	return iq.listPopAt(key, false, lock)
+}
+
+// Pop item from the head of list. Key is removed with the last item
+// Returns popped item on success and error on fail
+func (iq *IqDB) ListPopLeft(key string) (string, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	item, w, err := iq.listPopLeft(key, true)
+
+	if err != nil {
+		return "", err
+	}
+
+	return item, w.wait()
+}
+
+func (iq *IqDB) listPopLeft(key string, lock bool) (string, *aofWrite, error) {
+	return iq.listPopAt(key, true, lock)
+}
+
+func (iq *IqDB) listPopAt(key string, head bool, lock bool) (string, *aofWrite, error) {
+	v, err := iq.lockList(key, false)
+	if err != nil {
+		return "", nil, err
+	}
+	defer v.mx.Unlock()
+
+	l := len(v.list)
+	if l == 0 {
+		return "", nil, ErrKeyNotFound
+	}
+
+	var item string
+	if head {
+		item = v.list[0]
+		v.list = v.list[1:]
+	} else {
+		item = v.list[l-1]
+		v.list = v.list[0 : l-1]
+	}
+
+	// Key may be created again right after it is removed, so record goes first
+	var w *aofWrite
+	if lock {
+		w = iq.queueListPop(key, head)
+	}
+
+	return item, w, iq.removeEmptyList(key, v, lock)
+}
+
+// There are no empty lists, same as in Redis. Caller must hold list lock.
+// Key is removed only if it still has this list
+func (iq *IqDB) removeEmptyList(key string, v *list, lock bool) error {
+	if len(v.list) > 0 {
+		return nil
+	}
+
+	kv, err := iq.distmap.Get(key)
+	if err == ErrKeyNotFound || (err == nil && kv.list != v) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if iq.distmap.CompareAndRemove(key, kv) {
+		iq.unscheduleTTL(key, kv)
+	}
+
+	return nil
+}
+
+// Get list items from index to index inclusive. Negative index is counted from the end,
+// range is clamped to list bounds, so out of range indexes give fewer or no items
+// Returns items slice on success and error on fail
+func (iq *IqDB) ListRange(key string, from, to int) ([]string, error) {
+	v, err := iq.list(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	v.mx.RLock()
+	defer v.mx.RUnlock()
+
+	from, to, ok := normalizeRange(from, to, len(v.list))
+	if !ok {
+		return []string{}, nil
+	}
+
+	return append([]string(nil), v.list[from:to+1]...), nil
+}
+
+// Insert value before or after the first pivot item
+// Returns items count on success, -1 if there is no pivot and error on fail
+func (iq *IqDB) ListInsert(key string, before bool, pivot, value string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	l, w, err := iq.listInsert(key, before, pivot, value, true)
+	if err != nil || l < 0 {
+		return l, err
+	}
+
+	return l, w.wait()
+}
+
+func (iq *IqDB) listInsert(key string, before bool, pivot, value string, lock bool) (int, *aofWrite, error) {
+	v, err := iq.lockList(key, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer v.mx.Unlock()
+
+	for i, item := range v.list {
+		if item != pivot {
+			continue
+		}
+
+		if !before {
+			i++
+		}
+
+		l := make([]string, 0, len(v.list)+1)
+		l = append(append(append(l, v.list[:i]...), value), v.list[i:]...)
+		v.list = l
+
+		var w *aofWrite
+		if lock {
+			w = iq.queueListInsert(key, before, pivot, value)
+		}
+
+		return len(v.list), w, nil
+	}
+
+	return -1, nil, nil
+}
+
+// Set list item by its index. Negative index is counted from the end
+// Returns error on fail
+func (iq *IqDB) ListSet(key string, index int, value string) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	w, err := iq.listSet(key, index, value, true)
+	if err != nil {
+		return err
+	}
+
+	return w.wait()
+}
+
+func (iq *IqDB) listSet(key string, index int, value string, lock bool) (*aofWrite, error) {
+	v, err := iq.lockList(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer v.mx.Unlock()
+
+	i, ok := listIndex(index, len(v.list))
+	if !ok {
+		return nil, ErrListIndexError
+	}
+
+	v.list[i] = value
+
+	var w *aofWrite
+	if lock {
+		w = iq.queueListSet(key, index, value)
+	}
+
+	return w, nil
+}
+
+// Remove count items equal to value, starting from the head if count is positive
+// and from the end if it is negative. All such items are removed if count is 0.
+// Key is removed with the last item
+// Returns removed items count on success and error on fail
+func (iq *IqDB) ListRemove(key string, count int, value string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	n, w, err := iq.listRemove(key, count, value, true)
+	if err != nil || n == 0 {
+		return n, err
+	}
+
+	return n, w.wait()
+}
+
+func (iq *IqDB) listRemove(key string, count int, value string, lock bool) (int, *aofWrite, error) {
+	v, err := iq.lockList(key, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer v.mx.Unlock()
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+
+	l := len(v.list)
+	keep := make([]bool, l)
+	n := 0
+	for j := 0; j < l; j++ {
+		i := j
+		if count < 0 {
+			i = l - 1 - j
+		}
+
+		if v.list[i] == value && (limit == 0 || n < limit) {
+			n++
+			continue
+		}
+
+		keep[i] = true
+	}
+
+	if n == 0 {
+		return 0, nil, nil
+	}
+
+	items := make([]string, 0, l-n)
+	for i, item := range v.list {
+		if keep[i] {
+			items = append(items, item)
+		}
+	}
+	v.list = items
+
+	var w *aofWrite
+	if lock {
+		w = iq.queueListRemove(key, count, value)
+	}
+
+	return n, w, iq.removeEmptyList(key, v, lock)
+}
+
+// Trim list to items from start to stop inclusive, same indexes as in ListRange.
+// Key is removed if nothing is left
+// Returns error on fail
+func (iq *IqDB) ListTrim(key string, start, stop int) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	w, err := iq.listTrim(key, start, stop, true)
+	if err != nil {
+		return err
+	}
+
+	return w.wait()
+}
+
+func (iq *IqDB) listTrim(key string, start, stop int, lock bool) (*aofWrite, error) {
+	v, err := iq.lockList(key, false)
+	if err != nil {
+		return nil, err
+	}
+	defer v.mx.Unlock()
+
+	from, to, ok := normalizeRange(start, stop, len(v.list))
+	if !ok {
+		v.list = v.list[:0]
+	} else {
+		v.list = append([]string(nil), v.list[from:to+1]...)
+	}
+
+	var w *aofWrite
+	if lock {
+		w = iq.queueListTrim(key, start, stop)
+	}
+
+	return w, iq.removeEmptyList(key, v, lock)
+}
+
+// Pop item from the head of the first non-empty list, waiting until some of them gets items
+// or context is done. Waiters of the same key are served in FIFO order
+// Returns key and popped item on success and error on fail
+func (iq *IqDB) ListBlockingPopLeft(ctx context.Context, key ...string) (string, string, error) {
+	return iq.listBlockingPop(ctx, key, iq.ListPopLeft)
+}
+
+// Same as ListBlockingPopLeft, but item is popped from the end of list
+func (iq *IqDB) ListBlockingPop(ctx context.Context, key ...string) (string, string, error) {
+	return iq.listBlockingPop(ctx, key, iq.ListPop)
+}
+
+// Atomically pop item from src head or end and push it to dst head or end.
+// Source and destination may be the same list, item is rotated then
+// Returns moved item on success and error on fail
+func (iq *IqDB) ListMove(src, dst string, srcLeft, dstLeft bool) (string, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	item, w, err := iq.listMove(src, dst, srcLeft, dstLeft, true)
+	if err != nil {
+		return "", err
+	}
+
+	err = w.wait()
+	if err == nil {
+		iq.wakeListWaiters(dst)
+	}
+
+	return item, err
+}
+
+// Same as ListMove, but waits until src gets items or context is done
+func (iq *IqDB) ListBlockingMove(ctx context.Context, src, dst string, srcLeft, dstLeft bool) (string, error) {
+	_, item, err := iq.listBlockingPop(ctx, []string{src}, func(key string) (string, error) {
+		return iq.ListMove(key, dst, srcLeft, dstLeft)
+	})
+
+	return item, err
+}
+
+func (iq *IqDB) listMove(src, dst string, srcLeft, dstLeft bool, lock bool) (string, *aofWrite, error) {
+	s, d, err := iq.lockListPair(src, dst)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer s.mx.Unlock()
+	if d != s {
+		defer d.mx.Unlock()
+	}
+
+	// Source was emptied meanwhile, destination may have been just created
+	l := len(s.list)
+	if l == 0 {
+		err = iq.removeEmptyList(dst, d, lock)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return "", nil, ErrKeyNotFound
+	}
+
+	var item string
+	if srcLeft {
+		item = s.list[0]
+		s.list = s.list[1:]
+	} else {
+		item = s.list[l-1]
+		s.list = s.list[0 : l-1]
+	}
+
+	if dstLeft {
+		d.list = append([]string{item}, d.list...)
+	} else {
+		d.list = append(d.list, item)
+	}
+
+	var w *aofWrite
+	if lock {
+		w = iq.queueListMove(src, dst, srcLeft, dstLeft, item)
+	}
+
+	return item, w, iq.removeEmptyList(src, s, lock)
+}
+
+// Lock source and destination lists of move, destination is created if it does not exist.
+// Lists are looked up again until both locked ones are still there, same as in lockList
+// Returns locked lists on success and error on fail
+func (iq *IqDB) lockListPair(src, dst string) (*list, *list, error) {
+	for {
+		s, err := iq.list(src)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		d, err := iq.listForPush(dst)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Lists are locked in key order, so opposite moves do not deadlock
+		first, second := s, d
+		if dst < src {
+			first, second = d, s
+		}
+
+		first.mx.Lock()
+		if second != first {
+			second.mx.Lock()
+		}
+
+		if iq.isList(src, s) && iq.isList(dst, d) {
+			return s, d, nil
+		}
+
+		if second != first {
+			second.mx.Unlock()
+		}
+		first.mx.Unlock()
+	}
+}
+
+// Hashes
+func (iq *IqDB) hash(key string) (*hash, error) {
+	v, err := iq.distmap.Get(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v.dataType != dataTypeHash {
+		return nil, ErrKeyTypeError
+	}
+
+	return v.hash, nil
+}
+
+// Get hash value by key and field
+// Returns value on success and error on fail
+func (iq *IqDB) HashGet(key string, field string) (string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return "", err
+	}
+
+	if s, ok := v.hash.Load(field); ok {
+		return s.(string), nil
+	}
+
+	return "", ErrHashKeyNotFound
+}
+
+// Get hash fields and values map by key
+// Returns map of fields and values on success and error on fail
+func (iq *IqDB) HashGetAll(key string) (map[string]string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]string)
+	v.hash.Range(func(key, value interface{}) bool {
+		ret[key.(string)] = value.(string)
+		return true
+	})
+
+	return ret, nil
+}
+
+// Get hash keys of key
+// Returns string slice of keys on success and error on fail
+func (iq *IqDB) HashKeys(key string) ([]string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	v.hash.Range(func(key, value interface{}) bool {
+		ret = append(ret, key.(string))
+		return true
+	})
+
+	return ret, nil
+}
+
+// Get hash values of key
+// Returns string slice of values on success and error on fail
+func (iq *IqDB) HashValues(key string) ([]string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	v.hash.Range(func(key, value interface{}) bool {
+		ret = append(ret, value.(string))
+		return true
+	})
+
+	return ret, nil
+}
+
+// Get values of hash fields in the same order, missing fields are empty strings
+// Returns values slice on success and error on fail
+func (iq *IqDB) HashMultiGet(key string, field ...string) ([]string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(field))
+	for i, f := range field {
+		if s, ok := v.hash.Load(f); ok {
+			ret[i] = s.(string)
+		}
+	}
+
+	return ret, nil
+}
+
+// Get fields count of hash
+// Returns count on success and error on fail
+func (iq *IqDB) HashLen(key string) (int, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return v.len(), nil
+}
+
+// Check if hash has field. Missing key has no fields
+// Returns true if it has on success and error on fail
+func (iq *IqDB) HashExists(key, field string) (bool, error) {
+	v, err := iq.hash(key)
+
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := v.hash.Load(field)
+
+	return ok, nil
+}
+
+// Get length of hash field value, 0 if there is no such field
+// Returns length on success and error on fail
+func (iq *IqDB) HashStrLen(key, field string) (int, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if s, ok := v.hash.Load(field); ok {
+		return len(s.(string)), nil
+	}
+
+	return 0, nil
+}
+
+// Fields looked through by one HashScan call, same as in Redis
+const defaultHashScanCount = 10
+
+// Iterate hash fields matching glob pattern, empty pattern matches all. Cursor 0 starts iteration,
+// returned cursor is passed to the next call and is 0 when iteration is over. Fields are visited
+// in lexicographical order, so fields present during the whole iteration are returned once.
+// Count is a hint of how many fields to look through in one call
+// Returns next cursor and field-value pairs on success and error on fail
+func (iq *IqDB) HashScan(key string, cursor int, match string, count int) (int, []string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if cursor < 0 {
+		return 0, nil, ErrHashCursor
+	}
+
+	if count <= 0 {
+		count = defaultHashScanCount
+	}
+
+	fields := v.fields()
+	ret := make([]string, 0)
+
+	i := cursor
+	for ; i < len(fields) && i < cursor+count; i++ {
+		if match != "" {
+			ok, err := path.Match(match, fields[i])
+			if err != nil {
+				return 0, nil, err
+			}
+
+			if !ok {
+				continue
+			}
+		}
+
+		// Field may be deleted meanwhile
+		if s, ok := v.hash.Load(fields[i]); ok {
+			ret = append(ret, fields[i], s.(string))
+		}
+	}
+
+	if i >= len(fields) {
+		i = 0
+	}
+
+	return i, ret, nil
+}
+
+// Delete fields from hash
+// Returns count of deleted fields on success and error on fail
+func (iq *IqDB) HashDel(key string, field ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	// Records are queued before other updates of hash, as with updateValueLogged
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
+
+	deleted, err := iq.hashDel(key, field, true)
+	if err != nil || len(deleted) == 0 {
+		mx.Unlock()
+		return 0, err
+	}
+
+	w := iq.queueHashDel(key, deleted...)
+	mx.Unlock()
+
+	return len(deleted), w.wait()
+}
+
+// Returns fields which were there
+func (iq *IqDB) hashDel(key string, field []string, lock bool) ([]string, error) {
+	v, err := iq.hash(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make([]string, 0, len(field))
+	for _, f := range field {
+		if _, ok := v.hash.LoadAndDelete(f); ok {
+			deleted = append(deleted, f)
+		}
+	}
+
+	return deleted, iq.removeEmptyHash(key, v, lock)
+}
+
+// There are no empty hashes, same as in Redis. Caller must hold key update lock.
+// Key is removed only if it still has this hash
+func (iq *IqDB) removeEmptyHash(key string, h *hash, lock bool) error {
+	empty := true
+	h.hash.Range(func(_, _ interface{}) bool {
+		empty = false
+		return false
+	})
+
+	if !empty {
+		return nil
+	}
+
+	kv, err := iq.distmap.Get(key)
+	if err == ErrKeyNotFound || (err == nil && kv.hash != h) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if iq.distmap.CompareAndRemove(key, kv) {
+		iq.unscheduleTTL(key, kv)
+	}
+
+	return nil
+}
+
+// Set one or more field-value pairs on hash by key
+// Example: HashSet("test","k1","v1","k2","v2")
+// Returns count of new fields on success and error on fail
+func (iq *IqDB) HashSet(key string, args ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	if len(args)%2 != 0 {
+		return 0, ErrHashKeyValueMismatch
+	}
+
+	kv := make(map[string]string)
+	for i := 0; i < len(args); i += 2 {
+		kv[args[i]] = args[i+1]
+
+	}
+
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
+
+	n, err := iq.hashSet(key, kv, true)
+	if err != nil {
+		mx.Unlock()
+		return 0, err
+	}
+
+	w := iq.queueHashSet(key, args...)
+	mx.Unlock()
+
+	return n, w.wait()
+}
+
+func (iq *IqDB) hashSet(key string, kv map[string]string, lock bool) (int, error) {
+	h, err := iq.hashOrNew(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for k, v := range kv {
+		if _, loaded := h.hash.Swap(k, v); !loaded {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Set hash field only if it does not exist yet, missing hash is created
+// Returns true if field was set on success and error on fail
+func (iq *IqDB) HashSetNX(key, field, value string) (bool, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
+
+	ok, err := iq.hashSetNX(key, field, value)
+	if err != nil || !ok {
+		mx.Unlock()
+		return false, err
+	}
+
+	// It is a plain field set for replay
+	w := iq.queueHashSet(key, field, value)
+	mx.Unlock()
+
+	return true, w.wait()
+}
+
+func (iq *IqDB) hashSetNX(key, field, value string) (bool, error) {
+	h, err := iq.hashOrNew(key)
+	if err != nil {
+		return false, err
+	}
+
+	_, loaded := h.hash.LoadOrStore(field, value)
+
+	return !loaded, nil
+}
+
+// Increment integer value of hash field by delta, missing hash and field are created
+// Returns new value on success and error on fail
+func (iq *IqDB) HashIncrBy(key, field string, delta int64) (int64, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	mx := iq.distmap.updateLock(key)
+	mx.Lock()
+
+	v, err := iq.hashIncrBy(key, field, delta, true)
+	if err != nil {
+		mx.Unlock()
+		return 0, err
+	}
+
+	w := iq.queueHashIncrBy(key, field, delta)
+	mx.Unlock()
+
+	return v, w.wait()
+}
+
+func (iq *IqDB) hashIncrBy(key, field string, delta int64, lock bool) (int64, error) {
+	h, err := iq.hashOrNew(key)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		old, ok := h.hash.Load(field)
+
+		var v string
+		if ok {
+			v = old.(string)
+		}
+
+		n, err := addInt(v, ok, delta)
+		if err != nil {
+			return 0, err
+		}
+
+		// Field is replaced only if nobody changed it meanwhile
+		s := strconv.FormatInt(n, 10)
+		if ok {
+			if h.hash.CompareAndSwap(field, old, s) {
+				return n, nil
+			}
+
+			continue
+		}
+
+		if _, loaded := h.hash.LoadOrStore(field, s); !loaded {
+			return n, nil
+		}
+	}
+}
+
+// New empty hash, it is stored only if key does not exist
+// Returns false if key was created meanwhile
+func (iq *IqDB) newHash(key string) (*KV, bool) {
+	kv := &KV{dataType: dataTypeHash, hash: &hash{&sync.Map{}}}
+
+	return kv, iq.distmap.CompareAndSet(key, nil, kv)
+}
+
+// Hash by key, missing hash is created. Another writer may create it first
+func (iq *IqDB) hashOrNew(key string) (*hash, error) {
+	h, err := iq.hash(key)
+	if err != ErrKeyNotFound {
+		return h, err
+	}
+
+	if kv, ok := iq.newHash(key); ok {
+		return kv.hash, nil
+	}
+
+	return iq.hash(key)
+}
+
+// New empty list, it is stored only if key does not exist
+// Returns false if key was created meanwhile
+func (iq *IqDB) newList(key string) (*KV, bool) {
+	kv := &KV{dataType: dataTypeList, list: &list{mx: &sync.RWMutex{}, list: make([]string, 0)}}
+
+	return kv, iq.distmap.CompareAndSet(key, nil, kv)
+}
+
+// Sets
+
+// Helper method to obtain and check data type. Missing key is an empty set, nil is returned for it
+func (iq *IqDB) getSet(key string) (*set, error) {
+	v, err := iq.distmap.Get(key)
+
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v.dataType != dataTypeSet {
+		return nil, ErrKeyTypeError
+	}
+
+	return v.set, nil
+}
+
+// Add members to set, set is created if key does not exist
+// Returns count of members that were not in set on success and error on fail
+func (iq *IqDB) SetAdd(key string, member ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	if len(member) == 0 {
+		return 0, nil
+	}
+
+	n, err := iq.setAdd(key, member, true)
+	if err != nil {
+		return 0, err
+	}
+
+	err = iq.writeSetAdd(key, member...)
+
+	return n, err
+}
+
+func (iq *IqDB) setAdd(key string, member []string, lock bool) (int, error) {
+	s, err := iq.lockSet(key, true)
+	if err != nil {
+		return 0, err
+	}
+	defer s.mx.Unlock()
+
+	n := 0
+	for _, m := range member {
+		if _, ok := s.set[m]; !ok {
+			s.set[m] = struct{}{}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Remove members from set. Key is removed with the last member
+// Returns count of removed members on success and error on fail
+func (iq *IqDB) SetRemove(key string, member ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	n, err := iq.setRemove(key, member, true)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	err = iq.writeSetRem(key, member...)
+
+	return n, err
+}
+
+func (iq *IqDB) setRemove(key string, member []string, lock bool) (int, error) {
+	s, err := iq.lockSet(key, false)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	defer s.mx.Unlock()
+
+	n := 0
+	for _, m := range member {
+		if _, ok := s.set[m]; ok {
+			delete(s.set, m)
+			n++
+		}
+	}
+
+	return n, iq.removeEmptySet(key, s, lock)
+}
+
+// Lock set of key for write, it is created if create is set and key does not exist.
+// Set may be removed with its last member or replaced while its lock is awaited,
+// so it is looked up again until the locked one is still there. Caller must unlock the set
+// Returns locked set on success, nil if there is no key and error on fail
+func (iq *IqDB) lockSet(key string, create bool) (*set, error) {
+	for {
+		s, err := iq.getSet(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if s == nil {
+			if !create {
+				return nil, nil
+			}
+
+			// Somebody else may create it meanwhile
+			kv, ok := iq.newSet(key)
+			if !ok {
+				continue
+			}
+
+			s = kv.set
+		}
+
+		s.mx.Lock()
+		if iq.isSet(key, s) {
+			return s, nil
+		}
+		s.mx.Unlock()
+	}
+}
+
+// Whether set is still the one of key
+func (iq *IqDB) isSet(key string, s *set) bool {
+	kv, err := iq.distmap.Get(key)
+
+	return err == nil && kv.set == s
+}
+
+// There are no empty sets, same as in Redis. Caller must hold set lock.
+// Key is removed only if it still has this set
+func (iq *IqDB) removeEmptySet(key string, s *set, lock bool) error {
+	if len(s.set) > 0 {
+		return nil
+	}
+
+	kv, err := iq.distmap.Get(key)
+	if err == ErrKeyNotFound || (err == nil && kv.set != s) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if iq.distmap.CompareAndRemove(key, kv) {
+		iq.unscheduleTTL(key, kv)
+	}
+
+	return nil
+}
+
+// Check if member is in set
+// Returns true if it is on success and error on fail
+func (iq *IqDB) SetIsMember(key, member string) (bool, error) {
+	s, err := iq.getSet(key)
+
+	if err != nil || s == nil {
+		return false, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	_, ok := s.set[member]
+
+	return ok, nil
+}
+
+// Get all members of set in no particular order
+// Returns members slice on success and error on fail
+func (iq *IqDB) SetMembers(key string) ([]string, error) {
+	s, err := iq.getSet(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s == nil {
+		return []string{}, nil
+	}
+
+	return s.members(), nil
+}
+
+// Get set size
+// Returns members count on success and error on fail
+func (iq *IqDB) SetCard(key string) (int, error) {
+	s, err := iq.getSet(key)
+
+	if err != nil || s == nil {
+		return 0, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return len(s.set), nil
+}
+
+// Get members that are in every given set
+// Returns members slice on success and error on fail
+func (iq *IqDB) SetInter(key ...string) ([]string, error) {
+	return iq.setAlgebra(key, func(in []bool) bool {
+		for _, ok := range in {
+			if !ok {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// Get members that are in any of given sets
+// Returns members slice on success and error on fail
+func (iq *IqDB) SetUnion(key ...string) ([]string, error) {
+	return iq.setAlgebra(key, func(in []bool) bool {
+		return true
+	})
+}
+
+// Get members of the first set that are not in any of the others
+// Returns members slice on success and error on fail
+func (iq *IqDB) SetDiff(key ...string) ([]string, error) {
+	return iq.setAlgebra(key, func(in []bool) bool {
+		if !in[0] {
+			return false
+		}
+
+		for _, ok := range in[1:] {
+			if ok {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// Members of given sets that pass the filter. Filter gets membership of candidate in every set
+func (iq *IqDB) setAlgebra(keys []string, filter func(in []bool) bool) ([]string, error) {
+	sets := make([]*set, len(keys))
+	locked := make(map[*set]bool)
+	for i, key := range keys {
+		s, err := iq.getSet(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if s == nil {
+			s = makeSet(nil)
+		}
+
+		// The same key may be given twice
+		if !locked[s] {
+			s.mx.RLock()
+			defer s.mx.RUnlock()
+			locked[s] = true
+		}
+
+		sets[i] = s
+	}
+
+	ret := make([]string, 0)
+	seen := make(map[string]struct{})
+	in := make([]bool, len(sets))
+	for _, s := range sets {
+		for m := range s.set {
+			if _, ok := seen[m]; ok {
+				continue
+			}
+			seen[m] = struct{}{}
+
+			for i, o := range sets {
+				_, in[i] = o.set[m]
+			}
+
+			if filter(in) {
+				ret = append(ret, m)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// New empty set, it is stored only if key does not exist
+// Returns false if key was created meanwhile
+func (iq *IqDB) newSet(key string) (*KV, bool) {
+	kv := &KV{dataType: dataTypeSet, set: makeSet(nil)}
+
+	return kv, iq.distmap.CompareAndSet(key, nil, kv)
+}
+
+// Sorted sets
+
+// Helper method to obtain and check data type. Missing key is an empty sorted set, nil is returned for it
+func (iq *IqDB) getZSet(key string) (*zset, error) {
+	v, err := iq.distmap.Get(key)
+
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v.dataType != dataTypeZSet {
+		return nil, ErrKeyTypeError
+	}
+
+	return v.zset, nil
+}
+
+// Add members with scores to sorted set or update scores of existing ones.
+// Sorted set is created if key does not exist
+// Returns count of new members on success and error on fail
+func (iq *IqDB) SortedSetAdd(key string, member ...ScoredMember) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	if len(member) == 0 {
+		return 0, nil
+	}
+
+	for _, m := range member {
+		if math.IsNaN(m.Score) {
+			return 0, ErrScoreNotFloat
+		}
+	}
+
+	n, err := iq.zsetAdd(key, member, true)
+	if err != nil {
+		return 0, err
+	}
+
+	err = iq.writeZSetAdd(key, member)
+
+	return n, err
+}
+
+func (iq *IqDB) zsetAdd(key string, member []ScoredMember, lock bool) (int, error) {
+	z, err := iq.lockZSet(key, true)
+	if err != nil {
+		return 0, err
+	}
+	defer z.mx.Unlock()
+
+	n := 0
+	for _, m := range member {
+		if z.add(m.Member, m.Score) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Remove members from sorted set. Key is removed with the last member
+// Returns count of removed members on success and error on fail
+func (iq *IqDB) SortedSetRemove(key string, member ...string) (int, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	n, err := iq.zsetRemove(key, member, true)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	err = iq.writeZSetRem(key, member...)
+
+	return n, err
+}
+
+func (iq *IqDB) zsetRemove(key string, member []string, lock bool) (int, error) {
+	z, err := iq.lockZSet(key, false)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	defer z.mx.Unlock()
+
+	n := 0
+	for _, m := range member {
+		if z.remove(m) {
+			n++
+		}
+	}
+
+	return n, iq.removeEmptyZSet(key, z, lock)
+}
+
+// Lock sorted set of key for write, it is created if create is set and key does not exist.
+// Sorted set may be removed with its last member or replaced while its lock is awaited,
+// so it is looked up again until the locked one is still there. Caller must unlock the sorted set
+// Returns locked sorted set on success, nil if there is no key and error on fail
+func (iq *IqDB) lockZSet(key string, create bool) (*zset, error) {
+	for {
+		z, err := iq.getZSet(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if z == nil {
+			if !create {
+				return nil, nil
+			}
+
+			// Somebody else may create it meanwhile
+			kv, ok := iq.newZSet(key)
+			if !ok {
+				continue
+			}
+
+			z = kv.zset
+		}
+
+		z.mx.Lock()
+		if iq.isZSet(key, z) {
+			return z, nil
+		}
+		z.mx.Unlock()
+	}
+}
+
+// Whether sorted set is still the one of key
+func (iq *IqDB) isZSet(key string, z *zset) bool {
+	kv, err := iq.distmap.Get(key)
+
+	return err == nil && kv.zset == z
+}
+
+// There are no empty sorted sets, same as in Redis. Caller must hold sorted set lock.
+// Key is removed only if it still has this sorted set
+func (iq *IqDB) removeEmptyZSet(key string, z *zset, lock bool) error {
+	if len(z.scores) > 0 {
+		return nil
+	}
+
+	kv, err := iq.distmap.Get(key)
+	if err == ErrKeyNotFound || (err == nil && kv.zset != z) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if iq.distmap.CompareAndRemove(key, kv) {
+		iq.unscheduleTTL(key, kv)
+	}
+
+	return nil
+}
+
+// Get score of sorted set member
+// Returns score on success and error on fail
+func (iq *IqDB) SortedSetScore(key, member string) (float64, error) {
+	z, err := iq.getZSet(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if z == nil {
+		return 0, ErrSortedSetMemberNotFound
+	}
+
+	z.mx.RLock()
+	defer z.mx.RUnlock()
+
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, ErrSortedSetMemberNotFound
+	}
+
+	return score, nil
+}
+
+// Get zero based position of member in sorted set ordered by score
+// Returns rank on success and error on fail
+func (iq *IqDB) SortedSetRank(key, member string) (int, error) {
+	z, err := iq.getZSet(key)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if z == nil {
+		return 0, ErrSortedSetMemberNotFound
+	}
+
+	z.mx.RLock()
+	defer z.mx.RUnlock()
+
+	rank, ok := z.rank(member)
+	if !ok {
+		return 0, ErrSortedSetMemberNotFound
+	}
+
+	return rank, nil
+}
+
+// Get sorted set members from start to stop position inclusive, ordered by score.
+// Negative positions are counted from the end, -1 is the last member
+// Returns members slice on success and error on fail
+func (iq *IqDB) SortedSetRange(key string, start, stop int) ([]ScoredMember, error) {
+	return iq.zsetRange(key, start, stop, false)
+}
+
+// Same as SortedSetRange, but members are ordered from the highest score
+// Returns members slice on success and error on fail
+func (iq *IqDB) SortedSetRevRange(key string, start, stop int) ([]ScoredMember, error) {
+	return iq.zsetRange(key, start, stop, true)
+}
+
+func (iq *IqDB) zsetRange(key string, start, stop int, rev bool) ([]ScoredMember, error) {
+	z, err := iq.getZSet(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if z == nil {
+		return []ScoredMember{}, nil
+	}
+
+	z.mx.RLock()
+	defer z.mx.RUnlock()
+
+	return z.rangeByRank(start, stop, rev), nil
+}
+
+// Get sorted set members with scores from min to max inclusive, ordered by score.
+// The first offset members are skipped, then at most count members are returned, all if count is negative
+// Returns members slice on success and error on fail
+func (iq *IqDB) SortedSetRangeByScore(key string, min, max float64, offset, count int) ([]ScoredMember, error) {
+	z, err := iq.getZSet(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if z == nil {
+		return []ScoredMember{}, nil
+	}
+
+	z.mx.RLock()
+	defer z.mx.RUnlock()
+
+	return z.rangeByScore(min, max, offset, count), nil
+}
+
+// Increment score of sorted set member, missing member is added with score incr.
+// New score is logged as is, so replay does not depend on the previous one
+// Returns new score on success and error on fail
+func (iq *IqDB) SortedSetIncrBy(key, member string, incr float64) (float64, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	if math.IsNaN(incr) {
+		return 0, ErrScoreNotFloat
+	}
+
+	z, err := iq.lockZSet(key, true)
+	if err != nil {
+		return 0, err
+	}
+
+	score := z.scores[member] + incr
+	if math.IsNaN(score) {
+		z.mx.Unlock()
+		return 0, ErrScoreNaN
+	}
+
+	z.add(member, score)
+	z.mx.Unlock()
+
+	err = iq.writeZSetAdd(key, []ScoredMember{{Member: member, Score: score}})
+
+	return score, err
+}
+
+// Get sorted set size
+// Returns members count on success and error on fail
+func (iq *IqDB) SortedSetCard(key string) (int, error) {
+	z, err := iq.getZSet(key)
+
+	if err != nil || z == nil {
+		return 0, err
+	}
+
+	z.mx.RLock()
+	defer z.mx.RUnlock()
+
+	return len(z.scores), nil
+}
+
+// New empty sorted set, it is stored only if key does not exist
+// Returns false if key was created meanwhile
+func (iq *IqDB) newZSet(key string) (*KV, bool) {
+	kv := &KV{dataType: dataTypeZSet, zset: makeZSet(nil)}
+
+	return kv, iq.distmap.CompareAndSet(key, nil, kv)
+}
+
+// HyperLogLogs
+
+// Helper method to obtain and check data type. Missing key is an empty HLL, nil is returned for it
+func (iq *IqDB) getHLL(key string) (*hll, error) {
+	v, err := iq.distmap.Get(key)
+
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v.dataType != dataTypeHLL {
+		return nil, ErrKeyTypeError
+	}
+
+	return v.hll, nil
+}
+
+// Add elements to HyperLogLog, it is created if key does not exist
+// Returns true if estimated cardinality may have changed on success and error on fail
+func (iq *IqDB) HyperLogLogAdd(key string, element ...string) (bool, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	changed, err := iq.hllAdd(key, element, true)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	err = iq.writeHLLAdd(key, element...)
+
+	return true, err
+}
+
+func (iq *IqDB) hllAdd(key string, element []string, lock bool) (bool, error) {
+	h, err := iq.getHLL(key)
+
+	if err != nil {
+		return false, err
+	}
+
+	// New HLL is a change even without elements
+	changed := false
+	if h == nil {
+		kv, err := iq.newHLL(key)
+		if err != nil {
+			return false, err
+		}
+
+		h = kv.hll
+		changed = true
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	for _, e := range element {
+		if h.add(e) {
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// Get estimated count of unique elements added to HyperLogLogs. Count of many keys is the count
+// of their union. Missing keys are empty
+// Returns count on success and error on fail
+func (iq *IqDB) HyperLogLogCount(key ...string) (int, error) {
+	if len(key) == 1 {
+		h, err := iq.getHLL(key[0])
+		if err != nil || h == nil {
+			return 0, err
+		}
+
+		h.mx.RLock()
+		defer h.mx.RUnlock()
+
+		return h.count(), nil
+	}
+
+	regs, err := iq.hllUnion(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return hllCountRegisters(regs), nil
+}
+
+// Merge HyperLogLogs of src keys into dst, so it counts their union together with what it had.
+// Missing dst is created, its expiration is kept otherwise
+// Returns error on fail
+func (iq *IqDB) HyperLogLogMerge(dst string, src ...string) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	regs, err := iq.hllUnion(src)
+	if err != nil {
+		return err
+	}
+
+	err = iq.hllMerge(dst, regs, true)
+	if err != nil {
+		return err
+	}
+
+	// Registers of dst are merged into regs, so they are the whole result
+	return iq.writeHLLMerge(dst, makeHLLFromRegisters(regs).bytes())
+}
+
+// Raise registers of HLL to regs, regs are raised to the result. Missing HLL is created
+func (iq *IqDB) hllMerge(key string, regs []uint8, lock bool) error {
+	h, err := iq.getHLL(key)
+
+	if err != nil {
+		return err
+	}
+
+	if h == nil {
+		kv, err := iq.newHLL(key)
+		if err != nil {
+			return err
+		}
+
+		h = kv.hll
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.mergeInto(regs)
+
+	m := makeHLLFromRegisters(regs)
+	h.sparse, h.dense = m.sparse, m.dense
+
+	return nil
+}
+
+// Registers of union of HLLs, one byte each. HLLs are read one by one
+func (iq *IqDB) hllUnion(keys []string) ([]uint8, error) {
+	regs := make([]uint8, hllRegisters)
+	for _, key := range keys {
+		h, err := iq.getHLL(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if h == nil {
+			continue
+		}
+
+		h.mx.RLock()
+		h.mergeInto(regs)
+		h.mx.RUnlock()
+	}
+
+	return regs, nil
+}
+
+func (iq *IqDB) newHLL(key string) (*KV, error) {
+	kv := &KV{dataType: dataTypeHLL, hll: makeHLL()}
+	err := iq.distmap.Set(key, kv)
+
+	return kv, err
+}
+
+// Streams
+
+// Helper method to obtain and check data type. Missing key is nil
+func (iq *IqDB) getStream(key string) (*stream, error) {
+	v, err := iq.distmap.Get(key)
+
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if v.dataType != dataTypeStream {
+		return nil, ErrKeyTypeError
+	}
+
+	return v.stream, nil
+}
+
+// Stream with groups, it must exist. Group is looked up with stream locked,
+// as it may be destroyed and created again meanwhile
+func (iq *IqDB) getGroupStream(key string) (*stream, error) {
+	s, err := iq.getStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if s == nil {
+		return nil, ErrStreamNoGroup
+	}
+
+	return s, nil
+}
+
+// Group of stream. Caller must hold stream lock
+func (s *stream) group(name string) (*streamGroup, error) {
+	g := s.groups[name]
+	if g == nil {
+		return nil, ErrStreamNoGroup
+	}
+
+	return g, nil
+}
+
+// Append entry of field-value pairs to stream, stream is created if key does not exist.
+// ID * is generated from time, ms-* gets the next sequence number of ms, explicit ID must be
+// greater than the last one. Stream is trimmed to maxLen newest entries then, negative maxLen means no trimming.
+// Example: StreamAdd("events", "*", 1000, "type", "login", "user", "42")
+// Returns ID of entry on success and error on fail
+func (iq *IqDB) StreamAdd(key, id string, maxLen int, fields ...string) (string, error) {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return "", ErrStreamFields
+	}
+
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	sid, err := iq.streamAdd(key, id, maxLen, fields, true)
+	if err != nil {
+		return "", err
+	}
+
+	err = iq.writeStreamAdd(key, sid, maxLen, fields)
+	if err != nil {
+		return "", err
+	}
+
+	iq.waiters.notifyAll(key)
+
+	return sid.String(), nil
+}
+
+func (iq *IqDB) streamAdd(key, id string, maxLen int, fields []string, lock bool) (streamID, error) {
+	s, err := iq.getStream(key)
+
+	if err != nil {
+		return streamID{}, err
+	}
+
+	if s == nil {
+		kv, err := iq.newStream(key)
+		if err != nil {
+			return streamID{}, err
+		}
+
+		s = kv.stream
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	sid, err := s.nextID(id)
+	if err != nil {
+		return streamID{}, err
+	}
+
+	s.add(sid, fields)
+	if maxLen >= 0 {
+		s.trim(maxLen)
+	}
+
+	return sid, nil
+}
+
+// Get count of stream entries
+// Returns count on success and error on fail
+func (iq *IqDB) StreamLen(key string) (int, error) {
+	s, err := iq.getStream(key)
+
+	if err != nil || s == nil {
+		return 0, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return len(s.entries), nil
+}
+
+// Get stream entries with IDs from start to end inclusive, - and + are the lowest and the highest IDs.
+// ID without sequence number means all its millisecond. At most count entries are returned, all if count is negative
+// Returns entries slice on success and error on fail
+func (iq *IqDB) StreamRange(key, start, end string, count int) ([]StreamEntry, error) {
+	return iq.streamRange(key, start, end, count, false)
+}
+
+// Same as StreamRange, but entries are ordered from end to start
+// Returns entries slice on success and error on fail
+func (iq *IqDB) StreamRevRange(key, end, start string, count int) ([]StreamEntry, error) {
+	return iq.streamRange(key, start, end, count, true)
+}
+
+func (iq *IqDB) streamRange(key, start, end string, count int, rev bool) ([]StreamEntry, error) {
+	from, err := parseStreamBound(start, false)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := parseStreamBound(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := iq.getStream(key)
+	if err != nil || s == nil {
+		return make([]StreamEntry, 0), err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	return s.rangeEntries(from, to, count, rev), nil
+}
+
+// Trim stream to maxLen newest entries. Stream is kept even if it gets empty, as in Redis
+// Returns count of removed entries on success and error on fail
+func (iq *IqDB) StreamTrim(key string, maxLen int) (int, error) {
+	if maxLen < 0 {
+		return 0, ErrStreamMaxLen
+	}
+
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	n, err := iq.streamTrim(key, maxLen, true)
+	if err != nil || n == 0 {
+		return 0, err
+	}
+
+	err = iq.writeStreamTrim(key, maxLen)
+
+	return n, err
+}
+
+func (iq *IqDB) streamTrim(key string, maxLen int, lock bool) (int, error) {
+	s, err := iq.getStream(key)
+
+	if err != nil || s == nil {
+		return 0, err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.trim(maxLen), nil
+}
+
+// Create consumer group of stream. Group gets entries after id, $ is the last entry of stream.
+// Missing stream is created if mkStream is set
+// Returns error on fail
+func (iq *IqDB) StreamGroupCreate(key, group, id string, mkStream bool) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	s, err := iq.getStream(key)
+	if err != nil {
+		return err
+	}
+
+	if s == nil && !mkStream {
+		return ErrKeyNotFound
+	}
+
+	sid, err := iq.streamGroupCreate(key, group, id, true)
+	if err != nil {
+		return err
+	}
+
+	return iq.writeStreamGroupCreate(key, group, sid)
+}
+
+func (iq *IqDB) streamGroupCreate(key, group, id string, lock bool) (streamID, error) {
+	s, err := iq.getStream(key)
+
+	if err != nil {
+		return streamID{}, err
+	}
+
+	if s == nil {
+		kv, err := iq.newStream(key)
+		if err != nil {
+			return streamID{}, err
+		}
+
+		s = kv.stream
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.groups[group]; ok {
+		return streamID{}, ErrStreamGroupExists
+	}
+
+	sid := s.lastID
+	if id != "$" {
+		sid, err = parseStreamID(id, 0)
+		if err != nil {
+			return streamID{}, err
+		}
+	}
+
+	s.groups[group] = makeStreamGroup(sid)
+
+	return sid, nil
+}
+
+// Remove consumer group with its pending entries
+// Returns true if group was there on success and error on fail
+func (iq *IqDB) StreamGroupDestroy(key, group string) (bool, error) {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	ok, err := iq.streamGroupDestroy(key, group, true)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	err = iq.writeStreamGroupDestroy(key, group)
+
+	return true, err
+}
+
+func (iq *IqDB) streamGroupDestroy(key, group string, lock bool) (bool, error) {
+	s, err := iq.getStream(key)
+
+	if err != nil {
+		return false, err
+	}
+
+	if s == nil {
+		return false, ErrKeyNotFound
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if _, ok := s.groups[group]; !ok {
+		return false, nil
+	}
+
+	delete(s.groups, group)
+
+	return true, nil
+}
+
+// Read entries of stream as consumer of group. ID > gets entries never delivered to group, they become
+// pending for consumer until acknowledged. Other ID gets pending entries of consumer after it, e.g. 0 gets all;
+// entries trimmed meanwhile have nil fields. At most count entries are returned, all if count is not positive
+// Returns entries slice on success and error on fail
+func (iq *IqDB) StreamReadGroup(key, group, consumer, id string, count int) ([]StreamEntry, error) {
+	if id != ">" {
+		return iq.streamPendingEntries(key, group, consumer, id, count)
+	}
+
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	delivered := timeFunc()
+	entries, err := iq.streamReadGroup(key, group, consumer, count, delivered)
+	if err != nil || len(entries) == 0 {
+		return entries, err
+	}
+
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+
+	err = iq.writeStreamDeliver(key, group, consumer, delivered, ids)
+
+	return entries, err
+}
+
+// Same as StreamReadGroup with ID >, but waits until stream gets new entries or context is done.
+// Returns context error if it is done
+// Returns entries slice on success and error on fail
+func (iq *IqDB) StreamBlockingReadGroup(ctx context.Context, key, group, consumer string, count int) ([]StreamEntry, error) {
+	return iq.streamBlockingRead(ctx, key, func() ([]StreamEntry, error) {
+		return iq.StreamReadGroup(key, group, consumer, ">", count)
+	})
+}
+
+// Deliver new entries to consumer
+func (iq *IqDB) streamReadGroup(key, group, consumer string, count int, delivered time.Time) ([]StreamEntry, error) {
+	s, err := iq.getGroupStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	g, err := s.group(group)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]StreamEntry, 0)
+	for i := s.search(g.lastID); i < len(s.entries) && (count <= 0 || len(ret) < count); i++ {
+		e := s.entries[i]
+		if !g.lastID.less(e.id) {
+			continue
+		}
+
+		g.deliver(consumer, e.id, delivered)
+		ret = append(ret, e.export())
+	}
+
+	if len(ret) == 0 {
+		g.consumers[consumer] = delivered
+	}
+
+	return ret, nil
+}
+
+// Mark logged entries delivered
+func (iq *IqDB) streamDeliver(key, group, consumer string, delivered time.Time, ids []streamID, lock bool) error {
+	s, err := iq.getGroupStream(key)
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	g, err := s.group(group)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		g.deliver(consumer, id, delivered)
+	}
 
 	return nil
 }
 
-func (iq *IqDB) newHash(key string) (*KV, error) {
-	kv := &KV{dataType: dataTypeHash, hash: &hash{&sync.Map{}}}
-	err := iq.distmap.Set(key, kv)
+// Pending entries of consumer after id
+func (iq *IqDB) streamPendingEntries(key, group, consumer, id string, count int) ([]StreamEntry, error) {
+	after, err := parseStreamID(id, 0)
+	if err != nil {
+		return nil, err
+	}
 
-	return kv, err
+	s, err := iq.getGroupStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	g, err := s.group(group)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]StreamEntry, 0)
+	for _, pid := range g.pendingIDs(consumer) {
+		if count > 0 && len(ret) >= count {
+			break
+		}
+
+		if !after.less(pid) {
+			continue
+		}
+
+		e := StreamEntry{ID: pid.String()}
+		if se := s.entry(pid); se != nil {
+			e.Fields = se.fields
+		}
+
+		ret = append(ret, e)
+	}
+
+	return ret, nil
 }
 
-func (iq *IqDB) newList(key string) (*KV, error) {
-	kv := &KV{dataType: dataTypeList, list: &list{mx: &sync.RWMutex{}, list: make([]string, 0)}}
+// Acknowledge entries delivered to group, they are not pending anymore
+// Returns count of acknowledged entries on success and error on fail
+func (iq *IqDB) StreamAck(key, group string, id ...string) (int, error) {
+	ids, err := parseStreamIDs(id)
+	if err != nil {
+		return 0, err
+	}
+
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	acked, err := iq.streamAck(key, group, ids, true)
+	if err != nil || len(acked) == 0 {
+		return 0, err
+	}
+
+	err = iq.writeStreamAck(key, group, acked)
+
+	return len(acked), err
+}
+
+// Returns acknowledged IDs
+func (iq *IqDB) streamAck(key, group string, ids []streamID, lock bool) ([]string, error) {
+	s, err := iq.getStream(key)
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	g := s.groups[group]
+	if g == nil {
+		return nil, nil
+	}
+
+	acked := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := g.pending[id]; ok {
+			delete(g.pending, id)
+			acked = append(acked, id.String())
+		}
+	}
+
+	return acked, nil
+}
+
+// Get summary of entries delivered to group and not acknowledged yet
+// Returns summary on success and error on fail
+func (iq *IqDB) StreamPending(key, group string) (StreamPendingSummary, error) {
+	s, err := iq.getGroupStream(key)
+	if err != nil {
+		return StreamPendingSummary{}, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	g, err := s.group(group)
+	if err != nil {
+		return StreamPendingSummary{}, err
+	}
+
+	ids := g.pendingIDs("")
+	sum := StreamPendingSummary{Count: len(ids), Consumers: make(map[string]int)}
+	if len(ids) > 0 {
+		sum.First = ids[0].String()
+		sum.Last = ids[len(ids)-1].String()
+	}
+
+	for _, p := range g.pending {
+		sum.Consumers[p.consumer]++
+	}
+
+	return sum, nil
+}
+
+// Get pending entries of group with IDs from start to end inclusive, bounds are the same as in StreamRange.
+// Only entries of consumer are returned if it is not empty. At most count entries are returned, all if count is negative
+// Returns pending entries slice on success and error on fail
+func (iq *IqDB) StreamPendingRange(key, group, start, end string, count int, consumer string) ([]StreamPending, error) {
+	from, err := parseStreamBound(start, false)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := parseStreamBound(end, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := iq.getGroupStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	g, err := s.group(group)
+	if err != nil {
+		return nil, err
+	}
+
+	now := timeFunc()
+	ret := make([]StreamPending, 0)
+	for _, id := range g.pendingIDs(consumer) {
+		if count >= 0 && len(ret) >= count {
+			break
+		}
+
+		if id.less(from) || to.less(id) {
+			continue
+		}
+
+		p := g.pending[id]
+		ret = append(ret, StreamPending{ID: id.String(), Consumer: p.consumer, Idle: now.Sub(p.delivered), Deliveries: p.count})
+	}
+
+	return ret, nil
+}
+
+func (iq *IqDB) newStream(key string) (*KV, error) {
+	kv := &KV{dataType: dataTypeStream, stream: makeStream()}
 	err := iq.distmap.Set(key, kv)
 
 	return kv, err
 }
 
+// Replace key with restored stream
+func (iq *IqDB) streamRestore(key string, s *stream, lock bool) error {
+	err := iq.remove(key, lock)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	return iq.distmap.Set(key, &KV{dataType: dataTypeStream, stream: s})
+}
+
 func (iq *IqDB) ForeTTLRecheck() {
 	iq.ttl.checkTTL()
 }
@@ -0,0 +1,123 @@
+package iqdb
+
+import (
+	"sync"
+)
+
+// Point-in-time copy of dataset taken while writers keep going. Walker copies keys one by one,
+// and distmap copies a key before it is accessed if walker has not got to it yet,
+// so every key is copied as it was at the moment copy started.
+// Only keys accessed before walker gets to them are held twice in memory
+type datasetCopy struct {
+	dm *distmap
+	mx *sync.Mutex
+	// Keys walker is done with
+	done map[string]struct{}
+	// Keys accessed before walker got to them, as they were at the start. Nil KV means there was no such key
+	saved map[string]*KV
+}
+
+// Start copy of dataset. Caller must hold cutMx exclusively, so nothing changes at the start,
+// and must stop the copy when it is walked
+func (dm *distmap) startCopy() *datasetCopy {
+	c := &datasetCopy{
+		dm:    dm,
+		mx:    &sync.Mutex{},
+		done:  make(map[string]struct{}),
+		saved: make(map[string]*KV),
+	}
+
+	dm.copy.Store(c)
+
+	return c
+}
+
+func (dm *distmap) stopCopy() {
+	dm.copy.Store((*datasetCopy)(nil))
+}
+
+// Copy key before it is accessed if copy is in progress
+func (dm *distmap) preserve(key string, s *shard) {
+	if c, _ := dm.copy.Load().(*datasetCopy); c != nil {
+		c.preserve(key, s)
+	}
+}
+
+func (c *datasetCopy) preserve(key string, s *shard) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if _, ok := c.done[key]; ok {
+		return
+	}
+
+	if _, ok := c.saved[key]; ok {
+		return
+	}
+
+	var kv *KV
+	if v, ok := s.kv.Load(key); ok {
+		kv = v.(*KV).clone()
+	}
+
+	c.saved[key] = kv
+}
+
+// Pass copy of every key to fn until it returns error. Copy must be stopped then
+// Returns the first error of fn
+func (c *datasetCopy) walk(fn func(key string, kv *KV) error) error {
+	var err error
+	c.dm.Walk(func(key string, kv *KV) bool {
+		kv = c.take(key, kv)
+		if kv != nil {
+			err = fn(key, kv)
+		}
+
+		return err == nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// Keys removed after the start are not walked. Once copy is stopped,
+	// only keys created after the start may be saved
+	c.dm.stopCopy()
+
+	c.mx.Lock()
+	removed := make(map[string]*KV, len(c.saved))
+	for key, kv := range c.saved {
+		if kv != nil {
+			removed[key] = kv
+		}
+	}
+	c.mx.Unlock()
+
+	for key, kv := range removed {
+		err = fn(key, kv)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy of walked key, nil if there was no such key at the start
+func (c *datasetCopy) take(key string, kv *KV) *KV {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if _, ok := c.done[key]; ok {
+		return nil
+	}
+
+	c.done[key] = struct{}{}
+
+	if saved, ok := c.saved[key]; ok {
+		delete(c.saved, key)
+		return saved
+	}
+
+	return kv.clone()
+}
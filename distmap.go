@@ -3,35 +3,52 @@ package iqdb
 import (
 	"crypto/sha1"
 	"encoding/binary"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 type distmap struct {
 	shards     []*shard
 	mx         *sync.RWMutex
 	shardCount int
+	// *datasetCopy in progress, nil if there is none
+	copy atomic.Value
 }
 
 type shard struct {
 	kv *sync.Map
+	// Readers hold it shared, batch writers hold it exclusively,
+	// so batch stored across shards is never seen in part
+	mx *sync.RWMutex
+	// Serializes read-modify-write updates of values, so they are logged in the order they are applied
+	updateMx *sync.Mutex
 }
 
 func (dm *distmap) getShard(key string) *shard {
-	var shardKey int
+	return dm.shards[dm.shardIndex(key)]
+}
 
-	if dm.shardCount > 1 {
-		hasher := sha1.New()
-		hasher.Write([]byte(key))
-		shardKey = int(binary.BigEndian.Uint32(hasher.Sum(nil)) % uint32(dm.shardCount))
+// Index of key shard
+func (dm *distmap) shardIndex(key string) int {
+	if dm.shardCount <= 1 {
+		return 0
 	}
 
-	return dm.shards[shardKey]
+	hasher := sha1.New()
+	hasher.Write([]byte(key))
+
+	return int(binary.BigEndian.Uint32(hasher.Sum(nil)) % uint32(dm.shardCount))
 }
 
 func (dm *distmap) Get(key string) (*KV, error) {
 	shard := dm.getShard(key)
+	dm.preserve(key, shard)
 
+	shard.mx.RLock()
 	v, ok := shard.kv.Load(key)
+	shard.mx.RUnlock()
+
 	if !ok {
 		return nil, ErrKeyNotFound
 	}
@@ -41,21 +58,151 @@ func (dm *distmap) Get(key string) (*KV, error) {
 
 func (dm *distmap) Set(key string, kv *KV) error {
 	shard := dm.getShard(key)
+	dm.preserve(key, shard)
 
+	shard.mx.RLock()
 	shard.kv.Store(key, kv)
+	shard.mx.RUnlock()
+
 	return nil
 }
 
+// Lock of read-modify-write updates of key
+func (dm *distmap) updateLock(key string) *sync.Mutex {
+	return dm.getShard(key).updateMx
+}
+
+// Replace old KV of key with kv only if it is still there, nil old means no key.
+// Returns false if key was changed meanwhile
+func (dm *distmap) CompareAndSet(key string, old, kv *KV) bool {
+	shard := dm.getShard(key)
+	dm.preserve(key, shard)
+
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+
+	if old == nil {
+		_, loaded := shard.kv.LoadOrStore(key, kv)
+		return !loaded
+	}
+
+	return shard.kv.CompareAndSwap(key, old, kv)
+}
+
+// Remove key only if its KV is still old
+// Returns false if key was changed meanwhile
+func (dm *distmap) CompareAndRemove(key string, old *KV) bool {
+	shard := dm.getShard(key)
+	dm.preserve(key, shard)
+
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+
+	return shard.kv.CompareAndDelete(key, old)
+}
+
+// Get KVs of keys at once, nil for missing keys
+func (dm *distmap) GetMulti(keys []string) []*KV {
+	dm.preserveMulti(keys)
+
+	shards := dm.lockShards(keys, false)
+	defer unlockShards(shards, false)
+
+	return dm.load(keys)
+}
+
+// Store KVs of keys at once, readers see either none or all of them.
+// If check is given, batch is stored only if it returns true for current KVs of keys
+// Returns previous KVs, nil for missing keys, and whether batch was stored
+func (dm *distmap) SetMulti(keys []string, kvs []*KV, check func(old []*KV) bool) ([]*KV, bool) {
+	dm.preserveMulti(keys)
+
+	shards := dm.lockShards(keys, true)
+	defer unlockShards(shards, true)
+
+	old := dm.load(keys)
+	if check != nil && !check(old) {
+		return old, false
+	}
+
+	for i, key := range keys {
+		dm.getShard(key).kv.Store(key, kvs[i])
+	}
+
+	return old, true
+}
+
+// Keys are copied before shards are locked, so copying never waits for batch writers
+func (dm *distmap) preserveMulti(keys []string) {
+	if c, _ := dm.copy.Load().(*datasetCopy); c != nil {
+		for _, key := range keys {
+			c.preserve(key, dm.getShard(key))
+		}
+	}
+}
+
+// Caller must hold locks of key shards
+func (dm *distmap) load(keys []string) []*KV {
+	ret := make([]*KV, len(keys))
+	for i, key := range keys {
+		if v, ok := dm.getShard(key).kv.Load(key); ok {
+			ret[i] = v.(*KV)
+		}
+	}
+
+	return ret
+}
+
+// Lock shards of keys in index order, so batches do not deadlock
+// Returns locked shards
+func (dm *distmap) lockShards(keys []string, exclusive bool) []*shard {
+	idx := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		i := dm.shardIndex(key)
+		if !seen[i] {
+			seen[i] = true
+			idx = append(idx, i)
+		}
+	}
+
+	sort.Ints(idx)
+
+	shards := make([]*shard, len(idx))
+	for n, i := range idx {
+		shards[n] = dm.shards[i]
+		if exclusive {
+			shards[n].mx.Lock()
+		} else {
+			shards[n].mx.RLock()
+		}
+	}
+
+	return shards
+}
+
+func unlockShards(shards []*shard, exclusive bool) {
+	for _, s := range shards {
+		if exclusive {
+			s.mx.Unlock()
+		} else {
+			s.mx.RUnlock()
+		}
+	}
+}
+
 func (dm *distmap) Remove(key string) error {
 	shard := dm.getShard(key)
+	dm.preserve(key, shard)
 
-	_, ok := shard.kv.Load(key)
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+
+	_, ok := shard.kv.LoadAndDelete(key)
 	if !ok {
 		return ErrKeyNotFound
 	}
 
-	shard.kv.Delete(key)
-
 	return nil
 }
 
@@ -91,6 +238,21 @@ func (dm *distmap) Range() chan<- string {
 	return out
 }
 
+// Walk through all keys and values shard by shard until fn returns false
+func (dm *distmap) Walk(fn func(key string, kv *KV) bool) {
+	for _, shard := range dm.shards {
+		cont := true
+		shard.kv.Range(func(key, value interface{}) bool {
+			cont = fn(key.(string), value.(*KV))
+			return cont
+		})
+
+		if !cont {
+			return
+		}
+	}
+}
+
 func NewDistmap(shardCount int) *distmap {
 	dm := &distmap{
 		shardCount: shardCount,
@@ -100,7 +262,9 @@ func NewDistmap(shardCount int) *distmap {
 
 	for i := 0; i < shardCount; i++ {
 		dm.shards[i] = &shard{
-			kv: &sync.Map{},
+			kv:       &sync.Map{},
+			mx:       &sync.RWMutex{},
+			updateMx: &sync.Mutex{},
 		}
 	}
 
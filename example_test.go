@@ -5,12 +5,12 @@ import (
 	"os"
 )
 
-func ExampleEmbeddedServer() {
+func Example_embeddedServer() {
 	var err error
 
 	// Cleanup test db
 	if _, err := os.Stat("test"); err == nil {
-		os.Remove("test")
+		os.RemoveAll("test")
 	}
 
 	// Open new db or use existing one
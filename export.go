@@ -0,0 +1,333 @@
+package iqdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ravlio/iqdb/aof"
+)
+
+var ErrImportFormat = errors.New("wrong import record")
+
+// Data type names used in export
+var dataTypeNames = map[int]string{
+	dataTypeKV:     "string",
+	dataTypeList:   "list",
+	dataTypeHash:   "hash",
+	dataTypeSet:    "set",
+	dataTypeZSet:   "zset",
+	dataTypeHLL:    "hll",
+	dataTypeStream: "stream",
+}
+
+// Exported key, one JSON object per line. Only the field of key type is set.
+// Sorted set scores are strings, so infinite ones survive JSON.
+// HyperLogLog is Redis HYLL string, base64 encoded
+type ExportRecord struct {
+	Key       string            `json:"key"`
+	Type      string            `json:"type"`
+	Value     *string           `json:"value,omitempty"`
+	List      []string          `json:"list,omitempty"`
+	Hash      map[string]string `json:"hash,omitempty"`
+	Set       []string          `json:"set,omitempty"`
+	ZSet      map[string]string `json:"zset,omitempty"`
+	HLL       []byte            `json:"hll,omitempty"`
+	Stream    *ExportStream     `json:"stream,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+}
+
+// Exported stream with its consumer groups
+type ExportStream struct {
+	LastID  string              `json:"last_id"`
+	Entries []StreamEntry       `json:"entries"`
+	Groups  []ExportStreamGroup `json:"groups,omitempty"`
+}
+
+type ExportStreamGroup struct {
+	Name      string                `json:"name"`
+	LastID    string                `json:"last_id"`
+	Consumers []string              `json:"consumers,omitempty"`
+	Pending   []ExportStreamPending `json:"pending,omitempty"`
+}
+
+type ExportStreamPending struct {
+	ID         string    `json:"id"`
+	Consumer   string    `json:"consumer"`
+	Delivered  time.Time `json:"delivered"`
+	Deliveries int       `json:"deliveries"`
+}
+
+// Write every key to w as JSON Lines. Instance keeps serving meanwhile,
+// every key is read consistently, but the whole dataset is not a point-in-time cut
+// Returns error on fail
+func (iq *IqDB) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	var err error
+	iq.distmap.Walk(func(key string, kv *KV) bool {
+		c := kv.clone()
+		if isExpired(c.expire) {
+			return true
+		}
+
+		err = enc.Encode(newExportRecord(key, c))
+
+		return err == nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func newExportRecord(key string, kv *KV) *ExportRecord {
+	rec := &ExportRecord{Key: key, Type: dataTypeNames[kv.dataType]}
+
+	switch kv.dataType {
+	case dataTypeKV:
+		rec.Value = &kv.Value
+	case dataTypeList:
+		rec.List = kv.list.list
+	case dataTypeHash:
+		rec.Hash = make(map[string]string)
+		kv.hash.hash.Range(func(f, v interface{}) bool {
+			rec.Hash[f.(string)] = v.(string)
+			return true
+		})
+	case dataTypeSet:
+		rec.Set = kv.set.members()
+	case dataTypeZSet:
+		rec.ZSet = make(map[string]string)
+		for _, m := range kv.zset.members() {
+			rec.ZSet[m.Member] = formatScore(m.Score)
+		}
+	case dataTypeHLL:
+		rec.HLL = kv.hll.bytes()
+	case dataTypeStream:
+		rec.Stream = newExportStream(kv.stream)
+	}
+
+	if !kv.expire.IsZero() {
+		e := kv.expire.UTC()
+		rec.ExpiresAt = &e
+	}
+
+	return rec
+}
+
+// Load keys exported by Export. Existing keys are replaced, already expired ones are skipped.
+// Every key is written to AOF
+// Returns error on fail
+func (iq *IqDB) Import(r io.Reader) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	for n := 1; ; n++ {
+		rec := &ExportRecord{}
+
+		err := dec.Decode(rec)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("import record %d: %s", n, err)
+		}
+
+		kv, err := rec.kv()
+		if err != nil {
+			return fmt.Errorf("import record %d: %s", n, err)
+		}
+
+		if isExpired(kv.expire) {
+			continue
+		}
+
+		err = iq.importKV(rec.Key, kv)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (rec *ExportRecord) kv() (*KV, error) {
+	kv := &KV{}
+	if rec.ExpiresAt != nil {
+		kv.expire = *rec.ExpiresAt
+	}
+
+	switch rec.Type {
+	case dataTypeNames[dataTypeKV]:
+		if rec.Value == nil {
+			return nil, ErrImportFormat
+		}
+
+		kv.dataType = dataTypeKV
+		kv.Value = *rec.Value
+	case dataTypeNames[dataTypeList]:
+		if len(rec.List) == 0 {
+			return nil, ErrImportFormat
+		}
+
+		kv.dataType = dataTypeList
+		kv.list = makeList(rec.List)
+	case dataTypeNames[dataTypeHash]:
+		if len(rec.Hash) == 0 {
+			return nil, ErrImportFormat
+		}
+
+		args := make([]string, 0, len(rec.Hash)*2)
+		for f, v := range rec.Hash {
+			args = append(args, f, v)
+		}
+
+		kv.dataType = dataTypeHash
+		kv.hash = makeHash(args)
+	case dataTypeNames[dataTypeSet]:
+		if len(rec.Set) == 0 {
+			return nil, ErrImportFormat
+		}
+
+		kv.dataType = dataTypeSet
+		kv.set = makeSet(rec.Set)
+	case dataTypeNames[dataTypeZSet]:
+		if len(rec.ZSet) == 0 {
+			return nil, ErrImportFormat
+		}
+
+		members := make([]ScoredMember, 0, len(rec.ZSet))
+		for m, s := range rec.ZSet {
+			score, err := parseScore(s)
+			if err != nil {
+				return nil, err
+			}
+
+			members = append(members, ScoredMember{Member: m, Score: score})
+		}
+
+		kv.dataType = dataTypeZSet
+		kv.zset = makeZSet(members)
+	case dataTypeNames[dataTypeHLL]:
+		h, err := parseHLL(rec.HLL)
+		if err != nil {
+			return nil, err
+		}
+
+		kv.dataType = dataTypeHLL
+		kv.hll = h
+	case dataTypeNames[dataTypeStream]:
+		if rec.Stream == nil {
+			return nil, ErrImportFormat
+		}
+
+		s, err := rec.Stream.stream()
+		if err != nil {
+			return nil, err
+		}
+
+		kv.dataType = dataTypeStream
+		kv.stream = s
+	default:
+		return nil, ErrImportFormat
+	}
+
+	return kv, nil
+}
+
+func newExportStream(s *stream) *ExportStream {
+	es := &ExportStream{LastID: s.lastID.String(), Entries: s.rangeEntries(streamID{}, maxStreamID, -1, false)}
+	for name, g := range s.groups {
+		eg := ExportStreamGroup{Name: name, LastID: g.lastID.String()}
+		for consumer := range g.consumers {
+			eg.Consumers = append(eg.Consumers, consumer)
+		}
+
+		for _, id := range g.pendingIDs("") {
+			p := g.pending[id]
+			eg.Pending = append(eg.Pending, ExportStreamPending{ID: id.String(), Consumer: p.consumer, Delivered: p.delivered, Deliveries: p.count})
+		}
+
+		es.Groups = append(es.Groups, eg)
+	}
+
+	return es
+}
+
+func (es *ExportStream) stream() (*stream, error) {
+	var err error
+
+	s := makeStream()
+	s.lastID, err = parseStreamID(es.LastID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range es.Entries {
+		id, err := parseStreamID(e.ID, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(e.Fields) == 0 || len(e.Fields)%2 != 0 || s.lastID.less(id) {
+			return nil, ErrImportFormat
+		}
+
+		if len(s.entries) > 0 && !s.entries[len(s.entries)-1].id.less(id) {
+			return nil, ErrImportFormat
+		}
+
+		s.entries = append(s.entries, &streamEntry{id: id, fields: e.Fields})
+	}
+
+	for _, eg := range es.Groups {
+		lastID, err := parseStreamID(eg.LastID, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		g := makeStreamGroup(lastID)
+		for _, consumer := range eg.Consumers {
+			g.consumers[consumer] = timeFunc()
+		}
+
+		for _, p := range eg.Pending {
+			id, err := parseStreamID(p.ID, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			g.pending[id] = &streamPendingEntry{consumer: p.Consumer, delivered: p.Delivered, count: p.Deliveries}
+			if _, ok := g.consumers[p.Consumer]; !ok {
+				g.consumers[p.Consumer] = p.Delivered
+			}
+		}
+
+		s.groups[eg.Name] = g
+	}
+
+	return s, nil
+}
+
+// Replace key and log it as one batch, so replay never sees half of it
+func (iq *IqDB) importKV(key string, kv *KV) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	var b []byte
+	if old, err := iq.distmap.Get(key); err == nil {
+		iq.unscheduleTTL(key, old)
+		b = aof.Frame(aof.NewRecord(aof.OpRemove, key))
+	}
+
+	// Encode before the key is visible to other writers
+	b = append(b, iq.encodeKV(key, kv)...)
+	iq.restoreKV(key, kv)
+
+	return iq.writeFramed(b)
+}
@@ -0,0 +1,116 @@
+package iqdb
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// When AOF is synced to disk
+type FsyncPolicy int
+
+const (
+	// Sync once a second, up to a second of writes may be lost
+	FsyncEverySec FsyncPolicy = iota
+	// Sync before write is acknowledged. Records written in one batch share one sync
+	FsyncAlways
+	// Never sync explicitly, leave it to OS
+	FsyncNo
+)
+
+// AOF persistence state
+type AOFStatus struct {
+	FsyncPolicy FsyncPolicy
+	// Bytes written to AOF
+	Size int64
+	// Time of the last successful sync
+	LastFsync time.Time
+	// Age of the oldest write which is not synced yet, 0 if everything is synced
+	FsyncLag time.Duration
+	// AOF rewrite is in progress
+	Rewriting bool
+}
+
+// Get AOF persistence state
+func (iq *IqDB) AOFStatus() AOFStatus {
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	st := AOFStatus{
+		FsyncPolicy: iq.opts.FsyncPolicy,
+		Size:        iq.aofSize,
+		LastFsync:   iq.lastFsync,
+		Rewriting:   iq.isRewriting,
+	}
+
+	if !iq.unsyncedSince.IsZero() {
+		st.FsyncLag = time.Since(iq.unsyncedSince)
+	}
+
+	return st
+}
+
+// Flush buffer and sync AOF to disk
+func (iq *IqDB) fsync() error {
+	iq.syncMx.Lock()
+	err := iq.aofBuf.Flush()
+	f := iq.aof
+	seq := iq.writeSeq
+	started := time.Now()
+	iq.syncMx.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	// Rewrite has swapped and closed the file. Everything written before is synced in the new one
+	if err != nil && iq.aof != f {
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	iq.lastFsync = time.Now()
+	if iq.writeSeq == seq {
+		iq.unsyncedSince = time.Time{}
+	} else {
+		iq.unsyncedSince = started
+	}
+
+	return nil
+}
+
+// Period of background flushing and syncing
+func (iq *IqDB) syncerPeriod() time.Duration {
+	p := iq.opts.SyncPeriod
+	if iq.opts.FsyncPolicy == FsyncEverySec && (!iq.isAsync() || p > time.Second) {
+		p = time.Second
+	}
+
+	return p
+}
+
+func (iq *IqDB) needsSyncer() bool {
+	return iq.isAsync() || iq.opts.FsyncPolicy == FsyncEverySec
+}
+
+func (iq *IqDB) runSyncer() {
+	for range iq.syncTicker.C {
+		if iq.opts.FsyncPolicy != FsyncEverySec {
+			iq.flushAOFBuffer()
+			continue
+		}
+
+		err := iq.fsync()
+		if err != nil {
+			log.Errorf("AOF sync failed: %s", err)
+		}
+	}
+}
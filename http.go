@@ -1,6 +1,7 @@
 package iqdb
 
 import (
+	"context"
 	"time"
 )
 
@@ -16,6 +17,70 @@ func (h *http) Set(key, value string, ttl ...time.Duration) error {
 	panic("implement me")
 }
 
+func (h *http) SetWithOptions(key, value string, opts SetOptions) (SetResult, error) {
+	panic("implement me")
+}
+
+func (h *http) SetNX(key, value string, ttl ...time.Duration) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) GetSet(key, value string) (string, error) {
+	panic("implement me")
+}
+
+func (h *http) GetDel(key string) (string, error) {
+	panic("implement me")
+}
+
+func (h *http) Append(key, value string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) StrLen(key string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) GetRange(key string, start, end int) (string, error) {
+	panic("implement me")
+}
+
+func (h *http) SetRange(key string, offset int, value string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) MGet(key ...string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) MSet(args ...string) error {
+	panic("implement me")
+}
+
+func (h *http) MSetNX(args ...string) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) SetBit(key string, offset int, bit int) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) GetBit(key string, offset int) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) BitCount(key string, start, end int) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) BitPos(key string, bit int, start int, end ...int) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) BitOp(op string, dst string, src ...string) (int, error) {
+	panic("implement me")
+}
+
 func (h *http) Remove(key string) error {
 	panic("implement me")
 }
@@ -24,6 +89,22 @@ func (h *http) TTL(key string, ttl time.Duration) error {
 	panic("implement me")
 }
 
+func (h *http) Incr(key string) (int64, error) {
+	panic("implement me")
+}
+
+func (h *http) Decr(key string) (int64, error) {
+	panic("implement me")
+}
+
+func (h *http) IncrBy(key string, delta int64) (int64, error) {
+	panic("implement me")
+}
+
+func (h *http) IncrByFloat(key string, delta float64) (float64, error) {
+	panic("implement me")
+}
+
 func (h *http) Keys() chan<- string {
 	panic("implement me")
 }
@@ -40,7 +121,15 @@ func (h *http) ListPush(key string, value ...string) (int, error) {
 	panic("implement me")
 }
 
-func (h *http) ListPop(key string) (int, error) {
+func (h *http) ListPushLeft(key string, value ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) ListPop(key string) (string, error) {
+	panic("implement me")
+}
+
+func (h *http) ListPopLeft(key string) (string, error) {
 	panic("implement me")
 }
 
@@ -48,6 +137,38 @@ func (h *http) ListRange(key string, from, to int) ([]string, error) {
 	panic("implement me")
 }
 
+func (h *http) ListInsert(key string, before bool, pivot, value string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) ListSet(key string, index int, value string) error {
+	panic("implement me")
+}
+
+func (h *http) ListRemove(key string, count int, value string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) ListTrim(key string, start, stop int) error {
+	panic("implement me")
+}
+
+func (h *http) ListMove(src, dst string, srcLeft, dstLeft bool) (string, error) {
+	panic("implement me")
+}
+
+func (h *http) ListBlockingPop(ctx context.Context, key ...string) (string, string, error) {
+	panic("implement me")
+}
+
+func (h *http) ListBlockingPopLeft(ctx context.Context, key ...string) (string, string, error) {
+	panic("implement me")
+}
+
+func (h *http) ListBlockingMove(ctx context.Context, src, dst string, srcLeft, dstLeft bool) (string, error) {
+	panic("implement me")
+}
+
 func (h *http) HashGet(key string, field string) (string, error) {
 	panic("implement me")
 }
@@ -60,10 +181,170 @@ func (h *http) HashKeys(key string) ([]string, error) {
 	panic("implement me")
 }
 
-func (h *http) HashDel(key string, field string) error {
+func (h *http) HashValues(key string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) HashMultiGet(key string, field ...string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) HashLen(key string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) HashExists(key, field string) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) HashStrLen(key, field string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) HashScan(key string, cursor int, match string, count int) (int, []string, error) {
+	panic("implement me")
+}
+
+func (h *http) HashDel(key string, field ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) HashSet(key string, args ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) HashSetNX(key, field, value string) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) HashIncrBy(key, field string, delta int64) (int64, error) {
+	panic("implement me")
+}
+
+func (h *http) SetAdd(key string, member ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) SetRemove(key string, member ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) SetIsMember(key, member string) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) SetMembers(key string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) SetCard(key string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) SetInter(key ...string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) SetUnion(key ...string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) SetDiff(key ...string) ([]string, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetAdd(key string, member ...ScoredMember) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetRemove(key string, member ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetScore(key, member string) (float64, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetRank(key, member string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetRange(key string, start, stop int) ([]ScoredMember, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetRevRange(key string, start, stop int) ([]ScoredMember, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetRangeByScore(key string, min, max float64, offset, count int) ([]ScoredMember, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetIncrBy(key, member string, incr float64) (float64, error) {
+	panic("implement me")
+}
+
+func (h *http) SortedSetCard(key string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) HyperLogLogAdd(key string, element ...string) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) HyperLogLogCount(key ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) HyperLogLogMerge(dst string, src ...string) error {
+	panic("implement me")
+}
+
+func (h *http) StreamAdd(key, id string, maxLen int, fields ...string) (string, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamLen(key string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamRange(key, start, end string, count int) ([]StreamEntry, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamRevRange(key, end, start string, count int) ([]StreamEntry, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamTrim(key string, maxLen int) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamGroupCreate(key, group, id string, mkStream bool) error {
+	panic("implement me")
+}
+
+func (h *http) StreamGroupDestroy(key, group string) (bool, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamReadGroup(key, group, consumer, id string, count int) ([]StreamEntry, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamBlockingReadGroup(ctx context.Context, key, group, consumer string, count int) ([]StreamEntry, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamAck(key, group string, id ...string) (int, error) {
+	panic("implement me")
+}
+
+func (h *http) StreamPending(key, group string) (StreamPendingSummary, error) {
 	panic("implement me")
 }
 
-func (h *http) HashSet(key string, args ...string) error {
+func (h *http) StreamPendingRange(key, group, start, end string, count int, consumer string) ([]StreamPending, error) {
 	panic("implement me")
 }
@@ -2,10 +2,16 @@ package iqdb
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"github.com/ravlio/iqdb/aof"
 	log "github.com/sirupsen/logrus"
 	"io"
+	nethttp "net/http"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -16,40 +22,134 @@ var ErrListIndexError = errors.New("wrong list index")
 var ErrListOutOfBounds = errors.New("list range out of bounds")
 var ErrHashKeyNotFound = errors.New("hash key not found")
 var ErrHashKeyValueMismatch = errors.New("hash keys and values mismatch")
+var ErrHashCursor = errors.New("invalid cursor")
+var ErrSortedSetMemberNotFound = errors.New("sorted set member not found")
+var ErrScoreNotFloat = errors.New("score is not a valid float")
+var ErrScoreNaN = errors.New("resulting score is not a number")
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+var ErrNotFloat = errors.New("value is not a valid float")
+var ErrIncrOverflow = errors.New("increment or decrement would overflow")
+var ErrIncrNaN = errors.New("increment would produce NaN or Infinity")
+var ErrSetOptions = errors.New("conflicting set options")
+var ErrKeyValueMismatch = errors.New("keys and values mismatch")
+var ErrBitOffset = errors.New("bit offset is not an integer or out of range")
+var ErrBitValue = errors.New("bit is not an integer or out of range")
+var ErrBitOp = errors.New("wrong bit operation or number of keys")
+var ErrHLLCorrupt = errors.New("corrupted HyperLogLog value")
+var ErrStreamID = errors.New("invalid stream ID")
+var ErrStreamIDTooSmall = errors.New("stream ID is equal or smaller than the last one")
+var ErrStreamFields = errors.New("stream entry needs field-value pairs")
+var ErrStreamMaxLen = errors.New("stream max length is out of range")
+var ErrStreamNoGroup = errors.New("no such stream or consumer group")
+var ErrStreamGroupExists = errors.New("consumer group name already exists")
+var ErrStreamCorrupt = errors.New("corrupted stream value")
+var ErrOffsetOutOfRange = errors.New("offset is out of range")
+var ErrStringTooLong = errors.New("string exceeds maximum allowed size")
+var ErrClosed = errors.New("database is closed")
 
-// Three types of storage items
+// Values longer than that are never written, as in Redis
+const maxStringLen = 512 << 20
+
+// Types of storage items
 const (
 	dataTypeKV   = 1
 	dataTypeList = 2
 	dataTypeHash = 3
-)
-
-const (
-	opSet      = 1
-	opRemove   = 2
-	opTTL      = 3
-	opListPush = 4
-	opListPop  = 5
-	opHashDel  = 6
-	opHashSet  = 7
+	dataTypeSet  = 4
+	// Sorted set
+	dataTypeZSet = 5
+	// HyperLogLog
+	dataTypeHLL = 6
+	// Append-only log of entries with consumer groups
+	dataTypeStream = 7
 )
 
 type Client interface {
 	Get(key string) (string, error)
 	Set(key, value string, ttl ...time.Duration) error
+	SetWithOptions(key, value string, opts SetOptions) (SetResult, error)
+	SetNX(key, value string, ttl ...time.Duration) (bool, error)
+	GetSet(key, value string) (string, error)
+	GetDel(key string) (string, error)
+	Append(key, value string) (int, error)
+	StrLen(key string) (int, error)
+	GetRange(key string, start, end int) (string, error)
+	SetRange(key string, offset int, value string) (int, error)
+	MGet(key ...string) ([]string, error)
+	MSet(args ...string) error
+	MSetNX(args ...string) (bool, error)
+	SetBit(key string, offset int, bit int) (int, error)
+	GetBit(key string, offset int) (int, error)
+	BitCount(key string, start, end int) (int, error)
+	BitPos(key string, bit int, start int, end ...int) (int, error)
+	BitOp(op string, dst string, src ...string) (int, error)
 	Remove(key string) error
 	TTL(key string, ttl time.Duration) error
+	Incr(key string) (int64, error)
+	Decr(key string) (int64, error)
+	IncrBy(key string, delta int64) (int64, error)
+	IncrByFloat(key string, delta float64) (float64, error)
 	Keys() chan<- string
 	ListLen(key string) (int, error)
 	ListIndex(key string, index int) (string, error)
 	ListPush(key string, value ...string) (int, error)
-	ListPop(key string) (int, error)
+	ListPushLeft(key string, value ...string) (int, error)
+	ListPop(key string) (string, error)
+	ListPopLeft(key string) (string, error)
 	ListRange(key string, from, to int) ([]string, error)
+	ListInsert(key string, before bool, pivot, value string) (int, error)
+	ListSet(key string, index int, value string) error
+	ListRemove(key string, count int, value string) (int, error)
+	ListTrim(key string, start, stop int) error
+	ListMove(src, dst string, srcLeft, dstLeft bool) (string, error)
+	ListBlockingPop(ctx context.Context, key ...string) (string, string, error)
+	ListBlockingPopLeft(ctx context.Context, key ...string) (string, string, error)
+	ListBlockingMove(ctx context.Context, src, dst string, srcLeft, dstLeft bool) (string, error)
 	HashGet(key string, field string) (string, error)
 	HashGetAll(key string) (map[string]string, error)
 	HashKeys(key string) ([]string, error)
-	HashDel(key string, field string) error
-	HashSet(key string, args ...string) error
+	HashValues(key string) ([]string, error)
+	HashMultiGet(key string, field ...string) ([]string, error)
+	HashLen(key string) (int, error)
+	HashExists(key, field string) (bool, error)
+	HashStrLen(key, field string) (int, error)
+	HashScan(key string, cursor int, match string, count int) (int, []string, error)
+	HashDel(key string, field ...string) (int, error)
+	HashSet(key string, args ...string) (int, error)
+	HashSetNX(key, field, value string) (bool, error)
+	HashIncrBy(key, field string, delta int64) (int64, error)
+	SetAdd(key string, member ...string) (int, error)
+	SetRemove(key string, member ...string) (int, error)
+	SetIsMember(key, member string) (bool, error)
+	SetMembers(key string) ([]string, error)
+	SetCard(key string) (int, error)
+	SetInter(key ...string) ([]string, error)
+	SetUnion(key ...string) ([]string, error)
+	SetDiff(key ...string) ([]string, error)
+	SortedSetAdd(key string, member ...ScoredMember) (int, error)
+	SortedSetRemove(key string, member ...string) (int, error)
+	SortedSetScore(key, member string) (float64, error)
+	SortedSetRank(key, member string) (int, error)
+	SortedSetRange(key string, start, stop int) ([]ScoredMember, error)
+	SortedSetRevRange(key string, start, stop int) ([]ScoredMember, error)
+	SortedSetRangeByScore(key string, min, max float64, offset, count int) ([]ScoredMember, error)
+	SortedSetIncrBy(key, member string, incr float64) (float64, error)
+	SortedSetCard(key string) (int, error)
+	HyperLogLogAdd(key string, element ...string) (bool, error)
+	HyperLogLogCount(key ...string) (int, error)
+	HyperLogLogMerge(dst string, src ...string) error
+	StreamAdd(key, id string, maxLen int, fields ...string) (string, error)
+	StreamLen(key string) (int, error)
+	StreamRange(key, start, end string, count int) ([]StreamEntry, error)
+	StreamRevRange(key, end, start string, count int) ([]StreamEntry, error)
+	StreamTrim(key string, maxLen int) (int, error)
+	StreamGroupCreate(key, group, id string, mkStream bool) error
+	StreamGroupDestroy(key, group string) (bool, error)
+	StreamReadGroup(key, group, consumer, id string, count int) ([]StreamEntry, error)
+	StreamBlockingReadGroup(ctx context.Context, key, group, consumer string, count int) ([]StreamEntry, error)
+	StreamAck(key, group string, id ...string) (int, error)
+	StreamPending(key, group string) (StreamPendingSummary, error)
+	StreamPendingRange(key, group, start, end string, count int, consumer string) ([]StreamPending, error)
 }
 
 type Options struct {
@@ -64,6 +164,37 @@ type Options struct {
 	NoAsync bool
 	// Buffer sync period
 	SyncPeriod time.Duration
+	// When AOF is synced to disk. Default is once a second
+	FsyncPolicy FsyncPolicy
+	// Rewrite AOF automatically when it grows by this percent since the last rewrite. Disabled if 0
+	AOFRewritePercent int
+	// Minimal AOF size for automatic rewrite. Default is 64MB
+	AOFRewriteMinSize int64
+	// What to do with damaged AOF records on start
+	AOFRecovery AOFRecoveryMode
+	// Start new AOF segment when current one reaches this size. Default is 64MB
+	SegmentSize int64
+	// Start new AOF segment after this period. Disabled if 0
+	SegmentPeriod time.Duration
+	// Snapshot file loaded on start before AOF. Not used if empty.
+	// AOF segments covered by this snapshot are deleted
+	SnapshotFile string
+	// Save snapshot to SnapshotFile periodically. Disabled if 0
+	SnapshotPeriod time.Duration
+	// Called once a second during AOF replay on start and when it is finished
+	OnReplayProgress func(ReplayProgress)
+	// Compression of AOF records with large values
+	Compression Compression
+	// Records smaller than that are not compressed. Default is 1KB
+	CompressionMinSize int
+	// AES key of 16, 24 or 32 bytes. AOF segments and snapshots are encrypted with it if set
+	EncryptionKey []byte
+	// Keys data was encrypted with before. Such data is still readable
+	// and it is rewritten with EncryptionKey on start
+	PreviousEncryptionKeys [][]byte
+	// Token GET /backup requires as "Authorization: Bearer <token>".
+	// Backup is served to local clients only if it is empty
+	BackupToken string
 }
 
 var timeFunc = func() time.Time {
@@ -71,34 +202,78 @@ var timeFunc = func() time.Time {
 }
 
 type IqDB struct {
-	fname string
+	// AOF directory
+	fname    string
+	manifest *aof.Manifest
+	// Current segment size and creation time
+	segSize    int64
+	segStarted time.Time
 	// TCP reader and writer
-	redis *redisServer
-	opts  *Options
+	redis      *redisServer
+	httpServer *nethttp.Server
+	opts       *Options
 	// Error channel for goroutines
 	errch chan error
 	// Using distributed hashed map
 	distmap *distmap
+	// Clients blocked on empty lists
+	waiters *listWaiters
 	// TTL tree with scheduler
 	ttl *ttlTree
+	// Keys dropped on load as expired, set while DB is being opened
+	loadExpired *expiredKeys
 	// Time callback for back to the future (ttl testing purposes)
-	timeCb     func() time.Time
-	aof        *os.File
-	aofW       io.Writer
+	timeCb func() time.Time
+	aof    *os.File
+	aofW   io.Writer
+	// Cipher of the current segment, nil if it is not encrypted. Guarded by syncMx
+	cipher *aof.Cipher
+	// Encryption keys, guarded by syncMx
+	keys       *aof.Keyring
 	aofBuf     *bufio.Writer
 	syncTicker *time.Ticker
 	isSyncing  bool
 	syncMx     *sync.Mutex
+	// Writers hold it shared while applying op and writing it to AOF,
+	// so exclusive lock gives consistent cut of dataset and AOF
+	cutMx *sync.RWMutex
+	// Point-in-time copies of dataset are taken one at a time
+	copyMx *sync.Mutex
+	// Records written during AOF rewrite
+	rewriteBuf  *bytes.Buffer
+	isRewriting bool
+	// Running backups count, guarded by syncMx
+	backups int
+	aofSize int64
+	// AOF size after last rewrite, used for automatic rewrite
+	aofBaseSize    int64
+	snapshotTicker *time.Ticker
+	// Records queue for AOF writer, closed by Close
+	aofCh chan *aofWrite
+	// Closed when AOF writer has written everything queued and exited
+	aofDone chan struct{}
+	// Set by Close, guarded by cutMx
+	closed bool
+	// Written records count
+	writeSeq uint64
+	// Guarded by syncMx
+	lastFsync     time.Time
+	unsyncedSince time.Time
 }
 
 // KeyValue entity
 // Contains all types as pointers so they would not occupy much memory, just pointers
 type KV struct {
 	ttl      time.Duration
+	expire   time.Time
 	dataType int
 	Value    string
 	list     *list
 	hash     *hash
+	set      *set
+	zset     *zset
+	hll      *hll
+	stream   *stream
 }
 
 type list struct {
@@ -110,6 +285,125 @@ type hash struct {
 	hash *sync.Map
 }
 
+type set struct {
+	mx  *sync.RWMutex
+	set map[string]struct{}
+}
+
+func makeList(items []string) *list {
+	return &list{mx: &sync.RWMutex{}, list: items}
+}
+
+// Make hash from field-value pairs
+func makeHash(args []string) *hash {
+	h := &hash{&sync.Map{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		h.hash.Store(args[i], args[i+1])
+	}
+
+	return h
+}
+
+// Field-value pairs of hash
+func (h *hash) pairs() []string {
+	args := make([]string, 0)
+	h.hash.Range(func(f, v interface{}) bool {
+		args = append(args, f.(string), v.(string))
+		return true
+	})
+
+	return args
+}
+
+// Fields count. Map is walked, so it takes linear time
+func (h *hash) len() int {
+	n := 0
+	h.hash.Range(func(interface{}, interface{}) bool {
+		n++
+		return true
+	})
+
+	return n
+}
+
+// Fields in lexicographical order
+func (h *hash) fields() []string {
+	fields := make([]string, 0)
+	h.hash.Range(func(f, _ interface{}) bool {
+		fields = append(fields, f.(string))
+		return true
+	})
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+func makeSet(members []string) *set {
+	s := &set{mx: &sync.RWMutex{}, set: make(map[string]struct{}, len(members))}
+	for _, m := range members {
+		s.set[m] = struct{}{}
+	}
+
+	return s
+}
+
+// Members of set in no particular order
+func (s *set) members() []string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	ret := make([]string, 0, len(s.set))
+	for m := range s.set {
+		ret = append(ret, m)
+	}
+
+	return ret
+}
+
+// Deep copy of KV
+func (kv *KV) clone() *KV {
+	c := &KV{ttl: kv.ttl, expire: kv.expire, dataType: kv.dataType, Value: kv.Value}
+
+	if kv.list != nil {
+		kv.list.mx.RLock()
+		c.list = &list{mx: &sync.RWMutex{}, list: append([]string(nil), kv.list.list...)}
+		kv.list.mx.RUnlock()
+	}
+
+	if kv.hash != nil {
+		c.hash = &hash{&sync.Map{}}
+		kv.hash.hash.Range(func(k, v interface{}) bool {
+			c.hash.hash.Store(k, v)
+			return true
+		})
+	}
+
+	if kv.set != nil {
+		c.set = makeSet(kv.set.members())
+	}
+
+	if kv.zset != nil {
+		kv.zset.mx.RLock()
+		c.zset = makeZSet(kv.zset.members())
+		kv.zset.mx.RUnlock()
+	}
+
+	if kv.hll != nil {
+		kv.hll.mx.RLock()
+		c.hll = &hll{mx: &sync.RWMutex{}, sparse: append([]uint32(nil), kv.hll.sparse...), dense: append([]byte(nil), kv.hll.dense...)}
+		kv.hll.mx.RUnlock()
+	}
+
+	if kv.stream != nil {
+		kv.stream.mx.RLock()
+		c.stream = kv.stream.clone()
+		kv.stream.mx.RUnlock()
+	}
+
+	return c
+}
+
 func Open(fname string, opts *Options) (*IqDB, error) {
 	if opts.ShardCount <= 0 {
 		opts.ShardCount = 1
@@ -123,42 +417,148 @@ func Open(fname string, opts *Options) (*IqDB, error) {
 		opts.SyncPeriod = time.Second
 	}
 
+	if opts.AOFRewriteMinSize <= 0 {
+		opts.AOFRewriteMinSize = defaultAOFRewriteMinSize
+	}
+
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+
+	if opts.CompressionMinSize <= 0 {
+		opts.CompressionMinSize = defaultCompressionMinSize
+	}
+
 	db := &IqDB{
 		fname:   fname,
 		opts:    opts,
 		distmap: NewDistmap(opts.ShardCount),
+		waiters: newListWaiters(),
 		errch:   make(chan error),
 		syncMx:  &sync.Mutex{},
+		cutMx:   &sync.RWMutex{},
+		copyMx:  &sync.Mutex{},
+		aofCh:   make(chan *aofWrite, aofMaxBatch),
+		aofDone: make(chan struct{}),
+
+		loadExpired: newExpiredKeys(),
 	}
 
 	db.ttl = newTTLTree(db.removeFromHash)
 
-	aof, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	var err error
+
+	db.keys, err = aof.NewKeyring(opts.EncryptionKey, opts.PreviousEncryptionKeys...)
 	if err != nil {
 		return nil, err
 	}
 
-	db.aof = aof
-	db.aofBuf = bufio.NewWriter(aof)
+	db.manifest, err = openLogDir(fname, db.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := LogPosition{Segment: db.manifest.Segments[0]}
+	var restored bool
+	if opts.SnapshotFile != "" {
+		pos, restored, err = db.openSnapshot()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	version, truncated, err := db.readLog(pos)
+
+	if err != nil {
+		return nil, err
+	}
 
-	err = db.readAOF()
+	stale, err := db.hasStaleKey()
+	if err != nil {
+		return nil, err
+	}
 
+	f, c, size, err := db.openSegment(db.manifest.Last())
 	if err != nil {
 		return nil, err
 	}
 
-	if !opts.NoAsync && opts.SyncPeriod > 0 {
-		db.aofW = db.aofBuf
-		db.syncTicker = time.NewTicker(opts.SyncPeriod)
+	db.setAOFFile(f, c)
+	db.segSize = size
+	db.segStarted = time.Now()
+
+	// Nonces of encrypted records depend on their offsets, so appending
+	// at truncated offset would reuse nonces of discarded records
+	if truncated && c != nil {
+		db.syncMx.Lock()
+		err = db.startSegment()
+		db.syncMx.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.aofSize, err = db.logSize()
+	if err != nil {
+		return nil, err
+	}
+
+	db.aofBaseSize = db.aofSize
+
+	go db.runAOFWriter()
+
+	// Records of dropped keys are skipped on replay until they are removed,
+	// otherwise keys created again would be skipped next time
+	for _, key := range db.loadExpired.list() {
+		err = db.writeRemove(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.loadExpired = nil
+	db.ttl.start()
+
+	if db.needsSyncer() {
+		db.syncTicker = time.NewTicker(db.syncerPeriod())
 		go db.runSyncer()
+	}
 
-	} else {
-		db.aofW = aof
+	// AOF must contain everything restored from snapshot. Old format files
+	// and segments encrypted with old key are upgraded the same way
+	if restored || version < aofVersion || stale {
+		err = db.RewriteAOF()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.SnapshotFile != "" && opts.SnapshotPeriod > 0 {
+		db.snapshotTicker = time.NewTicker(opts.SnapshotPeriod)
+		go db.runSnapshotter()
 	}
 
 	return db, nil
 }
 
+func (iq *IqDB) isAsync() bool {
+	return !iq.opts.NoAsync && iq.opts.SyncPeriod > 0
+}
+
+// Use file as AOF, c is its cipher. Caller must hold syncMx if DB is already opened
+func (iq *IqDB) setAOFFile(f *os.File, c *aof.Cipher) {
+	iq.aof = f
+	iq.cipher = c
+	iq.aofBuf = bufio.NewWriter(f)
+
+	if iq.isAsync() {
+		iq.aofW = iq.aofBuf
+	} else {
+		iq.aofW = f
+	}
+}
+
 // We can redefine time to force TTL expiring
 func SetTimeFunc(cb func() time.Time) {
 	timeFunc = cb
@@ -171,20 +571,62 @@ func (iq *IqDB) Start() error {
 	}
 
 	if iq.opts.HTTPPort > 0 {
+		mux := nethttp.NewServeMux()
+		mux.HandleFunc("/backup", iq.handleBackup)
+
+		iq.httpServer = &nethttp.Server{Addr: ":" + strconv.Itoa(iq.opts.HTTPPort), Handler: mux}
 		go iq.serveHTTP()
 	}
 
 	return <-iq.errch
 }
 
-func (iq IqDB) Close() error {
-	if !iq.opts.NoAsync {
-		iq.flushAOFBuffer()
+func (iq *IqDB) Close() error {
+	// Writers hold cutMx while writing, so nothing is being queued once it is taken.
+	// Later writes fail and writer exits when it has written the rest of the queue
+	iq.cutMx.Lock()
+	if iq.closed {
+		iq.cutMx.Unlock()
+		return ErrClosed
+	}
+	iq.closed = true
+	close(iq.aofCh)
+	iq.cutMx.Unlock()
+
+	iq.ttl.stop()
+
+	if iq.snapshotTicker != nil {
+		iq.snapshotTicker.Stop()
+	}
+
+	if iq.syncTicker != nil {
+		iq.syncTicker.Stop()
 	}
 
 	if iq.opts.RedisPort > 0 {
 		iq.redis.Stop()
 	}
+
+	if iq.httpServer != nil {
+		iq.httpServer.Close()
+	}
+
+	<-iq.aofDone
+
+	// Rewrite in progress swaps the file, wait for it
+	iq.copyMx.Lock()
+	defer iq.copyMx.Unlock()
+
+	if iq.opts.FsyncPolicy != FsyncNo {
+		err := iq.fsync()
+		if err != nil {
+			iq.aof.Close()
+			return err
+		}
+	} else if iq.isAsync() {
+		iq.flushAOFBuffer()
+	}
+
 	return iq.aof.Close()
 }
 
@@ -192,4 +634,9 @@ func (iq *IqDB) serveHTTP() {
 	log.Info("Starting HTTP server ...")
 
 	log.Infof("HTTP server now accept connections on port %d ...", iq.opts.HTTPPort)
+
+	err := iq.httpServer.ListenAndServe()
+	if err != nethttp.ErrServerClosed {
+		iq.errch <- err
+	}
 }
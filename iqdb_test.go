@@ -1,12 +1,23 @@
 package iqdb_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/ravlio/iqdb"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"math"
 	"net"
+	nethttp "net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,7 +33,7 @@ func TestMain(m *testing.M) {
 
 	// Cleanup test db
 	if _, err := os.Stat("test"); err == nil {
-		os.Remove("test")
+		os.RemoveAll("test")
 	}
 
 	// Open new db or use existing one
@@ -77,7 +88,7 @@ func TestMain(m *testing.M) {
 	}
 
 	if _, err := os.Stat("test"); err == nil {
-		os.Remove("test")
+		os.RemoveAll("test")
 	} else {
 		panic("no db file!")
 	}
@@ -90,8 +101,11 @@ func TestAOF(t *testing.T) {
 
 	req := require.New(t)
 
+	os.RemoveAll("aofdb")
+	defer os.RemoveAll("aofdb")
+
 	// Open new db or use existing one
-	aof, err := iqdb.Open("aof", &iqdb.Options{ShardCount: 100})
+	aof, err := iqdb.Open("aofdb", &iqdb.Options{ShardCount: 100})
 
 	if err != nil {
 		panic(err)
@@ -103,11 +117,15 @@ func TestAOF(t *testing.T) {
 	req.NoError(aof.Set("k3", "v3"))
 	req.NoError(aof.Set("k3", "v4"))
 	req.NoError(aof.Remove("k2"))
-	req.NoError(aof.HashSet("h1", "k1", "v1", "k2", "v2"))
+	_, err = aof.HashSet("h1", "k1", "v1", "k2", "v2")
+	req.NoError(err)
 	req.NoError(aof.Remove("h1"))
-	req.NoError(aof.HashSet("h2", "k1", "v1", "k2", "v2"))
-	req.NoError(aof.HashSet("h2", "k3", "v3"))
-	req.NoError(aof.HashDel("h2", "k2"))
+	_, err = aof.HashSet("h2", "k1", "v1", "k2", "v2")
+	req.NoError(err)
+	_, err = aof.HashSet("h2", "k3", "v3")
+	req.NoError(err)
+	_, err = aof.HashDel("h2", "k2")
+	req.NoError(err)
 	_, err = aof.ListPush("l1", "a", "b", "c")
 	req.NoError(err)
 
@@ -122,7 +140,7 @@ func TestAOF(t *testing.T) {
 
 	req.NoError(aof.Close())
 
-	aof, err = iqdb.Open("aof", &iqdb.Options{ShardCount: 100})
+	aof, err = iqdb.Open("aofdb", &iqdb.Options{ShardCount: 100})
 
 	req.NoError(err)
 
@@ -158,247 +176,3892 @@ func TestAOF(t *testing.T) {
 	req.NoError(err)
 }
 
-func testOps(t *testing.T, cl iqdb.Client) {
-	var err error
-
+func TestAOFRewrite(t *testing.T) {
 	req := require.New(t)
 
-	t.Run("Standard KV", func(t *testing.T) {
-		_, err = cl.Get("unexisting")
-
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	os.RemoveAll("aofrw")
+	defer os.RemoveAll("aofrw")
 
-		req.NoError(cl.Set("k", ""))
+	aof, err := iqdb.Open("aofrw", &iqdb.Options{ShardCount: 10, NoAsync: true})
+	req.NoError(err)
 
-		res, err := cl.Get("k")
+	for i := 0; i < 100; i++ {
+		req.NoError(aof.Set("k", strconv.Itoa(i)))
+		_, err = aof.HashSet("h", "f", strconv.Itoa(i))
 		req.NoError(err)
+	}
+	req.NoError(aof.Set("ttl", "v", time.Minute))
+	_, err = aof.ListPush("l", "a", "b", "c")
+	req.NoError(err)
+	_, err = aof.ListPop("l")
+	req.NoError(err)
 
-		req.Equal("", res)
+	before := aof.AOFStatus().Size
 
-		req.NoError(cl.Set("k", "val2"))
+	req.NoError(aof.RewriteAOF())
 
-		res, err = cl.Get("k")
+	req.True(aof.AOFStatus().Size < before)
 
-		req.NoError(err)
+	// Writes after rewrite go to the new file
+	req.NoError(aof.Set("k2", "v2"))
+	req.NoError(aof.Close())
 
-		req.Equal("val2", res)
+	aof, err = iqdb.Open("aofrw", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		req.NoError(cl.Set("k2", "str1\n\rstr2"))
+	v, err := aof.Get("k")
+	req.NoError(err)
+	req.Equal("99", v)
 
-		res, err = cl.Get("k2")
+	v, err = aof.Get("k2")
+	req.NoError(err)
+	req.Equal("v2", v)
 
-		req.NoError(err)
+	v, err = aof.Get("ttl")
+	req.NoError(err)
+	req.Equal("v", v)
 
-		req.Equal("str1\n\rstr2", res)
+	v, err = aof.HashGet("h", "f")
+	req.NoError(err)
+	req.Equal("99", v)
 
-		req.NoError(cl.Remove("k2"))
+	l, err := aof.ListRange("l", 0, 1)
+	req.NoError(err)
+	req.Equal([]string{"a", "b"}, l)
 
-		res, err = cl.Get("k2")
+	req.NoError(aof.Close())
+}
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+func TestAOFRewriteConcurrentWrites(t *testing.T) {
+	req := require.New(t)
 
-		req.NoError(cl.Set("ttl", "val", time.Minute))
+	os.RemoveAll("aofrwc")
+	defer os.RemoveAll("aofrwc")
 
-		res, err = cl.Get("ttl")
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true}
+	aof, err := iqdb.Open("aofrwc", opts)
+	req.NoError(err)
 
+	for i := 0; i < 1000; i++ {
+		_, err = aof.ListPush("l"+strconv.Itoa(i), "a")
 		req.NoError(err)
+	}
 
-		req.Equal("val", res)
-	})
+	// Keys changed, created and removed while they are copied are kept exactly once
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			key := "l" + strconv.Itoa(i%1000)
+			_, err := aof.ListPush(key, "b")
+			req.NoError(err)
+			req.NoError(aof.Set("new"+strconv.Itoa(i), "v"))
+
+			if i%10 == 0 {
+				req.NoError(aof.Remove(key))
+			}
+		}
+	}()
 
-	if t.Failed() {
-		return
+	req.NoError(aof.RewriteAOF())
+	close(stop)
+	<-done
+
+	want := make(map[string][]string)
+	for i := 0; i < 1000; i++ {
+		key := "l" + strconv.Itoa(i)
+		l, err := aof.ListRange(key, 0, -1)
+		if err == iqdb.ErrKeyNotFound {
+			continue
+		}
+
+		req.NoError(err)
+		want[key] = l
 	}
+	req.NoError(aof.Close())
 
-	t.Run("Hashes", func(t *testing.T) {
-		_, err := cl.HashGetAll("unexisting")
+	aof, err = iqdb.Open("aofrwc", opts)
+	req.NoError(err)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	for i := 0; i < 1000; i++ {
+		key := "l" + strconv.Itoa(i)
+		l, err := aof.ListRange(key, 0, -1)
+		if _, ok := want[key]; !ok {
+			req.Equal(iqdb.ErrKeyNotFound, err, key)
+			continue
+		}
 
-		_, err = cl.HashGet("unexisting", "213")
+		req.NoError(err)
+		req.Equal(want[key], l, key)
+	}
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Close())
+}
 
-		err = cl.HashDel("unexisting", "123")
+func TestSnapshot(t *testing.T) {
+	req := require.New(t)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	for _, f := range []string{"aofsnap", "aofsnap.snap", "aofsnap2", "aofsnap2.snap"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
 
-		_, err = cl.HashKeys("unexisting")
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofsnap.snap"}
+	aof, err := iqdb.Open("aofsnap", opts)
+	req.NoError(err)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Set("k", "v"))
+	req.NoError(aof.Set("ttl", "v", time.Minute))
+	_, err = aof.ListPush("l", "a", "b")
+	req.NoError(err)
+	_, err = aof.HashSet("h", "f1", "v1")
+	req.NoError(err)
 
-		req.NoError(cl.HashSet("hash", "f1", "1"))
+	req.NoError(aof.SaveSnapshot("aofsnap.snap"))
 
-		h, err := cl.HashGetAll("hash")
+	// AOF tail after snapshot
+	_, err = aof.ListPush("l", "c")
+	req.NoError(err)
+	_, err = aof.HashSet("h", "f2", "v2")
+	req.NoError(err)
+	req.NoError(aof.Close())
 
-		req.Equal(map[string]string{"f1": "1"}, h)
+	aof, err = iqdb.Open("aofsnap", opts)
+	req.NoError(err)
 
-		v, err := cl.HashGet("hash", "f1")
+	l, err := aof.ListRange("l", 0, 2)
+	req.NoError(err)
+	req.Equal([]string{"a", "b", "c"}, l)
 
-		req.Equal(v, "1")
+	h, err := aof.HashGetAll("h")
+	req.NoError(err)
+	req.Equal(map[string]string{"f1": "v1", "f2": "v2"}, h)
 
-		req.NoError(cl.HashDel("hash", "unex"))
+	v, err := aof.Get("ttl")
+	req.NoError(err)
+	req.Equal("v", v)
 
-		keys, err := cl.HashKeys("hash")
+	req.NoError(aof.SaveSnapshot("aofsnap2.snap"))
+	req.NoError(aof.Close())
 
-		req.Equal([]string{"f1"}, keys)
+	// Snapshot copy is enough to restore the dataset
+	aof, err = iqdb.Open("aofsnap2", &iqdb.Options{ShardCount: 10, SnapshotFile: "aofsnap2.snap"})
+	req.NoError(err)
 
-		req.NoError(cl.HashDel("hash", "f1"))
+	l, err = aof.ListRange("l", 0, 2)
+	req.NoError(err)
+	req.Equal([]string{"a", "b", "c"}, l)
 
-		err = cl.HashSet("hash", "k1")
+	v, err = aof.Get("k")
+	req.NoError(err)
+	req.Equal("v", v)
 
-		req.Equal(iqdb.ErrHashKeyValueMismatch, err)
+	req.NoError(aof.Close())
+}
 
-		req.NoError(cl.HashSet("hash", "k1", "v1", "k2", "v2"))
+func TestExportImport(t *testing.T) {
+	req := require.New(t)
 
-		req.NoError(cl.HashSet("hash", "k3", "v3"))
+	for _, f := range []string{"aofexport", "aofimport"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
 
-		h, err = cl.HashGetAll("hash")
+	src, err := iqdb.Open("aofexport", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		req.Equal(map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}, h)
+	req.NoError(src.Set("k", "v"))
+	req.NoError(src.Set("empty", ""))
+	req.NoError(src.Set("ttl", "v", time.Hour))
+	_, err = src.ListPush("l", "a", "b")
+	req.NoError(err)
+	_, err = src.HashSet("h", "f1", "v1", "f2", "v2")
+	req.NoError(err)
 
-		req.NoError(cl.Remove("hash"))
+	buf := &bytes.Buffer{}
+	req.NoError(src.Export(buf))
+	req.NoError(src.Close())
+	req.Equal(5, strings.Count(buf.String(), "\n"))
+	req.Contains(buf.String(), `{"key":"l","type":"list","list":["a","b"]}`)
 
-		_, err = cl.HashGetAll("hash")
+	dst, err := iqdb.Open("aofimport", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
-	})
+	// Existing key of another type is replaced
+	req.NoError(dst.Set("l", "old"))
+	req.NoError(dst.Import(buf))
 
-	if t.Failed() {
-		return
-	}
+	err = dst.Import(strings.NewReader(`{"key":"x","type":"set"}`))
+	req.Error(err)
 
-	t.Run("Lists", func(t *testing.T) {
-		_, err := cl.ListLen("unexisting")
+	req.NoError(dst.Close())
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	dst, err = iqdb.Open("aofimport", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		_, err = cl.ListIndex("unexisting", 1)
+	v, err := dst.Get("empty")
+	req.NoError(err)
+	req.Equal("", v)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	l, err := dst.ListRange("l", 0, 1)
+	req.NoError(err)
+	req.Equal([]string{"a", "b"}, l)
 
-		_, err = cl.ListPop("unexisting")
+	h, err := dst.HashGetAll("h")
+	req.NoError(err)
+	req.Equal(map[string]string{"f1": "v1", "f2": "v2"}, h)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	buf.Reset()
+	req.NoError(dst.Export(buf))
+	req.Regexp(`{"key":"ttl","type":"string","value":"v","expires_at":"[^"]+"}`, buf.String())
 
-		_, err = cl.ListRange("unexisting", 0, 10)
+	req.NoError(dst.Close())
+}
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+func TestImportRDB(t *testing.T) {
+	req := require.New(t)
 
-		c, err := cl.ListPush("list", "a", "b", "c", "d")
+	os.RemoveAll("aofrdb")
+	defer os.RemoveAll("aofrdb")
 
-		req.NoError(err)
+	str := func(s string) string {
+		return string(rune(len(s))) + s
+	}
 
-		req.EqualValues(4, c)
+	expire := func(d time.Duration) string {
+		ms := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ms, uint64(time.Now().Add(d).UnixNano()/int64(time.Millisecond)))
+		return "\xfc" + string(ms)
+	}
 
-		c, err = cl.ListPop("list")
+	// Sparse HyperLogLog string: 100 zero registers, two registers of value 3 and zeros up to the end
+	hll := "HYLL\x01\x00\x00\x00" + strings.Repeat("\x00", 7) + "\x80" + "\x40\x63" + "\x89" + "\x7f\x99"
+
+	// Zero checksum means it was disabled on save
+	dump := "REDIS0009" + "\xfe\x00" +
+		"\x00" + str("k") + str("v") +
+		expire(time.Hour) + "\x00" + str("ttl") + str("v") +
+		expire(-time.Hour) + "\x00" + str("expired") + str("v") +
+		"\x01" + str("l") + "\x02" + str("a") + str("b") +
+		"\x04" + str("h") + "\x01" + str("f") + str("v") +
+		"\x02" + str("set") + "\x01" + str("m") +
+		"\x00" + str("hll") + str(hll) +
+		"\xfe\x01" + "\x00" + str("db1") + str("v") +
+		"\xff" + strings.Repeat("\x00", 8)
+
+	aof, err := iqdb.Open("aofrdb", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		req.NoError(err)
+	_, err = aof.ListPush("l", "old")
+	req.NoError(err)
 
-		req.EqualValues(3, c)
+	res, err := aof.ImportRDB(strings.NewReader(dump), 0)
+	req.NoError(err)
+	req.Equal(&iqdb.RDBImportResult{Keys: 5, Expired: 1, OtherDB: 1, Unsupported: map[string]int{"set": 1}}, res)
+	req.NoError(aof.Close())
 
-		l, err := cl.ListIndex("list", 1)
+	aof, err = iqdb.Open("aofrdb", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		req.NoError(err)
+	l, err := aof.ListRange("l", 0, 1)
+	req.NoError(err)
+	req.Equal([]string{"a", "b"}, l)
 
-		req.EqualValues("b", l)
+	h, err := aof.HashGetAll("h")
+	req.NoError(err)
+	req.Equal(map[string]string{"f": "v"}, h)
 
-		l, err = cl.ListIndex("list", 10)
+	v, err := aof.Get("ttl")
+	req.NoError(err)
+	req.Equal("v", v)
 
-		req.Equal(iqdb.ErrListIndexError, err)
+	_, err = aof.Get("expired")
+	req.Equal(iqdb.ErrKeyNotFound, err)
 
-		_, err = cl.ListRange("list", 0, 10)
+	n, err := aof.HyperLogLogCount("hll")
+	req.NoError(err)
+	req.Equal(2, n)
 
-		req.Equal(iqdb.ErrListOutOfBounds, err)
+	_, err = aof.ImportRDB(strings.NewReader("REDIS0009\x00"), 0)
+	req.Error(err)
 
-		lr, err := cl.ListRange("list", 0, 2)
+	req.NoError(aof.Close())
+}
 
-		req.Equal([]string{"a", "b", "c"}, lr)
+func TestAOFRecovery(t *testing.T) {
+	req := require.New(t)
 
-	})
+	os.RemoveAll("aofrec")
+	defer os.RemoveAll("aofrec")
 
-	t.Run("TTL", func(t *testing.T) {
-		req.NoError(cl.Set("nottl", "test1"))
-		req.NoError(cl.Set("ttl1sec", "test2", time.Second*1))
-		req.NoError(cl.Set("ttl10sec", "test3", time.Second*10))
+	aof, err := iqdb.Open("aofrec", &iqdb.Options{ShardCount: 10, NoAsync: true})
+	req.NoError(err)
+	req.NoError(aof.Set("k1", "v1"))
+	req.NoError(aof.Set("k2", "v2"))
+	req.NoError(aof.Set("k3", "v3"))
+	req.NoError(aof.Close())
 
-		v, err := cl.Get("nottl")
+	seg := "aofrec/00000001.aof"
+	fi, err := os.Stat(seg)
+	req.NoError(err)
+	size := fi.Size()
 
-		require.NoError(t, err)
+	// Torn tail: half-written record
+	f, err := os.OpenFile(seg, os.O_APPEND|os.O_WRONLY, 0600)
+	req.NoError(err)
+	_, err = f.Write([]byte{100, 0, 0, 0, 1, 2})
+	req.NoError(err)
+	req.NoError(f.Close())
 
-		req.EqualValues(v, "test1")
+	res, err := iqdb.CheckAOF("aofrec")
+	req.NoError(err)
+	req.True(res.TornTail)
+	req.Equal(3, res.Records)
+	req.Equal(size, res.ValidSize)
 
-		v, err = cl.Get("ttl1sec")
+	_, err = iqdb.Open("aofrec", &iqdb.Options{ShardCount: 10})
+	req.Error(err)
 
-		req.NoError(err)
+	aof, err = iqdb.Open("aofrec", &iqdb.Options{ShardCount: 10, AOFRecovery: iqdb.AOFRecoveryTruncateTail})
+	req.NoError(err)
+	v, err := aof.Get("k3")
+	req.NoError(err)
+	req.Equal("v3", v)
+	req.NoError(aof.Close())
 
-		req.EqualValues(v, "test2")
+	fi, err = os.Stat(seg)
+	req.NoError(err)
+	req.Equal(size, fi.Size())
 
-		v, err = cl.Get("ttl10sec")
+	// Bit rot in the last byte of the first record value
+	f, err = os.OpenFile(seg, os.O_RDWR, 0600)
+	req.NoError(err)
+	rec := int64(8 + 1 + 8 + 2 + 8 + 8 + 2)
+	_, err = f.WriteAt([]byte{'x'}, 8+rec-1)
+	req.NoError(err)
+	req.NoError(f.Close())
 
-		req.NoError(err)
+	res, err = iqdb.CheckAOF("aofrec")
+	req.NoError(err)
+	req.Equal(1, res.Corrupt)
+	req.Equal(2, res.Records)
 
-		req.EqualValues(v, "test3")
+	aof, err = iqdb.Open("aofrec", &iqdb.Options{ShardCount: 10, AOFRecovery: iqdb.AOFRecoverySkipCorrupt})
+	req.NoError(err)
+	_, err = aof.Get("k1")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+	v, err = aof.Get("k2")
+	req.NoError(err)
+	req.Equal("v2", v)
+	req.NoError(aof.Close())
+}
 
-		timeShift := time.Second * 2
+func TestAOFDeadlines(t *testing.T) {
+	req := require.New(t)
 
-		iqdb.SetTimeFunc(func() time.Time {
-			return time.Now().Add(timeShift)
-		})
+	os.RemoveAll("aofttl")
+	defer os.RemoveAll("aofttl")
 
-		db.ForeTTLRecheck()
-		_, err = cl.Get("ttl1sec")
+	now := time.Now()
+	iqdb.SetTimeFunc(func() time.Time {
+		return now
+	})
+	defer iqdb.SetTimeFunc(time.Now)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	aof, err := iqdb.Open("aofttl", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+	req.NoError(aof.Set("short", "v", time.Millisecond*500))
+	req.NoError(aof.Set("k", "v", time.Second*20))
+	req.NoError(aof.Set("nottl", "v"))
+	req.NoError(aof.Close())
 
-		v, err = cl.Get("ttl10sec")
+	// Restart 10 seconds later must not extend key lifetime
+	iqdb.SetTimeFunc(func() time.Time {
+		return now.Add(time.Second * 10)
+	})
 
-		req.NoError(err)
+	aof, err = iqdb.Open("aofttl", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-		req.EqualValues(v, "test3")
+	_, err = aof.Get("short")
+	req.Equal(iqdb.ErrKeyNotFound, err)
 
-		timeShift = timeShift + time.Minute
+	_, err = aof.Get("k")
+	req.NoError(err)
 
-		iqdb.SetTimeFunc(func() time.Time {
-			return time.Now().Add(timeShift)
-		})
+	iqdb.SetTimeFunc(func() time.Time {
+		return now.Add(time.Second * 21)
+	})
+	aof.ForeTTLRecheck()
 
-		db.ForeTTLRecheck()
+	_, err = aof.Get("k")
+	req.Equal(iqdb.ErrKeyNotFound, err)
 
-		_, err = cl.Get("ttl10sec")
+	_, err = aof.Get("nottl")
+	req.NoError(err)
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Close())
+}
 
-		req.NoError(cl.TTL("nottl", time.Second))
+func TestAOFExpiredReplay(t *testing.T) {
+	req := require.New(t)
 
-		timeShift = timeShift + time.Second*2
+	os.RemoveAll("aofexpired")
+	defer os.RemoveAll("aofexpired")
 
-		iqdb.SetTimeFunc(func() time.Time {
-			return time.Now().Add(timeShift)
-		})
-		db.ForeTTLRecheck()
+	now := time.Now()
+	iqdb.SetTimeFunc(func() time.Time {
+		return now
+	})
+	defer iqdb.SetTimeFunc(time.Now)
 
-		_, err = cl.Get("nottl")
+	aof, err := iqdb.Open("aofexpired", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+	req.NoError(aof.Set("k", "v", time.Second*2))
+	req.NoError(aof.Remove("k"))
+	_, err = aof.ListPush("l", "a")
+	req.NoError(err)
+	req.NoError(aof.TTL("l", time.Second*2))
+	_, err = aof.ListPush("l", "b")
+	req.NoError(err)
+	req.NoError(aof.Close())
 
-		req.Equal(iqdb.ErrKeyNotFound, err)
+	// Records that follow expired key must not fail replay
+	iqdb.SetTimeFunc(func() time.Time {
+		return now.Add(time.Hour)
+	})
+
+	aof, err = iqdb.Open("aofexpired", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+
+	_, err = aof.Get("k")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	_, err = aof.ListLen("l")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	// Keys created again after they were dropped on load or expired while running
+	_, err = aof.ListPush("l", "c")
+	req.NoError(err)
+	req.NoError(aof.Set("s", "v", time.Second*2))
 
+	iqdb.SetTimeFunc(func() time.Time {
+		return now.Add(time.Hour + time.Second*3)
 	})
-	if t.Failed() {
-		return
-	}
-}
+	aof.ForeTTLRecheck()
 
-func TestRedis(t *testing.T) {
-	var err error
+	_, err = aof.ListPush("s", "d")
+	req.NoError(err)
+	req.NoError(aof.Close())
 
-	req := require.New(t)
+	aof, err = iqdb.Open("aofexpired", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
 
-	req.NoError(redis.Set("k", "v", time.Second))
+	l, err := aof.ListRange("l", 0, -1)
+	req.NoError(err)
+	req.Equal([]string{"c"}, l)
 
-	k, err := redis.Get("k")
+	l, err = aof.ListRange("s", 0, -1)
 	req.NoError(err)
+	req.Equal([]string{"d"}, l)
 
-	req.Equal("v", k)
+	req.NoError(aof.Close())
+}
+
+func TestFsyncAlways(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofsync")
+	defer os.RemoveAll("aofsync")
+
+	aof, err := iqdb.Open("aofsync", &iqdb.Options{ShardCount: 10, FsyncPolicy: iqdb.FsyncAlways})
+	req.NoError(err)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				req.NoError(aof.Set(strconv.Itoa(i*10+j), "v"))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	st := aof.AOFStatus()
+	req.Equal(iqdb.FsyncAlways, st.FsyncPolicy)
+	req.False(st.LastFsync.IsZero())
+	req.Zero(st.FsyncLag)
+
+	// Everything acknowledged is on disk already
+	fi, err := os.Stat("aofsync/00000001.aof")
+	req.NoError(err)
+	req.Equal(st.Size, fi.Size())
+
+	req.NoError(aof.Close())
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofclose")
+	defer os.RemoveAll("aofclose")
+
+	aof, err := iqdb.Open("aofclose", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+
+	// Writes racing with Close either succeed and are on disk or fail with ErrClosed
+	written := make([][]string, 10)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := strconv.Itoa(i*100000 + j)
+				err := aof.Set(key, "v")
+				if err != nil {
+					req.Equal(iqdb.ErrClosed, err)
+					return
+				}
+				written[i] = append(written[i], key)
+			}
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	req.NoError(aof.Close())
+	wg.Wait()
+
+	req.Equal(iqdb.ErrClosed, aof.Set("k", "v"))
+	req.Equal(iqdb.ErrClosed, aof.Close())
+
+	aof, err = iqdb.Open("aofclose", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+
+	for _, keys := range written {
+		for _, key := range keys {
+			v, err := aof.Get(key)
+			req.NoError(err)
+			req.Equal("v", v)
+		}
+	}
+
+	req.NoError(aof.Close())
+}
+
+func TestAOFSegments(t *testing.T) {
+	req := require.New(t)
+
+	for _, f := range []string{"aofseg", "aofseg.snap", "aofmig"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	opts := &iqdb.Options{ShardCount: 10, SegmentSize: 200, SnapshotFile: "aofseg.snap"}
+	aof, err := iqdb.Open("aofseg", opts)
+	req.NoError(err)
+
+	for i := 0; i < 20; i++ {
+		_, err = aof.ListPush("l", strconv.Itoa(i))
+		req.NoError(err)
+	}
+
+	pos := aof.LogPosition()
+	req.True(pos.Segment > 1)
+
+	_, err = os.Stat("aofseg/00000001.aof")
+	req.NoError(err)
+
+	// Snapshot covers all segments written so far
+	req.NoError(aof.SaveSnapshot("aofseg.snap"))
+
+	_, err = os.Stat("aofseg/00000001.aof")
+	req.True(os.IsNotExist(err))
+
+	_, err = aof.ListPush("l", "20")
+	req.NoError(err)
+	last := aof.LogPosition().Segment
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofseg", opts)
+	req.NoError(err)
+
+	n, err := aof.ListLen("l")
+	req.NoError(err)
+	req.Equal(21, n)
+	req.NoError(aof.Close())
+
+	// Single file AOF becomes the first segment
+	b, err := ioutil.ReadFile(fmt.Sprintf("aofseg/%08d.aof", last))
+	req.NoError(err)
+	req.NoError(ioutil.WriteFile("aofmig", b, 0600))
+
+	aof, err = iqdb.Open("aofmig", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+	_, err = aof.ListLen("l")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	fi, err := os.Stat("aofmig")
+	req.NoError(err)
+	req.True(fi.IsDir())
+
+	// Torn segment which is not the last one is not truncated, nor are the later ones dropped
+	os.RemoveAll("aofseg")
+	os.Remove("aofseg.snap")
+	opts = &iqdb.Options{ShardCount: 10, SegmentSize: 200, AOFRecovery: iqdb.AOFRecoveryTruncateTail}
+	aof, err = iqdb.Open("aofseg", opts)
+	req.NoError(err)
+	for i := 0; i < 20; i++ {
+		_, err = aof.ListPush("l", strconv.Itoa(i))
+		req.NoError(err)
+	}
+	last = aof.LogPosition().Segment
+	req.True(last > 2)
+	req.NoError(aof.Close())
+
+	fi, err = os.Stat("aofseg/00000001.aof")
+	req.NoError(err)
+	req.NoError(os.Truncate("aofseg/00000001.aof", fi.Size()-1))
+
+	_, err = iqdb.Open("aofseg", opts)
+	req.True(errors.Is(err, iqdb.ErrAOFTornTail))
+
+	_, err = os.Stat(fmt.Sprintf("aofseg/%08d.aof", last))
+	req.NoError(err)
+}
+
+func testOps(t *testing.T, cl iqdb.Client) {
+	var err error
+
+	req := require.New(t)
+
+	t.Run("Standard KV", func(t *testing.T) {
+		_, err = cl.Get("unexisting")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		req.NoError(cl.Set("k", ""))
+
+		res, err := cl.Get("k")
+		req.NoError(err)
+
+		req.Equal("", res)
+
+		req.NoError(cl.Set("k", "val2"))
+
+		res, err = cl.Get("k")
+
+		req.NoError(err)
+
+		req.Equal("val2", res)
+
+		req.NoError(cl.Set("k2", "str1\n\rstr2"))
+
+		res, err = cl.Get("k2")
+
+		req.NoError(err)
+
+		req.Equal("str1\n\rstr2", res)
+
+		req.NoError(cl.Remove("k2"))
+
+		res, err = cl.Get("k2")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		req.NoError(cl.Set("ttl", "val", time.Minute))
+
+		res, err = cl.Get("ttl")
+
+		req.NoError(err)
+
+		req.Equal("val", res)
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Strings", func(t *testing.T) {
+		n, err := cl.Append("str", "Hello")
+
+		req.NoError(err)
+
+		req.Equal(5, n)
+
+		n, err = cl.Append("str", " World")
+
+		req.NoError(err)
+
+		req.Equal(11, n)
+
+		n, err = cl.StrLen("str")
+
+		req.NoError(err)
+
+		req.Equal(11, n)
+
+		n, err = cl.StrLen("unexisting")
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		v, err := cl.GetRange("str", 0, 4)
+
+		req.NoError(err)
+
+		req.Equal("Hello", v)
+
+		v, err = cl.GetRange("str", -5, -1)
+
+		req.NoError(err)
+
+		req.Equal("World", v)
+
+		v, err = cl.GetRange("str", 20, 30)
+
+		req.NoError(err)
+
+		req.Equal("", v)
+
+		n, err = cl.SetRange("str", 6, "Redis")
+
+		req.NoError(err)
+
+		req.Equal(11, n)
+
+		n, err = cl.SetRange("padded", 3, "x")
+
+		req.NoError(err)
+
+		req.Equal(4, n)
+
+		v, err = cl.Get("padded")
+
+		req.NoError(err)
+
+		req.Equal("\x00\x00\x00x", v)
+
+		_, err = cl.SetRange("padded", -1, "x")
+
+		req.Equal(iqdb.ErrOffsetOutOfRange, err)
+
+		v, err = cl.GetSet("str", "new")
+
+		req.NoError(err)
+
+		req.Equal("Hello Redis", v)
+
+		_, err = cl.GetSet("fresh", "v")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		v, err = cl.GetDel("fresh")
+
+		req.NoError(err)
+
+		req.Equal("v", v)
+
+		_, err = cl.GetDel("fresh")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		ok, err := cl.SetNX("lock", "owner1", time.Minute)
+
+		req.NoError(err)
+
+		req.True(ok)
+
+		ok, err = cl.SetNX("lock", "owner2")
+
+		req.NoError(err)
+
+		req.False(ok)
+
+		res, err := cl.SetWithOptions("lock", "owner2", iqdb.SetOptions{XX: true, Get: true, KeepTTL: true})
+
+		req.NoError(err)
+
+		req.Equal(iqdb.SetResult{Set: true, Existed: true, Old: "owner1"}, res)
+
+		res, err = cl.SetWithOptions("nolock", "v", iqdb.SetOptions{XX: true})
+
+		req.NoError(err)
+
+		req.False(res.Set)
+
+		_, err = cl.Get("nolock")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		res, err = cl.SetWithOptions("nolock", "v", iqdb.SetOptions{NX: true, Get: true, TTL: time.Minute})
+
+		req.NoError(err)
+
+		req.Equal(iqdb.SetResult{Set: true}, res)
+
+		_, err = cl.SetWithOptions("nolock", "v", iqdb.SetOptions{NX: true, XX: true})
+
+		req.Error(err)
+
+		_, err = cl.ListPush("strlist", "a")
+
+		req.NoError(err)
+
+		_, err = cl.Append("strlist", "a")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+
+		_, err = cl.SetWithOptions("strlist", "v", iqdb.SetOptions{Get: true})
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+
+		req.NoError(cl.Remove("strlist"))
+
+		req.NoError(cl.MSet("m1", "v1", "m2", "v2"))
+
+		vals, err := cl.MGet("m1", "unexisting", "m2")
+
+		req.NoError(err)
+
+		req.Equal([]string{"v1", "", "v2"}, vals)
+
+		ok, err = cl.MSetNX("m2", "x", "m3", "x")
+
+		req.NoError(err)
+
+		req.False(ok)
+
+		_, err = cl.Get("m3")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		ok, err = cl.MSetNX("m3", "v3", "m4", "v4")
+
+		req.NoError(err)
+
+		req.True(ok)
+
+		vals, err = cl.MGet("m3", "m4")
+
+		req.NoError(err)
+
+		req.Equal([]string{"v3", "v4"}, vals)
+
+		req.Equal(iqdb.ErrKeyValueMismatch, cl.MSet("m1"))
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Bitmaps", func(t *testing.T) {
+		old, err := cl.SetBit("bits", 7, 1)
+
+		req.NoError(err)
+
+		req.Equal(0, old)
+
+		old, err = cl.SetBit("bits", 7, 1)
+
+		req.NoError(err)
+
+		req.Equal(1, old)
+
+		v, err := cl.Get("bits")
+
+		req.NoError(err)
+
+		req.Equal("\x01", v)
+
+		_, err = cl.SetBit("bits", 17, 1)
+
+		req.NoError(err)
+
+		v, err = cl.Get("bits")
+
+		req.NoError(err)
+
+		req.Equal("\x01\x00\x40", v)
+
+		bit, err := cl.GetBit("bits", 17)
+
+		req.NoError(err)
+
+		req.Equal(1, bit)
+
+		bit, err = cl.GetBit("bits", 1000)
+
+		req.NoError(err)
+
+		req.Equal(0, bit)
+
+		bit, err = cl.GetBit("unexisting", 3)
+
+		req.NoError(err)
+
+		req.Equal(0, bit)
+
+		_, err = cl.SetBit("bits", -1, 1)
+
+		req.Equal(iqdb.ErrBitOffset, err)
+
+		_, err = cl.SetBit("bits", 1, 2)
+
+		req.Equal(iqdb.ErrBitValue, err)
+
+		req.NoError(cl.Set("bitstr", "foobar"))
+
+		n, err := cl.BitCount("bitstr", 0, -1)
+
+		req.NoError(err)
+
+		req.Equal(26, n)
+
+		n, err = cl.BitCount("bitstr", 1, 1)
+
+		req.NoError(err)
+
+		req.Equal(6, n)
+
+		n, err = cl.BitCount("unexisting", 0, -1)
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		req.NoError(cl.Set("bitpos", "\xff\xf0\x00"))
+
+		pos, err := cl.BitPos("bitpos", 0, 0)
+
+		req.NoError(err)
+
+		req.Equal(12, pos)
+
+		pos, err = cl.BitPos("bitpos", 1, 2)
+
+		req.NoError(err)
+
+		req.Equal(-1, pos)
+
+		req.NoError(cl.Set("bitones", "\xff\xff"))
+
+		pos, err = cl.BitPos("bitones", 0, 0)
+
+		req.NoError(err)
+
+		req.Equal(16, pos)
+
+		pos, err = cl.BitPos("bitones", 0, 0, -1)
+
+		req.NoError(err)
+
+		req.Equal(-1, pos)
+
+		pos, err = cl.BitPos("unexisting", 1, 0)
+
+		req.NoError(err)
+
+		req.Equal(-1, pos)
+
+		req.NoError(cl.Set("bitop1", "\xf0\x0f"))
+		req.NoError(cl.Set("bitop2", "\xff"))
+
+		n, err = cl.BitOp(iqdb.BitAnd, "bitres", "bitop1", "bitop2")
+
+		req.NoError(err)
+
+		req.Equal(2, n)
+
+		v, err = cl.Get("bitres")
+
+		req.NoError(err)
+
+		req.Equal("\xf0\x00", v)
+
+		_, err = cl.BitOp(iqdb.BitOr, "bitres", "bitop1", "bitop2", "unexisting")
+
+		req.NoError(err)
+
+		v, err = cl.Get("bitres")
+
+		req.NoError(err)
+
+		req.Equal("\xff\x0f", v)
+
+		_, err = cl.BitOp(iqdb.BitXor, "bitres", "bitop1", "bitop2")
+
+		req.NoError(err)
+
+		v, err = cl.Get("bitres")
+
+		req.NoError(err)
+
+		req.Equal("\x0f\x0f", v)
+
+		_, err = cl.BitOp(iqdb.BitNot, "bitres", "bitop1")
+
+		req.NoError(err)
+
+		v, err = cl.Get("bitres")
+
+		req.NoError(err)
+
+		req.Equal("\x0f\xf0", v)
+
+		n, err = cl.BitOp(iqdb.BitAnd, "bitres", "unexisting")
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		_, err = cl.Get("bitres")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.BitOp(iqdb.BitNot, "bitres", "bitop1", "bitop2")
+
+		req.Equal(iqdb.ErrBitOp, err)
+
+		_, err = cl.BitOp("NAND", "bitres", "bitop1")
+
+		req.Equal(iqdb.ErrBitOp, err)
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Counters", func(t *testing.T) {
+		n, err := cl.Incr("counter")
+
+		req.NoError(err)
+
+		req.EqualValues(1, n)
+
+		n, err = cl.IncrBy("counter", 41)
+
+		req.NoError(err)
+
+		req.EqualValues(42, n)
+
+		n, err = cl.Decr("counter")
+
+		req.NoError(err)
+
+		req.EqualValues(41, n)
+
+		v, err := cl.Get("counter")
+
+		req.NoError(err)
+
+		req.Equal("41", v)
+
+		f, err := cl.IncrByFloat("counter", 0.5)
+
+		req.NoError(err)
+
+		req.Equal(41.5, f)
+
+		_, err = cl.Incr("counter")
+
+		req.Equal(iqdb.ErrNotInteger, err)
+
+		req.NoError(cl.Set("counter", strconv.FormatInt(math.MaxInt64, 10)))
+
+		_, err = cl.Incr("counter")
+
+		req.Equal(iqdb.ErrIncrOverflow, err)
+
+		req.NoError(cl.Set("counter", ""))
+
+		_, err = cl.Incr("counter")
+
+		req.Equal(iqdb.ErrNotInteger, err)
+
+		n, err = cl.HashIncrBy("hcounter", "f", 5)
+
+		req.NoError(err)
+
+		req.EqualValues(5, n)
+
+		n, err = cl.HashIncrBy("hcounter", "f", -7)
+
+		req.NoError(err)
+
+		req.EqualValues(-2, n)
+
+		_, err = cl.HashSet("hcounter", "s", "str")
+
+		req.NoError(err)
+
+		_, err = cl.HashIncrBy("hcounter", "s", 1)
+
+		req.Equal(iqdb.ErrNotInteger, err)
+
+		_, err = cl.ListPush("lcounter", "a")
+
+		req.NoError(err)
+
+		_, err = cl.Incr("lcounter")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Hashes", func(t *testing.T) {
+		_, err := cl.HashGetAll("unexisting")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.HashGet("unexisting", "213")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.HashDel("unexisting", "123")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.HashKeys("unexisting")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		n, err := cl.HashSet("hash", "f1", "1")
+
+		req.NoError(err)
+
+		req.Equal(1, n)
+
+		h, err := cl.HashGetAll("hash")
+
+		req.Equal(map[string]string{"f1": "1"}, h)
+
+		v, err := cl.HashGet("hash", "f1")
+
+		req.Equal(v, "1")
+
+		n, err = cl.HashDel("hash", "unex")
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		keys, err := cl.HashKeys("hash")
+
+		req.Equal([]string{"f1"}, keys)
+
+		_, err = cl.HashDel("hash", "f1")
+
+		req.NoError(err)
+
+		_, err = cl.HashSet("hash", "k1")
+
+		req.Equal(iqdb.ErrHashKeyValueMismatch, err)
+
+		_, err = cl.HashSet("hash", "k1", "v1", "k2", "v2")
+
+		req.NoError(err)
+
+		_, err = cl.HashSet("hash", "k3", "v3")
+
+		req.NoError(err)
+
+		h, err = cl.HashGetAll("hash")
+
+		req.Equal(map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}, h)
+
+		n, err = cl.HashSet("hash", "k3", "v3.1", "k4", "v4")
+
+		req.NoError(err)
+
+		req.Equal(1, n)
+
+		ok, err := cl.HashSetNX("hash", "k4", "other")
+
+		req.NoError(err)
+
+		req.False(ok)
+
+		ok, err = cl.HashSetNX("hash", "k5", "v5")
+
+		req.NoError(err)
+
+		req.True(ok)
+
+		n, err = cl.HashLen("hash")
+
+		req.NoError(err)
+
+		req.Equal(5, n)
+
+		ok, err = cl.HashExists("hash", "k5")
+
+		req.NoError(err)
+
+		req.True(ok)
+
+		ok, err = cl.HashExists("unexisting", "k5")
+
+		req.NoError(err)
+
+		req.False(ok)
+
+		n, err = cl.HashStrLen("hash", "k3")
+
+		req.NoError(err)
+
+		req.Equal(4, n)
+
+		n, err = cl.HashStrLen("hash", "unex")
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		vals, err := cl.HashMultiGet("hash", "k1", "unex", "k4")
+
+		req.NoError(err)
+
+		req.Equal([]string{"v1", "", "v4"}, vals)
+
+		vals, err = cl.HashValues("hash")
+
+		req.NoError(err)
+
+		req.ElementsMatch([]string{"v1", "v2", "v3.1", "v4", "v5"}, vals)
+
+		cursor, pairs, err := cl.HashScan("hash", 0, "", 2)
+
+		req.NoError(err)
+
+		req.Equal(2, cursor)
+
+		req.Equal([]string{"k1", "v1", "k2", "v2"}, pairs)
+
+		cursor, pairs, err = cl.HashScan("hash", cursor, "k[45]", 10)
+
+		req.NoError(err)
+
+		req.Equal(0, cursor)
+
+		req.Equal([]string{"k4", "v4", "k5", "v5"}, pairs)
+
+		n, err = cl.HashDel("hash", "k1", "k2", "unex")
+
+		req.NoError(err)
+
+		req.Equal(2, n)
+
+		req.NoError(cl.Remove("hash"))
+
+		_, err = cl.HashGetAll("hash")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Lists", func(t *testing.T) {
+		_, err := cl.ListLen("unexisting")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.ListIndex("unexisting", 1)
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.ListPop("unexisting")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		_, err = cl.ListRange("unexisting", 0, 10)
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		c, err := cl.ListPush("list", "a", "b", "c", "d")
+
+		req.NoError(err)
+
+		req.EqualValues(4, c)
+
+		l, err := cl.ListPop("list")
+
+		req.NoError(err)
+
+		req.Equal("d", l)
+
+		l, err = cl.ListIndex("list", 1)
+
+		req.NoError(err)
+
+		req.EqualValues("b", l)
+
+		l, err = cl.ListIndex("list", -1)
+
+		req.NoError(err)
+
+		req.Equal("c", l)
+
+		l, err = cl.ListIndex("list", 10)
+
+		req.Equal(iqdb.ErrListIndexError, err)
+
+		lr, err := cl.ListRange("list", 0, 10)
+
+		req.NoError(err)
+
+		req.Equal([]string{"a", "b", "c"}, lr)
+
+		lr, err = cl.ListRange("list", -2, -1)
+
+		req.NoError(err)
+
+		req.Equal([]string{"b", "c"}, lr)
+
+		lr, err = cl.ListRange("list", 5, 10)
+
+		req.NoError(err)
+
+		req.Empty(lr)
+
+		c, err = cl.ListPushLeft("list", "x", "y")
+
+		req.NoError(err)
+
+		req.Equal(5, c)
+
+		l, err = cl.ListPopLeft("list")
+
+		req.NoError(err)
+
+		req.Equal("y", l)
+
+		c, err = cl.ListInsert("list", true, "b", "b0")
+
+		req.NoError(err)
+
+		req.Equal(5, c)
+
+		c, err = cl.ListInsert("list", false, "c", "c1")
+
+		req.NoError(err)
+
+		req.Equal(6, c)
+
+		c, err = cl.ListInsert("list", true, "none", "z")
+
+		req.NoError(err)
+
+		req.Equal(-1, c)
+
+		req.NoError(cl.ListSet("list", -1, "last"))
+
+		req.Equal(iqdb.ErrListIndexError, cl.ListSet("list", 6, "z"))
+
+		lr, err = cl.ListRange("list", 0, -1)
+
+		req.NoError(err)
+
+		req.Equal([]string{"x", "a", "b0", "b", "c", "last"}, lr)
+
+		_, err = cl.ListPush("list", "a", "x", "a")
+
+		req.NoError(err)
+
+		c, err = cl.ListRemove("list", -2, "a")
+
+		req.NoError(err)
+
+		req.Equal(2, c)
+
+		c, err = cl.ListRemove("list", 0, "x")
+
+		req.NoError(err)
+
+		req.Equal(2, c)
+
+		lr, err = cl.ListRange("list", 0, -1)
+
+		req.NoError(err)
+
+		req.Equal([]string{"a", "b0", "b", "c", "last"}, lr)
+
+		req.NoError(cl.ListTrim("list", 1, -2))
+
+		lr, err = cl.ListRange("list", 0, -1)
+
+		req.NoError(err)
+
+		req.Equal([]string{"b0", "b", "c"}, lr)
+
+		req.NoError(cl.ListTrim("list", 5, 10))
+
+		_, err = cl.ListLen("list")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, _, err = cl.ListBlockingPopLeft(ctx, "queue")
+		cancel()
+
+		req.Equal(context.DeadlineExceeded, err)
+
+		_, err = cl.ListPush("queue", "j1", "j2")
+
+		req.NoError(err)
+
+		k, l, err := cl.ListBlockingPopLeft(context.Background(), "none", "queue")
+
+		req.NoError(err)
+
+		req.Equal("queue", k)
+
+		req.Equal("j1", l)
+
+		l, err = cl.ListBlockingMove(context.Background(), "queue", "processing", false, true)
+
+		req.NoError(err)
+
+		req.Equal("j2", l)
+
+		l, err = cl.ListMove("processing", "processing", true, false)
+
+		req.NoError(err)
+
+		req.Equal("j2", l)
+
+		_, err = cl.ListMove("queue", "processing", true, true)
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Sets", func(t *testing.T) {
+		members, err := cl.SetMembers("unexisting")
+
+		req.NoError(err)
+
+		req.Empty(members)
+
+		n, err := cl.SetAdd("tags", "a", "b", "c", "a")
+
+		req.NoError(err)
+
+		req.Equal(3, n)
+
+		n, err = cl.SetAdd("tags", "c", "d")
+
+		req.NoError(err)
+
+		req.Equal(1, n)
+
+		n, err = cl.SetCard("tags")
+
+		req.NoError(err)
+
+		req.Equal(4, n)
+
+		ok, err := cl.SetIsMember("tags", "b")
+
+		req.NoError(err)
+
+		req.True(ok)
+
+		ok, err = cl.SetIsMember("tags", "x")
+
+		req.NoError(err)
+
+		req.False(ok)
+
+		n, err = cl.SetRemove("tags", "a", "x")
+
+		req.NoError(err)
+
+		req.Equal(1, n)
+
+		members, err = cl.SetMembers("tags")
+
+		req.NoError(err)
+
+		req.ElementsMatch([]string{"b", "c", "d"}, members)
+
+		_, err = cl.SetAdd("other", "c", "d", "e")
+
+		req.NoError(err)
+
+		members, err = cl.SetInter("tags", "other")
+
+		req.NoError(err)
+
+		req.ElementsMatch([]string{"c", "d"}, members)
+
+		members, err = cl.SetUnion("tags", "other", "unexisting")
+
+		req.NoError(err)
+
+		req.ElementsMatch([]string{"b", "c", "d", "e"}, members)
+
+		members, err = cl.SetDiff("tags", "other")
+
+		req.NoError(err)
+
+		req.ElementsMatch([]string{"b"}, members)
+
+		members, err = cl.SetInter("tags", "unexisting")
+
+		req.NoError(err)
+
+		req.Empty(members)
+
+		req.NoError(cl.Set("str", "v"))
+
+		_, err = cl.SetAdd("str", "a")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+
+		_, err = cl.SetUnion("tags", "str")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+
+		// Set is removed with its last member
+		n, err = cl.SetRemove("other", "c", "d", "e")
+
+		req.NoError(err)
+
+		req.Equal(3, n)
+
+		_, err = cl.Get("other")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	t.Run("Sorted sets", func(t *testing.T) {
+		members, err := cl.SortedSetRange("unexisting", 0, -1)
+
+		req.NoError(err)
+
+		req.Empty(members)
+
+		_, err = cl.SortedSetScore("unexisting", "a")
+
+		req.Equal(iqdb.ErrSortedSetMemberNotFound, err)
+
+		n, err := cl.SortedSetAdd("board",
+			iqdb.ScoredMember{Member: "carol", Score: 30},
+			iqdb.ScoredMember{Member: "alice", Score: 10},
+			iqdb.ScoredMember{Member: "bob", Score: 20},
+			iqdb.ScoredMember{Member: "dave", Score: 20},
+		)
+
+		req.NoError(err)
+
+		req.Equal(4, n)
+
+		// Score update is not a new member
+		n, err = cl.SortedSetAdd("board", iqdb.ScoredMember{Member: "alice", Score: 5})
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		score, err := cl.SortedSetScore("board", "alice")
+
+		req.NoError(err)
+
+		req.Equal(5.0, score)
+
+		rank, err := cl.SortedSetRank("board", "dave")
+
+		req.NoError(err)
+
+		req.Equal(2, rank)
+
+		_, err = cl.SortedSetRank("board", "eve")
+
+		req.Equal(iqdb.ErrSortedSetMemberNotFound, err)
+
+		members, err = cl.SortedSetRange("board", 0, -1)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.ScoredMember{{"alice", 5}, {"bob", 20}, {"dave", 20}, {"carol", 30}}, members)
+
+		members, err = cl.SortedSetRevRange("board", 0, 1)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.ScoredMember{{"carol", 30}, {"dave", 20}}, members)
+
+		members, err = cl.SortedSetRange("board", -2, 100)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.ScoredMember{{"dave", 20}, {"carol", 30}}, members)
+
+		members, err = cl.SortedSetRangeByScore("board", 10, math.Inf(1), 1, 1)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.ScoredMember{{"dave", 20}}, members)
+
+		members, err = cl.SortedSetRangeByScore("board", math.Inf(-1), 20, 0, -1)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.ScoredMember{{"alice", 5}, {"bob", 20}, {"dave", 20}}, members)
+
+		score, err = cl.SortedSetIncrBy("board", "alice", 30.5)
+
+		req.NoError(err)
+
+		req.Equal(35.5, score)
+
+		score, err = cl.SortedSetIncrBy("board", "eve", -1)
+
+		req.NoError(err)
+
+		req.Equal(-1.0, score)
+
+		n, err = cl.SortedSetRemove("board", "bob", "unexisting")
+
+		req.NoError(err)
+
+		req.Equal(1, n)
+
+		n, err = cl.SortedSetCard("board")
+
+		req.NoError(err)
+
+		req.Equal(4, n)
+
+		members, err = cl.SortedSetRevRange("board", 0, 0)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.ScoredMember{{"alice", 35.5}}, members)
+
+		_, err = cl.SortedSetAdd("str", iqdb.ScoredMember{Member: "a", Score: 1})
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+	})
+
+	t.Run("HyperLogLogs", func(t *testing.T) {
+		changed, err := cl.HyperLogLogAdd("hll", "a", "b", "c", "d", "e", "f", "g")
+
+		req.NoError(err)
+
+		req.True(changed)
+
+		changed, err = cl.HyperLogLogAdd("hll", "a", "b")
+
+		req.NoError(err)
+
+		req.False(changed)
+
+		n, err := cl.HyperLogLogCount("hll")
+
+		req.NoError(err)
+
+		req.Equal(7, n)
+
+		n, err = cl.HyperLogLogCount("unexisting")
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		changed, err = cl.HyperLogLogAdd("hllempty")
+
+		req.NoError(err)
+
+		req.True(changed)
+
+		n, err = cl.HyperLogLogCount("hllempty")
+
+		req.NoError(err)
+
+		req.Equal(0, n)
+
+		_, err = cl.HyperLogLogAdd("hll2", "f", "g", "h", "i")
+
+		req.NoError(err)
+
+		n, err = cl.HyperLogLogCount("hll", "hll2", "unexisting")
+
+		req.NoError(err)
+
+		req.Equal(9, n)
+
+		req.NoError(cl.HyperLogLogMerge("hllmerged", "hll", "hll2"))
+
+		n, err = cl.HyperLogLogCount("hllmerged")
+
+		req.NoError(err)
+
+		req.Equal(9, n)
+
+		_, err = cl.HyperLogLogAdd("hll2", "j")
+
+		req.NoError(err)
+
+		req.NoError(cl.HyperLogLogMerge("hllmerged", "hll2"))
+
+		n, err = cl.HyperLogLogCount("hllmerged")
+
+		req.NoError(err)
+
+		req.Equal(10, n)
+
+		_, err = cl.HyperLogLogAdd("str", "a")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+
+		_, err = cl.HyperLogLogCount("hll", "str")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+
+		req.Equal(iqdb.ErrKeyTypeError, cl.HyperLogLogMerge("str", "hll"))
+	})
+
+	t.Run("Streams", func(t *testing.T) {
+		id, err := cl.StreamAdd("stream", "1-1", -1, "type", "login", "user", "1")
+
+		req.NoError(err)
+
+		req.Equal("1-1", id)
+
+		id, err = cl.StreamAdd("stream", "1-*", -1, "type", "logout")
+
+		req.NoError(err)
+
+		req.Equal("1-2", id)
+
+		id, err = cl.StreamAdd("stream", "5", -1, "type", "login")
+
+		req.NoError(err)
+
+		req.Equal("5-0", id)
+
+		_, err = cl.StreamAdd("stream", "5-0", -1, "type", "login")
+
+		req.Equal(iqdb.ErrStreamIDTooSmall, err)
+
+		_, err = cl.StreamAdd("stream", "*", -1, "type")
+
+		req.Equal(iqdb.ErrStreamFields, err)
+
+		id, err = cl.StreamAdd("stream", "*", -1, "type", "ping")
+
+		req.NoError(err)
+
+		entries, err := cl.StreamRange("stream", "-", "+", -1)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.StreamEntry{
+			{ID: "1-1", Fields: []string{"type", "login", "user", "1"}},
+			{ID: "1-2", Fields: []string{"type", "logout"}},
+			{ID: "5-0", Fields: []string{"type", "login"}},
+			{ID: id, Fields: []string{"type", "ping"}},
+		}, entries)
+
+		entries, err = cl.StreamRange("stream", "1", "5", -1)
+
+		req.NoError(err)
+
+		req.Len(entries, 3)
+
+		entries, err = cl.StreamRevRange("stream", "+", "-", 2)
+
+		req.NoError(err)
+
+		req.Equal(id, entries[0].ID)
+
+		req.Equal("5-0", entries[1].ID)
+
+		entries, err = cl.StreamRange("unexisting", "-", "+", -1)
+
+		req.NoError(err)
+
+		req.Len(entries, 0)
+
+		n, err := cl.StreamLen("stream")
+
+		req.NoError(err)
+
+		req.Equal(4, n)
+
+		_, err = cl.StreamAdd("stream", "*", 3, "type", "ping")
+
+		req.NoError(err)
+
+		n, err = cl.StreamTrim("stream", 2)
+
+		req.NoError(err)
+
+		req.Equal(1, n)
+
+		n, err = cl.StreamLen("stream")
+
+		req.NoError(err)
+
+		req.Equal(2, n)
+
+		// Consumer groups
+		req.Equal(iqdb.ErrKeyNotFound, cl.StreamGroupCreate("queue", "workers", "$", false))
+
+		req.NoError(cl.StreamGroupCreate("queue", "workers", "$", true))
+
+		req.Equal(iqdb.ErrStreamGroupExists, cl.StreamGroupCreate("queue", "workers", "0", false))
+
+		for i := 1; i <= 3; i++ {
+			_, err = cl.StreamAdd("queue", strconv.Itoa(i), -1, "job", strconv.Itoa(i))
+
+			req.NoError(err)
+		}
+
+		entries, err = cl.StreamReadGroup("queue", "workers", "alice", ">", 2)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.StreamEntry{
+			{ID: "1-0", Fields: []string{"job", "1"}},
+			{ID: "2-0", Fields: []string{"job", "2"}},
+		}, entries)
+
+		entries, err = cl.StreamReadGroup("queue", "workers", "bob", ">", 0)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.StreamEntry{{ID: "3-0", Fields: []string{"job", "3"}}}, entries)
+
+		entries, err = cl.StreamReadGroup("queue", "workers", "bob", ">", 0)
+
+		req.NoError(err)
+
+		req.Len(entries, 0)
+
+		// History of consumer
+		entries, err = cl.StreamReadGroup("queue", "workers", "alice", "0", 0)
+
+		req.NoError(err)
+
+		req.Len(entries, 2)
+
+		sum, err := cl.StreamPending("queue", "workers")
+
+		req.NoError(err)
+
+		req.Equal(iqdb.StreamPendingSummary{
+			Count:     3,
+			First:     "1-0",
+			Last:      "3-0",
+			Consumers: map[string]int{"alice": 2, "bob": 1},
+		}, sum)
+
+		n, err = cl.StreamAck("queue", "workers", "1-0", "3-0", "9-0")
+
+		req.NoError(err)
+
+		req.Equal(2, n)
+
+		pending, err := cl.StreamPendingRange("queue", "workers", "-", "+", -1, "")
+
+		req.NoError(err)
+
+		req.Len(pending, 1)
+
+		req.Equal("2-0", pending[0].ID)
+
+		req.Equal("alice", pending[0].Consumer)
+
+		req.Equal(1, pending[0].Deliveries)
+
+		pending, err = cl.StreamPendingRange("queue", "workers", "-", "+", 10, "bob")
+
+		req.NoError(err)
+
+		req.Len(pending, 0)
+
+		// Trimmed pending entry has no fields
+		_, err = cl.StreamTrim("queue", 0)
+
+		req.NoError(err)
+
+		entries, err = cl.StreamReadGroup("queue", "workers", "alice", "0", 0)
+
+		req.NoError(err)
+
+		req.Equal([]iqdb.StreamEntry{{ID: "2-0"}}, entries)
+
+		_, err = cl.StreamReadGroup("queue", "nogroup", "alice", ">", 0)
+
+		req.Equal(iqdb.ErrStreamNoGroup, err)
+
+		ok, err := cl.StreamGroupDestroy("queue", "workers")
+
+		req.NoError(err)
+
+		req.True(ok)
+
+		ok, err = cl.StreamGroupDestroy("queue", "workers")
+
+		req.NoError(err)
+
+		req.False(ok)
+
+		_, err = cl.StreamAdd("str", "*", -1, "a", "b")
+
+		req.Equal(iqdb.ErrKeyTypeError, err)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		req.NoError(cl.Set("nottl", "test1"))
+		req.NoError(cl.Set("ttl1sec", "test2", time.Second*1))
+		req.NoError(cl.Set("ttl10sec", "test3", time.Second*10))
+
+		v, err := cl.Get("nottl")
+
+		require.NoError(t, err)
+
+		req.EqualValues(v, "test1")
+
+		v, err = cl.Get("ttl1sec")
+
+		req.NoError(err)
+
+		req.EqualValues(v, "test2")
+
+		v, err = cl.Get("ttl10sec")
+
+		req.NoError(err)
+
+		req.EqualValues(v, "test3")
+
+		timeShift := time.Second * 2
+
+		iqdb.SetTimeFunc(func() time.Time {
+			return time.Now().Add(timeShift)
+		})
+
+		db.ForeTTLRecheck()
+		_, err = cl.Get("ttl1sec")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		v, err = cl.Get("ttl10sec")
+
+		req.NoError(err)
+
+		req.EqualValues(v, "test3")
+
+		timeShift = timeShift + time.Minute
+
+		iqdb.SetTimeFunc(func() time.Time {
+			return time.Now().Add(timeShift)
+		})
+
+		db.ForeTTLRecheck()
+
+		_, err = cl.Get("ttl10sec")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+		req.NoError(cl.TTL("nottl", time.Second))
+
+		timeShift = timeShift + time.Second*2
+
+		iqdb.SetTimeFunc(func() time.Time {
+			return time.Now().Add(timeShift)
+		})
+		db.ForeTTLRecheck()
+
+		_, err = cl.Get("nottl")
+
+		req.Equal(iqdb.ErrKeyNotFound, err)
+
+	})
+	if t.Failed() {
+		return
+	}
+}
+
+func TestSets(t *testing.T) {
+	req := require.New(t)
+
+	for _, f := range []string{"aofset", "aofset.snap", "aofset.jsonl"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofset.snap"}
+	aof, err := iqdb.Open("aofset", opts)
+	req.NoError(err)
+
+	_, err = aof.SetAdd("s", "a", "b", "c")
+	req.NoError(err)
+	_, err = aof.SetRemove("s", "b")
+	req.NoError(err)
+	_, err = aof.SetAdd("gone", "x")
+	req.NoError(err)
+	_, err = aof.SetRemove("gone", "x")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	members := func(aof *iqdb.IqDB) {
+		m, err := aof.SetMembers("s")
+		req.NoError(err)
+		req.ElementsMatch([]string{"a", "c"}, m)
+
+		n, err := aof.SetCard("gone")
+		req.NoError(err)
+		req.Zero(n)
+	}
+
+	// Replay
+	aof, err = iqdb.Open("aofset", opts)
+	req.NoError(err)
+	members(aof)
+
+	// Rewrite and snapshot
+	req.NoError(aof.RewriteAOF())
+	req.NoError(aof.SaveSnapshot("aofset.snap"))
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofset", opts)
+	req.NoError(err)
+	members(aof)
+
+	f, err := os.Create("aofset.jsonl")
+	req.NoError(err)
+	req.NoError(aof.Export(f))
+	req.NoError(f.Close())
+	req.NoError(aof.Remove("s"))
+
+	f, err = os.Open("aofset.jsonl")
+	req.NoError(err)
+	req.NoError(aof.Import(f))
+	req.NoError(f.Close())
+	members(aof)
+
+	req.NoError(aof.Close())
+}
+
+func TestSetAddRemoveRace(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofsetrace")
+	defer os.RemoveAll("aofsetrace")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofsetrace", opts)
+	req.NoError(err)
+
+	// Set is removed with its last member and created again all the time,
+	// add must not go to the removed one
+	var removed int
+	mx := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				m := fmt.Sprintf("%d-%d", i, j)
+				_, err := aof.SetAdd("s", m)
+				req.NoError(err)
+
+				n, err := aof.SetRemove("s", m)
+				req.NoError(err)
+				mx.Lock()
+				removed += n
+				mx.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	req.Equal(4000, removed)
+	members, err := aof.SetMembers("s")
+	req.NoError(err)
+	req.Empty(members)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofsetrace", opts)
+	req.NoError(err)
+
+	members, err = aof.SetMembers("s")
+	req.NoError(err)
+	req.Empty(members)
+	req.NoError(aof.Close())
+}
+
+func TestSortedSets(t *testing.T) {
+	req := require.New(t)
+
+	for _, f := range []string{"aofzset", "aofzset.snap"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofzset.snap"}
+	aof, err := iqdb.Open("aofzset", opts)
+	req.NoError(err)
+
+	_, err = aof.SortedSetAdd("z", iqdb.ScoredMember{Member: "a", Score: 1}, iqdb.ScoredMember{Member: "b", Score: 2},
+		iqdb.ScoredMember{Member: "c", Score: math.Inf(1)})
+	req.NoError(err)
+	_, err = aof.SortedSetIncrBy("z", "a", 2.25)
+	req.NoError(err)
+	_, err = aof.SortedSetRemove("z", "b")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	expected := []iqdb.ScoredMember{{"a", 3.25}, {"c", math.Inf(1)}}
+
+	aof, err = iqdb.Open("aofzset", opts)
+	req.NoError(err)
+
+	members, err := aof.SortedSetRange("z", 0, -1)
+	req.NoError(err)
+	req.Equal(expected, members)
+
+	req.NoError(aof.RewriteAOF())
+	req.NoError(aof.SaveSnapshot("aofzset.snap"))
+
+	var buf bytes.Buffer
+	req.NoError(aof.Export(&buf))
+	req.Contains(buf.String(), `"zset":{"a":"3.25","c":"+Inf"}`)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofzset", opts)
+	req.NoError(err)
+
+	members, err = aof.SortedSetRange("z", 0, -1)
+	req.NoError(err)
+	req.Equal(expected, members)
+
+	req.NoError(aof.Remove("z"))
+	req.NoError(aof.Import(&buf))
+
+	members, err = aof.SortedSetRange("z", 0, -1)
+	req.NoError(err)
+	req.Equal(expected, members)
+
+	req.NoError(aof.Close())
+}
+
+func TestSortedSetAddRemoveRace(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofzsetrace")
+	defer os.RemoveAll("aofzsetrace")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofzsetrace", opts)
+	req.NoError(err)
+
+	// Sorted set is removed with its last member and created again all the time,
+	// add must not go to the removed one
+	var removed int
+	mx := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				m := fmt.Sprintf("%d-%d", i, j)
+				_, err := aof.SortedSetAdd("z", iqdb.ScoredMember{Member: m, Score: float64(j)})
+				req.NoError(err)
+
+				n, err := aof.SortedSetRemove("z", m)
+				req.NoError(err)
+				mx.Lock()
+				removed += n
+				mx.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	req.Equal(4000, removed)
+	n, err := aof.SortedSetCard("z")
+	req.NoError(err)
+	req.Equal(0, n)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofzsetrace", opts)
+	req.NoError(err)
+
+	n, err = aof.SortedSetCard("z")
+	req.NoError(err)
+	req.Equal(0, n)
+	req.NoError(aof.Close())
+}
+
+func TestHyperLogLogs(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofhll")
+	defer os.RemoveAll("aofhll")
+
+	for _, f := range []string{"aofhll.snap", "aofhll.snap.tmp"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofhll.snap"}
+	aof, err := iqdb.Open("aofhll", opts)
+	req.NoError(err)
+
+	// The large one turns dense, the small one stays sparse
+	for i := 0; i < 20000; i += 100 {
+		visitors := make([]string, 0, 100)
+		for j := i; j < i+100; j++ {
+			visitors = append(visitors, "user:"+strconv.Itoa(j))
+		}
+
+		_, err = aof.HyperLogLogAdd("page:home", visitors...)
+		req.NoError(err)
+	}
+
+	_, err = aof.HyperLogLogAdd("page:about", "user:1", "user:2", "user:20001")
+	req.NoError(err)
+
+	req.NoError(aof.HyperLogLogMerge("site", "page:home", "page:about"))
+	req.NoError(aof.TTL("site", time.Hour))
+
+	home, err := aof.HyperLogLogCount("page:home")
+	req.NoError(err)
+	req.InEpsilon(20000, home, 0.02)
+
+	site, err := aof.HyperLogLogCount("site")
+	req.NoError(err)
+	req.InEpsilon(20001, site, 0.02)
+	req.NoError(aof.Close())
+
+	check := func() {
+		n, err := aof.HyperLogLogCount("page:home")
+		req.NoError(err)
+		req.Equal(home, n)
+
+		n, err = aof.HyperLogLogCount("page:about")
+		req.NoError(err)
+		req.Equal(3, n)
+
+		n, err = aof.HyperLogLogCount("site")
+		req.NoError(err)
+		req.Equal(site, n)
+	}
+
+	aof, err = iqdb.Open("aofhll", opts)
+	req.NoError(err)
+	check()
+
+	req.NoError(aof.RewriteAOF())
+	req.NoError(aof.SaveSnapshot("aofhll.snap"))
+
+	var buf bytes.Buffer
+	req.NoError(aof.Export(&buf))
+	req.Contains(buf.String(), `"type":"hll"`)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofhll", opts)
+	req.NoError(err)
+	check()
+
+	for _, key := range []string{"page:home", "page:about", "site"} {
+		req.NoError(aof.Remove(key))
+	}
+
+	req.NoError(aof.Import(&buf))
+	check()
+
+	// Merge keeps expiration of destination
+	timeShift := 2 * time.Hour
+	iqdb.SetTimeFunc(func() time.Time {
+		return time.Now().Add(timeShift)
+	})
+	defer iqdb.SetTimeFunc(time.Now)
+
+	aof.ForeTTLRecheck()
+	n, err := aof.HyperLogLogCount("site")
+	req.NoError(err)
+	req.Equal(0, n)
+
+	req.NoError(aof.Close())
+}
+
+func TestStreams(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofstream")
+	defer os.RemoveAll("aofstream")
+
+	for _, f := range []string{"aofstream.snap", "aofstream.snap.tmp"} {
+		os.Remove(f)
+		defer os.Remove(f)
+	}
+
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofstream.snap"}
+	aof, err := iqdb.Open("aofstream", opts)
+	req.NoError(err)
+
+	req.NoError(aof.StreamGroupCreate("events", "mailer", "$", true))
+	req.NoError(aof.StreamGroupCreate("events", "billing", "$", false))
+
+	ids := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		id, err := aof.StreamAdd("events", "*", 4, "order", strconv.Itoa(i))
+		req.NoError(err)
+		ids = append(ids, id)
+	}
+
+	// Generated IDs grow even within a millisecond, the oldest entry is trimmed
+	entries, err := aof.StreamRange("events", "-", "+", -1)
+	req.NoError(err)
+	req.Len(entries, 4)
+	for i, e := range entries {
+		req.Equal(ids[i+1], e.ID)
+	}
+
+	entries, err = aof.StreamReadGroup("events", "mailer", "m1", ">", 2)
+	req.NoError(err)
+	req.Len(entries, 2)
+	req.Equal(ids[1], entries[0].ID)
+
+	_, err = aof.StreamReadGroup("events", "mailer", "m2", ">", 0)
+	req.NoError(err)
+
+	n, err := aof.StreamAck("events", "mailer", ids[1])
+	req.NoError(err)
+	req.Equal(1, n)
+
+	_, err = aof.StreamGroupDestroy("events", "billing")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	check := func() {
+		entries, err := aof.StreamRange("events", "-", "+", -1)
+		req.NoError(err)
+		req.Len(entries, 4)
+		req.Equal(ids[1], entries[0].ID)
+		req.Equal([]string{"order", "4"}, entries[3].Fields)
+
+		sum, err := aof.StreamPending("events", "mailer")
+		req.NoError(err)
+		req.Equal(iqdb.StreamPendingSummary{
+			Count:     3,
+			First:     ids[2],
+			Last:      ids[4],
+			Consumers: map[string]int{"m1": 1, "m2": 2},
+		}, sum)
+
+		_, err = aof.StreamPending("events", "billing")
+		req.Equal(iqdb.ErrStreamNoGroup, err)
+
+		// The last ID stays, so new IDs are never less than trimmed ones
+		_, err = aof.StreamAdd("events", ids[4], -1, "order", "dup")
+		req.Equal(iqdb.ErrStreamIDTooSmall, err)
+	}
+
+	aof, err = iqdb.Open("aofstream", opts)
+	req.NoError(err)
+	check()
+
+	req.NoError(aof.RewriteAOF())
+	req.NoError(aof.SaveSnapshot("aofstream.snap"))
+
+	var buf bytes.Buffer
+	req.NoError(aof.Export(&buf))
+	req.Contains(buf.String(), `"type":"stream"`)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofstream", opts)
+	req.NoError(err)
+	check()
+
+	req.NoError(aof.Remove("events"))
+	req.NoError(aof.Import(&buf))
+	check()
+
+	// Blocking reader gets the entry added after it started waiting
+	got := make(chan []iqdb.StreamEntry)
+	go func() {
+		entries, err := aof.StreamBlockingReadGroup(context.Background(), "events", "mailer", "m3", 0)
+		req.NoError(err)
+		got <- entries
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	id, err := aof.StreamAdd("events", "*", -1, "order", "5")
+	req.NoError(err)
+	req.Equal([]iqdb.StreamEntry{{ID: id, Fields: []string{"order", "5"}}}, <-got)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = aof.StreamBlockingReadGroup(ctx, "events", "mailer", "m3", 0)
+	req.Equal(context.DeadlineExceeded, err)
+
+	// Blocking read over Redis protocol
+	req.NoError(redis.StreamGroupCreate("bus", "g", "$", true))
+	go func() {
+		entries, err := redis.StreamBlockingReadGroup(context.Background(), "bus", "g", "c", 1)
+		req.NoError(err)
+		got <- entries
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	id, err = direct.StreamAdd("bus", "*", -1, "msg", "hi")
+	req.NoError(err)
+	req.Equal([]iqdb.StreamEntry{{ID: id, Fields: []string{"msg", "hi"}}}, <-got)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = redis.StreamBlockingReadGroup(ctx, "bus", "g", "c", 1)
+	req.Equal(context.DeadlineExceeded, err)
+
+	req.NoError(aof.Close())
+}
+
+func TestCounters(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofcounter")
+	defer os.RemoveAll("aofcounter")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofcounter", opts)
+	req.NoError(err)
+
+	req.NoError(aof.Set("ttl", "10", time.Hour))
+
+	// Concurrent increments never get lost
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				_, err := aof.Incr("c")
+				req.NoError(err)
+				_, err = aof.HashIncrBy("h", "f", 2)
+				req.NoError(err)
+				_, err = aof.IncrBy("ttl", 1)
+				req.NoError(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	_, err = aof.IncrByFloat("f", 1.25)
+	req.NoError(err)
+	_, err = aof.IncrByFloat("f", -0.5)
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofcounter", opts)
+	req.NoError(err)
+
+	v, err := aof.Get("c")
+	req.NoError(err)
+	req.Equal("1000", v)
+
+	v, err = aof.HashGet("h", "f")
+	req.NoError(err)
+	req.Equal("2000", v)
+
+	v, err = aof.Get("f")
+	req.NoError(err)
+	req.Equal("0.75", v)
+
+	// Increment keeps expiration
+	v, err = aof.Get("ttl")
+	req.NoError(err)
+	req.Equal("1010", v)
+
+	timeShift := 2 * time.Hour
+	iqdb.SetTimeFunc(func() time.Time {
+		return time.Now().Add(timeShift)
+	})
+	defer iqdb.SetTimeFunc(time.Now)
+
+	aof.ForeTTLRecheck()
+	_, err = aof.Get("ttl")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	req.NoError(aof.Close())
+}
+
+func TestExpiredCounters(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofexpcounter")
+	defer os.RemoveAll("aofexpcounter")
+
+	now := time.Now()
+	iqdb.SetTimeFunc(func() time.Time {
+		return now
+	})
+	defer iqdb.SetTimeFunc(time.Now)
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofexpcounter", opts)
+	req.NoError(err)
+
+	req.NoError(aof.Set("rl", "0", time.Minute))
+	for i := 0; i < 5; i++ {
+		_, err = aof.Incr("rl")
+		req.NoError(err)
+	}
+
+	req.NoError(aof.Set("lazy", "0", time.Minute))
+	_, err = aof.ListPush("l", "a")
+	req.NoError(err)
+	req.NoError(aof.TTL("l", time.Minute))
+	_, err = aof.ListPush("l", "b")
+	req.NoError(err)
+
+	// Expired key is not removed yet, increment starts it over without expiration
+	iqdb.SetTimeFunc(func() time.Time {
+		return now.Add(time.Minute * 2)
+	})
+
+	n, err := aof.IncrBy("lazy", 3)
+	req.NoError(err)
+	req.EqualValues(3, n)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofexpcounter", opts)
+	req.NoError(err)
+
+	_, err = aof.Get("rl")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	_, err = aof.ListLen("l")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	v, err := aof.Get("lazy")
+	req.NoError(err)
+	req.Equal("3", v)
+
+	req.NoError(aof.Close())
+}
+
+func TestConcurrentSetIncr(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofsetincr")
+	defer os.RemoveAll("aofsetincr")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofsetincr", opts)
+	req.NoError(err)
+
+	// Replay applies sets and increments in the order memory did
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if j%10 == i {
+					req.NoError(aof.Set("n", strconv.Itoa(j)))
+					continue
+				}
+
+				_, err := aof.IncrBy("n", 1)
+				req.NoError(err)
+				_, err = aof.IncrByFloat("f", 0.5)
+				req.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n, err := aof.Get("n")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofsetincr", opts)
+	req.NoError(err)
+
+	v, err := aof.Get("n")
+	req.NoError(err)
+	req.Equal(n, v)
+
+	v, err = aof.Get("f")
+	req.NoError(err)
+	req.Equal("450", v)
+
+	req.NoError(aof.Close())
+}
+
+func TestLists(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aoflist")
+	defer os.RemoveAll("aoflist")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aoflist", opts)
+	req.NoError(err)
+
+	_, err = aof.ListPush("l", "a", "b", "c", "b")
+	req.NoError(err)
+	_, err = aof.ListPushLeft("l", "y", "x")
+	req.NoError(err)
+
+	v, err := aof.ListPopLeft("l")
+	req.NoError(err)
+	req.Equal("x", v)
+
+	v, err = aof.ListPop("l")
+	req.NoError(err)
+	req.Equal("b", v)
+
+	_, err = aof.ListInsert("l", false, "a", "a1")
+	req.NoError(err)
+	req.NoError(aof.ListSet("l", -1, "z"))
+
+	n, err := aof.ListRemove("l", 0, "b")
+	req.NoError(err)
+	req.Equal(1, n)
+
+	req.NoError(aof.ListTrim("l", 1, -1))
+
+	// Emptied list is gone
+	_, err = aof.ListPush("gone", "a")
+	req.NoError(err)
+	_, err = aof.ListPop("gone")
+	req.NoError(err)
+
+	_, err = aof.ListLen("gone")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	want, err := aof.ListRange("l", 0, -1)
+	req.NoError(err)
+	req.Equal([]string{"a", "a1", "z"}, want)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aoflist", opts)
+	req.NoError(err)
+
+	l, err := aof.ListRange("l", 0, -1)
+	req.NoError(err)
+	req.Equal(want, l)
+
+	_, err = aof.ListLen("gone")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	req.NoError(aof.Close())
+}
+
+func TestListPushPopRace(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aoflistrace")
+	defer os.RemoveAll("aoflistrace")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aoflistrace", opts)
+	req.NoError(err)
+
+	// List is removed with its last item and created again all the time,
+	// push must not go to the removed one
+	var popped int
+	mx := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				_, err := aof.ListPush("q", "v")
+				req.NoError(err)
+
+				_, err = aof.ListPopLeft("q")
+				if err == iqdb.ErrKeyNotFound {
+					continue
+				}
+
+				req.NoError(err)
+				mx.Lock()
+				popped++
+				mx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var left int
+	for {
+		_, err = aof.ListPopLeft("q")
+		if err == iqdb.ErrKeyNotFound {
+			break
+		}
+
+		req.NoError(err)
+		left++
+	}
+
+	req.Equal(8000, popped+left)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aoflistrace", opts)
+	req.NoError(err)
+
+	_, err = aof.ListLen("q")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Close())
+}
+
+func TestListReplayOrder(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aoflistorder")
+	defer os.RemoveAll("aoflistorder")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aoflistorder", opts)
+	req.NoError(err)
+
+	// Replay gives the same list whatever order changes are applied in
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := strconv.Itoa(i)
+			for j := 0; j < 200; j++ {
+				var err error
+				switch j % 8 {
+				case 0, 1:
+					_, err = aof.ListPush("l", v, v)
+				case 2:
+					_, err = aof.ListPushLeft("l", v)
+				case 3:
+					_, err = aof.ListPopLeft("l")
+				case 4:
+					err = aof.ListSet("l", 0, v)
+				case 5:
+					_, err = aof.ListInsert("l", true, strconv.Itoa((i+1)%8), v)
+				case 6:
+					_, err = aof.ListRemove("l", 1, strconv.Itoa((i+2)%8))
+				default:
+					err = aof.ListTrim("l", 0, 20)
+				}
+
+				if err == iqdb.ErrKeyNotFound || err == iqdb.ErrListIndexError {
+					err = nil
+				}
+				req.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	l, err := aof.ListRange("l", 0, -1)
+	if err == iqdb.ErrKeyNotFound {
+		err = nil
+	}
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aoflistorder", opts)
+	req.NoError(err)
+
+	v, err := aof.ListRange("l", 0, -1)
+	if err == iqdb.ErrKeyNotFound {
+		err = nil
+	}
+	req.NoError(err)
+	req.Equal(l, v)
+	req.NoError(aof.Close())
+}
+
+func TestBlockingLists(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofblock")
+	defer os.RemoveAll("aofblock")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofblock", opts)
+	req.NoError(err)
+
+	// Waiters are served in the order they came
+	got := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, v, err := aof.ListBlockingPopLeft(context.Background(), "other", "q")
+			req.NoError(err)
+			got <- v
+		}()
+
+		// Let waiter queue before the next one
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	_, err = aof.ListPush("q", "a", "b")
+	req.NoError(err)
+	req.Equal("a", <-got)
+	req.Equal("b", <-got)
+
+	_, err = aof.ListPushLeft("q", "c")
+	req.NoError(err)
+	req.Equal("c", <-got)
+
+	// Canceled waiter is gone from the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := aof.ListBlockingMove(ctx, "q", "work", true, false)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	req.Equal(context.Canceled, <-done)
+
+	moved := make(chan string)
+	go func() {
+		v, err := aof.ListBlockingMove(context.Background(), "q", "work", true, false)
+		req.NoError(err)
+		moved <- v
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = aof.ListPush("q", "d", "e")
+	req.NoError(err)
+	req.Equal("d", <-moved)
+
+	l, err := aof.ListRange("q", 0, -1)
+	req.NoError(err)
+	req.Equal([]string{"e"}, l)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofblock", opts)
+	req.NoError(err)
+
+	l, err = aof.ListRange("q", 0, -1)
+	req.NoError(err)
+	req.Equal([]string{"e"}, l)
+
+	l, err = aof.ListRange("work", 0, -1)
+	req.NoError(err)
+	req.Equal([]string{"d"}, l)
+
+	req.NoError(aof.Close())
+}
+
+func TestHashes(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofhash")
+	defer os.RemoveAll("aofhash")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofhash", opts)
+	req.NoError(err)
+
+	n, err := aof.HashSet("h", "a", "1", "b", "2", "c", "3")
+	req.NoError(err)
+	req.Equal(3, n)
+
+	n, err = aof.HashDel("h", "a", "c", "none")
+	req.NoError(err)
+	req.Equal(2, n)
+
+	ok, err := aof.HashSetNX("h", "b", "other")
+	req.NoError(err)
+	req.False(ok)
+
+	ok, err = aof.HashSetNX("h", "d", "4")
+	req.NoError(err)
+	req.True(ok)
+
+	ok, err = aof.HashSetNX("new", "f", "v")
+	req.NoError(err)
+	req.True(ok)
+
+	// Hash is removed with its last field
+	_, err = aof.HashSet("gone", "a", "1")
+	req.NoError(err)
+	n, err = aof.HashDel("gone", "a")
+	req.NoError(err)
+	req.Equal(1, n)
+	_, err = aof.Type("gone")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofhash", opts)
+	req.NoError(err)
+
+	_, err = aof.Type("gone")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	h, err := aof.HashGetAll("h")
+	req.NoError(err)
+	req.Equal(map[string]string{"b": "2", "d": "4"}, h)
+
+	h, err = aof.HashGetAll("new")
+	req.NoError(err)
+	req.Equal(map[string]string{"f": "v"}, h)
+
+	req.NoError(aof.Close())
+}
+
+func TestHashSetRace(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofhashrace")
+	defer os.RemoveAll("aofhashrace")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofhashrace", opts)
+	req.NoError(err)
+
+	// Writers race to create every hash, none of their fields may be lost
+	want := make(map[string]string)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		f := strconv.Itoa(i)
+		want[f] = f
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := aof.HashSet("h"+strconv.Itoa(j), f, f)
+				req.NoError(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for j := 0; j < 100; j++ {
+		h, err := aof.HashGetAll("h" + strconv.Itoa(j))
+		req.NoError(err)
+		req.Equal(want, h)
+	}
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofhashrace", opts)
+	req.NoError(err)
+
+	for j := 0; j < 100; j++ {
+		h, err := aof.HashGetAll("h" + strconv.Itoa(j))
+		req.NoError(err)
+		req.Equal(want, h)
+	}
+	req.NoError(aof.Close())
+}
+
+func TestHashFieldRace(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofhashfield")
+	defer os.RemoveAll("aofhashfield")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofhashfield", opts)
+	req.NoError(err)
+
+	_, err = aof.HashSet("h", "keep", "1")
+	req.NoError(err)
+
+	// Replay gives the same field whatever order its updates are applied in
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var err error
+				switch j % 4 {
+				case 0:
+					_, err = aof.HashSet("h", "f", strconv.Itoa(i))
+				case 1:
+					_, err = aof.HashSetNX("h", "f", strconv.Itoa(i))
+				case 2:
+					_, err = aof.HashIncrBy("h", "f", 1)
+					if err == iqdb.ErrNotInteger {
+						err = nil
+					}
+				default:
+					_, err = aof.HashDel("h", "f")
+				}
+				req.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	h, err := aof.HashGetAll("h")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofhashfield", opts)
+	req.NoError(err)
+
+	v, err := aof.HashGetAll("h")
+	req.NoError(err)
+	req.Equal(h, v)
+	req.NoError(aof.Close())
+}
+
+func TestHashSetDelRace(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofhashdel")
+	defer os.RemoveAll("aofhashdel")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofhashdel", opts)
+	req.NoError(err)
+
+	// Hash is removed with its last field and created again all the time,
+	// set must not go to the removed one
+	var deleted int
+	mx := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				f := fmt.Sprintf("%d-%d", i, j)
+				_, err := aof.HashSet("h", f, "v")
+				req.NoError(err)
+
+				n, err := aof.HashDel("h", f)
+				req.NoError(err)
+				mx.Lock()
+				deleted += n
+				mx.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	req.Equal(4000, deleted)
+	_, err = aof.Type("h")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofhashdel", opts)
+	req.NoError(err)
+
+	_, err = aof.Type("h")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+	req.NoError(aof.Close())
+}
+
+func TestStrings(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofstring")
+	defer os.RemoveAll("aofstring")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofstring", opts)
+	req.NoError(err)
+
+	req.NoError(aof.Set("a", "x", time.Hour))
+	_, err = aof.Append("a", "yz")
+	req.NoError(err)
+	_, err = aof.SetRange("a", 1, "Y")
+	req.NoError(err)
+
+	req.NoError(aof.Set("d", "v"))
+	_, err = aof.GetDel("d")
+	req.NoError(err)
+
+	ok, err := aof.SetNX("lock", "1", time.Hour)
+	req.NoError(err)
+	req.True(ok)
+
+	_, err = aof.SetWithOptions("lock", "2", iqdb.SetOptions{XX: true, KeepTTL: true})
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofstring", opts)
+	req.NoError(err)
+
+	v, err := aof.Get("a")
+	req.NoError(err)
+	req.Equal("xYz", v)
+
+	_, err = aof.Get("d")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	v, err = aof.Get("lock")
+	req.NoError(err)
+	req.Equal("2", v)
+
+	req.NoError(aof.Set("g", "v", time.Hour))
+
+	// Append and KEEPTTL keep expiration
+	timeShift := 2 * time.Hour
+	iqdb.SetTimeFunc(func() time.Time {
+		return time.Now().Add(timeShift)
+	})
+	defer iqdb.SetTimeFunc(time.Now)
+
+	// Expired key is missing even if it is not removed yet
+	_, err = aof.GetDel("g")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	aof.ForeTTLRecheck()
+	_, err = aof.Get("a")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	_, err = aof.Get("lock")
+	req.Equal(iqdb.ErrKeyNotFound, err)
+
+	req.NoError(aof.Close())
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofappend")
+	defer os.RemoveAll("aofappend")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofappend", opts)
+	req.NoError(err)
+
+	// Replay gives the same value whatever order appends are applied in
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := aof.Append("a", strconv.Itoa(i))
+				req.NoError(err)
+				_, err = aof.SetRange("r", j, strconv.Itoa(i))
+				req.NoError(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	a, err := aof.Get("a")
+	req.NoError(err)
+	req.Len(a, 1000)
+	r, err := aof.Get("r")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofappend", opts)
+	req.NoError(err)
+
+	v, err := aof.Get("a")
+	req.NoError(err)
+	req.Equal(a, v)
+
+	v, err = aof.Get("r")
+	req.NoError(err)
+	req.Equal(r, v)
+
+	req.NoError(aof.Close())
+}
+
+func TestMSet(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofmset")
+	defer os.RemoveAll("aofmset")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofmset", opts)
+	req.NoError(err)
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+
+	// Readers never see a part of batch
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			args := make([]string, 0, len(keys)*2)
+			for _, k := range keys {
+				args = append(args, k, strconv.Itoa(i))
+			}
+			req.NoError(aof.MSet(args...))
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		vals, err := aof.MGet(keys...)
+		req.NoError(err)
+
+		for _, v := range vals {
+			req.Equal(vals[0], v)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// Batch keeps its order with operations on every key on replay
+	req.NoError(aof.Set("a", "old"))
+	req.NoError(aof.MSet("a", "1", "b", "1", "c", "1"))
+	_, err = aof.Append("a", "z")
+	req.NoError(err)
+	req.NoError(aof.Remove("b"))
+	req.NoError(aof.MSet("b", "2", "c", "2"))
+	_, err = aof.Append("c", "z")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofmset", opts)
+	req.NoError(err)
+
+	vals, err := aof.MGet("a", "b", "c")
+	req.NoError(err)
+	req.Equal([]string{"1z", "2", "2z"}, vals)
+
+	req.NoError(aof.Close())
+}
+
+func TestBitmaps(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofbitmap")
+	defer os.RemoveAll("aofbitmap")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofbitmap", opts)
+	req.NoError(err)
+
+	// Daily active users, user ID is bit offset
+	for _, id := range []int{1, 5, 9, 100} {
+		_, err = aof.SetBit("active:mon", id, 1)
+		req.NoError(err)
+	}
+
+	_, err = aof.SetBit("active:mon", 9, 0)
+	req.NoError(err)
+
+	for _, id := range []int{5, 7, 100} {
+		_, err = aof.SetBit("active:tue", id, 1)
+		req.NoError(err)
+	}
+
+	_, err = aof.BitOp(iqdb.BitAnd, "active:both", "active:mon", "active:tue")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofbitmap", opts)
+	req.NoError(err)
+
+	n, err := aof.BitCount("active:mon", 0, -1)
+	req.NoError(err)
+	req.Equal(3, n)
+
+	bit, err := aof.GetBit("active:mon", 9)
+	req.NoError(err)
+	req.Equal(0, bit)
+
+	n, err = aof.BitCount("active:both", 0, -1)
+	req.NoError(err)
+	req.Equal(2, n)
+
+	pos, err := aof.BitPos("active:both", 1, 0)
+	req.NoError(err)
+	req.Equal(5, pos)
+
+	// Single bit updates keep binary value intact
+	v, err := aof.Get("active:tue")
+	req.NoError(err)
+	req.Len(v, 13)
+	req.Equal(byte(0x05), v[0])
+
+	// Padding longer than a chunk of zeros
+	_, err = aof.SetBit("active:tue", 5000*8+7, 1)
+	req.NoError(err)
+	v, err = aof.Get("active:tue")
+	req.NoError(err)
+	req.Len(v, 5001)
+	req.Equal(byte(0x05), v[0])
+	req.Equal(strings.Repeat("\x00", 5000-13), v[13:5000])
+	req.Equal(byte(0x01), v[5000])
+
+	req.NoError(aof.Close())
+}
+
+func TestExpiredBitmapUpdate(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofbitexp")
+	defer os.RemoveAll("aofbitexp")
+
+	opts := &iqdb.Options{ShardCount: 10}
+	aof, err := iqdb.Open("aofbitexp", opts)
+	req.NoError(err)
+
+	req.NoError(aof.Set("b", "x", time.Second))
+	req.NoError(aof.Set("a", "x", time.Second))
+	req.NoError(aof.Set("r", "xyz", time.Second))
+
+	// Keys are expired but not removed yet, updates create them again
+	iqdb.SetTimeFunc(func() time.Time {
+		return time.Now().Add(2 * time.Second)
+	})
+	defer iqdb.SetTimeFunc(time.Now)
+
+	_, err = aof.SetBit("b", 3, 1)
+	req.NoError(err)
+	_, err = aof.Append("a", "y")
+	req.NoError(err)
+	_, err = aof.SetRange("r", 1, "Y")
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofbitexp", opts)
+	req.NoError(err)
+
+	bit, err := aof.GetBit("b", 3)
+	req.NoError(err)
+	req.Equal(1, bit)
+
+	v, err := aof.Get("b")
+	req.NoError(err)
+	req.Equal("\x10", v)
+
+	v, err = aof.Get("a")
+	req.NoError(err)
+	req.Equal("y", v)
+
+	v, err = aof.Get("r")
+	req.NoError(err)
+	req.Equal("\x00Y", v)
+
+	req.NoError(aof.Close())
+}
+
+func TestEncryption(t *testing.T) {
+	req := require.New(t)
+
+	for _, f := range []string{"aofenc", "aofenc.snap"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	key1 := bytes.Repeat([]byte("1"), 32)
+	key2 := bytes.Repeat([]byte("2"), 16)
+	secret := "very secret value"
+
+	// Whether secret is stored in plain text somewhere
+	leaked := func() bool {
+		files, err := ioutil.ReadDir("aofenc")
+		req.NoError(err)
+
+		paths := []string{"aofenc.snap"}
+		for _, fi := range files {
+			paths = append(paths, "aofenc/"+fi.Name())
+		}
+
+		for _, p := range paths {
+			b, err := ioutil.ReadFile(p)
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			req.NoError(err)
+			if bytes.Contains(b, []byte(secret)) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofenc.snap", EncryptionKey: key1}
+	aof, err := iqdb.Open("aofenc", opts)
+	req.NoError(err)
+
+	req.NoError(aof.Set("k", secret))
+	_, err = aof.ListPush("l", secret)
+	req.NoError(err)
+	req.NoError(aof.SaveSnapshot("aofenc.snap"))
+
+	// AOF tail after snapshot
+	_, err = aof.HashSet("h", "f", secret)
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	req.False(leaked())
+
+	_, err = iqdb.Open("aofenc", &iqdb.Options{SnapshotFile: "aofenc.snap"})
+	req.True(errors.Is(err, iqdb.ErrEncryptionKey))
+
+	_, err = iqdb.Open("aofenc", &iqdb.Options{SnapshotFile: "aofenc.snap", EncryptionKey: key2})
+	req.True(errors.Is(err, iqdb.ErrEncryptionKey))
+
+	// Data is rewritten with new key on start
+	opts = &iqdb.Options{ShardCount: 10, NoAsync: true, SnapshotFile: "aofenc.snap", EncryptionKey: key2, PreviousEncryptionKeys: [][]byte{key1}}
+	aof, err = iqdb.Open("aofenc", opts)
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	aof, err = iqdb.Open("aofenc", &iqdb.Options{ShardCount: 10, NoAsync: true, EncryptionKey: key2})
+	req.NoError(err)
+
+	v, err := aof.Get("k")
+	req.NoError(err)
+	req.Equal(secret, v)
+
+	v, err = aof.HashGet("h", "f")
+	req.NoError(err)
+	req.Equal(secret, v)
+
+	l, err := aof.ListRange("l", 0, 0)
+	req.NoError(err)
+	req.Equal([]string{secret}, l)
+
+	req.False(leaked())
+
+	// Encryption is turned off the same way
+	req.NoError(aof.RotateEncryptionKey(nil))
+	req.NoError(aof.Close())
+	req.True(leaked())
+
+	aof, err = iqdb.Open("aofenc", &iqdb.Options{ShardCount: 10, NoAsync: true})
+	req.NoError(err)
+
+	v, err = aof.Get("k")
+	req.NoError(err)
+	req.Equal(secret, v)
+
+	req.NoError(aof.Close())
+
+	_, err = iqdb.Open("aofenc", &iqdb.Options{EncryptionKey: []byte("short")})
+	req.Equal(iqdb.ErrEncryptionKeySize, err)
+}
+
+func TestEncryptionTornTail(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofenctorn")
+	defer os.RemoveAll("aofenctorn")
+
+	key := bytes.Repeat([]byte("1"), 32)
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, EncryptionKey: key, AOFRecovery: iqdb.AOFRecoveryTruncateTail}
+	aof, err := iqdb.Open("aofenctorn", opts)
+	req.NoError(err)
+	req.NoError(aof.Set("k1", "v1"))
+	req.NoError(aof.Close())
+
+	seg := "aofenctorn/00000001.aof"
+	fi, err := os.Stat(seg)
+	req.NoError(err)
+	size := fi.Size()
+
+	f, err := os.OpenFile(seg, os.O_APPEND|os.O_WRONLY, 0600)
+	req.NoError(err)
+	_, err = f.Write([]byte{100, 0, 0, 0, 1, 2})
+	req.NoError(err)
+	req.NoError(f.Close())
+
+	// Truncated segment is not appended to, its offsets were already used with its nonce base
+	aof, err = iqdb.Open("aofenctorn", opts)
+	req.NoError(err)
+	req.NoError(aof.Set("k2", "v2"))
+	req.NoError(aof.Close())
+
+	fi, err = os.Stat(seg)
+	req.NoError(err)
+	req.Equal(size, fi.Size())
+
+	_, err = os.Stat("aofenctorn/00000002.aof")
+	req.NoError(err)
+
+	aof, err = iqdb.Open("aofenctorn", &iqdb.Options{ShardCount: 10, EncryptionKey: key})
+	req.NoError(err)
+
+	for _, k := range []string{"k1", "k2"} {
+		_, err = aof.Get(k)
+		req.NoError(err)
+	}
+
+	req.NoError(aof.Close())
+}
+
+func TestCompression(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofzip")
+	defer os.RemoveAll("aofzip")
+
+	big := strings.Repeat(`{"name":"value","list":[1,2,3]}`, 100)
+
+	aof, err := iqdb.Open("aofzip", &iqdb.Options{ShardCount: 10, NoAsync: true})
+	req.NoError(err)
+	req.NoError(aof.Set("plain", big))
+	req.NoError(aof.Close())
+
+	size := func() int64 {
+		res, err := iqdb.CheckAOF("aofzip")
+		req.NoError(err)
+
+		return res.Size
+	}
+
+	plainSize := size()
+
+	// Compressed records are appended to plain ones
+	opts := &iqdb.Options{ShardCount: 10, NoAsync: true, Compression: iqdb.CompressionDeflate}
+	aof, err = iqdb.Open("aofzip", opts)
+	req.NoError(err)
+
+	req.NoError(aof.Set("k", big))
+	req.NoError(aof.Set("small", "v"))
+	_, err = aof.ListPush("l", big, big)
+	req.NoError(err)
+	_, err = aof.HashSet("h", "f", big)
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	req.True(size() < plainSize*2)
+
+	aof, err = iqdb.Open("aofzip", &iqdb.Options{ShardCount: 10, NoAsync: true})
+	req.NoError(err)
+
+	for _, k := range []string{"plain", "k"} {
+		v, err := aof.Get(k)
+		req.NoError(err)
+		req.Equal(big, v)
+	}
+
+	v, err := aof.Get("small")
+	req.NoError(err)
+	req.Equal("v", v)
+
+	l, err := aof.ListRange("l", 0, 1)
+	req.NoError(err)
+	req.Equal([]string{big, big}, l)
+
+	v, err = aof.HashGet("h", "f")
+	req.NoError(err)
+	req.Equal(big, v)
+
+	req.NoError(aof.Close())
+
+	// Rewrite compresses the whole dataset
+	aof, err = iqdb.Open("aofzip", opts)
+	req.NoError(err)
+	req.NoError(aof.RewriteAOF())
+	req.NoError(aof.Close())
+
+	req.True(size() < plainSize)
+
+	aof, err = iqdb.Open("aofzip", opts)
+	req.NoError(err)
+
+	v, err = aof.Get("plain")
+	req.NoError(err)
+	req.Equal(big, v)
+
+	req.NoError(aof.Close())
+}
+
+func TestParallelReplay(t *testing.T) {
+	req := require.New(t)
+
+	os.RemoveAll("aofpar")
+	defer os.RemoveAll("aofpar")
+
+	opts := &iqdb.Options{ShardCount: 16, SegmentSize: 4096}
+	aof, err := iqdb.Open("aofpar", opts)
+	req.NoError(err)
+
+	ops := 0
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+
+		// Result depends on the order of operations on the key
+		req.NoError(aof.Set("s"+k, "old"))
+		req.NoError(aof.Remove("s" + k))
+		req.NoError(aof.Set("s"+k, k))
+
+		_, err = aof.ListPush("l"+k, "a", "b")
+		req.NoError(err)
+		_, err = aof.ListPop("l" + k)
+		req.NoError(err)
+		_, err = aof.ListPush("l"+k, k)
+		req.NoError(err)
+
+		_, err = aof.HashSet("h"+k, "f", "old")
+
+		req.NoError(err)
+		_, err = aof.HashDel("h"+k, "f")
+		req.NoError(err)
+		_, err = aof.HashSet("h"+k, "f", k)
+		req.NoError(err)
+
+		ops += 9
+	}
+	req.NoError(aof.Close())
+
+	var last iqdb.ReplayProgress
+	aof, err = iqdb.Open("aofpar", &iqdb.Options{ShardCount: 16, OnReplayProgress: func(p iqdb.ReplayProgress) {
+		last = p
+	}})
+	req.NoError(err)
+
+	req.EqualValues(ops, last.Records)
+	req.Equal(last.Total, last.Read)
+	req.True(last.Total > 0)
+
+	for i := 0; i < 100; i++ {
+		k := strconv.Itoa(i)
+
+		v, err := aof.Get("s" + k)
+		req.NoError(err)
+		req.Equal(k, v)
+
+		l, err := aof.ListRange("l"+k, 0, 1)
+		req.NoError(err)
+		req.Equal([]string{"a", k}, l)
+
+		v, err = aof.HashGet("h"+k, "f")
+		req.NoError(err)
+		req.Equal(k, v)
+	}
+
+	req.NoError(aof.Close())
+}
+
+// Writer calling fn before the second write
+type secondWriteHook struct {
+	w      io.Writer
+	writes int
+	fn     func()
+}
+
+func (h *secondWriteHook) Write(p []byte) (int, error) {
+	h.writes++
+	if h.writes == 2 {
+		h.fn()
+	}
+
+	return h.w.Write(p)
+}
+
+func TestBackup(t *testing.T) {
+	req := require.New(t)
+
+	for _, f := range []string{"aofbak", "aofbak2", "aofbak3", "aofbak3.snap", "aofbak4", "aofbak5"} {
+		os.RemoveAll(f)
+		defer os.RemoveAll(f)
+	}
+
+	aof, err := iqdb.Open("aofbak", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+
+	req.NoError(aof.Set("k", "v"))
+	_, err = aof.ListPush("l", "a", "b")
+	req.NoError(err)
+	_, err = aof.HashSet("h", "f", "v")
+	req.NoError(err)
+
+	// The first write is backup header, snapshot is taken before the second one,
+	// so this key comes with AOF tail
+	buf := &bytes.Buffer{}
+	err = aof.Backup(context.Background(), &secondWriteHook{w: buf, fn: func() {
+		req.NoError(aof.Set("during", "backup"))
+	}})
+	req.NoError(err)
+	req.NoError(aof.Close())
+
+	check := func(db *iqdb.IqDB) {
+		for k, v := range map[string]string{"k": "v", "during": "backup"} {
+			got, err := db.Get(k)
+			req.NoError(err)
+			req.Equal(v, got)
+		}
+
+		l, err := db.ListRange("l", 0, 1)
+		req.NoError(err)
+		req.Equal([]string{"a", "b"}, l)
+
+		v, err := db.HashGet("h", "f")
+		req.NoError(err)
+		req.Equal("v", v)
+	}
+
+	restored, err := iqdb.Restore(bytes.NewReader(buf.Bytes()), "aofbak2", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+	check(restored)
+	req.NoError(restored.Close())
+
+	// Restored AOF doesn't need the snapshot
+	restored, err = iqdb.Open("aofbak2", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+	check(restored)
+	req.NoError(restored.Close())
+
+	_, err = iqdb.Restore(bytes.NewReader(buf.Bytes()), "aofbak2", &iqdb.Options{})
+	req.Equal(iqdb.ErrRestoreTarget, err)
+
+	opts := &iqdb.Options{ShardCount: 10, SnapshotFile: "aofbak3.snap"}
+	restored, err = iqdb.Restore(bytes.NewReader(buf.Bytes()), "aofbak3", opts)
+	req.NoError(err)
+	req.NoError(restored.Close())
+
+	restored, err = iqdb.Open("aofbak3", opts)
+	req.NoError(err)
+	check(restored)
+	req.NoError(restored.Close())
+
+	_, err = iqdb.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-3]), "aofbak4", &iqdb.Options{})
+	req.Equal(io.ErrUnexpectedEOF, err)
+
+	// Backup of running server
+	resp, err := nethttp.Get("http://localhost:8888/backup")
+	req.NoError(err)
+	defer resp.Body.Close()
+	req.Equal(nethttp.StatusOK, resp.StatusCode)
+
+	restored, err = iqdb.Restore(resp.Body, "aofbak5", &iqdb.Options{ShardCount: 10})
+	req.NoError(err)
+	req.NoError(restored.Close())
+
+	// Backup with token
+	os.RemoveAll("aofbak6")
+	defer os.RemoveAll("aofbak6")
+
+	tokenDB, err := iqdb.Open("aofbak6", &iqdb.Options{ShardCount: 10, HTTPPort: 8889, BackupToken: "secret"})
+	req.NoError(err)
+	go tokenDB.Start()
+
+	get := func(token string) *nethttp.Response {
+		r, err := nethttp.NewRequest(nethttp.MethodGet, "http://localhost:8889/backup", nil)
+		req.NoError(err)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		for i := 0; ; i++ {
+			resp, err := nethttp.DefaultClient.Do(r)
+			if err == nil {
+				return resp
+			}
+
+			req.True(i < 10, err)
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	resp = get("")
+	resp.Body.Close()
+	req.Equal(nethttp.StatusUnauthorized, resp.StatusCode)
+
+	resp = get("wrong")
+	resp.Body.Close()
+	req.Equal(nethttp.StatusUnauthorized, resp.StatusCode)
+
+	resp = get("secret")
+	req.Equal(nethttp.StatusOK, resp.StatusCode)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	req.NoError(err)
+	resp.Body.Close()
+	req.NoError(tokenDB.Close())
+}
+
+func TestRedis(t *testing.T) {
+	var err error
+
+	req := require.New(t)
+
+	req.NoError(redis.Set("k", "v", time.Second))
+
+	k, err := redis.Get("k")
+	req.NoError(err)
+
+	req.Equal("v", k)
+}
+
+func TestRedisBlockingDisconnect(t *testing.T) {
+	req := require.New(t)
+
+	conn, err := net.Dial("tcp", ":7777")
+	req.NoError(err)
+
+	_, err = conn.Write([]byte("*3\r\n$5\r\nBLPOP\r\n$10\r\nblockgoneq\r\n$1\r\n0\r\n"))
+	req.NoError(err)
+	time.Sleep(time.Millisecond * 50)
+	req.NoError(conn.Close())
+	time.Sleep(time.Millisecond * 50)
+
+	// Pop of gone client does not take the item
+	_, err = db.ListPush("blockgoneq", "a")
+	req.NoError(err)
+	time.Sleep(time.Millisecond * 50)
+
+	l, err := db.ListRange("blockgoneq", 0, -1)
+	req.NoError(err)
+	req.Equal([]string{"a"}, l)
+	req.NoError(db.Remove("blockgoneq"))
+
+	// Same for stream group reads
+	req.NoError(db.StreamGroupCreate("blockgones", "g", "$", true))
+
+	conn, err = net.Dial("tcp", ":7777")
+	req.NoError(err)
+
+	_, err = conn.Write([]byte("*9\r\n$10\r\nXREADGROUP\r\n$5\r\nGROUP\r\n$1\r\ng\r\n$1\r\nc\r\n$5\r\nBLOCK\r\n$1\r\n0\r\n$7\r\nSTREAMS\r\n$10\r\nblockgones\r\n$1\r\n>\r\n"))
+	req.NoError(err)
+	time.Sleep(time.Millisecond * 50)
+	req.NoError(conn.Close())
+	time.Sleep(time.Millisecond * 50)
+
+	_, err = db.StreamAdd("blockgones", "*", -1, "f", "v")
+	req.NoError(err)
+	time.Sleep(time.Millisecond * 50)
+
+	sum, err := db.StreamPending("blockgones", "g")
+	req.NoError(err)
+	req.Equal(0, sum.Count)
+	req.NoError(db.Remove("blockgones"))
 }
 
 func TestOps(t *testing.T) {
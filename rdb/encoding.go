@@ -0,0 +1,266 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// Bounds checked reader of serialized collections
+type cursor struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (c *cursor) take(n int) []byte {
+	if c.err != nil || n < 0 || c.pos+n > len(c.b) {
+		c.err = ErrFormat
+		return nil
+	}
+
+	b := c.b[c.pos : c.pos+n]
+	c.pos += n
+
+	return b
+}
+
+func (c *cursor) byte() byte {
+	b := c.take(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+// Next byte without consuming it
+func (c *cursor) peek() byte {
+	if c.err != nil || c.pos >= len(c.b) {
+		c.err = ErrFormat
+		return 0
+	}
+
+	return c.b[c.pos]
+}
+
+func (c *cursor) int(n int) string {
+	b := c.take(n)
+	if b == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(intLE(b), 10)
+}
+
+const ziplistEnd = 0xff
+
+// Ziplist: [uint32 bytes][uint32 tail offset][uint16 count][entries][0xff].
+// Every entry is [previous entry length][encoding][data]
+func parseZiplist(b []byte) ([]string, error) {
+	c := &cursor{b: b}
+	c.take(10)
+
+	ret := make([]string, 0)
+	for c.peek() != ziplistEnd && c.err == nil {
+		if c.byte() == 254 {
+			c.take(4)
+		}
+
+		enc := c.byte()
+
+		switch enc >> 6 {
+		case 0:
+			ret = append(ret, string(c.take(int(enc&0x3f))))
+			continue
+		case 1:
+			l := int(enc&0x3f)<<8 | int(c.byte())
+			ret = append(ret, string(c.take(l)))
+			continue
+		case 2:
+			l := c.take(4)
+			if l != nil {
+				ret = append(ret, string(c.take(int(binary.BigEndian.Uint32(l)))))
+			}
+			continue
+		}
+
+		switch {
+		case enc == 0xc0:
+			ret = append(ret, c.int(2))
+		case enc == 0xd0:
+			ret = append(ret, c.int(4))
+		case enc == 0xe0:
+			ret = append(ret, c.int(8))
+		case enc == 0xf0:
+			ret = append(ret, c.int(3))
+		case enc == 0xfe:
+			ret = append(ret, c.int(1))
+		case enc >= 0xf1 && enc <= 0xfd:
+			// 4 bit immediate value from 0 to 12
+			ret = append(ret, strconv.Itoa(int(enc&0x0f)-1))
+		default:
+			c.err = ErrFormat
+		}
+	}
+
+	return ret, c.err
+}
+
+const listpackEnd = 0xff
+
+// Listpack: [uint32 bytes][uint16 count][entries][0xff].
+// Every entry is [encoding][data][entry length backwards]
+func parseListpack(b []byte) ([]string, error) {
+	c := &cursor{b: b}
+	c.take(6)
+
+	ret := make([]string, 0)
+	for c.peek() != listpackEnd && c.err == nil {
+		start := c.pos
+		enc := c.byte()
+
+		switch {
+		case enc&0x80 == 0:
+			ret = append(ret, strconv.Itoa(int(enc&0x7f)))
+		case enc&0xc0 == 0x80:
+			ret = append(ret, string(c.take(int(enc&0x3f))))
+		case enc&0xe0 == 0xc0:
+			// 13 bit signed integer
+			v := int(enc&0x1f)<<8 | int(c.byte())
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			ret = append(ret, strconv.Itoa(v))
+		case enc&0xf0 == 0xe0:
+			l := int(enc&0x0f)<<8 | int(c.byte())
+			ret = append(ret, string(c.take(l)))
+		case enc == 0xf0:
+			l := c.take(4)
+			if l != nil {
+				ret = append(ret, string(c.take(int(binary.LittleEndian.Uint32(l)))))
+			}
+		case enc == 0xf1:
+			ret = append(ret, c.int(2))
+		case enc == 0xf2:
+			ret = append(ret, c.int(3))
+		case enc == 0xf3:
+			ret = append(ret, c.int(4))
+		case enc == 0xf4:
+			ret = append(ret, c.int(8))
+		default:
+			c.err = ErrFormat
+		}
+
+		c.take(backlenSize(c.pos - start))
+	}
+
+	return ret, c.err
+}
+
+// Entry length is stored backwards in 7 bit groups
+func backlenSize(l int) int {
+	switch {
+	case l < 1<<7:
+		return 1
+	case l < 1<<14:
+		return 2
+	case l < 1<<21:
+		return 3
+	case l < 1<<28:
+		return 4
+	}
+
+	return 5
+}
+
+const zipmapEnd = 0xff
+
+// Zipmap: [byte count][key length][key][value length][byte free][value][free bytes]...[0xff]
+func parseZipmap(b []byte) ([]string, error) {
+	c := &cursor{b: b}
+	c.take(1)
+
+	ret := make([]string, 0)
+	for c.peek() != zipmapEnd && c.err == nil {
+		k := c.take(zipmapLen(c))
+		l := zipmapLen(c)
+		free := int(c.byte())
+		v := c.take(l)
+		c.take(free)
+
+		ret = append(ret, string(k), string(v))
+	}
+
+	return ret, c.err
+}
+
+func zipmapLen(c *cursor) int {
+	l := c.byte()
+	if l < 254 {
+		return int(l)
+	}
+
+	if l == 254 {
+		b := c.take(4)
+		if b != nil {
+			return int(binary.LittleEndian.Uint32(b))
+		}
+	}
+
+	c.err = ErrFormat
+
+	return 0
+}
+
+// LZF: literal runs and back references controlled by the first byte
+func lzfDecompress(in []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 1<<5 {
+			n := ctrl + 1
+			if i+n > len(in) {
+				return nil, ErrFormat
+			}
+
+			out = append(out, in[i:i+n]...)
+			i += n
+			continue
+		}
+
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return nil, ErrFormat
+			}
+
+			n += int(in[i])
+			i++
+		}
+
+		if i >= len(in) {
+			return nil, ErrFormat
+		}
+
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+
+		if ref < 0 {
+			return nil, ErrFormat
+		}
+
+		// Reference may overlap with the bytes being written
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if len(out) != size {
+		return nil, ErrFormat
+	}
+
+	return out, nil
+}
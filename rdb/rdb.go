@@ -0,0 +1,375 @@
+// Package rdb reads Redis RDB dump files.
+//
+// Strings, lists and hashes are decoded in every encoding Redis has used for them,
+// including ziplists, listpacks, quicklists, zipmaps and LZF compressed strings.
+// Values of other types are skipped, their keys are still returned, so callers can report them
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+var ErrFormat = errors.New("wrong RDB format")
+var ErrVersion = errors.New("unsupported RDB version")
+var ErrChecksum = errors.New("RDB checksum mismatch")
+
+var errFunction = errors.New("RDB functions of pre-release format are not supported")
+
+const magic = "REDIS"
+
+// The newest known version
+const maxVersion = 12
+
+// Strings longer than that are never written, so length is garbage
+const maxStringLen = 512 << 20
+
+// Opcodes
+const (
+	opSlotInfo     = 0xf4
+	opFunction     = 0xf5
+	opFunction2    = 0xf6
+	opModuleAux    = 0xf7
+	opIdle         = 0xf8
+	opFreq         = 0xf9
+	opAux          = 0xfa
+	opResizeDB     = 0xfb
+	opExpireTimeMs = 0xfc
+	opExpireTime   = 0xfd
+	opSelectDB     = 0xfe
+	opEOF          = 0xff
+)
+
+// Value types
+const (
+	typeString              = 0
+	typeList                = 1
+	typeSet                 = 2
+	typeZSet                = 3
+	typeHash                = 4
+	typeZSet2               = 5
+	typeModule              = 6
+	typeModule2             = 7
+	typeHashZipmap          = 9
+	typeListZiplist         = 10
+	typeSetIntset           = 11
+	typeZSetZiplist         = 12
+	typeHashZiplist         = 13
+	typeListQuicklist       = 14
+	typeStreamListpacks     = 15
+	typeHashListpack        = 16
+	typeZSetListpack        = 17
+	typeListQuicklist2      = 18
+	typeStreamListpacks2    = 19
+	typeSetListpack         = 20
+	typeStreamListpacks3    = 21
+	typeHashMetadataPreGA   = 22
+	typeHashListpackExPreGA = 23
+	typeHashMetadata        = 24
+	typeHashListpackEx      = 25
+)
+
+// Kinds of values
+const (
+	KindString = "string"
+	KindList   = "list"
+	KindHash   = "hash"
+	KindSet    = "set"
+	KindZSet   = "zset"
+	KindStream = "stream"
+	KindModule = "module"
+	// Hash with expiring fields
+	KindHashFieldTTL = "hash-field-ttl"
+)
+
+var kinds = map[byte]string{
+	typeString:              KindString,
+	typeList:                KindList,
+	typeSet:                 KindSet,
+	typeZSet:                KindZSet,
+	typeHash:                KindHash,
+	typeZSet2:               KindZSet,
+	typeModule:              KindModule,
+	typeModule2:             KindModule,
+	typeHashZipmap:          KindHash,
+	typeListZiplist:         KindList,
+	typeSetIntset:           KindSet,
+	typeZSetZiplist:         KindZSet,
+	typeHashZiplist:         KindHash,
+	typeListQuicklist:       KindList,
+	typeStreamListpacks:     KindStream,
+	typeHashListpack:        KindHash,
+	typeZSetListpack:        KindZSet,
+	typeListQuicklist2:      KindList,
+	typeStreamListpacks2:    KindStream,
+	typeSetListpack:         KindSet,
+	typeStreamListpacks3:    KindStream,
+	typeHashMetadataPreGA:   KindHashFieldTTL,
+	typeHashListpackExPreGA: KindHashFieldTTL,
+	typeHashMetadata:        KindHashFieldTTL,
+	typeHashListpackEx:      KindHashFieldTTL,
+}
+
+// Single key read from RDB. Only the field of value kind is set,
+// values of other kinds are skipped
+type Entry struct {
+	DB   int
+	Key  string
+	Kind string
+	// Zero if key does not expire
+	Expire time.Time
+	Value  string
+	List   []string
+	// Field-value pairs
+	Hash []string
+}
+
+// Sequential RDB reader
+type Reader struct {
+	in      *crcReader
+	Version int
+	// Auxiliary fields, e.g. redis-ver
+	Aux map[string]string
+	db  int
+}
+
+// Read RDB header
+// Returns reader on success and error on fail
+func NewReader(r io.Reader) (*Reader, error) {
+	rdr := &Reader{in: &crcReader{r: bufio.NewReader(r)}, Aux: make(map[string]string)}
+
+	hdr, err := rdr.readFull(len(magic) + 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(hdr[:len(magic)]) != magic {
+		return nil, ErrFormat
+	}
+
+	rdr.Version, err = strconv.Atoi(string(hdr[len(magic):]))
+	if err != nil {
+		return nil, ErrFormat
+	}
+
+	if rdr.Version < 1 || rdr.Version > maxVersion {
+		return nil, ErrVersion
+	}
+
+	return rdr, nil
+}
+
+// Read next key. Returns io.EOF after the last key when checksum is valid
+func (r *Reader) Next() (*Entry, error) {
+	var expire time.Time
+
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+
+		switch op {
+		case opEOF:
+			return nil, r.readChecksum()
+		case opSelectDB:
+			var db uint64
+			db, err = r.readLength()
+			r.db = int(db)
+		case opResizeDB:
+			err = r.skipLengths(2)
+		case opSlotInfo:
+			err = r.skipLengths(3)
+		case opAux:
+			var k, v string
+			k, err = r.readString()
+			if err == nil {
+				v, err = r.readString()
+			}
+
+			r.Aux[k] = v
+		case opFunction2:
+			_, err = r.readString()
+		case opFunction:
+			err = errFunction
+		case opModuleAux:
+			_, err = r.readLength()
+			if err == nil {
+				err = r.skipModule2()
+			}
+		case opIdle:
+			_, err = r.readLength()
+		case opFreq:
+			_, err = r.readByte()
+		case opExpireTime:
+			var b []byte
+			b, err = r.readFull(4)
+			if err == nil {
+				expire = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			}
+		case opExpireTimeMs:
+			var b []byte
+			b, err = r.readFull(8)
+			if err == nil {
+				expire = time.Unix(0, int64(binary.LittleEndian.Uint64(b))*int64(time.Millisecond))
+			}
+		default:
+			e, err := r.readEntry(op)
+			if err != nil {
+				return nil, unexpected(err)
+			}
+
+			e.Expire = expire
+
+			return e, nil
+		}
+
+		if err != nil {
+			return nil, unexpected(err)
+		}
+	}
+}
+
+// Key appeared in the middle of the file can't end it
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (r *Reader) readChecksum() error {
+	// Checksum covers everything up to it, including EOF opcode
+	sum := r.in.crc
+
+	if r.Version < 5 {
+		return io.EOF
+	}
+
+	b, err := r.readFull(8)
+	if err != nil {
+		return unexpected(err)
+	}
+
+	// Zero if checksum was disabled on save
+	expected := binary.LittleEndian.Uint64(b)
+	if expected != 0 && expected != sum {
+		return ErrChecksum
+	}
+
+	return io.EOF
+}
+
+func (r *Reader) readEntry(t byte) (*Entry, error) {
+	kind, ok := kinds[t]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown value type %d", ErrFormat, t)
+	}
+
+	key, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Entry{DB: r.db, Key: key, Kind: kind}
+
+	switch t {
+	case typeString:
+		e.Value, err = r.readString()
+	case typeList:
+		e.List, err = r.readStrings(1)
+	case typeHash:
+		e.Hash, err = r.readStrings(2)
+	case typeHashZipmap:
+		err = r.readEncoded(&e.Hash, parseZipmap)
+	case typeListZiplist:
+		err = r.readEncoded(&e.List, parseZiplist)
+	case typeHashZiplist:
+		err = r.readEncoded(&e.Hash, parseZiplist)
+	case typeHashListpack:
+		err = r.readEncoded(&e.Hash, parseListpack)
+	case typeListQuicklist:
+		e.List, err = r.readQuicklist(false)
+	case typeListQuicklist2:
+		e.List, err = r.readQuicklist(true)
+	default:
+		err = r.skipValue(t)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Kind == KindHash && len(e.Hash)%2 != 0 {
+		return nil, ErrFormat
+	}
+
+	return e, nil
+}
+
+// Read string with serialized collection and parse it
+func (r *Reader) readEncoded(dst *[]string, parse func(b []byte) ([]string, error)) error {
+	s, err := r.readString()
+	if err != nil {
+		return err
+	}
+
+	*dst, err = parse([]byte(s))
+
+	return err
+}
+
+// Quicklist is a list of ziplist nodes, version 2 has listpack or plain nodes
+func (r *Reader) readQuicklist(v2 bool) ([]string, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for i := uint64(0); i < n; i++ {
+		container := uint64(quicklistPacked)
+		if v2 {
+			container, err = r.readLength()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		if container == quicklistPlain {
+			ret = append(ret, s)
+			continue
+		}
+
+		var items []string
+		if v2 {
+			items, err = parseListpack([]byte(s))
+		} else {
+			items, err = parseZiplist([]byte(s))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, items...)
+	}
+
+	return ret, nil
+}
+
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
@@ -0,0 +1,205 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func rdbString(s string) []byte {
+	b := []byte{byte(len(s))}
+	if len(s) >= 1<<6 {
+		b = []byte{0x40 | byte(len(s)>>8), byte(len(s))}
+	}
+
+	return append(b, s...)
+}
+
+// Ziplist of already encoded entries, prevlen is taken from entry sizes
+func ziplist(entries ...[]byte) []byte {
+	body := make([]byte, 0)
+	prev := 0
+	for _, e := range entries {
+		body = append(body, byte(prev))
+		body = append(body, e...)
+		prev = len(e) + 1
+	}
+
+	b := make([]byte, 10)
+	binary.LittleEndian.PutUint32(b, uint32(10+len(body)+1))
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(entries)))
+
+	return append(append(b, body...), ziplistEnd)
+}
+
+// Listpack of already encoded entries, backlen is appended to each
+func listpack(entries ...[]byte) []byte {
+	body := make([]byte, 0)
+	for _, e := range entries {
+		body = append(body, e...)
+		body = append(body, byte(len(e)))
+	}
+
+	b := make([]byte, 6)
+	binary.LittleEndian.PutUint32(b, uint32(6+len(body)+1))
+	binary.LittleEndian.PutUint16(b[4:], uint16(len(entries)))
+
+	return append(append(b, body...), listpackEnd)
+}
+
+func lpString(s string) []byte {
+	return append([]byte{0x80 | byte(len(s))}, s...)
+}
+
+func TestCRC64(t *testing.T) {
+	require.Equal(t, uint64(0xe9c6d914c4b8d9ca), crc64Update(0, []byte("123456789")))
+}
+
+func TestLZF(t *testing.T) {
+	req := require.New(t)
+
+	// Literal "a" and back reference of 9 bytes to it
+	b, err := lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x00}, 10)
+	req.NoError(err)
+	req.Equal("aaaaaaaaaa", string(b))
+
+	_, err = lzfDecompress([]byte{0x00, 'a', 0xe0, 0x00, 0x05}, 10)
+	req.Equal(ErrFormat, err)
+}
+
+func TestListpack(t *testing.T) {
+	req := require.New(t)
+
+	lp := listpack(lpString("f"), []byte{100}, []byte{0xdf, 0xfd}, []byte{0xf1, 0x18, 0xfc}, append([]byte{0xe0, 70}, bytes.Repeat([]byte("x"), 70)...))
+	items, err := parseListpack(lp)
+	req.NoError(err)
+	req.Equal([]string{"f", "100", "-3", "-1000", string(bytes.Repeat([]byte("x"), 70))}, items)
+
+	_, err = parseListpack(lp[:len(lp)-3])
+	req.Equal(ErrFormat, err)
+}
+
+func TestReader(t *testing.T) {
+	req := require.New(t)
+
+	deadline := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	ms := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ms, uint64(deadline.UnixNano()/int64(time.Millisecond)))
+
+	b := []byte("REDIS0009")
+	b = append(b, opAux)
+	b = append(b, rdbString("redis-ver")...)
+	b = append(b, rdbString("5.0.7")...)
+	b = append(b, opSelectDB, 0, opResizeDB, 8, 1)
+
+	b = append(b, typeString)
+	b = append(b, rdbString("s")...)
+	b = append(b, rdbString("hello")...)
+
+	b = append(b, opExpireTimeMs)
+	b = append(b, ms...)
+	b = append(b, typeString)
+	b = append(b, rdbString("int")...)
+	b = append(b, 0xc0|encInt16, 0xd2, 0x04)
+
+	b = append(b, typeString)
+	b = append(b, rdbString("lzf")...)
+	b = append(b, 0xc0|encLZF, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00)
+
+	b = append(b, typeListZiplist)
+	b = append(b, rdbString("zl")...)
+	b = append(b, rdbString(string(ziplist([]byte{0x01, 'a'}, []byte{0xfe, 0xfb}, []byte{0xf3})))...)
+
+	b = append(b, typeHashListpack)
+	b = append(b, rdbString("hl")...)
+	b = append(b, rdbString(string(listpack(lpString("f"), lpString("v"), lpString("n"), []byte{7})))...)
+
+	b = append(b, typeListQuicklist2)
+	b = append(b, rdbString("ql")...)
+	b = append(b, 2, quicklistPlain)
+	b = append(b, rdbString("big")...)
+	b = append(b, quicklistPacked)
+	b = append(b, rdbString(string(listpack(lpString("x"), []byte{0xdf, 0xfd})))...)
+
+	b = append(b, typeSet)
+	b = append(b, rdbString("set")...)
+	b = append(b, 2)
+	b = append(b, rdbString("m1")...)
+	b = append(b, rdbString("m2")...)
+
+	b = append(b, typeZSet2)
+	b = append(b, rdbString("zs")...)
+	b = append(b, 1)
+	b = append(b, rdbString("m")...)
+	b = append(b, make([]byte, 8)...)
+
+	b = append(b, typeHash)
+	b = append(b, rdbString("h")...)
+	b = append(b, 1)
+	b = append(b, rdbString("f")...)
+	b = append(b, rdbString("v")...)
+
+	b = append(b, opSelectDB, 1)
+	b = append(b, typeString)
+	b = append(b, rdbString("other")...)
+	b = append(b, rdbString("v")...)
+
+	b = append(b, opEOF)
+	sum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(sum, crc64Update(0, b))
+	b = append(b, sum...)
+
+	r, err := NewReader(bytes.NewReader(b))
+	req.NoError(err)
+	req.Equal(9, r.Version)
+
+	entries := make(map[string]*Entry)
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		req.NoError(err)
+		entries[e.Key] = e
+	}
+
+	req.Equal("5.0.7", r.Aux["redis-ver"])
+	req.Len(entries, 10)
+
+	req.Equal(&Entry{Key: "s", Kind: KindString, Value: "hello"}, entries["s"])
+	req.Equal("1234", entries["int"].Value)
+	req.True(deadline.Equal(entries["int"].Expire))
+	req.True(entries["lzf"].Expire.IsZero())
+	req.Equal("aaaaaaaaaa", entries["lzf"].Value)
+	req.Equal([]string{"a", "-5", "2"}, entries["zl"].List)
+	req.Equal([]string{"f", "v", "n", "7"}, entries["hl"].Hash)
+	req.Equal([]string{"big", "x", "-3"}, entries["ql"].List)
+	req.Equal(&Entry{Key: "set", Kind: KindSet}, entries["set"])
+	req.Equal(KindZSet, entries["zs"].Kind)
+	req.Equal([]string{"f", "v"}, entries["h"].Hash)
+	req.Equal(1, entries["other"].DB)
+
+	// Value damaged after save
+	i := bytes.Index(b, []byte("hello"))
+	b[i] = 'j'
+
+	r, err = NewReader(bytes.NewReader(b))
+	req.NoError(err)
+
+	for {
+		_, err = r.Next()
+		if err != nil {
+			break
+		}
+	}
+
+	req.Equal(ErrChecksum, err)
+
+	_, err = NewReader(bytes.NewReader([]byte("REDIS0099")))
+	req.Equal(ErrVersion, err)
+}
@@ -0,0 +1,466 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+var errModuleValue = errors.New("RDB module value of version 1 can't be skipped")
+
+// Redis uses CRC-64 Jones with zero initial value and without final xor
+var crcTable = crc64.MakeTable(bits.Reverse64(0xad93d23594c935a9))
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// Keeps checksum of everything consumed
+type crcReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc64Update(c.crc, p[:n])
+
+	return n, err
+}
+
+func (r *Reader) readFull(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r.in, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (r *Reader) readByte() (byte, error) {
+	b, err := r.readFull(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return b[0], nil
+}
+
+// Length is prefixed with its size in two high bits of the first byte.
+// Encoded flag is set for specially encoded strings, length is the encoding then
+func (r *Reader) readLengthEnc() (uint64, bool, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		b2, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case 2:
+		switch b {
+		case 0x80:
+			l, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+
+			return uint64(binary.BigEndian.Uint32(l)), false, nil
+		case 0x81:
+			l, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+
+			return binary.BigEndian.Uint64(l), false, nil
+		}
+
+		return 0, false, ErrFormat
+	}
+
+	return uint64(b & 0x3f), true, nil
+}
+
+func (r *Reader) readLength() (uint64, error) {
+	l, enc, err := r.readLengthEnc()
+	if err == nil && enc {
+		err = ErrFormat
+	}
+
+	return l, err
+}
+
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+func (r *Reader) readString() (string, error) {
+	l, enc, err := r.readLengthEnc()
+	if err != nil {
+		return "", err
+	}
+
+	if !enc {
+		if l > maxStringLen {
+			return "", ErrFormat
+		}
+
+		b, err := r.readFull(int(l))
+
+		return string(b), err
+	}
+
+	switch l {
+	case encInt8, encInt16, encInt32:
+		b, err := r.readFull(1 << l)
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatInt(intLE(b), 10), nil
+	case encLZF:
+		clen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+
+		ulen, err := r.readLength()
+		if err != nil {
+			return "", err
+		}
+
+		if clen > maxStringLen || ulen > maxStringLen {
+			return "", ErrFormat
+		}
+
+		b, err := r.readFull(int(clen))
+		if err != nil {
+			return "", err
+		}
+
+		b, err = lzfDecompress(b, int(ulen))
+
+		return string(b), err
+	}
+
+	return "", ErrFormat
+}
+
+// Read n strings multiplied by mul, e.g. 2 for field-value pairs
+func (r *Reader) readStrings(mul uint64) ([]string, error) {
+	n, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, 0)
+	for i := uint64(0); i < n*mul; i++ {
+		s, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, s)
+	}
+
+	return ret, nil
+}
+
+func (r *Reader) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		_, err := r.readLength()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Reader) skipStrings(n uint64) error {
+	for i := uint64(0); i < n; i++ {
+		_, err := r.readString()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Skip value of type which is not decoded
+func (r *Reader) skipValue(t byte) error {
+	switch t {
+	case typeSet:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		return r.skipStrings(n)
+	case typeZSet, typeZSet2:
+		n, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		for i := uint64(0); i < n; i++ {
+			_, err = r.readString()
+			if err == nil {
+				err = r.skipScore(t)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case typeSetIntset, typeZSetZiplist, typeZSetListpack, typeSetListpack, typeHashListpackExPreGA:
+		_, err := r.readString()
+		return err
+	case typeHashListpackEx:
+		// Minimal field expiration time goes first
+		_, err := r.readFull(8)
+		if err == nil {
+			_, err = r.readString()
+		}
+
+		return err
+	case typeHashMetadataPreGA, typeHashMetadata:
+		return r.skipHashMetadata(t)
+	case typeModule2:
+		_, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		return r.skipModule2()
+	case typeStreamListpacks, typeStreamListpacks2, typeStreamListpacks3:
+		return r.skipStream(t)
+	}
+
+	return errModuleValue
+}
+
+// Scores of old sorted sets are strings with one byte length, 253-255 are NaN and infinities
+func (r *Reader) skipScore(t byte) error {
+	if t == typeZSet2 {
+		_, err := r.readFull(8)
+		return err
+	}
+
+	l, err := r.readByte()
+	if err != nil || l >= 253 {
+		return err
+	}
+
+	_, err = r.readFull(int(l))
+
+	return err
+}
+
+// Hash with per field TTL: [minimal expire time] count, then TTL, field and value for each field
+func (r *Reader) skipHashMetadata(t byte) error {
+	if t == typeHashMetadata {
+		_, err := r.readFull(8)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		_, err = r.readLength()
+		if err == nil {
+			err = r.skipStrings(2)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Module opcodes of self-describing module values
+const (
+	moduleOpEOF    = 0
+	moduleOpSInt   = 1
+	moduleOpUInt   = 2
+	moduleOpFloat  = 3
+	moduleOpDouble = 4
+	moduleOpString = 5
+)
+
+func (r *Reader) skipModule2() error {
+	for {
+		op, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case moduleOpEOF:
+			return nil
+		case moduleOpSInt, moduleOpUInt:
+			_, err = r.readLength()
+		case moduleOpFloat:
+			_, err = r.readFull(4)
+		case moduleOpDouble:
+			_, err = r.readFull(8)
+		case moduleOpString:
+			_, err = r.readString()
+		default:
+			err = ErrFormat
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Reader) skipStream(t byte) error {
+	n, err := r.readLength()
+	if err != nil {
+		return err
+	}
+
+	// Node key and listpack for every node
+	err = r.skipStrings(n * 2)
+	if err != nil {
+		return err
+	}
+
+	// Length and last ID, then first ID, max deleted ID and entries added since version 2
+	lengths := 3
+	if t >= typeStreamListpacks2 {
+		lengths += 5
+	}
+
+	err = r.skipLengths(lengths)
+	if err != nil {
+		return err
+	}
+
+	groups, err := r.readLength()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < groups; i++ {
+		err = r.skipConsumerGroup(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Reader) skipConsumerGroup(t byte) error {
+	_, err := r.readString()
+	if err != nil {
+		return err
+	}
+
+	// Last delivered ID, entries read since version 2
+	lengths := 2
+	if t >= typeStreamListpacks2 {
+		lengths++
+	}
+
+	err = r.skipLengths(lengths)
+	if err != nil {
+		return err
+	}
+
+	pending, err := r.readLength()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < pending; i++ {
+		// Raw ID and delivery time, then delivery count
+		_, err = r.readFull(16 + 8)
+		if err == nil {
+			_, err = r.readLength()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	consumers, err := r.readLength()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < consumers; i++ {
+		_, err = r.readString()
+		if err != nil {
+			return err
+		}
+
+		// Seen time, active time since version 3
+		times := 8
+		if t >= typeStreamListpacks3 {
+			times += 8
+		}
+
+		_, err = r.readFull(times)
+		if err != nil {
+			return err
+		}
+
+		pending, err := r.readLength()
+		if err != nil {
+			return err
+		}
+
+		if pending > maxStringLen/16 {
+			return ErrFormat
+		}
+
+		_, err = r.readFull(int(pending) * 16)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Little endian signed integer of 1 to 8 bytes
+func intLE(b []byte) int64 {
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+
+	shift := uint(64 - 8*len(b))
+
+	return int64(v<<shift) >> shift
+}
@@ -0,0 +1,130 @@
+package iqdb
+
+import (
+	"io"
+
+	"github.com/ravlio/iqdb/rdb"
+	log "github.com/sirupsen/logrus"
+)
+
+// Result of Redis RDB import
+type RDBImportResult struct {
+	// Imported keys
+	Keys int
+	// Keys expired before import
+	Expired int
+	// Keys of other Redis databases
+	OtherDB int
+	// Keys of types iqdb does not support, by type
+	Unsupported map[string]int
+}
+
+// Load Redis RDB dump. Keys of Redis database db are imported, existing keys are replaced.
+// HyperLogLog strings become HyperLogLogs. Every key is written to AOF.
+// Keys of unsupported types are logged and counted in result
+// Returns import result on success and error on fail
+func (iq *IqDB) ImportRDB(r io.Reader, db int) (*RDBImportResult, error) {
+	rdr, err := rdb.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RDBImportResult{Unsupported: make(map[string]int)}
+	for {
+		e, err := rdr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return res, err
+		}
+
+		switch {
+		case e.DB != db:
+			res.OtherDB++
+		case isExpired(e.Expire):
+			res.Expired++
+		case e.Kind != rdb.KindString && e.Kind != rdb.KindList && e.Kind != rdb.KindHash:
+			log.Warnf("RDB import: skipping key %q of unsupported type %s", e.Key, e.Kind)
+			res.Unsupported[e.Kind]++
+		default:
+			err = iq.importRDBEntry(e)
+			if err != nil {
+				return res, err
+			}
+
+			res.Keys++
+		}
+	}
+
+	for kind, n := range res.Unsupported {
+		log.Warnf("RDB import: %d keys of unsupported type %s were not imported", n, kind)
+	}
+
+	return res, nil
+}
+
+func (iq *IqDB) importRDBEntry(e *rdb.Entry) error {
+	iq.cutMx.RLock()
+	defer iq.cutMx.RUnlock()
+
+	err := iq.remove(e.Key, true)
+	if err == nil {
+		err = iq.writeRemove(e.Key)
+	}
+
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	switch e.Kind {
+	case rdb.KindString:
+		// HyperLogLogs are plain strings in Redis
+		if h, perr := parseHLL([]byte(e.Value)); perr == nil {
+			regs := make([]uint8, hllRegisters)
+			h.mergeInto(regs)
+
+			err = iq.hllMerge(e.Key, regs, true)
+			if err == nil {
+				err = iq.writeHLLMerge(e.Key, []byte(e.Value))
+			}
+
+			break
+		}
+
+		err = iq.set(e.Key, e.Value, e.Expire, true)
+		if err != nil {
+			return err
+		}
+
+		return iq.writeSet(e.Key, e.Value, e.Expire)
+	case rdb.KindList:
+		var w *aofWrite
+		_, w, err = iq.listPush(e.Key, e.List, true)
+		if err == nil {
+			err = w.wait()
+		}
+	case rdb.KindHash:
+		vals := make(map[string]string, len(e.Hash)/2)
+		for i := 0; i+1 < len(e.Hash); i += 2 {
+			vals[e.Hash[i]] = e.Hash[i+1]
+		}
+
+		_, err = iq.hashSet(e.Key, vals, true)
+		if err == nil {
+			err = iq.writeHashSet(e.Key, e.Hash...)
+		}
+	}
+
+	if err != nil || e.Expire.IsZero() {
+		return err
+	}
+
+	err = iq._ttl(e.Key, e.Expire, true)
+	if err != nil {
+		return err
+	}
+
+	return iq.writeTTL(e.Key, e.Expire)
+}
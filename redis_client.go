@@ -2,6 +2,7 @@ package iqdb
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"net"
 	"strconv"
@@ -13,6 +14,9 @@ type redisType string
 var ErrRedisWrongArgNum = errors.New("wrong arguments number")
 var ErrRedisWrongTTL = errors.New("wrong TTL")
 var ErrRedisUnknownParseError = errors.New("unknown parse error")
+var ErrRedisSyntaxError = errors.New("syntax error")
+var ErrRedisWrongTimeout = errors.New("timeout is not a float or out of range")
+var ErrRedisSingleStream = errors.New("only one stream per read is supported")
 
 const (
 	redisTypeString  redisType = "+"
@@ -84,6 +88,204 @@ func (cl *RedisClient) Set(key, value string, ttl ...time.Duration) error {
 	return nil
 }
 
+func (cl *RedisClient) SetWithOptions(key, value string, opts SetOptions) (SetResult, error) {
+	args := []string{"SET", key, value}
+	if opts.NX {
+		args = append(args, "NX")
+	}
+
+	if opts.XX {
+		args = append(args, "XX")
+	}
+
+	if opts.Get {
+		args = append(args, "GET")
+	}
+
+	if opts.KeepTTL {
+		args = append(args, "KEEPTTL")
+	}
+
+	if opts.TTL > 0 {
+		args = append(args, "PX", strconv.FormatInt(opts.TTL.Milliseconds(), 10))
+	}
+
+	err := cl.w.writeStringSlice(args)
+	if err != nil {
+		return SetResult{}, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return SetResult{}, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return SetResult{}, err
+	}
+
+	// Nil reply is an empty array
+	ok := len(msg.Arr) > 0
+	if !opts.Get {
+		return SetResult{Set: ok}, nil
+	}
+
+	res := SetResult{Existed: ok}
+	if ok {
+		res.Old = string(msg.Arr[0].Bulk)
+	}
+
+	res.Set = !(opts.NX && res.Existed) && !(opts.XX && !res.Existed)
+
+	return res, nil
+}
+
+func (cl *RedisClient) SetNX(key, value string, ttl ...time.Duration) (bool, error) {
+	if ttl != nil && ttl[0] > 0 {
+		res, err := cl.SetWithOptions(key, value, SetOptions{NX: true, TTL: ttl[0]})
+
+		return res.Set, err
+	}
+
+	err := cl.w.write("SETNX", key, value)
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return false, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
+func (cl *RedisClient) GetSet(key, value string) (string, error) {
+	return cl.stringCommand("GETSET", key, value)
+}
+
+func (cl *RedisClient) GetDel(key string) (string, error) {
+	return cl.stringCommand("GETDEL", key)
+}
+
+func (cl *RedisClient) Append(key, value string) (int, error) {
+	return cl.intCommand("APPEND", key, value)
+}
+
+func (cl *RedisClient) StrLen(key string) (int, error) {
+	return cl.intCommand("STRLEN", key)
+}
+
+func (cl *RedisClient) GetRange(key string, start, end int) (string, error) {
+	return cl.stringCommand("GETRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
+}
+
+func (cl *RedisClient) SetRange(key string, offset int, value string) (int, error) {
+	return cl.intCommand("SETRANGE", key, strconv.Itoa(offset), value)
+}
+
+func (cl *RedisClient) SetBit(key string, offset int, bit int) (int, error) {
+	return cl.intCommand("SETBIT", key, strconv.Itoa(offset), strconv.Itoa(bit))
+}
+
+func (cl *RedisClient) GetBit(key string, offset int) (int, error) {
+	return cl.intCommand("GETBIT", key, strconv.Itoa(offset))
+}
+
+func (cl *RedisClient) BitCount(key string, start, end int) (int, error) {
+	return cl.intCommand("BITCOUNT", key, strconv.Itoa(start), strconv.Itoa(end))
+}
+
+func (cl *RedisClient) BitPos(key string, bit int, start int, end ...int) (int, error) {
+	args := []string{key, strconv.Itoa(bit), strconv.Itoa(start)}
+	if end != nil {
+		args = append(args, strconv.Itoa(end[0]))
+	}
+
+	return cl.intCommand("BITPOS", args...)
+}
+
+func (cl *RedisClient) BitOp(op string, dst string, src ...string) (int, error) {
+	return cl.intCommand("BITOP", append([]string{op, dst}, src...)...)
+}
+
+// Send command with string arguments and read string reply
+func (cl *RedisClient) stringCommand(cmd string, args ...string) (string, error) {
+	err := cl.w.writeStringSlice(append([]string{cmd}, args...))
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return "", err
+	}
+
+	return getFirstBulkAsString(msg)
+}
+
+// Send command with string arguments and read integer reply
+func (cl *RedisClient) intCommand(cmd string, args ...string) (int, error) {
+	err := cl.w.writeStringSlice(append([]string{cmd}, args...))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+// Values of keys in one round trip
+func (cl *RedisClient) MGet(key ...string) ([]string, error) {
+	return cl.stringSliceCommand("MGET", key...)
+}
+
+func (cl *RedisClient) MSet(args ...string) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return ErrKeyValueMismatch
+	}
+
+	return cl.okCommand("MSET", args...)
+}
+
+func (cl *RedisClient) MSetNX(args ...string) (bool, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return false, ErrKeyValueMismatch
+	}
+
+	err := cl.w.writeStringSlice(append([]string{"MSETNX"}, args...))
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return false, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
 func (cl *RedisClient) Remove(key string) error {
 	err := cl.w.write("DEL", key)
 
@@ -118,6 +320,65 @@ func (cl *RedisClient) Keys() chan<- string {
 	panic("implement me")
 }
 
+func (cl *RedisClient) Incr(key string) (int64, error) {
+	return cl.int64Command("INCR", key)
+}
+
+func (cl *RedisClient) Decr(key string) (int64, error) {
+	return cl.int64Command("DECR", key)
+}
+
+func (cl *RedisClient) IncrBy(key string, delta int64) (int64, error) {
+	return cl.int64Command("INCRBY", key, strconv.FormatInt(delta, 10))
+}
+
+func (cl *RedisClient) IncrByFloat(key string, delta float64) (float64, error) {
+	err := cl.w.write("INCRBYFLOAT", key, formatFloat(delta))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	s, err := getFirstBulkAsString(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+// Send command with string arguments and read integer reply
+func (cl *RedisClient) int64Command(cmd string, args ...string) (int64, error) {
+	err := cl.w.writeStringSlice(append([]string{cmd}, args...))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	s, err := getFirstBulkAsString(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(s, 10, 64)
+}
+
 func (cl *RedisClient) ListLen(key string) (int, error) {
 	err := cl.w.write("LLEN", key)
 
@@ -156,8 +417,16 @@ func (cl *RedisClient) ListIndex(key string, index int) (string, error) {
 }
 
 func (cl *RedisClient) ListPush(key string, value ...string) (int, error) {
+	return cl.listPushCommand("RPUSH", key, value)
+}
+
+func (cl *RedisClient) ListPushLeft(key string, value ...string) (int, error) {
+	return cl.listPushCommand("LPUSH", key, value)
+}
+
+func (cl *RedisClient) listPushCommand(cmd, key string, value []string) (int, error) {
 	ss := make([]string, len(value)+2)
-	ss[0] = "LPUSH"
+	ss[0] = cmd
 	ss[1] = key
 
 	for i, v := range value {
@@ -180,23 +449,31 @@ func (cl *RedisClient) ListPush(key string, value ...string) (int, error) {
 	return getFirstBulkAsInt(msg)
 }
 
-func (cl *RedisClient) ListPop(key string) (int, error) {
-	err := cl.w.write("LPOP", key)
+func (cl *RedisClient) ListPop(key string) (string, error) {
+	return cl.listPopCommand("RPOP", key)
+}
+
+func (cl *RedisClient) ListPopLeft(key string) (string, error) {
+	return cl.listPopCommand("LPOP", key)
+}
+
+func (cl *RedisClient) listPopCommand(cmd, key string) (string, error) {
+	err := cl.w.write(cmd, key)
 
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
 	msg, err := cl.r.Read()
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
 	if err = checkErr(msg); err != nil {
-		return 0, err
+		return "", err
 	}
 
-	return getFirstBulkAsInt(msg)
+	return getFirstBulkAsString(msg)
 }
 
 func (cl *RedisClient) ListRange(key string, from, to int) ([]string, error) {
@@ -218,121 +495,678 @@ func (cl *RedisClient) ListRange(key string, from, to int) ([]string, error) {
 	return getFirstBulkAsStringSlice(msg)
 }
 
-func (cl *RedisClient) HashGet(key string, field string) (string, error) {
-	err := cl.w.write("HGET", key, field)
+func (cl *RedisClient) ListInsert(key string, before bool, pivot, value string) (int, error) {
+	where := "AFTER"
+	if before {
+		where = "BEFORE"
+	}
+
+	err := cl.w.write("LINSERT", key, where, pivot, value)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
 	msg, err := cl.r.Read()
 	if err != nil {
-		return "", err
+		return 0, err
 	}
 
 	if err = checkErr(msg); err != nil {
-		return "", err
+		return 0, err
 	}
 
-	return getFirstBulkAsString(msg)
+	return getFirstBulkAsInt(msg)
 }
 
-func (cl *RedisClient) HashGetAll(key string) (map[string]string, error) {
-	err := cl.w.write("HGETALL", key)
+func (cl *RedisClient) ListSet(key string, index int, value string) error {
+	return cl.okCommand("LSET", key, strconv.Itoa(index), value)
+}
+
+func (cl *RedisClient) ListRemove(key string, count int, value string) (int, error) {
+	err := cl.w.write("LREM", key, count, value)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	msg, err := cl.r.Read()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	if err = checkErr(msg); err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return getFirstBulkAsStringMap(msg)
+	return getFirstBulkAsInt(msg)
 }
 
-func (cl *RedisClient) HashKeys(key string) ([]string, error) {
-	err := cl.w.write("HKEYS", key)
+func (cl *RedisClient) ListTrim(key string, start, stop int) error {
+	return cl.okCommand("LTRIM", key, strconv.Itoa(start), strconv.Itoa(stop))
+}
+
+// Send command with string arguments and check that it succeeded
+func (cl *RedisClient) okCommand(cmd string, args ...string) error {
+	err := cl.w.writeStringSlice(append([]string{cmd}, args...))
 	if err != nil {
-		return nil, err
+		return err
 	}
+
 	msg, err := cl.r.Read()
 	if err != nil {
-		return nil, err
-	}
-
-	if err = checkErr(msg); err != nil {
-		return nil, err
+		return err
 	}
 
-	return getFirstBulkAsStringSlice(msg)
+	return checkErr(msg)
 }
 
-func (cl *RedisClient) HashDel(key string, field string) error {
-	err := cl.w.write("HDEL", key, field)
-
+func (cl *RedisClient) ListMove(src, dst string, srcLeft, dstLeft bool) (string, error) {
+	err := cl.w.write("LMOVE", src, dst, sideArg(srcLeft), sideArg(dstLeft))
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	msg, err := cl.r.Read()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if err = checkErr(msg); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return getFirstBulkAsString(msg)
 }
 
-func (cl *RedisClient) HashSet(key string, args ...string) error {
-	ss := make([]string, len(args)+2)
-	ss[0] = "HSET"
-	ss[1] = key
+// Timeout is taken from context deadline. Connection is blocked until reply,
+// so canceling context without deadline does not unblock the call
+func (cl *RedisClient) ListBlockingPop(ctx context.Context, key ...string) (string, string, error) {
+	return cl.blockingPopCommand(ctx, "BRPOP", key)
+}
 
-	for i, v := range args {
-		ss[i+2] = v
-	}
-	err := cl.w.writeStringSlice(ss)
+func (cl *RedisClient) ListBlockingPopLeft(ctx context.Context, key ...string) (string, string, error) {
+	return cl.blockingPopCommand(ctx, "BLPOP", key)
+}
+
+func (cl *RedisClient) blockingPopCommand(ctx context.Context, cmd string, key []string) (string, string, error) {
+	timeout, err := blockingTimeout(ctx)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	msg, err := cl.r.Read()
 
+	r, err := cl.stringSliceCommand(cmd, append(append([]string(nil), key...), timeout)...)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	if err = checkErr(msg); err != nil {
-		return err
+	// Nil reply on timeout
+	if len(r) == 0 {
+		return "", "", context.DeadlineExceeded
 	}
 
-	return nil
+	if len(r) != 2 {
+		return "", "", ErrRedisUnknownParseError
+	}
+
+	return r[0], r[1], nil
 }
 
-func getFirstBulkAsString(msg *redisMessage) (string, error) {
-	if msg.Type != redisTypeArray {
-		return "", ErrRedisUnknownParseError
+func (cl *RedisClient) ListBlockingMove(ctx context.Context, src, dst string, srcLeft, dstLeft bool) (string, error) {
+	timeout, err := blockingTimeout(ctx)
+	if err != nil {
+		return "", err
 	}
 
-	if len(msg.Arr) == 0 {
-		return "", ErrRedisUnknownParseError
+	r, err := cl.stringSliceCommand("BLMOVE", src, dst, sideArg(srcLeft), sideArg(dstLeft), timeout)
+	if err != nil {
+		return "", err
 	}
 
-	return string(msg.Arr[0].Bulk), nil
+	if len(r) == 0 {
+		return "", context.DeadlineExceeded
+	}
+
+	return r[0], nil
 }
 
-func getFirstBulkAsStringSlice(msg *redisMessage) ([]string, error) {
-	if msg.Type != redisTypeArray {
+// Seconds left till context deadline, 0 if there is no deadline
+func blockingTimeout(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	d, ok := ctx.Deadline()
+	if !ok {
+		return "0", nil
+	}
+
+	left := time.Until(d)
+	if left <= 0 {
+		return "", context.DeadlineExceeded
+	}
+
+	return strconv.FormatFloat(left.Seconds(), 'f', -1, 64), nil
+}
+
+func sideArg(left bool) string {
+	if left {
+		return "LEFT"
+	}
+
+	return "RIGHT"
+}
+
+func (cl *RedisClient) HashGet(key string, field string) (string, error) {
+	err := cl.w.write("HGET", key, field)
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return "", err
+	}
+
+	return getFirstBulkAsString(msg)
+}
+
+func (cl *RedisClient) HashGetAll(key string) (map[string]string, error) {
+	err := cl.w.write("HGETALL", key)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return nil, err
+	}
+
+	return getFirstBulkAsStringMap(msg)
+}
+
+func (cl *RedisClient) HashKeys(key string) ([]string, error) {
+	err := cl.w.write("HKEYS", key)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := cl.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return nil, err
+	}
+
+	return getFirstBulkAsStringSlice(msg)
+}
+
+func (cl *RedisClient) HashValues(key string) ([]string, error) {
+	return cl.stringSliceCommand("HVALS", key)
+}
+
+func (cl *RedisClient) HashMultiGet(key string, field ...string) ([]string, error) {
+	return cl.stringSliceCommand("HMGET", append([]string{key}, field...)...)
+}
+
+func (cl *RedisClient) HashLen(key string) (int, error) {
+	err := cl.w.write("HLEN", key)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) HashExists(key, field string) (bool, error) {
+	err := cl.w.write("HEXISTS", key, field)
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return false, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
+func (cl *RedisClient) HashStrLen(key, field string) (int, error) {
+	err := cl.w.write("HSTRLEN", key, field)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) HashScan(key string, cursor int, match string, count int) (int, []string, error) {
+	args := []string{key, strconv.Itoa(cursor)}
+	if match != "" {
+		args = append(args, "MATCH", match)
+	}
+
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+
+	r, err := cl.stringSliceCommand("HSCAN", args...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(r) == 0 {
+		return 0, nil, ErrRedisUnknownParseError
+	}
+
+	next, err := strconv.Atoi(r[0])
+	if err != nil {
+		return 0, nil, ErrRedisUnknownParseError
+	}
+
+	return next, r[1:], nil
+}
+
+func (cl *RedisClient) HashDel(key string, field ...string) (int, error) {
+	err := cl.w.writeStringSlice(append([]string{"HDEL", key}, field...))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) HashSet(key string, args ...string) (int, error) {
+	ss := make([]string, len(args)+2)
+	ss[0] = "HSET"
+	ss[1] = key
+
+	for i, v := range args {
+		ss[i+2] = v
+	}
+	err := cl.w.writeStringSlice(ss)
+	if err != nil {
+		return 0, err
+	}
+	msg, err := cl.r.Read()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) HashSetNX(key, field, value string) (bool, error) {
+	err := cl.w.write("HSETNX", key, field, value)
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return false, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
+func (cl *RedisClient) SetAdd(key string, member ...string) (int, error) {
+	err := cl.w.writeStringSlice(append([]string{"SADD", key}, member...))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) SetRemove(key string, member ...string) (int, error) {
+	err := cl.w.writeStringSlice(append([]string{"SREM", key}, member...))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) SetIsMember(key, member string) (bool, error) {
+	err := cl.w.write("SISMEMBER", key, member)
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return false, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
+func (cl *RedisClient) SetMembers(key string) ([]string, error) {
+	return cl.stringSliceCommand("SMEMBERS", key)
+}
+
+func (cl *RedisClient) SetCard(key string) (int, error) {
+	err := cl.w.write("SCARD", key)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) SetInter(key ...string) ([]string, error) {
+	return cl.stringSliceCommand("SINTER", key...)
+}
+
+func (cl *RedisClient) SetUnion(key ...string) ([]string, error) {
+	return cl.stringSliceCommand("SUNION", key...)
+}
+
+func (cl *RedisClient) SetDiff(key ...string) ([]string, error) {
+	return cl.stringSliceCommand("SDIFF", key...)
+}
+
+func (cl *RedisClient) SortedSetAdd(key string, member ...ScoredMember) (int, error) {
+	args := []string{"ZADD", key}
+	for _, m := range member {
+		args = append(args, formatScore(m.Score), m.Member)
+	}
+
+	err := cl.w.writeStringSlice(args)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) SortedSetRemove(key string, member ...string) (int, error) {
+	err := cl.w.writeStringSlice(append([]string{"ZREM", key}, member...))
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) SortedSetScore(key, member string) (float64, error) {
+	err := cl.w.write("ZSCORE", key, member)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsScore(msg)
+}
+
+func (cl *RedisClient) SortedSetRank(key, member string) (int, error) {
+	err := cl.w.write("ZRANK", key, member)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) SortedSetRange(key string, start, stop int) ([]ScoredMember, error) {
+	return cl.scoredCommand("ZRANGE", key, strconv.Itoa(start), strconv.Itoa(stop), "WITHSCORES")
+}
+
+func (cl *RedisClient) SortedSetRevRange(key string, start, stop int) ([]ScoredMember, error) {
+	return cl.scoredCommand("ZREVRANGE", key, strconv.Itoa(start), strconv.Itoa(stop), "WITHSCORES")
+}
+
+func (cl *RedisClient) SortedSetRangeByScore(key string, min, max float64, offset, count int) ([]ScoredMember, error) {
+	return cl.scoredCommand("ZRANGEBYSCORE", key, formatScore(min), formatScore(max), "WITHSCORES",
+		"LIMIT", strconv.Itoa(offset), strconv.Itoa(count))
+}
+
+func (cl *RedisClient) SortedSetIncrBy(key, member string, incr float64) (float64, error) {
+	err := cl.w.write("ZINCRBY", key, formatScore(incr), member)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsScore(msg)
+}
+
+func (cl *RedisClient) SortedSetCard(key string) (int, error) {
+	err := cl.w.write("ZCARD", key)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return 0, err
+	}
+
+	return getFirstBulkAsInt(msg)
+}
+
+func (cl *RedisClient) HyperLogLogAdd(key string, element ...string) (bool, error) {
+	err := cl.w.writeStringSlice(append([]string{"PFADD", key}, element...))
+	if err != nil {
+		return false, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return false, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
+func (cl *RedisClient) HyperLogLogCount(key ...string) (int, error) {
+	return cl.intCommand("PFCOUNT", key...)
+}
+
+func (cl *RedisClient) HyperLogLogMerge(dst string, src ...string) error {
+	return cl.okCommand("PFMERGE", append([]string{dst}, src...)...)
+}
+
+// Send sorted set range command and read member-score pairs reply
+func (cl *RedisClient) scoredCommand(cmd string, args ...string) ([]ScoredMember, error) {
+	r, err := cl.stringSliceCommand(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := parseScorePairs(r)
+	if err != nil {
 		return nil, ErrRedisUnknownParseError
 	}
 
+	return members, nil
+}
+
+// Send command with string arguments and read string slice reply
+func (cl *RedisClient) stringSliceCommand(cmd string, args ...string) ([]string, error) {
+	err := cl.w.writeStringSlice(append([]string{cmd}, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return nil, err
+	}
+
+	return getFirstBulkAsStringSlice(msg)
+}
+
+func (cl *RedisClient) HashIncrBy(key, field string, delta int64) (int64, error) {
+	return cl.int64Command("HINCRBY", key, field, strconv.FormatInt(delta, 10))
+}
+
+// Start AOF rewrite on server in background
+func (cl *RedisClient) RewriteAOF() error {
+	err := cl.w.write("BGREWRITEAOF")
+
+	if err != nil {
+		return err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return err
+	}
+
+	return checkErr(msg)
+}
+
+func getFirstBulkAsString(msg *redisMessage) (string, error) {
+	if msg.Type != redisTypeArray {
+		return "", ErrRedisUnknownParseError
+	}
+
 	if len(msg.Arr) == 0 {
+		return "", ErrRedisUnknownParseError
+	}
+
+	return string(msg.Arr[0].Bulk), nil
+}
+
+// Empty array is an empty slice
+func getFirstBulkAsStringSlice(msg *redisMessage) ([]string, error) {
+	if msg.Type != redisTypeArray {
 		return nil, ErrRedisUnknownParseError
 	}
 
@@ -373,10 +1207,301 @@ func getFirstBulkAsInt(msg *redisMessage) (int, error) {
 	return strconv.Atoi(string(msg.Arr[0].Bulk))
 }
 
+func getFirstBulkAsScore(msg *redisMessage) (float64, error) {
+	s, err := getFirstBulkAsString(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	return parseScore(s)
+}
+
+func getFirstBulkAsBool(msg *redisMessage) (bool, error) {
+	s, err := getFirstBulkAsString(msg)
+	if err != nil {
+		return false, err
+	}
+
+	return s == "1", nil
+}
+
 func checkErr(msg *redisMessage) error {
+	if len(msg.Arr) == 0 {
+		return nil
+	}
+
 	if msg.Arr[0].Type == redisTypeError {
 		return msg.Arr[0].Err
 	}
 
 	return nil
 }
+
+func (cl *RedisClient) StreamAdd(key, id string, maxLen int, fields ...string) (string, error) {
+	args := []string{"XADD", key}
+	if maxLen >= 0 {
+		args = append(args, "MAXLEN", strconv.Itoa(maxLen))
+	}
+
+	err := cl.w.writeStringSlice(append(append(args, id), fields...))
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return "", err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return "", err
+	}
+
+	return getFirstBulkAsString(msg)
+}
+
+func (cl *RedisClient) StreamLen(key string) (int, error) {
+	return cl.intCommand("XLEN", key)
+}
+
+func (cl *RedisClient) StreamRange(key, start, end string, count int) ([]StreamEntry, error) {
+	return cl.streamRangeCommand("XRANGE", key, start, end, count)
+}
+
+func (cl *RedisClient) StreamRevRange(key, end, start string, count int) ([]StreamEntry, error) {
+	return cl.streamRangeCommand("XREVRANGE", key, end, start, count)
+}
+
+func (cl *RedisClient) streamRangeCommand(cmd, key, from, to string, count int) ([]StreamEntry, error) {
+	args := []string{key, from, to}
+	if count >= 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+
+	msg, err := cl.arrayCommand(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStreamEntries(msg)
+}
+
+func (cl *RedisClient) StreamTrim(key string, maxLen int) (int, error) {
+	return cl.intCommand("XTRIM", key, "MAXLEN", strconv.Itoa(maxLen))
+}
+
+func (cl *RedisClient) StreamGroupCreate(key, group, id string, mkStream bool) error {
+	args := []string{"CREATE", key, group, id}
+	if mkStream {
+		args = append(args, "MKSTREAM")
+	}
+
+	return cl.okCommand("XGROUP", args...)
+}
+
+func (cl *RedisClient) StreamGroupDestroy(key, group string) (bool, error) {
+	msg, err := cl.arrayCommand("XGROUP", "DESTROY", key, group)
+	if err != nil {
+		return false, err
+	}
+
+	return getFirstBulkAsBool(msg)
+}
+
+func (cl *RedisClient) StreamReadGroup(key, group, consumer, id string, count int) ([]StreamEntry, error) {
+	return cl.streamReadGroupCommand(key, group, consumer, id, count, "")
+}
+
+// Timeout is taken from context deadline, as of list blocking pops
+func (cl *RedisClient) StreamBlockingReadGroup(ctx context.Context, key, group, consumer string, count int) ([]StreamEntry, error) {
+	timeout, err := blockingTimeoutMillis(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := cl.streamReadGroupCommand(key, group, consumer, ">", count, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nil reply on timeout
+	if len(r) == 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	return r, nil
+}
+
+func (cl *RedisClient) streamReadGroupCommand(key, group, consumer, id string, count int, block string) ([]StreamEntry, error) {
+	args := []string{"GROUP", group, consumer}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+
+	if block != "" {
+		args = append(args, "BLOCK", block)
+	}
+
+	msg, err := cl.arrayCommand("XREADGROUP", append(args, "STREAMS", key, id)...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nil reply if there are no new entries, otherwise key and its entries
+	if len(msg.Arr) == 0 {
+		return make([]StreamEntry, 0), nil
+	}
+
+	if len(msg.Arr) != 1 || len(msg.Arr[0].Arr) != 2 {
+		return nil, ErrRedisUnknownParseError
+	}
+
+	return parseStreamEntries(msg.Arr[0].Arr[1])
+}
+
+func (cl *RedisClient) StreamAck(key, group string, id ...string) (int, error) {
+	return cl.intCommand("XACK", append([]string{key, group}, id...)...)
+}
+
+func (cl *RedisClient) StreamPending(key, group string) (StreamPendingSummary, error) {
+	msg, err := cl.arrayCommand("XPENDING", key, group)
+	if err != nil {
+		return StreamPendingSummary{}, err
+	}
+
+	if len(msg.Arr) != 4 {
+		return StreamPendingSummary{}, ErrRedisUnknownParseError
+	}
+
+	count, err := strconv.Atoi(string(msg.Arr[0].Bulk))
+	if err != nil {
+		return StreamPendingSummary{}, ErrRedisUnknownParseError
+	}
+
+	r := StreamPendingSummary{
+		Count:     count,
+		First:     string(msg.Arr[1].Bulk),
+		Last:      string(msg.Arr[2].Bulk),
+		Consumers: make(map[string]int),
+	}
+
+	for _, c := range msg.Arr[3].Arr {
+		if len(c.Arr) != 2 {
+			return StreamPendingSummary{}, ErrRedisUnknownParseError
+		}
+
+		n, err := strconv.Atoi(string(c.Arr[1].Bulk))
+		if err != nil {
+			return StreamPendingSummary{}, ErrRedisUnknownParseError
+		}
+
+		r.Consumers[string(c.Arr[0].Bulk)] = n
+	}
+
+	return r, nil
+}
+
+func (cl *RedisClient) StreamPendingRange(key, group, start, end string, count int, consumer string) ([]StreamPending, error) {
+	args := []string{key, group, start, end, strconv.Itoa(count)}
+	if consumer != "" {
+		args = append(args, consumer)
+	}
+
+	msg, err := cl.arrayCommand("XPENDING", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]StreamPending, len(msg.Arr))
+	for i, p := range msg.Arr {
+		if len(p.Arr) != 4 {
+			return nil, ErrRedisUnknownParseError
+		}
+
+		idle, err := strconv.ParseInt(string(p.Arr[2].Bulk), 10, 64)
+		if err != nil {
+			return nil, ErrRedisUnknownParseError
+		}
+
+		deliveries, err := strconv.Atoi(string(p.Arr[3].Bulk))
+		if err != nil {
+			return nil, ErrRedisUnknownParseError
+		}
+
+		r[i] = StreamPending{
+			ID:         string(p.Arr[0].Bulk),
+			Consumer:   string(p.Arr[1].Bulk),
+			Idle:       time.Duration(idle) * time.Millisecond,
+			Deliveries: deliveries,
+		}
+	}
+
+	return r, nil
+}
+
+// Send command with string arguments and read array reply
+func (cl *RedisClient) arrayCommand(cmd string, args ...string) (*redisMessage, error) {
+	err := cl.w.writeStringSlice(append([]string{cmd}, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := cl.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkErr(msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Type != redisTypeArray {
+		return nil, ErrRedisUnknownParseError
+	}
+
+	return msg, nil
+}
+
+// Entries of ID and field-value pairs arrays. Fields of entry trimmed from stream are nil
+func parseStreamEntries(msg *redisMessage) ([]StreamEntry, error) {
+	if msg.Type != redisTypeArray {
+		return nil, ErrRedisUnknownParseError
+	}
+
+	r := make([]StreamEntry, len(msg.Arr))
+	for i, e := range msg.Arr {
+		if len(e.Arr) != 2 {
+			return nil, ErrRedisUnknownParseError
+		}
+
+		r[i].ID = string(e.Arr[0].Bulk)
+		if e.Arr[1].Type == redisTypeArray {
+			r[i].Fields = make([]string, len(e.Arr[1].Arr))
+			for j, f := range e.Arr[1].Arr {
+				r[i].Fields[j] = string(f.Bulk)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// Milliseconds left till context deadline, 0 if there is no deadline
+func blockingTimeoutMillis(ctx context.Context) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	d, ok := ctx.Deadline()
+	if !ok {
+		return "0", nil
+	}
+
+	left := time.Until(d)
+	if left <= 0 {
+		return "", context.DeadlineExceeded
+	}
+
+	// Rounded up, so that 0 does not block forever
+	return strconv.FormatInt(int64((left+time.Millisecond-1)/time.Millisecond), 10), nil
+}
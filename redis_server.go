@@ -2,24 +2,37 @@ package iqdb
 
 import (
 	"bufio"
+	"context"
 	"github.com/sirupsen/logrus"
+	"math"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 )
 
 type redisServer struct {
-	port  int
-	cl    Client
+	port int
+	cl   Client
+	// Used for administrative commands
+	db    *IqDB
 	ln    net.Listener
 	stopc chan struct{}
+	// Blocking commands are cancelled on stop
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func newRedisServer(port int, cl Client) *redisServer {
+func newRedisServer(port int, db *IqDB) *redisServer {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &redisServer{
-		port:  port,
-		cl:    cl,
-		stopc: make(chan struct{}, 1),
+		port:   port,
+		cl:     db,
+		db:     db,
+		stopc:  make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 func (srv *redisServer) Serve() {
@@ -51,15 +64,23 @@ func (srv *redisServer) Serve() {
 }
 
 func (srv *redisServer) Stop() {
+	srv.cancel()
 	srv.stopc <- struct{}{}
 }
 
 func (srv *redisServer) handleConnection(c net.Conn) {
-	reader := newRedisReader(bufio.NewReader(c))
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	reader := newRedisReader(br)
 	writer := newRedisWriter(c)
 
 	for {
 		msg, err := reader.Read()
+		// Connection is closed or broken
+		if err != nil {
+			return
+		}
 
 		switch msg.Type {
 		case redisTypeArray:
@@ -75,6 +96,35 @@ func (srv *redisServer) handleConnection(c net.Conn) {
 					key := string(msg.Arr[1].Bulk)
 					val := string(msg.Arr[2].Bulk)
 
+					// Options: NX, XX, GET, KEEPTTL, EX seconds, PX milliseconds.
+					// Single numeric argument is TTL in nanoseconds
+					if len(msg.Arr) > 3 && !isNumber(msg.Arr[3].Bulk) {
+						opts, err := setOptions(msg.Arr[3:])
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						res, err := srv.cl.SetWithOptions(key, val, opts)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						// Nil reply if there was no old value or value was not set
+						switch {
+						case opts.Get && res.Existed:
+							writer.write(res.Old)
+						case !opts.Get && res.Set:
+							writer.write("OK")
+						default:
+							writer.writeStringSlice(nil)
+						}
+						continue
+					}
+
 					var ttl time.Duration
 					if len(msg.Arr) == 4 {
 						ttli, err := strconv.Atoi(string(msg.Arr[3].Bulk))
@@ -110,24 +160,34 @@ func (srv *redisServer) handleConnection(c net.Conn) {
 
 					writer.write(v)
 					continue
-				case "DEL":
-					if len(msg.Arr) < 1 {
+				case "SETNX", "GETSET", "APPEND":
+					if len(msg.Arr) < 3 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
+					val := string(msg.Arr[2].Bulk)
+
+					var v interface{}
+					switch string(msg.Arr[0].Bulk) {
+					case "SETNX":
+						v, err = srv.cl.SetNX(key, val)
+					case "GETSET":
+						v, err = srv.cl.GetSet(key, val)
+					default:
+						v, err = srv.cl.Append(key, val)
+					}
 
-					err := srv.cl.Remove(key)
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write("OK")
+					writer.write(v)
 					continue
 
-				case "TTL":
+				case "GETDEL", "STRLEN":
 					if len(msg.Arr) < 2 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
@@ -135,33 +195,43 @@ func (srv *redisServer) handleConnection(c net.Conn) {
 
 					key := string(msg.Arr[1].Bulk)
 
-					var ttl time.Duration
-					ttli, err := strconv.Atoi(string(msg.Arr[2].Bulk))
-					ttl = time.Duration(ttli)
-					if err != nil {
-						err = writer.write(ErrRedisWrongTTL)
-						continue
+					var v interface{}
+					if string(msg.Arr[0].Bulk) == "GETDEL" {
+						v, err = srv.cl.GetDel(key)
+					} else {
+						v, err = srv.cl.StrLen(key)
 					}
 
-					err = srv.cl.TTL(key, ttl)
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write("OK")
+					writer.write(v)
 					continue
 
-				case "HGET":
-					if len(msg.Arr) < 2 {
+				case "GETRANGE":
+					if len(msg.Arr) < 4 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
-					field := string(msg.Arr[2].Bulk)
+					start, err := strconv.Atoi(string(msg.Arr[2].Bulk))
 
-					v, err := srv.cl.HashGet(key, field)
+					if err != nil {
+						writer.write(ErrNotInteger)
+						continue
+					}
+
+					end, err := strconv.Atoi(string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(ErrNotInteger)
+						continue
+					}
+
+					v, err := srv.cl.GetRange(key, start, end)
 
 					if err != nil {
 						writer.write(err)
@@ -171,136 +241,262 @@ func (srv *redisServer) handleConnection(c net.Conn) {
 					writer.write(v)
 					continue
 
-				case "HSET":
-					if len(msg.Arr) < 3 {
+				case "SETRANGE":
+					if len(msg.Arr) < 4 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
-					fields := make([]string, 0)
+					offset, err := strconv.Atoi(string(msg.Arr[2].Bulk))
 
-					for _, v := range msg.Arr[2:] {
-						fields = append(fields, string(v.Bulk))
+					if err != nil {
+						writer.write(ErrNotInteger)
+						continue
 					}
 
-					err := srv.cl.HashSet(key, fields...)
+					n, err := srv.cl.SetRange(key, offset, string(msg.Arr[3].Bulk))
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write("OK")
+					writer.write(n)
 					continue
 
-				case "HGETALL":
-					if len(msg.Arr) < 1 {
+				case "SETBIT":
+					if len(msg.Arr) < 4 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
+					offset, err := strconv.Atoi(string(msg.Arr[2].Bulk))
 
-					v, err := srv.cl.HashGetAll(key)
+					if err != nil {
+						writer.write(ErrBitOffset)
+						continue
+					}
+
+					bit, err := strconv.Atoi(string(msg.Arr[3].Bulk))
 
 					if err != nil {
-						writer.write(err)
+						writer.write(ErrBitValue)
 						continue
 					}
 
-					r := make([]string, len(v)*2)
+					old, err := srv.cl.SetBit(key, offset, bit)
 
-					i := 0
-					for k, a := range v {
-						r[i] = k
-						r[i+1] = a
-						i += 2
+					if err != nil {
+						writer.write(err)
+						continue
 					}
 
-					writer.writeStringSlice(r)
+					writer.write(old)
 					continue
 
-				case "HDEL":
+				case "GETBIT":
 					if len(msg.Arr) < 3 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
-					field := string(msg.Arr[2].Bulk)
+					offset, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(ErrBitOffset)
+						continue
+					}
 
-					err := srv.cl.HashDel(key, field)
+					bit, err := srv.cl.GetBit(key, offset)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write("OK")
+					writer.write(bit)
 					continue
 
-				case "HKEYS":
-					if len(msg.Arr) < 1 {
+				case "BITCOUNT":
+					// Range is optional, but start and end go together
+					if len(msg.Arr) != 2 && len(msg.Arr) != 4 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
+					start, end := 0, -1
 
-					v, err := srv.cl.HashKeys(key)
+					if len(msg.Arr) == 4 {
+						start, err = strconv.Atoi(string(msg.Arr[2].Bulk))
+
+						if err != nil {
+							writer.write(ErrNotInteger)
+							continue
+						}
+
+						end, err = strconv.Atoi(string(msg.Arr[3].Bulk))
+
+						if err != nil {
+							writer.write(ErrNotInteger)
+							continue
+						}
+					}
+
+					n, err := srv.cl.BitCount(key, start, end)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.writeStringSlice(v)
+					writer.write(n)
 					continue
 
-				case "LLEN":
-					if len(msg.Arr) < 2 {
+				case "BITPOS":
+					if len(msg.Arr) < 3 || len(msg.Arr) > 5 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
+					bit, err := strconv.Atoi(string(msg.Arr[2].Bulk))
 
-					v, err := srv.cl.ListLen(key)
+					if err != nil {
+						writer.write(ErrBitValue)
+						continue
+					}
+
+					start := 0
+					if len(msg.Arr) > 3 {
+						start, err = strconv.Atoi(string(msg.Arr[3].Bulk))
+
+						if err != nil {
+							writer.write(ErrNotInteger)
+							continue
+						}
+					}
+
+					// End changes the result for clear bits, so it is passed only if given
+					var end []int
+					if len(msg.Arr) > 4 {
+						e, err := strconv.Atoi(string(msg.Arr[4].Bulk))
+
+						if err != nil {
+							writer.write(ErrNotInteger)
+							continue
+						}
+
+						end = append(end, e)
+					}
+
+					pos, err := srv.cl.BitPos(key, bit, start, end...)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write(v)
+					writer.write(pos)
 					continue
 
-				case "LINDEX":
+				case "BITOP":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					dst := string(msg.Arr[2].Bulk)
+					src := make([]string, 0, len(msg.Arr)-3)
+					for _, v := range msg.Arr[3:] {
+						src = append(src, string(v.Bulk))
+					}
+
+					n, err := srv.cl.BitOp(string(msg.Arr[1].Bulk), dst, src...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "MGET":
 					if len(msg.Arr) < 2 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
-					key := string(msg.Arr[1].Bulk)
-					index, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+					keys := make([]string, 0, len(msg.Arr)-1)
+					for _, v := range msg.Arr[1:] {
+						keys = append(keys, string(v.Bulk))
+					}
+
+					v, err := srv.cl.MGet(keys...)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					v, err := srv.cl.ListIndex(key, index)
+					writer.writeStringSlice(v)
+					continue
+
+				case "MSET", "MSETNX":
+					if len(msg.Arr) < 3 || len(msg.Arr)%2 != 1 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					args := make([]string, 0, len(msg.Arr)-1)
+					for _, v := range msg.Arr[1:] {
+						args = append(args, string(v.Bulk))
+					}
+
+					if string(msg.Arr[0].Bulk) == "MSET" {
+						err = srv.cl.MSet(args...)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						writer.write("OK")
+						continue
+					}
+
+					ok, err := srv.cl.MSetNX(args...)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write(v)
+					writer.write(ok)
+					continue
+
+				case "DEL":
+					if len(msg.Arr) < 1 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					err := srv.cl.Remove(key)
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write("OK")
 					continue
 
-				case "LPOP":
+				case "TTL":
 					if len(msg.Arr) < 2 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
@@ -308,12 +504,37 @@ func (srv *redisServer) handleConnection(c net.Conn) {
 
 					key := string(msg.Arr[1].Bulk)
 
+					var ttl time.Duration
+					ttli, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+					ttl = time.Duration(ttli)
+					if err != nil {
+						err = writer.write(ErrRedisWrongTTL)
+						continue
+					}
+
+					err = srv.cl.TTL(key, ttl)
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					v, err := srv.cl.ListPop(key)
+					writer.write("OK")
+					continue
+
+				case "INCR", "DECR":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					var v int64
+					if string(msg.Arr[0].Bulk) == "INCR" {
+						v, err = srv.cl.Incr(key)
+					} else {
+						v, err = srv.cl.Decr(key)
+					}
 
 					if err != nil {
 						writer.write(err)
@@ -323,67 +544,1620 @@ func (srv *redisServer) handleConnection(c net.Conn) {
 					writer.write(v)
 					continue
 
-				case "LRANGE":
-					if len(msg.Arr) < 4 {
+				case "INCRBY":
+					if len(msg.Arr) < 3 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
-					from, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+					delta, err := strconv.ParseInt(string(msg.Arr[2].Bulk), 10, 64)
 
 					if err != nil {
-						writer.write(err)
+						writer.write(ErrNotInteger)
 						continue
 					}
 
-					to, err := strconv.Atoi(string(msg.Arr[3].Bulk))
+					v, err := srv.cl.IncrBy(key, delta)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					v, err := srv.cl.ListRange(key, from, to)
+					writer.write(v)
+					continue
+
+				case "INCRBYFLOAT":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					delta, err := strconv.ParseFloat(string(msg.Arr[2].Bulk), 64)
+
+					if err != nil {
+						writer.write(ErrNotFloat)
+						continue
+					}
+
+					v, err := srv.cl.IncrByFloat(key, delta)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.writeStringSlice(v)
+					writer.write(formatFloat(v))
 					continue
 
-				case "LPUSH":
-					if len(msg.Arr) < 3 {
+				case "HINCRBY":
+					if len(msg.Arr) < 4 {
 						err = writer.write(ErrRedisWrongArgNum)
 						continue
 					}
 
 					key := string(msg.Arr[1].Bulk)
-					fields := make([]string, 0)
+					field := string(msg.Arr[2].Bulk)
+					delta, err := strconv.ParseInt(string(msg.Arr[3].Bulk), 10, 64)
 
-					for _, v := range msg.Arr[2:] {
-						fields = append(fields, string(v.Bulk))
+					if err != nil {
+						writer.write(ErrNotInteger)
+						continue
 					}
 
-					i, err := srv.cl.ListPush(key, fields...)
+					v, err := srv.cl.HashIncrBy(key, field, delta)
 
 					if err != nil {
 						writer.write(err)
 						continue
 					}
 
-					writer.write(i)
+					writer.write(v)
 					continue
-				}
-			}
-		}
 
-		err = writer.write(ErrRedisUnknownParseError)
-		if err != nil {
-			logrus.Error(err)
-			return
-		}
-	}
+				case "HGET":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					field := string(msg.Arr[2].Bulk)
+
+					v, err := srv.cl.HashGet(key, field)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "HSET":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					fields := make([]string, 0)
+
+					for _, v := range msg.Arr[2:] {
+						fields = append(fields, string(v.Bulk))
+					}
+
+					n, err := srv.cl.HashSet(key, fields...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "HGETALL":
+					if len(msg.Arr) < 1 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					v, err := srv.cl.HashGetAll(key)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					r := make([]string, len(v)*2)
+
+					i := 0
+					for k, a := range v {
+						r[i] = k
+						r[i+1] = a
+						i += 2
+					}
+
+					writer.writeStringSlice(r)
+					continue
+
+				case "HDEL":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					fields := make([]string, 0)
+
+					for _, v := range msg.Arr[2:] {
+						fields = append(fields, string(v.Bulk))
+					}
+
+					n, err := srv.cl.HashDel(key, fields...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "HSETNX":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					ok, err := srv.cl.HashSetNX(key, string(msg.Arr[2].Bulk), string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(ok)
+					continue
+
+				case "HMGET":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					fields := make([]string, 0)
+
+					for _, v := range msg.Arr[2:] {
+						fields = append(fields, string(v.Bulk))
+					}
+
+					v, err := srv.cl.HashMultiGet(key, fields...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(v)
+					continue
+
+				case "HVALS":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					v, err := srv.cl.HashValues(string(msg.Arr[1].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(v)
+					continue
+
+				case "HLEN":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					n, err := srv.cl.HashLen(string(msg.Arr[1].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "HEXISTS", "HSTRLEN":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					field := string(msg.Arr[2].Bulk)
+
+					var v interface{}
+					if string(msg.Arr[0].Bulk) == "HEXISTS" {
+						v, err = srv.cl.HashExists(key, field)
+					} else {
+						v, err = srv.cl.HashStrLen(key, field)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "HSCAN":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					cursor, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(ErrHashCursor)
+						continue
+					}
+
+					// Options: MATCH pattern, COUNT count
+					match, count := "", 0
+					for i := 3; i < len(msg.Arr) && err == nil; i += 2 {
+						if i+1 >= len(msg.Arr) {
+							err = ErrRedisSyntaxError
+							break
+						}
+
+						switch string(msg.Arr[i].Bulk) {
+						case "MATCH":
+							match = string(msg.Arr[i+1].Bulk)
+						case "COUNT":
+							count, err = strconv.Atoi(string(msg.Arr[i+1].Bulk))
+						default:
+							err = ErrRedisSyntaxError
+						}
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					next, pairs, err := srv.cl.HashScan(key, cursor, match, count)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					// Flat reply: cursor followed by field-value pairs
+					writer.writeStringSlice(append([]string{strconv.Itoa(next)}, pairs...))
+					continue
+
+				case "HKEYS":
+					if len(msg.Arr) < 1 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					v, err := srv.cl.HashKeys(key)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(v)
+					continue
+
+				case "LLEN":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					v, err := srv.cl.ListLen(key)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "LINDEX":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					index, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					v, err := srv.cl.ListIndex(key, index)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "LPOP", "RPOP":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					var v string
+					if string(msg.Arr[0].Bulk) == "LPOP" {
+						v, err = srv.cl.ListPopLeft(key)
+					} else {
+						v, err = srv.cl.ListPop(key)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "LRANGE":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					from, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					to, err := strconv.Atoi(string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					v, err := srv.cl.ListRange(key, from, to)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(v)
+					continue
+
+				case "LPUSH", "RPUSH":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					fields := make([]string, 0)
+
+					for _, v := range msg.Arr[2:] {
+						fields = append(fields, string(v.Bulk))
+					}
+
+					var i int
+					if string(msg.Arr[0].Bulk) == "LPUSH" {
+						i, err = srv.cl.ListPushLeft(key, fields...)
+					} else {
+						i, err = srv.cl.ListPush(key, fields...)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(i)
+					continue
+
+				case "LINSERT":
+					if len(msg.Arr) < 5 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					var before bool
+					switch string(msg.Arr[2].Bulk) {
+					case "BEFORE":
+						before = true
+					case "AFTER":
+					default:
+						writer.write(ErrRedisSyntaxError)
+						continue
+					}
+
+					i, err := srv.cl.ListInsert(key, before, string(msg.Arr[3].Bulk), string(msg.Arr[4].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(i)
+					continue
+
+				case "LSET":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					index, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					err = srv.cl.ListSet(key, index, string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write("OK")
+					continue
+
+				case "LREM":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					count, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					i, err := srv.cl.ListRemove(key, count, string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(i)
+					continue
+
+				case "LTRIM":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					start, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					stop, err := strconv.Atoi(string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					err = srv.cl.ListTrim(key, start, stop)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write("OK")
+					continue
+
+				case "BLPOP", "BRPOP":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					keys := make([]string, 0, len(msg.Arr)-2)
+					for _, v := range msg.Arr[1 : len(msg.Arr)-1] {
+						keys = append(keys, string(v.Bulk))
+					}
+
+					ctx, cancel, err := srv.blockingContext(c, br, msg.Arr[len(msg.Arr)-1].Bulk)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					left := string(msg.Arr[0].Bulk) == "BLPOP"
+
+					var key, v string
+					if left {
+						key, v, err = srv.cl.ListBlockingPopLeft(ctx, keys...)
+					} else {
+						key, v, err = srv.cl.ListBlockingPop(ctx, keys...)
+					}
+					cancel()
+
+					if err == context.DeadlineExceeded {
+						writer.writeStringSlice(nil)
+						continue
+					}
+
+					// Client is gone or server is stopped
+					if err == context.Canceled {
+						return
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					// Item is returned to where it was popped from if client can't get it
+					err = writer.write(key, v)
+					if err != nil {
+						if left {
+							_, err = srv.cl.ListPushLeft(key, v)
+						} else {
+							_, err = srv.cl.ListPush(key, v)
+						}
+
+						if err != nil {
+							logrus.Errorf("can't return popped item to %s: %v", key, err)
+						}
+
+						return
+					}
+					continue
+
+				case "LMOVE", "BLMOVE":
+					blocking := string(msg.Arr[0].Bulk) == "BLMOVE"
+					if len(msg.Arr) < 5 || (blocking && len(msg.Arr) < 6) {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					src := string(msg.Arr[1].Bulk)
+					dst := string(msg.Arr[2].Bulk)
+					srcLeft, ok1 := listSide(msg.Arr[3].Bulk)
+					dstLeft, ok2 := listSide(msg.Arr[4].Bulk)
+
+					if !ok1 || !ok2 {
+						writer.write(ErrRedisSyntaxError)
+						continue
+					}
+
+					var v string
+					if blocking {
+						var ctx context.Context
+						var cancel context.CancelFunc
+						ctx, cancel, err = srv.blockingContext(c, br, msg.Arr[5].Bulk)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						// Moved item stays in dst even if reply is lost
+						v, err = srv.cl.ListBlockingMove(ctx, src, dst, srcLeft, dstLeft)
+						cancel()
+
+						if err == context.DeadlineExceeded {
+							writer.writeStringSlice(nil)
+							continue
+						}
+
+						if err == context.Canceled {
+							return
+						}
+					} else {
+						v, err = srv.cl.ListMove(src, dst, srcLeft, dstLeft)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "SADD", "SREM":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					members := make([]string, 0)
+
+					for _, v := range msg.Arr[2:] {
+						members = append(members, string(v.Bulk))
+					}
+
+					var n int
+					if string(msg.Arr[0].Bulk) == "SADD" {
+						n, err = srv.cl.SetAdd(key, members...)
+					} else {
+						n, err = srv.cl.SetRemove(key, members...)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "SISMEMBER":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					member := string(msg.Arr[2].Bulk)
+
+					v, err := srv.cl.SetIsMember(key, member)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "SMEMBERS":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					v, err := srv.cl.SetMembers(key)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(v)
+					continue
+
+				case "SCARD":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					v, err := srv.cl.SetCard(key)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "SINTER", "SUNION", "SDIFF":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					keys := make([]string, 0)
+
+					for _, v := range msg.Arr[1:] {
+						keys = append(keys, string(v.Bulk))
+					}
+
+					var v []string
+					switch string(msg.Arr[0].Bulk) {
+					case "SINTER":
+						v, err = srv.cl.SetInter(keys...)
+					case "SUNION":
+						v, err = srv.cl.SetUnion(keys...)
+					default:
+						v, err = srv.cl.SetDiff(keys...)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(v)
+					continue
+
+				case "ZADD":
+					if len(msg.Arr) < 4 || len(msg.Arr)%2 != 0 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					members := make([]ScoredMember, 0)
+
+					for i := 2; i < len(msg.Arr); i += 2 {
+						score, err := parseScore(string(msg.Arr[i].Bulk))
+						if err != nil {
+							break
+						}
+
+						members = append(members, ScoredMember{Member: string(msg.Arr[i+1].Bulk), Score: score})
+					}
+
+					if len(members) != (len(msg.Arr)-2)/2 {
+						writer.write(ErrScoreNotFloat)
+						continue
+					}
+
+					n, err := srv.cl.SortedSetAdd(key, members...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "ZREM":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					members := make([]string, 0)
+
+					for _, v := range msg.Arr[2:] {
+						members = append(members, string(v.Bulk))
+					}
+
+					n, err := srv.cl.SortedSetRemove(key, members...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "ZSCORE":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					member := string(msg.Arr[2].Bulk)
+
+					v, err := srv.cl.SortedSetScore(key, member)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(formatScore(v))
+					continue
+
+				case "ZRANK":
+					if len(msg.Arr) < 3 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					member := string(msg.Arr[2].Bulk)
+
+					v, err := srv.cl.SortedSetRank(key, member)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "ZRANGE", "ZREVRANGE":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					start, err := strconv.Atoi(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					stop, err := strconv.Atoi(string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					var v []ScoredMember
+					if string(msg.Arr[0].Bulk) == "ZRANGE" {
+						v, err = srv.cl.SortedSetRange(key, start, stop)
+					} else {
+						v, err = srv.cl.SortedSetRevRange(key, start, stop)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					withScores := len(msg.Arr) > 4 && string(msg.Arr[4].Bulk) == "WITHSCORES"
+					writer.writeStringSlice(scoredReply(v, withScores))
+					continue
+
+				case "ZRANGEBYSCORE":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					min, err := parseScore(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					max, err := parseScore(string(msg.Arr[3].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					// Options: WITHSCORES, LIMIT offset count
+					withScores := false
+					offset, count := 0, -1
+					for i := 4; i < len(msg.Arr) && err == nil; i++ {
+						switch string(msg.Arr[i].Bulk) {
+						case "WITHSCORES":
+							withScores = true
+						case "LIMIT":
+							if i+2 >= len(msg.Arr) {
+								err = ErrRedisWrongArgNum
+								break
+							}
+
+							offset, err = strconv.Atoi(string(msg.Arr[i+1].Bulk))
+							if err == nil {
+								count, err = strconv.Atoi(string(msg.Arr[i+2].Bulk))
+							}
+
+							i += 2
+						default:
+							err = ErrRedisUnknownParseError
+						}
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					v, err := srv.cl.SortedSetRangeByScore(key, min, max, offset, count)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeStringSlice(scoredReply(v, withScores))
+					continue
+
+				case "ZINCRBY":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					incr, err := parseScore(string(msg.Arr[2].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					member := string(msg.Arr[3].Bulk)
+
+					v, err := srv.cl.SortedSetIncrBy(key, member, incr)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(formatScore(v))
+					continue
+
+				case "ZCARD":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+
+					v, err := srv.cl.SortedSetCard(key)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(v)
+					continue
+
+				case "PFADD":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					elements := make([]string, 0, len(msg.Arr)-2)
+					for _, v := range msg.Arr[2:] {
+						elements = append(elements, string(v.Bulk))
+					}
+
+					changed, err := srv.cl.HyperLogLogAdd(key, elements...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(changed)
+					continue
+
+				case "PFCOUNT":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					keys := make([]string, 0, len(msg.Arr)-1)
+					for _, v := range msg.Arr[1:] {
+						keys = append(keys, string(v.Bulk))
+					}
+
+					n, err := srv.cl.HyperLogLogCount(keys...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "PFMERGE":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					dst := string(msg.Arr[1].Bulk)
+					src := make([]string, 0, len(msg.Arr)-2)
+					for _, v := range msg.Arr[2:] {
+						src = append(src, string(v.Bulk))
+					}
+
+					err := srv.cl.HyperLogLogMerge(dst, src...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write("OK")
+					continue
+
+				case "XADD":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					args := msg.Arr[2:]
+					maxLen := -1
+
+					if string(args[0].Bulk) == "MAXLEN" {
+						maxLen, args, err = streamMaxLen(args)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+					}
+
+					if len(args) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					fields := make([]string, 0, len(args)-1)
+					for _, v := range args[1:] {
+						fields = append(fields, string(v.Bulk))
+					}
+
+					id, err := srv.cl.StreamAdd(key, string(args[0].Bulk), maxLen, fields...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(id)
+					continue
+
+				case "XLEN":
+					if len(msg.Arr) < 2 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					n, err := srv.cl.StreamLen(string(msg.Arr[1].Bulk))
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "XRANGE", "XREVRANGE":
+					if len(msg.Arr) != 4 && len(msg.Arr) != 6 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					count := -1
+
+					if len(msg.Arr) == 6 {
+						if string(msg.Arr[4].Bulk) != "COUNT" {
+							writer.write(ErrRedisSyntaxError)
+							continue
+						}
+
+						count, err = strconv.Atoi(string(msg.Arr[5].Bulk))
+
+						if err != nil {
+							writer.write(ErrNotInteger)
+							continue
+						}
+					}
+
+					var entries []StreamEntry
+					if string(msg.Arr[0].Bulk) == "XRANGE" {
+						entries, err = srv.cl.StreamRange(key, string(msg.Arr[2].Bulk), string(msg.Arr[3].Bulk), count)
+					} else {
+						entries, err = srv.cl.StreamRevRange(key, string(msg.Arr[2].Bulk), string(msg.Arr[3].Bulk), count)
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.writeArgs(streamEntriesReply(entries))
+					continue
+
+				case "XTRIM":
+					if len(msg.Arr) < 4 || string(msg.Arr[2].Bulk) != "MAXLEN" {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					maxLen, args, err := streamMaxLen(msg.Arr[2:])
+
+					if err == nil && len(args) != 0 {
+						err = ErrRedisSyntaxError
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					n, err := srv.cl.StreamTrim(string(msg.Arr[1].Bulk), maxLen)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "XGROUP":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[2].Bulk)
+					group := string(msg.Arr[3].Bulk)
+
+					switch string(msg.Arr[1].Bulk) {
+					case "CREATE":
+						if len(msg.Arr) < 5 || len(msg.Arr) > 6 {
+							err = writer.write(ErrRedisWrongArgNum)
+							continue
+						}
+
+						mkStream := len(msg.Arr) == 6
+						if mkStream && string(msg.Arr[5].Bulk) != "MKSTREAM" {
+							writer.write(ErrRedisSyntaxError)
+							continue
+						}
+
+						err := srv.cl.StreamGroupCreate(key, group, string(msg.Arr[4].Bulk), mkStream)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						writer.write("OK")
+					case "DESTROY":
+						ok, err := srv.cl.StreamGroupDestroy(key, group)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						writer.write(ok)
+					default:
+						writer.write(ErrRedisSyntaxError)
+					}
+
+					continue
+
+				case "XREADGROUP":
+					// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] STREAMS key id
+					if len(msg.Arr) < 7 || string(msg.Arr[1].Bulk) != "GROUP" {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					group := string(msg.Arr[2].Bulk)
+					consumer := string(msg.Arr[3].Bulk)
+					count := 0
+					var block []byte
+
+					args := msg.Arr[4:]
+					for len(args) > 1 && string(args[0].Bulk) != "STREAMS" {
+						switch string(args[0].Bulk) {
+						case "COUNT":
+							count, err = strconv.Atoi(string(args[1].Bulk))
+							if err != nil {
+								err = ErrNotInteger
+							}
+						case "BLOCK":
+							block = args[1].Bulk
+						default:
+							err = ErrRedisSyntaxError
+						}
+
+						if err != nil {
+							break
+						}
+
+						args = args[2:]
+					}
+
+					if err == nil && (len(args) == 0 || string(args[0].Bulk) != "STREAMS") {
+						err = ErrRedisSyntaxError
+					}
+
+					if err == nil && len(args) != 3 {
+						err = ErrRedisSingleStream
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					key := string(args[1].Bulk)
+					id := string(args[2].Bulk)
+
+					var entries []StreamEntry
+					if block != nil && id == ">" {
+						var ctx context.Context
+						var cancel context.CancelFunc
+
+						ctx, cancel, err = srv.streamBlockingContext(c, br, block)
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						// Entries delivered to consumer that can't get the reply stay pending in group
+						entries, err = srv.cl.StreamBlockingReadGroup(ctx, key, group, consumer, count)
+						cancel()
+
+						if err == context.Canceled {
+							return
+						}
+					} else {
+						entries, err = srv.cl.StreamReadGroup(key, group, consumer, id, count)
+					}
+
+					// Nil reply if there are no new entries
+					if err == context.DeadlineExceeded || (err == nil && id == ">" && len(entries) == 0) {
+						err = writer.writeStringSlice(nil)
+						continue
+					}
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write([]interface{}{key, streamEntriesReply(entries)})
+					continue
+
+				case "XACK":
+					if len(msg.Arr) < 4 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					ids := make([]string, 0, len(msg.Arr)-3)
+					for _, v := range msg.Arr[3:] {
+						ids = append(ids, string(v.Bulk))
+					}
+
+					n, err := srv.cl.StreamAck(string(msg.Arr[1].Bulk), string(msg.Arr[2].Bulk), ids...)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write(n)
+					continue
+
+				case "XPENDING":
+					// XPENDING key group [start end count [consumer]]
+					if len(msg.Arr) != 3 && len(msg.Arr) != 6 && len(msg.Arr) != 7 {
+						err = writer.write(ErrRedisWrongArgNum)
+						continue
+					}
+
+					key := string(msg.Arr[1].Bulk)
+					group := string(msg.Arr[2].Bulk)
+
+					if len(msg.Arr) == 3 {
+						sum, err := srv.cl.StreamPending(key, group)
+
+						if err != nil {
+							writer.write(err)
+							continue
+						}
+
+						consumers := make([]string, 0, len(sum.Consumers))
+						for c := range sum.Consumers {
+							consumers = append(consumers, c)
+						}
+
+						sort.Strings(consumers)
+
+						counts := make([]interface{}, len(consumers))
+						for i, c := range consumers {
+							counts[i] = []interface{}{c, sum.Consumers[c]}
+						}
+
+						writer.write(sum.Count, sum.First, sum.Last, counts)
+						continue
+					}
+
+					count, err := strconv.Atoi(string(msg.Arr[5].Bulk))
+
+					if err != nil {
+						writer.write(ErrNotInteger)
+						continue
+					}
+
+					consumer := ""
+					if len(msg.Arr) == 7 {
+						consumer = string(msg.Arr[6].Bulk)
+					}
+
+					pending, err := srv.cl.StreamPendingRange(key, group, string(msg.Arr[3].Bulk), string(msg.Arr[4].Bulk), count, consumer)
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					r := make([]interface{}, len(pending))
+					for i, p := range pending {
+						r[i] = []interface{}{p.ID, p.Consumer, int64(p.Idle / time.Millisecond), p.Deliveries}
+					}
+
+					writer.writeArgs(r)
+					continue
+
+				case "BGREWRITEAOF":
+					err := srv.db.startRewrite()
+
+					if err != nil {
+						writer.write(err)
+						continue
+					}
+
+					writer.write("Background append only file rewriting started")
+					continue
+				}
+			}
+		}
+
+		err = writer.write(ErrRedisUnknownParseError)
+		if err != nil {
+			logrus.Error(err)
+			return
+		}
+	}
+}
+
+// Options of SET command
+func setOptions(args []*redisMessage) (SetOptions, error) {
+	var opts SetOptions
+	var expire bool
+
+	for i := 0; i < len(args); i++ {
+		switch string(args[i].Bulk) {
+		case "NX":
+			opts.NX = true
+		case "XX":
+			opts.XX = true
+		case "GET":
+			opts.Get = true
+		case "KEEPTTL":
+			opts.KeepTTL = true
+		case "EX", "PX":
+			if expire || i+1 >= len(args) {
+				return opts, ErrRedisSyntaxError
+			}
+
+			n, err := strconv.ParseInt(string(args[i+1].Bulk), 10, 64)
+			if err != nil || n <= 0 {
+				return opts, ErrRedisWrongTTL
+			}
+
+			unit := time.Second
+			if string(args[i].Bulk) == "PX" {
+				unit = time.Millisecond
+			}
+
+			if n > math.MaxInt64/int64(unit) {
+				return opts, ErrRedisWrongTTL
+			}
+
+			opts.TTL = time.Duration(n) * unit
+			expire = true
+			i++
+		default:
+			return opts, ErrRedisSyntaxError
+		}
+	}
+
+	if (opts.NX && opts.XX) || (opts.KeepTTL && expire) {
+		return opts, ErrRedisSyntaxError
+	}
+
+	return opts, nil
+}
+
+func isNumber(b []byte) bool {
+	_, err := strconv.ParseInt(string(b), 10, 64)
+
+	return err == nil
+}
+
+// Context of blocking command with timeout in seconds, 0 means no timeout
+func (srv *redisServer) blockingContext(c net.Conn, br *bufio.Reader, timeout []byte) (context.Context, context.CancelFunc, error) {
+	t, err := strconv.ParseFloat(string(timeout), 64)
+	if err != nil || t < 0 || math.IsInf(t, 0) || math.IsNaN(t) {
+		return nil, nil, ErrRedisWrongTimeout
+	}
+
+	ctx, cancel := srv.connContext(c, br, time.Duration(t*float64(time.Second)))
+
+	return ctx, cancel, nil
+}
+
+// Context of blocking command with timeout, 0 means no timeout. It is cancelled when client closes
+// connection or server is stopped, so nobody pops items for a gone client.
+// Cancel must be called before the next command is read
+func (srv *redisServer) connContext(c net.Conn, br *bufio.Reader, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout == 0 {
+		ctx, cancel = context.WithCancel(srv.ctx)
+	} else {
+		ctx, cancel = context.WithTimeout(srv.ctx, timeout)
+	}
+
+	// Client sends nothing while it is blocked, so read fails only when connection is closed.
+	// Peek leaves pipelined commands in the buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_, err := br.Peek(1)
+		if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Timeout()) {
+			cancel()
+		}
+	}()
+
+	return ctx, func() {
+		cancel()
+
+		// Wake up the watcher, reader can't be shared with it
+		c.SetReadDeadline(time.Now())
+		<-done
+		c.SetReadDeadline(time.Time{})
+	}
+}
+
+// LEFT or RIGHT argument of list move, true is for LEFT
+func listSide(side []byte) (bool, bool) {
+	switch string(side) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+
+	return false, false
+}
+
+// Members of sorted set reply, followed by their scores if withScores is set
+func scoredReply(members []ScoredMember, withScores bool) []string {
+	if withScores {
+		return scorePairs(members)
+	}
+
+	r := make([]string, len(members))
+	for i, m := range members {
+		r[i] = m.Member
+	}
+
+	return r
+}
+
+// Timeout of stream blocking read in milliseconds, 0 waits forever
+func (srv *redisServer) streamBlockingContext(c net.Conn, br *bufio.Reader, timeout []byte) (context.Context, context.CancelFunc, error) {
+	ms, err := strconv.ParseInt(string(timeout), 10, 64)
+	if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+		return nil, nil, ErrRedisWrongTimeout
+	}
+
+	ctx, cancel := srv.connContext(c, br, time.Duration(ms)*time.Millisecond)
+
+	return ctx, cancel, nil
+}
+
+// MAXLEN [=|~] count of XADD and XTRIM. Trimming is always exact
+// Returns max length and the rest of args on success and error on fail
+func streamMaxLen(args []*redisMessage) (int, []*redisMessage, error) {
+	args = args[1:]
+	if len(args) > 0 && (string(args[0].Bulk) == "=" || string(args[0].Bulk) == "~") {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return 0, nil, ErrRedisSyntaxError
+	}
+
+	n, err := strconv.Atoi(string(args[0].Bulk))
+	if err != nil || n < 0 {
+		return 0, nil, ErrStreamMaxLen
+	}
+
+	return n, args[1:], nil
+}
+
+// Entries as ID and field-value pairs arrays, as in Redis
+func streamEntriesReply(entries []StreamEntry) []interface{} {
+	r := make([]interface{}, len(entries))
+	for i, e := range entries {
+		// Trimmed entry of pending list has no fields
+		var fields interface{}
+		if e.Fields != nil {
+			f := make([]interface{}, len(e.Fields))
+			for j, v := range e.Fields {
+				f[j] = v
+			}
+
+			fields = f
+		}
+
+		r[i] = []interface{}{e.ID, fields}
+	}
+
+	return r
 }
@@ -28,8 +28,21 @@ func (w *redisWriter) writeStringSlice(args []string) error {
 }
 
 func (w *redisWriter) writeArgs(args []interface{}) error {
+	buf, err := appendArgs(make([]byte, 0, 10*len(args)), args)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(buf)
+
+	return err
+}
+
+// Append array of args, args may be arrays themselves
+func appendArgs(buf []byte, args []interface{}) ([]byte, error) {
+	var err error
+
 	argsNum := len(args)
-	buf := make([]byte, 0, 10*argsNum)
 	buf = append(buf, '*')
 	buf = strconv.AppendInt(buf, int64(argsNum), 10)
 	buf = appendTail(buf)
@@ -80,14 +93,17 @@ func (w *redisWriter) writeArgs(args []interface{}) error {
 			buf = appendUint64(buf, uint64(v))
 		case error:
 			buf = appendError(buf, arg.(error))
+		case []interface{}:
+			buf, err = appendArgs(buf, v)
+			if err != nil {
+				return nil, err
+			}
 		default:
-			return errors.New(fmt.Sprintf("Invalid argument type : {%s} while writing.", reflect.TypeOf(arg)))
+			return nil, errors.New(fmt.Sprintf("Invalid argument type : {%s} while writing.", reflect.TypeOf(arg)))
 		}
 	}
 
-	_, err := w.w.Write(buf)
-
-	return err
+	return buf, nil
 }
 
 // write data
@@ -0,0 +1,207 @@
+package iqdb
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ravlio/iqdb/aof"
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations queued for every apply worker
+const replayQueueSize = 1024
+
+// How often replay progress is reported
+const replayProgressPeriod = time.Second
+
+// AOF replay progress
+type ReplayProgress struct {
+	// Bytes of AOF read and total bytes to replay
+	Read  int64
+	Total int64
+	// Operations applied
+	Records int64
+}
+
+// Parallel AOF replay. Operations are decoded by the caller and applied by workers.
+// Worker is chosen by the key shard, so operations on one key keep their order.
+// Operations on many keys are applied by the caller when all queued ones are applied
+type replayer struct {
+	iq     *IqDB
+	queues []chan replayTask
+	wg     *sync.WaitGroup
+	// Closed on the first apply error
+	failed  chan struct{}
+	errOnce *sync.Once
+	err     error
+	// Bytes of already read segments
+	read     int64
+	total    int64
+	records  int64
+	started  time.Time
+	reported time.Time
+}
+
+// Operation to apply or barrier to pass
+type replayTask struct {
+	op      *aof.Op
+	barrier *sync.WaitGroup
+}
+
+// Start apply workers, one per shard but no more than CPUs
+func (iq *IqDB) newReplayer(total int64) *replayer {
+	n := iq.opts.ShardCount
+	if p := runtime.GOMAXPROCS(0); n > p {
+		n = p
+	}
+
+	r := &replayer{
+		iq:       iq,
+		wg:       &sync.WaitGroup{},
+		failed:   make(chan struct{}),
+		errOnce:  &sync.Once{},
+		total:    total,
+		started:  time.Now(),
+		reported: time.Now(),
+	}
+
+	for i := 0; i < n; i++ {
+		q := make(chan replayTask, replayQueueSize)
+		r.queues = append(r.queues, q)
+
+		r.wg.Add(1)
+		go r.run(q)
+	}
+
+	return r
+}
+
+func (r *replayer) run(q chan replayTask) {
+	defer r.wg.Done()
+
+	for t := range q {
+		if t.barrier != nil {
+			t.barrier.Done()
+			continue
+		}
+
+		err := r.iq.applyOp(t.op)
+		if err != nil {
+			r.fail(err)
+			// Drain the queue, so the decoder is never blocked
+			for t := range q {
+				if t.barrier != nil {
+					t.barrier.Done()
+				}
+			}
+			return
+		}
+
+		atomic.AddInt64(&r.records, 1)
+	}
+}
+
+func (r *replayer) fail(err error) {
+	r.errOnce.Do(func() {
+		r.err = err
+		close(r.failed)
+	})
+}
+
+// Queue operation to the worker of its shard
+// Returns error of failed worker
+func (r *replayer) apply(op *aof.Op) error {
+	if op.Code == aof.OpMSet {
+		return r.applyMulti(op)
+	}
+
+	q := r.queues[r.iq.distmap.shardIndex(op.Key)%len(r.queues)]
+
+	select {
+	case q <- replayTask{op: op}:
+		return nil
+	case <-r.failed:
+		return r.err
+	}
+}
+
+// Wait until all queued operations are applied and apply operation on many keys
+func (r *replayer) applyMulti(op *aof.Op) error {
+	barrier := &sync.WaitGroup{}
+	barrier.Add(len(r.queues))
+
+	for _, q := range r.queues {
+		select {
+		case q <- replayTask{barrier: barrier}:
+		case <-r.failed:
+			return r.err
+		}
+	}
+
+	barrier.Wait()
+
+	select {
+	case <-r.failed:
+		return r.err
+	default:
+	}
+
+	err := r.iq.applyOp(op)
+	if err != nil {
+		r.fail(err)
+		return err
+	}
+
+	atomic.AddInt64(&r.records, 1)
+
+	return nil
+}
+
+// Report progress once in a while, n is bytes read of the current segment
+func (r *replayer) progress(n int64) {
+	if time.Since(r.reported) < replayProgressPeriod {
+		return
+	}
+
+	p := r.report(r.read + n)
+	log.Infof("AOF replay: %d of %d bytes read, %d operations applied", p.Read, p.Total, p.Records)
+}
+
+// Segment is read, n is its bytes read
+func (r *replayer) segmentDone(n int64) {
+	r.read += n
+}
+
+func (r *replayer) report(read int64) ReplayProgress {
+	r.reported = time.Now()
+
+	p := ReplayProgress{Read: read, Total: r.total, Records: atomic.LoadInt64(&r.records)}
+	if r.iq.opts.OnReplayProgress != nil {
+		r.iq.opts.OnReplayProgress(p)
+	}
+
+	return p
+}
+
+// Wait for queued operations to be applied and stop workers
+// Returns the first apply error
+func (r *replayer) wait() error {
+	for _, q := range r.queues {
+		close(q)
+	}
+
+	r.wg.Wait()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	p := r.report(r.total)
+	if p.Records > 0 {
+		log.Infof("AOF replay finished: %d operations applied in %s", p.Records, time.Since(r.started))
+	}
+
+	return nil
+}
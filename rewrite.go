@@ -0,0 +1,298 @@
+package iqdb
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ravlio/iqdb/aof"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrRewriteInProgress = errors.New("AOF rewrite already in progress")
+
+// Default minimal AOF size for automatic rewrite
+const defaultAOFRewriteMinSize = 64 << 20
+
+// Rewrite AOF so it contains only the minimal set of operations
+// needed to rebuild the current dataset. Writes are not blocked while the new file is built:
+// records that arrive in the meantime are captured and appended before the files are swapped
+// Returns error on fail
+func (iq *IqDB) RewriteAOF() error {
+	iq.syncMx.Lock()
+	err := iq.canRewrite()
+	if err != nil {
+		iq.syncMx.Unlock()
+		return err
+	}
+	iq.isRewriting = true
+	iq.syncMx.Unlock()
+
+	return iq.rewriteAOF()
+}
+
+// Make key the current encryption key and rewrite AOF with it. Snapshot is removed by rewrite,
+// so old keys are not needed after that. Nil key disables encryption.
+// If rewrite is already in progress, only new segments use new key and rotation must be retried
+// Returns error on fail
+func (iq *IqDB) RotateEncryptionKey(key []byte) error {
+	iq.syncMx.Lock()
+	keys, err := iq.keys.Rotate(key)
+	if err == nil {
+		iq.keys = keys
+	}
+	iq.syncMx.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return iq.RewriteAOF()
+}
+
+// Start rewrite in background
+func (iq *IqDB) startRewrite() error {
+	iq.syncMx.Lock()
+	err := iq.canRewrite()
+	if err != nil {
+		iq.syncMx.Unlock()
+		return err
+	}
+	iq.isRewriting = true
+	iq.syncMx.Unlock()
+
+	go iq.runRewrite()
+
+	return nil
+}
+
+func (iq *IqDB) runRewrite() {
+	log.Info("AOF rewrite started")
+
+	err := iq.rewriteAOF()
+	if err != nil {
+		log.Errorf("AOF rewrite failed: %s", err)
+		return
+	}
+
+	log.Info("AOF rewrite finished")
+}
+
+// Backup needs old segments, so rewrite waits for it. Caller must hold syncMx
+func (iq *IqDB) canRewrite() error {
+	if iq.isRewriting {
+		return ErrRewriteInProgress
+	}
+
+	if iq.backups > 0 {
+		return ErrBackupInProgress
+	}
+
+	return nil
+}
+
+// Called with syncMx held after each AOF write
+func (iq *IqDB) needsRewrite() bool {
+	if iq.opts.AOFRewritePercent <= 0 || iq.canRewrite() != nil {
+		return false
+	}
+
+	if iq.aofSize < iq.opts.AOFRewriteMinSize {
+		return false
+	}
+
+	base := iq.aofBaseSize
+	if base <= 0 {
+		base = 1
+	}
+
+	return (iq.aofSize-base)*100/base >= int64(iq.opts.AOFRewritePercent)
+}
+
+// isRewriting flag must be set by caller
+func (iq *IqDB) rewriteAOF() error {
+	defer func() {
+		iq.syncMx.Lock()
+		iq.isRewriting = false
+		iq.rewriteBuf = nil
+		iq.syncMx.Unlock()
+	}()
+
+	// Start point-in-time copy of dataset and capturing new records at the same moment.
+	// Keys are copied while the new file is written, writers are held only for the start
+	iq.copyMx.Lock()
+	defer iq.copyMx.Unlock()
+
+	iq.cutMx.Lock()
+	if iq.closed {
+		iq.cutMx.Unlock()
+		return ErrClosed
+	}
+	data := iq.distmap.startCopy()
+	iq.syncMx.Lock()
+	iq.rewriteBuf = &bytes.Buffer{}
+	hdr, c, err := segmentHeader(iq.keys)
+	iq.syncMx.Unlock()
+	iq.cutMx.Unlock()
+
+	defer iq.distmap.stopCopy()
+
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(iq.fname, "rewrite.tmp")
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	size, err := iq.writeDataset(f, data, hdr, c)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// Append everything that was written during rewrite and swap the files
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	b := iq.rewriteBuf.Bytes()
+	if c != nil {
+		b = c.SealFrames(b, size)
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	// Rewritten segment replaces all the others
+	seg := iq.manifest.Next()
+	m := &aof.Manifest{ID: iq.manifest.ID, Segments: []uint64{seg}}
+	if err == nil {
+		err = os.Rename(tmp, iq.segmentPath(seg))
+	}
+	if err == nil {
+		err = aof.WriteManifest(iq.fname, m)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		os.Remove(iq.segmentPath(seg))
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Flush the buffer of the old segment just to release it properly
+	iq.aofBuf.Flush()
+	iq.aof.Close()
+
+	old := iq.manifest.Segments
+	iq.manifest = m
+	iq.setAOFFile(f, c)
+	iq.removeSegments(old)
+
+	// Snapshot points to the old segments, so it can't be used anymore. It is removed
+	// only once rewritten AOF is in place, the one left behind is ignored as it matches no segment
+	if iq.opts.SnapshotFile != "" {
+		err = os.Remove(iq.opts.SnapshotFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("can't remove snapshot %s: %v", iq.opts.SnapshotFile, err)
+		}
+	}
+
+	iq.segSize = fi.Size()
+	iq.segStarted = time.Now()
+	iq.aofSize = iq.segSize
+	iq.aofBaseSize = iq.aofSize
+
+	return nil
+}
+
+// Write segment header and minimal op stream for every key of copy, sealed with c if it is set
+// Returns written size on success and error on fail
+func (iq *IqDB) writeDataset(w io.Writer, data *datasetCopy, hdr []byte, c *aof.Cipher) (int64, error) {
+	bw := bufio.NewWriter(w)
+
+	_, err := bw.Write(hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(len(hdr))
+	err = data.walk(func(key string, kv *KV) error {
+		if isExpired(kv.expire) {
+			return nil
+		}
+
+		b := iq.encodeKV(key, kv)
+		if c != nil {
+			b = c.SealFrames(b, size)
+		}
+
+		_, err := bw.Write(b)
+		size += int64(len(b))
+
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return size, bw.Flush()
+}
+
+// Framed records recreating key with its expiration
+func (iq *IqDB) encodeKV(key string, kv *KV) []byte {
+	var r []byte
+	switch kv.dataType {
+	case dataTypeKV:
+		r = aof.Frame(iq.compress(encodeSet(key, kv.Value, kv.expire)))
+	case dataTypeList:
+		r = aof.Frame(iq.compress(encodeListPush(key, kv.list.list)))
+	case dataTypeHash:
+		r = aof.Frame(iq.compress(encodeHashSet(key, kv.hash.pairs())))
+	case dataTypeSet:
+		r = aof.Frame(iq.compress(encodeSetAdd(key, kv.set.members())))
+	case dataTypeZSet:
+		r = aof.Frame(iq.compress(encodeZSetAdd(key, kv.zset.members())))
+	case dataTypeHLL:
+		r = aof.Frame(iq.compress(encodeHLLMerge(key, kv.hll.bytes())))
+	case dataTypeStream:
+		r = aof.Frame(iq.compress(encodeStreamRestore(key, kv.stream.bytes())))
+	}
+
+	if kv.dataType != dataTypeKV && !kv.expire.IsZero() {
+		r = append(r, aof.Frame(encodeTTL(key, kv.expire))...)
+	}
+
+	return r
+}
+
+// Collect point-in-time copy of all keys
+func collectCopy(c *datasetCopy) map[string]*KV {
+	data := make(map[string]*KV)
+
+	_ = c.walk(func(key string, kv *KV) error {
+		data[key] = kv
+		return nil
+	})
+
+	return data
+}
@@ -0,0 +1,431 @@
+package iqdb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ravlio/iqdb/aof"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default segment size for rotation
+const defaultSegmentSize = 64 << 20
+
+// Position in AOF: segment number and byte offset inside it
+type LogPosition struct {
+	Segment uint64
+	Offset  int64
+}
+
+func (iq *IqDB) segmentPath(seg uint64) string {
+	return filepath.Join(iq.fname, aof.SegmentName(seg))
+}
+
+func newLogID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Prepare AOF directory and read its manifest.
+// Single file AOF of previous versions becomes the first segment
+func openLogDir(dir string, keys *aof.Keyring) (*aof.Manifest, error) {
+	fi, err := os.Stat(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil && !fi.IsDir() {
+		log.Infof("moving single file AOF %s to segment directory", dir)
+
+		tmp := dir + ".migrate"
+		err = os.Rename(dir, tmp)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.Mkdir(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.Rename(tmp, filepath.Join(dir, aof.SegmentName(1)))
+		if err != nil {
+			return nil, err
+		}
+
+		m := &aof.Manifest{ID: newLogID(), Segments: []uint64{1}}
+
+		return m, aof.WriteManifest(dir, m)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := aof.ReadManifest(dir)
+	if os.IsNotExist(err) {
+		var hdr []byte
+		m = &aof.Manifest{ID: newLogID(), Segments: []uint64{1}}
+		hdr, _, err = segmentHeader(keys)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, aof.SegmentName(1)), hdr, 0600)
+		}
+		if err == nil {
+			err = aof.WriteManifest(dir, m)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	removeOrphanSegments(dir, m)
+
+	return m, nil
+}
+
+// Remove segments left by interrupted rewrite or retention
+func removeOrphanSegments(dir string, m *aof.Manifest) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	live := make(map[string]bool)
+	for _, s := range m.Segments {
+		live[aof.SegmentName(s)] = true
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, aof.SegmentExt) || live[name] {
+			continue
+		}
+
+		log.Warnf("removing orphan AOF segment %s", name)
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+// Header of new segment, encrypted with the current key if there is one
+// Returns header and its cipher on success and error on fail
+func segmentHeader(keys *aof.Keyring) ([]byte, *aof.Cipher, error) {
+	c, err := keys.NewCipher()
+	if err != nil || c == nil {
+		return aof.Header(), nil, err
+	}
+
+	return c.Header(), c, nil
+}
+
+// Cipher and key ID of existing segment, nil if it is not encrypted.
+// Returns ErrEncryptionKey if keys don't have its key
+func readSegmentCipher(path string, keys *aof.Keyring) (*aof.Cipher, []byte, error) {
+	r, err := aof.Open(path, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	if r.KeyID == nil {
+		return nil, nil, nil
+	}
+
+	hdr, err := r.RawHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := keys.Cipher(hdr[aofHeaderSize:])
+	if err == aof.ErrKey {
+		err = fmt.Errorf("%s: %w", path, ErrEncryptionKey)
+	}
+
+	return c, r.KeyID, err
+}
+
+// Open segment for appending, new segment gets AOF header
+// Returns segment file, its cipher and size on success and error on fail
+func (iq *IqDB) openSegment(seg uint64) (*os.File, *aof.Cipher, int64, error) {
+	path := iq.segmentPath(seg)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+
+	size := fi.Size()
+	if size > 0 {
+		c, _, err := readSegmentCipher(path, iq.keys)
+		if err != nil {
+			f.Close()
+			return nil, nil, 0, err
+		}
+
+		return f, c, size, nil
+	}
+
+	hdr, c, err := segmentHeader(iq.keys)
+	if err == nil {
+		_, err = f.Write(hdr)
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, nil, 0, err
+	}
+
+	return f, c, int64(len(hdr)), nil
+}
+
+// Size of the current segment header. Caller must hold syncMx
+func (iq *IqDB) segmentHeaderLen() int64 {
+	if iq.cipher != nil {
+		return aof.HeaderLen(aof.VersionEncrypted)
+	}
+
+	return aofHeaderSize
+}
+
+// Whether some segment is not encrypted with the current key.
+// Such log is rewritten on start
+func (iq *IqDB) hasStaleKey() (bool, error) {
+	for _, s := range iq.manifest.Segments {
+		_, id, err := readSegmentCipher(iq.segmentPath(s), iq.keys)
+		if err != nil {
+			return false, err
+		}
+
+		if !bytes.Equal(id, iq.keys.CurrentID()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Whether log has no records yet, e.g. it was just created
+func (iq *IqDB) isEmptyLog() (bool, error) {
+	if len(iq.manifest.Segments) != 1 {
+		return false, nil
+	}
+
+	r, err := aof.Open(iq.segmentPath(iq.manifest.Last()), nil)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	return r.Size <= r.Pos(), nil
+}
+
+// Current end of AOF
+func (iq *IqDB) LogPosition() LogPosition {
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	return LogPosition{Segment: iq.manifest.Last(), Offset: iq.segSize}
+}
+
+// Called with syncMx held after each AOF write
+func (iq *IqDB) needsRotate() bool {
+	if iq.segSize <= iq.segmentHeaderLen() {
+		return false
+	}
+
+	if iq.segSize >= iq.opts.SegmentSize {
+		return true
+	}
+
+	return iq.opts.SegmentPeriod > 0 && time.Since(iq.segStarted) >= iq.opts.SegmentPeriod
+}
+
+// Start new segment. Caller must hold syncMx
+func (iq *IqDB) rotate() error {
+	if iq.segSize <= iq.segmentHeaderLen() {
+		return nil
+	}
+
+	err := iq.aofBuf.Flush()
+	if err == nil {
+		err = iq.aof.Sync()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return iq.startSegment()
+}
+
+// Open next segment and make it current. Caller must hold syncMx
+func (iq *IqDB) startSegment() error {
+	seg := iq.manifest.Next()
+	f, c, size, err := iq.openSegment(seg)
+	if err != nil {
+		return err
+	}
+
+	m := &aof.Manifest{ID: iq.manifest.ID, Segments: append(append([]uint64(nil), iq.manifest.Segments...), seg)}
+	err = aof.WriteManifest(iq.fname, m)
+	if err != nil {
+		f.Close()
+		os.Remove(iq.segmentPath(seg))
+		return err
+	}
+
+	iq.aof.Close()
+	iq.manifest = m
+	iq.setAOFFile(f, c)
+	iq.segSize = size
+	iq.segStarted = time.Now()
+	iq.aofSize += size
+
+	return nil
+}
+
+// Delete segments before position, they are covered by snapshot
+func (iq *IqDB) pruneSegments(pos LogPosition) error {
+	iq.syncMx.Lock()
+	defer iq.syncMx.Unlock()
+
+	// Log was rewritten in the meantime. Backup needs old segments, they are pruned after next snapshot
+	if !iq.manifest.Has(pos.Segment) || iq.backups > 0 {
+		return nil
+	}
+
+	keep := make([]uint64, 0)
+	drop := make([]uint64, 0)
+	for _, s := range iq.manifest.Segments {
+		if s < pos.Segment {
+			drop = append(drop, s)
+		} else {
+			keep = append(keep, s)
+		}
+	}
+
+	if len(drop) == 0 {
+		return nil
+	}
+
+	m := &aof.Manifest{ID: iq.manifest.ID, Segments: keep}
+	err := aof.WriteManifest(iq.fname, m)
+	if err != nil {
+		return err
+	}
+
+	iq.manifest = m
+	iq.removeSegments(drop)
+
+	return nil
+}
+
+func (iq *IqDB) removeSegments(segs []uint64) {
+	for _, s := range segs {
+		path := iq.segmentPath(s)
+
+		fi, err := os.Stat(path)
+		if err == nil {
+			iq.aofSize -= fi.Size()
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			log.Warnf("can't remove AOF segment %s: %s", path, err)
+		}
+	}
+}
+
+// Replay segments starting from position. Operations are applied in parallel
+// Returns the oldest format version met and whether the last segment was truncated on success
+func (iq *IqDB) readLog(pos LogPosition) (int, bool, error) {
+	total, err := iq.logSize()
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, s := range iq.manifest.Segments {
+		if s < pos.Segment {
+			fi, err := os.Stat(iq.segmentPath(s))
+			if err != nil {
+				return 0, false, err
+			}
+
+			total -= fi.Size()
+		}
+	}
+
+	r := iq.newReplayer(total - pos.Offset)
+	version, truncated, err := iq.readSegments(pos, r)
+
+	werr := r.wait()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return version, truncated, werr
+}
+
+// Only the last segment may be truncated
+func (iq *IqDB) readSegments(pos LogPosition, r *replayer) (int, bool, error) {
+	version := aofVersion
+	truncated := false
+
+	for i, seg := range iq.manifest.Segments {
+		if seg < pos.Segment {
+			continue
+		}
+
+		var offset int64
+		if seg == pos.Segment {
+			offset = pos.Offset
+		}
+
+		last := i == len(iq.manifest.Segments)-1
+
+		v, t, err := iq.readAOF(iq.segmentPath(seg), offset, last, r)
+		if err != nil {
+			return 0, false, err
+		}
+
+		if v < version {
+			version = v
+		}
+
+		truncated = t
+	}
+
+	return version, truncated, nil
+}
+
+// Total size of live segments
+func (iq *IqDB) logSize() (int64, error) {
+	var size int64
+
+	for _, s := range iq.manifest.Segments {
+		fi, err := os.Stat(iq.segmentPath(s))
+		if err != nil {
+			return 0, err
+		}
+
+		size += fi.Size()
+	}
+
+	return size, nil
+}
@@ -0,0 +1,566 @@
+package iqdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/ravlio/iqdb/aof"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrSnapshotFormat = errors.New("wrong snapshot format")
+var ErrSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+const snapshotMagic = "IQDBSNAP"
+
+const (
+	// Snapshot of single file AOF, header has AOF offset and checksum of preceding chunk
+	snapshotVersionOffset = 1
+	// Snapshot of segmented AOF, header has log ID and position
+	snapshotVersionPosition = 2
+	// Encrypted snapshot of segmented AOF
+	snapshotVersionEncrypted = 3
+)
+
+const snapshotVersion = snapshotVersionPosition
+
+// Plain size of encrypted snapshot chunk
+const snapshotChunkSize = 64 << 10
+
+// The last chunk is sealed with this bit set in its index, so truncated snapshot is detected
+const snapshotLastChunk = 1 << 63
+
+// Snapshot file layout:
+//
+//	[magic][byte version][string log ID][uint64 segment][uint64 offset][uint64 key count]
+//	[records...][uint32 CRC32 of everything above]
+//
+// Each record is
+//
+//	[byte data type][string key][uint64 expire unix nanoseconds, 0 if none][value]
+//
+// where value is a string for KV, string list for lists and field-value string list for hashes.
+// Strings and lists are encoded the same way as in AOF.
+//
+// Encrypted snapshot is
+//
+//	[magic][byte version][key ID][nonce base][chunks...]
+//
+// where chunks are [uint32 length][sealed chunk] of the plain snapshot above,
+// chunk index is used as nonce offset
+type snapshotHeader struct {
+	// Empty for old snapshots, they can be used only to restore empty AOF
+	logID string
+	pos   LogPosition
+	count uint64
+}
+
+// Write point-in-time snapshot of the whole dataset to w.
+// Snapshot remembers AOF position it was taken at, so only the rest of AOF is replayed after it
+// Returns error on fail
+func (iq *IqDB) Snapshot(w io.Writer) error {
+	_, err := iq.snapshot(w)
+
+	return err
+}
+
+// AOF is rotated at the moment of snapshot, so snapshot covers whole segments before position
+func (iq *IqDB) snapshot(w io.Writer) (LogPosition, error) {
+	iq.copyMx.Lock()
+	defer iq.copyMx.Unlock()
+
+	iq.cutMx.Lock()
+	cp := iq.distmap.startCopy()
+	iq.syncMx.Lock()
+	err := iq.rotate()
+	pos := LogPosition{Segment: iq.manifest.Last(), Offset: iq.segSize}
+	id := iq.manifest.ID
+	c, cerr := iq.keys.NewCipher()
+	iq.syncMx.Unlock()
+	iq.cutMx.Unlock()
+
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		iq.distmap.stopCopy()
+		return pos, err
+	}
+
+	// Snapshot starts with keys count, so keys are collected first
+	data := collectCopy(cp)
+
+	return pos, writeSnapshot(w, data, snapshotHeader{logID: id, pos: pos}, c)
+}
+
+// Save snapshot to file. File is replaced atomically
+// Returns error on fail
+func (iq *IqDB) SaveSnapshot(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	pos, err := iq.snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if path != iq.opts.SnapshotFile {
+		return nil
+	}
+
+	return iq.pruneSegments(pos)
+}
+
+func (iq *IqDB) runSnapshotter() {
+	for range iq.snapshotTicker.C {
+		err := iq.SaveSnapshot(iq.opts.SnapshotFile)
+		if err != nil {
+			log.Errorf("snapshot failed: %s", err)
+		}
+	}
+}
+
+// Write snapshot, encrypted with c if it is set
+func writeSnapshot(w io.Writer, data map[string]*KV, h snapshotHeader, c *aof.Cipher) error {
+	if c == nil {
+		return writeSnapshotData(w, data, h)
+	}
+
+	hdr := append([]byte(snapshotMagic), snapshotVersionEncrypted)
+	_, err := w.Write(append(hdr, c.EncryptionHeader()...))
+	if err != nil {
+		return err
+	}
+
+	s := &snapshotSealer{w: w, c: c}
+	err = writeSnapshotData(s, data, h)
+	if err != nil {
+		return err
+	}
+
+	return s.Close()
+}
+
+func writeSnapshotData(w io.Writer, data map[string]*KV, h snapshotHeader) error {
+	bw := bufio.NewWriter(w)
+	sum := crc32.NewIEEE()
+	mw := io.MultiWriter(bw, sum)
+
+	hdr := aof.Record(snapshotMagic)
+	hdr = append(hdr, snapshotVersion)
+	hdr = hdr.PutString(h.logID)
+	hdr = hdr.PutUint64(h.pos.Segment)
+	hdr = hdr.PutUint64(uint64(h.pos.Offset))
+	hdr = hdr.PutUint64(uint64(len(data)))
+
+	_, err := mw.Write(hdr)
+	if err != nil {
+		return err
+	}
+
+	for key, kv := range data {
+		_, err = mw.Write(encodeSnapshotRecord(key, kv))
+		if err != nil {
+			return err
+		}
+	}
+
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, sum.Sum32())
+	_, err = bw.Write(crc)
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func encodeSnapshotRecord(key string, kv *KV) aof.Record {
+	r := aof.Record{byte(kv.dataType)}
+	r = r.PutString(key)
+
+	r = r.PutUint64(unixNano(kv.expire))
+
+	switch kv.dataType {
+	case dataTypeKV:
+		r = r.PutString(kv.Value)
+	case dataTypeList:
+		r = r.PutStrings(kv.list.list)
+	case dataTypeHash:
+		r = r.PutStrings(kv.hash.pairs())
+	case dataTypeSet:
+		r = r.PutStrings(kv.set.members())
+	case dataTypeZSet:
+		r = r.PutStrings(kv.zset.pairs())
+	case dataTypeHLL:
+		r = r.PutString(string(kv.hll.bytes()))
+	case dataTypeStream:
+		r = r.PutString(string(kv.stream.bytes()))
+	}
+
+	return r
+}
+
+// Snapshot reader keeps running checksum of everything read
+type snapshotReader struct {
+	rdr  io.Reader
+	sum  hashSum32
+	hdr  snapshotHeader
+	read uint64
+}
+
+// Same as hash.Hash32, that package name is taken by hash type
+type hashSum32 interface {
+	io.Writer
+	Sum32() uint32
+}
+
+// Encrypted snapshot is decrypted with keys. Returns ErrEncryptionKey if keys don't have its key
+func newSnapshotReader(r io.Reader, keys *aof.Keyring) (*snapshotReader, error) {
+	br := bufio.NewReader(r)
+
+	b, err := br.Peek(len(snapshotMagic) + 1)
+	if err == nil && string(b[:len(snapshotMagic)]) == snapshotMagic && b[len(snapshotMagic)] == snapshotVersionEncrypted {
+		hdr := make([]byte, len(b)+aof.EncryptionHeaderSize)
+		_, err = io.ReadFull(br, hdr)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := keys.Cipher(hdr[len(b):])
+		if err != nil {
+			return nil, err
+		}
+
+		br = bufio.NewReader(&snapshotOpener{rdr: br, c: c})
+	}
+
+	sum := crc32.NewIEEE()
+	sr := &snapshotReader{rdr: io.TeeReader(br, sum), sum: sum}
+
+	magic := make([]byte, len(snapshotMagic)+1)
+	_, err = io.ReadFull(sr.rdr, magic)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, ErrSnapshotFormat
+	}
+
+	switch magic[len(snapshotMagic)] {
+	case snapshotVersionOffset:
+		// Offset and chunk checksum of single file AOF are useless now
+		_, err = io.ReadFull(sr.rdr, make([]byte, 8+4))
+	case snapshotVersionPosition:
+		sr.hdr.logID, err = aof.ReadString(sr.rdr)
+		if err == nil {
+			sr.hdr.pos.Segment, err = aof.ReadUint64(sr.rdr)
+		}
+		if err == nil {
+			var offset uint64
+			offset, err = aof.ReadUint64(sr.rdr)
+			sr.hdr.pos.Offset = int64(offset)
+		}
+	default:
+		return nil, ErrSnapshotFormat
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	sr.hdr.count, err = aof.ReadUint64(sr.rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// Read next record. Returns io.EOF after the last record when checksum is valid
+func (sr *snapshotReader) next() (string, *KV, error) {
+	if sr.read == sr.hdr.count {
+		expected := sr.sum.Sum32()
+
+		crc := make([]byte, 4)
+		_, err := io.ReadFull(sr.rdr, crc)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if binary.LittleEndian.Uint32(crc) != expected {
+			return "", nil, ErrSnapshotChecksum
+		}
+
+		return "", nil, io.EOF
+	}
+
+	dt := make([]byte, 1)
+	_, err := io.ReadFull(sr.rdr, dt)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := aof.ReadString(sr.rdr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	expire, err := aof.ReadUint64(sr.rdr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	kv := &KV{dataType: int(dt[0]), expire: fromUnixNano(expire)}
+
+	switch kv.dataType {
+	case dataTypeKV:
+		kv.Value, err = aof.ReadString(sr.rdr)
+	case dataTypeList:
+		var l []string
+		l, err = aof.ReadStrings(sr.rdr)
+		kv.list = makeList(l)
+	case dataTypeHash:
+		var args []string
+		args, err = aof.ReadStrings(sr.rdr)
+		kv.hash = makeHash(args)
+	case dataTypeSet:
+		var m []string
+		m, err = aof.ReadStrings(sr.rdr)
+		kv.set = makeSet(m)
+	case dataTypeZSet:
+		var args []string
+		var members []ScoredMember
+		args, err = aof.ReadStrings(sr.rdr)
+		if err == nil {
+			members, err = parseScorePairs(args)
+		}
+		kv.zset = makeZSet(members)
+	case dataTypeHLL:
+		var b []byte
+		b, err = aof.ReadBytes(sr.rdr)
+		if err == nil {
+			kv.hll, err = parseHLL(b)
+		}
+	case dataTypeStream:
+		var b []byte
+		b, err = aof.ReadBytes(sr.rdr)
+		if err == nil {
+			kv.stream, err = parseStream(b)
+		}
+	default:
+		err = ErrSnapshotFormat
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	sr.read++
+
+	return key, kv, nil
+}
+
+// Load snapshot records into the storage. Already expired keys are skipped,
+// so are AOF records of them that follow the snapshot
+func (iq *IqDB) loadSnapshot(sr *snapshotReader) error {
+	for {
+		key, kv, err := sr.next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if isExpired(kv.expire) {
+			iq.loadExpired.add(key)
+			continue
+		}
+
+		iq.restoreKV(key, kv)
+	}
+}
+
+// Open configured snapshot file and decide whether AOF continues it.
+// Returns AOF position to replay from and true if AOF must be rebuilt from loaded snapshot
+func (iq *IqDB) openSnapshot() (LogPosition, bool, error) {
+	start := LogPosition{Segment: iq.manifest.Segments[0]}
+
+	f, err := os.Open(iq.opts.SnapshotFile)
+	if os.IsNotExist(err) {
+		return start, false, nil
+	}
+
+	if err != nil {
+		return start, false, err
+	}
+	defer f.Close()
+
+	sr, err := newSnapshotReader(f, iq.keys)
+	if err == aof.ErrKey {
+		return start, false, fmt.Errorf("%s: %w", iq.opts.SnapshotFile, ErrEncryptionKey)
+	}
+
+	if err != nil {
+		return start, false, err
+	}
+
+	if sr.hdr.logID == iq.manifest.ID && iq.manifest.Has(sr.hdr.pos.Segment) {
+		return sr.hdr.pos, false, iq.loadSnapshot(sr)
+	}
+
+	empty, err := iq.isEmptyLog()
+	if err != nil {
+		return start, false, err
+	}
+
+	if empty {
+		// Fresh AOF, e.g. restoring from copied snapshot
+		log.Infof("AOF is empty, restoring from snapshot %s", iq.opts.SnapshotFile)
+		return start, true, iq.loadSnapshot(sr)
+	}
+
+	log.Warnf("snapshot %s does not match AOF, ignoring it", iq.opts.SnapshotFile)
+
+	return start, false, nil
+}
+
+// Writer sealing snapshot stream in chunks
+type snapshotSealer struct {
+	w     io.Writer
+	c     *aof.Cipher
+	buf   []byte
+	index uint64
+}
+
+func (s *snapshotSealer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		k := snapshotChunkSize - len(s.buf)
+		if k > len(p) {
+			k = len(p)
+		}
+
+		s.buf = append(s.buf, p[:k]...)
+		p = p[k:]
+
+		if len(s.buf) == snapshotChunkSize {
+			err := s.flush(s.index)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (s *snapshotSealer) flush(index uint64) error {
+	sealed := s.c.Seal(s.buf, index)
+
+	b := make([]byte, 4, 4+len(sealed))
+	binary.LittleEndian.PutUint32(b, uint32(len(sealed)))
+	_, err := s.w.Write(append(b, sealed...))
+
+	s.buf = s.buf[:0]
+	s.index++
+
+	return err
+}
+
+// Seal the rest as the last chunk
+func (s *snapshotSealer) Close() error {
+	return s.flush(s.index | snapshotLastChunk)
+}
+
+// Reader of chunks written by snapshotSealer
+type snapshotOpener struct {
+	rdr   io.Reader
+	c     *aof.Cipher
+	buf   []byte
+	index uint64
+	last  bool
+}
+
+func (o *snapshotOpener) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.last {
+			return 0, io.EOF
+		}
+
+		err := o.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+
+	return n, nil
+}
+
+func (o *snapshotOpener) next() error {
+	l := make([]byte, 4)
+	_, err := io.ReadFull(o.rdr, l)
+	// Snapshot can't end before the last chunk
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Sealed chunk is longer by GCM tag
+	n := binary.LittleEndian.Uint32(l)
+	if n > snapshotChunkSize+16 {
+		return ErrSnapshotFormat
+	}
+
+	sealed := make([]byte, n)
+	_, err = io.ReadFull(o.rdr, sealed)
+	if err != nil {
+		return err
+	}
+
+	o.buf, err = o.c.Open(sealed, o.index)
+	if err != nil {
+		o.buf, err = o.c.Open(sealed, o.index|snapshotLastChunk)
+		o.last = err == nil
+	}
+
+	if err != nil {
+		return ErrSnapshotChecksum
+	}
+
+	o.index++
+
+	return nil
+}
@@ -0,0 +1,425 @@
+package iqdb
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ravlio/iqdb/aof"
+)
+
+// Stream entry with its ID and field-value pairs
+type StreamEntry struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+// Entry delivered to consumer of group and not acknowledged yet
+type StreamPending struct {
+	ID       string
+	Consumer string
+	// Time since the last delivery
+	Idle time.Duration
+	// How many times entry was delivered
+	Deliveries int
+}
+
+// Pending entries of consumer group
+type StreamPendingSummary struct {
+	Count int
+	// The lowest and the highest pending IDs, empty if there are no pending entries
+	First string
+	Last  string
+	// Pending entries count by consumer
+	Consumers map[string]int
+}
+
+// Stream ID is milliseconds time and sequence number within millisecond, as in Redis
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamID = streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(than streamID) bool {
+	if id.ms == than.ms {
+		return id.seq < than.seq
+	}
+
+	return id.ms < than.ms
+}
+
+// Parse ms-seq ID, seq is used if ID has milliseconds only
+// Returns ID on success and ErrStreamID on fail
+func parseStreamID(s string, seq uint64) (streamID, error) {
+	ms := s
+	i := strings.IndexByte(s, '-')
+	if i >= 0 {
+		ms = s[:i]
+	}
+
+	m, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return streamID{}, ErrStreamID
+	}
+
+	if i < 0 {
+		return streamID{ms: m, seq: seq}, nil
+	}
+
+	seq, err = strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return streamID{}, ErrStreamID
+	}
+
+	return streamID{ms: m, seq: seq}, nil
+}
+
+// Parse IDs, sequence numbers are required
+// Returns IDs on success and ErrStreamID on fail
+func parseStreamIDs(ids []string) ([]streamID, error) {
+	ret := make([]streamID, len(ids))
+	for i, v := range ids {
+		if strings.IndexByte(v, '-') < 0 {
+			return nil, ErrStreamID
+		}
+
+		id, err := parseStreamID(v, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		ret[i] = id
+	}
+
+	return ret, nil
+}
+
+// Range bound, - and + are the lowest and the highest IDs. Missing sequence is the lowest one
+// for start of range and the highest one for its end
+func parseStreamBound(s string, end bool) (streamID, error) {
+	switch s {
+	case "-":
+		return streamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	if end {
+		return parseStreamID(s, math.MaxUint64)
+	}
+
+	return parseStreamID(s, 0)
+}
+
+// Entries are ordered by ID, trimmed ones are cut from the head.
+// The last ID stays after its entry is trimmed, so IDs are never reused
+type stream struct {
+	mx      *sync.RWMutex
+	entries []*streamEntry
+	lastID  streamID
+	groups  map[string]*streamGroup
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string
+}
+
+type streamGroup struct {
+	// The last ID delivered to group
+	lastID  streamID
+	pending map[streamID]*streamPendingEntry
+	// Consumers by name with the time they were seen, consumers stay after their entries are acknowledged
+	consumers map[string]time.Time
+}
+
+type streamPendingEntry struct {
+	consumer  string
+	delivered time.Time
+	count     int
+}
+
+func makeStream() *stream {
+	return &stream{mx: &sync.RWMutex{}, entries: make([]*streamEntry, 0), groups: make(map[string]*streamGroup)}
+}
+
+func makeStreamGroup(lastID streamID) *streamGroup {
+	return &streamGroup{lastID: lastID, pending: make(map[streamID]*streamPendingEntry), consumers: make(map[string]time.Time)}
+}
+
+// ID of new entry. * is generated from time, ms-* gets the next sequence of ms, other IDs are taken as is.
+// ID must be greater than the last one. Caller must hold the lock
+// Returns ID on success and error on fail
+func (s *stream) nextID(id string) (streamID, error) {
+	if id == "*" {
+		ms := uint64(timeFunc().UnixNano() / int64(time.Millisecond))
+		if ms > s.lastID.ms {
+			return streamID{ms: ms}, nil
+		}
+
+		if s.lastID.seq == math.MaxUint64 {
+			return streamID{}, ErrStreamIDTooSmall
+		}
+
+		return streamID{ms: s.lastID.ms, seq: s.lastID.seq + 1}, nil
+	}
+
+	var next streamID
+	if strings.HasSuffix(id, "-*") {
+		ms, err := strconv.ParseUint(strings.TrimSuffix(id, "-*"), 10, 64)
+		if err != nil {
+			return streamID{}, ErrStreamID
+		}
+
+		next = streamID{ms: ms}
+		if ms == s.lastID.ms {
+			if s.lastID.seq == math.MaxUint64 {
+				return streamID{}, ErrStreamIDTooSmall
+			}
+
+			next.seq = s.lastID.seq + 1
+		}
+	} else {
+		var err error
+		next, err = parseStreamID(id, 0)
+		if err != nil {
+			return streamID{}, err
+		}
+	}
+
+	// 0-0 is never a valid entry ID
+	if next == (streamID{}) || !s.lastID.less(next) {
+		return streamID{}, ErrStreamIDTooSmall
+	}
+
+	return next, nil
+}
+
+// Append entry, ID must be greater than the last one. Caller must hold write lock
+func (s *stream) add(id streamID, fields []string) {
+	s.entries = append(s.entries, &streamEntry{id: id, fields: fields})
+	s.lastID = id
+}
+
+// Keep maxLen newest entries. Caller must hold write lock
+// Returns count of removed entries
+func (s *stream) trim(maxLen int) int {
+	n := len(s.entries) - maxLen
+	if n <= 0 {
+		return 0
+	}
+
+	// Trimmed entries are released, array is reallocated by later appends
+	for i := 0; i < n; i++ {
+		s.entries[i] = nil
+	}
+
+	s.entries = s.entries[n:]
+
+	return n
+}
+
+// Position of the first entry with ID not less than id. Caller must hold the lock
+func (s *stream) search(id streamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(id)
+	})
+}
+
+// Entry by ID, nil if there is no such entry. Caller must hold the lock
+func (s *stream) entry(id streamID) *streamEntry {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].id == id {
+		return s.entries[i]
+	}
+
+	return nil
+}
+
+// Entries from start to end ID inclusive, at most count of them, all if count is negative.
+// Reversed range starts from end. Caller must hold the lock
+func (s *stream) rangeEntries(start, end streamID, count int, rev bool) []StreamEntry {
+	ret := make([]StreamEntry, 0)
+	if end.less(start) {
+		return ret
+	}
+
+	from, to := s.search(start), s.search(end)
+	if to < len(s.entries) && s.entries[to].id == end {
+		to++
+	}
+
+	for i := from; i < to && (count < 0 || len(ret) < count); i++ {
+		e := s.entries[i]
+		if rev {
+			e = s.entries[to-1-(i-from)]
+		}
+
+		ret = append(ret, e.export())
+	}
+
+	return ret
+}
+
+func (e *streamEntry) export() StreamEntry {
+	return StreamEntry{ID: e.id.String(), Fields: e.fields}
+}
+
+// Mark entry delivered to consumer, delivery count of pending entry grows. Caller must hold write lock
+func (g *streamGroup) deliver(consumer string, id streamID, delivered time.Time) {
+	p, ok := g.pending[id]
+	if !ok {
+		p = &streamPendingEntry{}
+		g.pending[id] = p
+	}
+
+	p.consumer = consumer
+	p.delivered = delivered
+	p.count++
+
+	g.consumers[consumer] = delivered
+	if g.lastID.less(id) {
+		g.lastID = id
+	}
+}
+
+// Pending IDs ordered, only IDs of consumer if it is not empty. Caller must hold the lock
+func (g *streamGroup) pendingIDs(consumer string) []streamID {
+	ids := make([]streamID, 0, len(g.pending))
+	for id, p := range g.pending {
+		if consumer == "" || p.consumer == consumer {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].less(ids[j])
+	})
+
+	return ids
+}
+
+// Deep copy of stream. Caller must hold the lock
+func (s *stream) clone() *stream {
+	c := makeStream()
+	c.entries = append(c.entries, s.entries...)
+	c.lastID = s.lastID
+
+	for name, g := range s.groups {
+		cg := makeStreamGroup(g.lastID)
+		for id, p := range g.pending {
+			cp := *p
+			cg.pending[id] = &cp
+		}
+
+		for consumer, seen := range g.consumers {
+			cg.consumers[consumer] = seen
+		}
+
+		c.groups[name] = cg
+	}
+
+	return c
+}
+
+// Binary form of stream with its groups, used by AOF rewrite and snapshots. Caller must hold the lock
+func (s *stream) bytes() []byte {
+	r := aof.Record{}.PutUint64(s.lastID.ms).PutUint64(s.lastID.seq)
+
+	r = r.PutUint64(uint64(len(s.entries)))
+	for _, e := range s.entries {
+		r = r.PutUint64(e.id.ms).PutUint64(e.id.seq).PutStrings(e.fields)
+	}
+
+	r = r.PutUint64(uint64(len(s.groups)))
+	for name, g := range s.groups {
+		r = r.PutString(name).PutUint64(g.lastID.ms).PutUint64(g.lastID.seq)
+
+		r = r.PutUint64(uint64(len(g.consumers)))
+		for consumer, seen := range g.consumers {
+			r = r.PutString(consumer).PutUint64(unixNano(seen))
+		}
+
+		r = r.PutUint64(uint64(len(g.pending)))
+		for id, p := range g.pending {
+			r = r.PutUint64(id.ms).PutUint64(id.seq).PutString(p.consumer).PutUint64(unixNano(p.delivered)).PutUint64(uint64(p.count))
+		}
+	}
+
+	return r
+}
+
+// Parse binary form of stream
+// Returns stream on success and ErrStreamCorrupt on fail
+func parseStream(b []byte) (*stream, error) {
+	rdr := bytes.NewReader(b)
+	s := makeStream()
+
+	// Every read is checked at the end, the first error sticks
+	var err error
+	u := func() uint64 {
+		var v uint64
+		if err == nil {
+			v, err = aof.ReadUint64(rdr)
+		}
+
+		return v
+	}
+
+	str := func() string {
+		var v string
+		if err == nil {
+			v, err = aof.ReadString(rdr)
+		}
+
+		return v
+	}
+
+	id := func() streamID {
+		return streamID{ms: u(), seq: u()}
+	}
+
+	s.lastID = id()
+
+	for n := u(); n > 0 && err == nil; n-- {
+		e := &streamEntry{id: id()}
+		if err == nil {
+			e.fields, err = aof.ReadStrings(rdr)
+		}
+
+		s.entries = append(s.entries, e)
+	}
+
+	for n := u(); n > 0 && err == nil; n-- {
+		name := str()
+		g := makeStreamGroup(id())
+
+		for c := u(); c > 0 && err == nil; c-- {
+			consumer := str()
+			g.consumers[consumer] = fromUnixNano(u())
+		}
+
+		for p := u(); p > 0 && err == nil; p-- {
+			pid := id()
+			g.pending[pid] = &streamPendingEntry{consumer: str(), delivered: fromUnixNano(u()), count: int(u())}
+		}
+
+		s.groups[name] = g
+	}
+
+	if err != nil || rdr.Len() != 0 {
+		return nil, ErrStreamCorrupt
+	}
+
+	return s, nil
+}
@@ -22,7 +22,14 @@ func (i *ttlTreeItem) Less(than btree.Item) bool {
 		return false
 	}
 
-	return i.expire.Before(than.(*ttlTreeItem).expire)
+	t := than.(*ttlTreeItem)
+
+	// Different keys may expire at the same moment
+	if i.expire.Equal(t.expire) {
+		return i.key < t.key
+	}
+
+	return i.expire.Before(t.expire)
 }
 
 func NewttlTreeItem(key string, ttl time.Duration) ttlTreeItem {
@@ -33,10 +40,49 @@ func NewttlTreeItem(key string, ttl time.Duration) ttlTreeItem {
 	}
 }
 
+func newTTLTreeItemAt(key string, expire time.Time) ttlTreeItem {
+	return ttlTreeItem{
+		key:    key,
+		ttl:    expire.Sub(timeFunc()),
+		expire: expire,
+	}
+}
+
+// Absolute expiration time for TTL. Zero time means no expiration
+func deadline(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return timeFunc().Add(ttl)
+}
+
+func isExpired(expire time.Time) bool {
+	return !expire.IsZero() && !expire.After(timeFunc())
+}
+
+// Deadlines are persisted as unix nanoseconds, 0 means no expiration
+func unixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return uint64(t.UnixNano())
+}
+
+func fromUnixNano(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, int64(n))
+}
+
 type ttlTree struct {
 	delCb  func(key string) error
 	tree   *btree.BTree
 	ticker *time.Ticker
+	stopCh chan struct{}
 
 	mu *sync.Mutex
 }
@@ -57,11 +103,31 @@ func (t *ttlTree) Delete(item btree.Item) {
 }
 
 func (t *ttlTree) loop() {
-	for range t.ticker.C {
-		t.checkTTL()
+	for {
+		select {
+		case <-t.ticker.C:
+			t.checkTTL()
+		case <-t.stopCh:
+			return
+		}
 	}
 }
 
+// Start expiring keys. Expiration is logged, so it is started once AOF writer is running
+func (t *ttlTree) start() {
+	t.ticker = time.NewTicker(time.Second)
+	go t.loop()
+}
+
+func (t *ttlTree) stop() {
+	if t.ticker == nil {
+		return
+	}
+
+	t.ticker.Stop()
+	close(t.stopCh)
+}
+
 func (t *ttlTree) checkTTL() {
 	items := []btree.Item{}
 
@@ -80,14 +146,11 @@ func (t *ttlTree) checkTTL() {
 }
 
 func newTTLTree(delCb func(key string) error) *ttlTree {
-	tree := &ttlTree{
+	return &ttlTree{
 		delCb:  delCb,
 		tree:   btree.New(32),
-		ticker: time.NewTicker(time.Second),
+		stopCh: make(chan struct{}),
 
 		mu: &sync.Mutex{},
 	}
-	go tree.loop()
-
-	return tree
 }
@@ -0,0 +1,230 @@
+package iqdb
+
+import (
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/google/btree"
+)
+
+// Sorted set member with its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// Sorted set keeps scores by member and members ordered by score in BTree.
+// Members with equal scores are ordered lexicographically, as in Redis
+type zset struct {
+	mx     *sync.RWMutex
+	scores map[string]float64
+	tree   *btree.BTree
+}
+
+type zsetItem struct {
+	member string
+	score  float64
+}
+
+func (i *zsetItem) Less(than btree.Item) bool {
+	t := than.(*zsetItem)
+
+	if i.score == t.score {
+		return i.member < t.member
+	}
+
+	return i.score < t.score
+}
+
+func makeZSet(members []ScoredMember) *zset {
+	z := &zset{mx: &sync.RWMutex{}, scores: make(map[string]float64, len(members)), tree: btree.New(32)}
+	for _, m := range members {
+		z.add(m.Member, m.Score)
+	}
+
+	return z
+}
+
+// Set member score. Caller must hold write lock
+// Returns true if member is new
+func (z *zset) add(member string, score float64) bool {
+	old, ok := z.scores[member]
+	if ok {
+		if old == score {
+			return false
+		}
+
+		z.tree.Delete(&zsetItem{member: member, score: old})
+	}
+
+	z.scores[member] = score
+	z.tree.ReplaceOrInsert(&zsetItem{member: member, score: score})
+
+	return !ok
+}
+
+// Caller must hold write lock
+// Returns true if member was there
+func (z *zset) remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+
+	delete(z.scores, member)
+	z.tree.Delete(&zsetItem{member: member, score: score})
+
+	return true
+}
+
+// Position of member in score order. BTree has no ranks, so it takes linear time.
+// Caller must hold read lock
+func (z *zset) rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+
+	rank := 0
+	z.tree.AscendLessThan(&zsetItem{member: member, score: score}, func(btree.Item) bool {
+		rank++
+		return true
+	})
+
+	return rank, true
+}
+
+// Members from start to stop position inclusive, counted from the end if rev is set.
+// Negative positions are counted from the other end. Caller must hold read lock
+func (z *zset) rangeByRank(start, stop int, rev bool) []ScoredMember {
+	ret := make([]ScoredMember, 0)
+
+	start, stop, ok := normalizeRange(start, stop, len(z.scores))
+	if !ok {
+		return ret
+	}
+
+	i := 0
+	iter := func(item btree.Item) bool {
+		if i >= start {
+			it := item.(*zsetItem)
+			ret = append(ret, ScoredMember{Member: it.member, Score: it.score})
+		}
+
+		i++
+
+		return i <= stop
+	}
+
+	if rev {
+		z.tree.Descend(iter)
+	} else {
+		z.tree.Ascend(iter)
+	}
+
+	return ret
+}
+
+// Members with scores from min to max inclusive, offset members are skipped.
+// Negative count means all. Caller must hold read lock
+func (z *zset) rangeByScore(min, max float64, offset, count int) []ScoredMember {
+	ret := make([]ScoredMember, 0)
+	if count == 0 {
+		return ret
+	}
+
+	z.tree.AscendGreaterOrEqual(&zsetItem{score: min}, func(item btree.Item) bool {
+		it := item.(*zsetItem)
+		if it.score > max {
+			return false
+		}
+
+		if offset > 0 {
+			offset--
+			return true
+		}
+
+		ret = append(ret, ScoredMember{Member: it.member, Score: it.score})
+
+		return count < 0 || len(ret) < count
+	})
+
+	return ret
+}
+
+// Members in score order. Caller must hold read lock
+func (z *zset) members() []ScoredMember {
+	return z.rangeByRank(0, -1, false)
+}
+
+// Member-score pairs of sorted set in score order
+func (z *zset) pairs() []string {
+	z.mx.RLock()
+	defer z.mx.RUnlock()
+
+	return scorePairs(z.members())
+}
+
+// Clamp Redis style inclusive range to [0, l). Returns false if range is empty
+func normalizeRange(start, stop, l int) (int, int, bool) {
+	if start < 0 {
+		start += l
+	}
+
+	if stop < 0 {
+		stop += l
+	}
+
+	if start < 0 {
+		start = 0
+	}
+
+	if stop >= l {
+		stop = l - 1
+	}
+
+	return start, stop, start <= stop
+}
+
+// Scores are persisted as strings, shortest representation that reads back exactly
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func parseScore(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, ErrScoreNotFloat
+	}
+
+	return score, nil
+}
+
+func scorePairs(members []ScoredMember) []string {
+	args := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		args = append(args, m.Member, formatScore(m.Score))
+	}
+
+	return args
+}
+
+// Members from member-score pairs
+func parseScorePairs(args []string) ([]ScoredMember, error) {
+	if len(args)%2 != 0 {
+		return nil, ErrScoreNotFloat
+	}
+
+	members := make([]ScoredMember, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		score, err := parseScore(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, ScoredMember{Member: args[i], Score: score})
+	}
+
+	return members, nil
+}